@@ -19,6 +19,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -26,40 +27,35 @@ import (
 var cmdArchive = &subcommands.Command{
 	UsageLine: "archive <.toArchive>",
 	ShortDesc: "archive files to a dumbcas archive",
-	LongDesc:  "Archives files listed in <.toArchive> file to a directory in the DumbCas(tm) layout. Files listed may be in relative path or in absolute path and may contain environment variables.",
+	LongDesc:  "Archives files listed in <.toArchive> file to a directory in the DumbCas(tm) layout. Files listed may be in relative path or in absolute path and may contain environment variables and glob patterns. Lines starting with ! are exclusion patterns, like !*.tmp, !node_modules or !${HOME}/.cache/. Lines starting with # are ignored.",
 	CommandRun: func() subcommands.CommandRun {
 		c := &archiveRun{}
 		c.Init()
 		c.Flags.StringVar(&c.comment, "comment", "", "Comment to embed in the file")
+		c.Flags.StringVar(&c.excludeFrom, "exclude-from", "", "File listing additional exclusion patterns, one per line")
+		c.Flags.IntVar(&c.jobs, "jobs", 1, "Number of files hashed and archived concurrently. Use more on SSDs and multi-core machines.")
+		c.Flags.Int64Var(&c.chunkThreshold, "chunk-threshold", 0, "Files larger than this size in mb are stored in content-defined chunks, so only the modified parts are stored again. 0 disables chunking.")
 		return c
 	},
 }
 
 type archiveRun struct {
 	CommonFlags
-	comment string
+	comment        string
+	excludeFrom    string
+	jobs           int
+	chunkThreshold int64
 }
 
-// For an item, tries to refresh its sha1 efficiently.
-func updateFile(cache *EntryCache, item inputItem) (bool, error) {
-	now := time.Now().Unix()
-	size := item.Size()
-	timestamp := item.ModTime().Unix()
+// Returns true if the digest in |cache| is still valid for |item|, in which
+// case it is marked as tested.
+func isCacheValid(cache *EntryCache, item inputItem) bool {
 	// If the file already exist, check for the timestamp and size to match.
-	if cache.Size == size && cache.Timestamp == timestamp {
-		cache.LastTested = now
-		return false, nil
+	if cache.Size == item.Size() && cache.Timestamp == item.ModTime().Unix() {
+		cache.LastTested = time.Now().Unix()
+		return true
 	}
-
-	digest, err := sha1FilePath(item.fullPath)
-	if err != nil {
-		return false, err
-	}
-	cache.Sha1 = digest
-	cache.Size = size
-	cache.Timestamp = timestamp
-	cache.LastTested = now
-	return true, nil
+	return false
 }
 
 // Reads a file with each line as an entry in the slice.
@@ -108,6 +104,7 @@ type StatsValues struct {
 	errors           syncInt
 	found            syncInt // enumerateInputs()
 	totalSize        syncInt
+	nbExcluded       syncInt
 	nbHashed         syncInt // hashInputs()
 	bytesHashed      syncInt
 	nbNotHashed      syncInt
@@ -116,6 +113,8 @@ type StatsValues struct {
 	bytesArchived    syncInt
 	nbNotArchived    syncInt
 	bytesNotArchived syncInt
+	nbChanged        syncInt // Files that changed while being archived.
+	bytesChanged     syncInt
 }
 
 // Stores statistic of the on-going process.
@@ -124,6 +123,11 @@ type Stats struct {
 	interrupted syncInt
 	out         chan<- string
 	done        chan<- bool
+	// Protects the Cache, which is shared by hashInputs() and archiveInputs().
+	cacheLock sync.Mutex
+	// Items that were stored under a different digest than the one cached.
+	changedLock sync.Mutex
+	changed     []itemToArchive
 }
 
 // Creates a copy of StatsValues. Note that the copy *may* be inconsistent.
@@ -132,6 +136,7 @@ func (s *StatsValues) Copy() *StatsValues {
 		s.errors.g(),
 		s.found.g(),
 		s.totalSize.g(),
+		s.nbExcluded.g(),
 		s.nbHashed.g(),
 		s.bytesHashed.g(),
 		s.nbNotHashed.g(),
@@ -140,6 +145,8 @@ func (s *StatsValues) Copy() *StatsValues {
 		s.bytesArchived.g(),
 		s.nbNotArchived.g(),
 		s.bytesNotArchived.g(),
+		s.nbChanged.g(),
+		s.bytesChanged.g(),
 	}
 }
 
@@ -148,6 +155,7 @@ func (lhs *StatsValues) Equals(rhs *StatsValues) bool {
 	return (lhs.errors.Get() == rhs.errors.Get() &&
 		lhs.found.Get() == rhs.found.Get() &&
 		lhs.totalSize.Get() == rhs.totalSize.Get() &&
+		lhs.nbExcluded.Get() == rhs.nbExcluded.Get() &&
 		lhs.nbHashed.Get() == rhs.nbHashed.Get() &&
 		lhs.bytesHashed.Get() == rhs.bytesHashed.Get() &&
 		lhs.nbNotHashed.Get() == rhs.nbNotHashed.Get() &&
@@ -155,7 +163,25 @@ func (lhs *StatsValues) Equals(rhs *StatsValues) bool {
 		lhs.nbArchived.Get() == rhs.nbArchived.Get() &&
 		lhs.bytesArchived.Get() == rhs.bytesArchived.Get() &&
 		lhs.nbNotArchived.Get() == rhs.nbNotArchived.Get() &&
-		lhs.bytesNotArchived.Get() == rhs.bytesNotArchived.Get())
+		lhs.bytesNotArchived.Get() == rhs.bytesNotArchived.Get() &&
+		lhs.nbChanged.Get() == rhs.nbChanged.Get() &&
+		lhs.bytesChanged.Get() == rhs.bytesChanged.Get())
+}
+
+// Converts the counters to the statistics saved in the Node.
+func (s *StatsValues) nodeStats() *NodeStats {
+	return &NodeStats{
+		Found:         s.found.Get(),
+		Size:          s.totalSize.Get(),
+		Excluded:      s.nbExcluded.Get(),
+		Hashed:        s.nbHashed.Get(),
+		BytesHashed:   s.bytesHashed.Get(),
+		InCache:       s.nbNotHashed.Get(),
+		Archived:      s.nbArchived.Get(),
+		BytesArchived: s.bytesArchived.Get(),
+		Changed:       s.nbChanged.Get(),
+		Errors:        s.errors.Get(),
+	}
 }
 
 type inputItem struct {
@@ -165,8 +191,8 @@ type inputItem struct {
 }
 
 // enumerateInputs reads the directories trees of each inputs and send each
-// file into the output channel.
-func (s *Stats) enumerateInputs(inputs []string) <-chan inputItem {
+// file into the output channel. Excluded directories are not enumerated.
+func (s *Stats) enumerateInputs(inputs []string, excludes Excludes) <-chan inputItem {
 	// Throtttle after 128k entries.
 	c := make(chan inputItem, 128000)
 	go func() {
@@ -188,9 +214,20 @@ func (s *Stats) enumerateInputs(inputs []string) <-chan inputItem {
 				s.out <- fmt.Sprintf("Failed to process %s: %s", input, err)
 				continue
 			}
+			if excludes.MatchRecursive(input, stat.IsDir()) {
+				s.nbExcluded.Add(1)
+				continue
+			}
 			if stat.IsDir() {
 				// Send the items back in the channel.
-				d := EnumerateTree(input)
+				skip := func(fullPath string, info os.FileInfo) bool {
+					if excludes.Match(fullPath, info.IsDir()) {
+						s.nbExcluded.Add(1)
+						return true
+					}
+					return false
+				}
+				d := EnumerateTreeSkip(input, skip)
 				cont := true
 				for cont {
 					select {
@@ -234,25 +271,25 @@ func (s *Stats) enumerateInputs(inputs []string) <-chan inputItem {
 }
 
 type itemToArchive struct {
-	fullPath string
-	relPath  string
-	sha1     string
-	size     int64
+	fullPath  string
+	relPath   string
+	sha1      string
+	chunks    []Chunk
+	size      int64
+	timestamp int64
+	// Set when the digest is not known yet. It is calculated while the item is
+	// archived and then saved in this cache entry.
+	cache *EntryCache
 }
 
-// Calculates each entry. Assumes inputs is cleaned paths.
-func (s *Stats) hashInputs(a DumbcasApplication, inputs <-chan inputItem) <-chan itemToArchive {
+// Looks up the digest of each entry in the cache. The entries not in the cache
+// are hashed by archiveInputs() while they are stored so they are only read
+// once. Assumes inputs is cleaned paths.
+func (s *Stats) hashInputs(cache Cache, inputs <-chan inputItem) <-chan itemToArchive {
 	c := make(chan itemToArchive, 4096)
 	go func() {
-		// LoadCache must return a valid Cache instance even in case of failure.
-		cache, err := a.LoadCache()
-		if err != nil {
-			s.out <- fmt.Sprintf("Failed to load cache: %s\nWARNING: It will be unbearably slow!", err)
-		}
 		defer func() {
-			// Must save the cache *before* sending the 'done' signal.
 			close(c)
-			cache.Close()
 			s.done <- true
 		}()
 		for {
@@ -263,45 +300,76 @@ func (s *Stats) hashInputs(a DumbcasApplication, inputs <-chan inputItem) <-chan
 				return
 			case item, ok := <-inputs:
 				if !ok {
-					s.out <- fmt.Sprintf("Done hashing.")
+					s.out <- fmt.Sprintf("Done looking up the cache.")
 					return
 				}
 				if item.IsDir() {
 					panic("This can't happen; enumerateInputs() should eat all the directories.")
 				}
 				size := item.Size()
+				s.cacheLock.Lock()
 				cachedItem := FindInCache(cache, item.fullPath)
-				if wasHashed, err := updateFile(cachedItem, item); err != nil {
-					// Eat the error and continue archiving other items.
-					s.errors.Add(1)
-					s.out <- fmt.Sprintf("Failed to process %s: %s", item.fullPath, err)
-					continue
-				} else if wasHashed {
-					//s.out <- fmt.Sprintf("Hashed: %s", item.relPath)
-					s.nbHashed.Add(1)
-					s.bytesHashed.Add(size)
-				} else {
+				if isCacheValid(cachedItem, item) {
+					digest := cachedItem.Sha1
+					chunks := cachedItem.Chunks
+					s.cacheLock.Unlock()
 					s.nbNotHashed.Add(1)
 					s.bytesNotHashed.Add(size)
+					c <- itemToArchive{item.fullPath, item.relPath, digest, chunks, size, 0, nil}
+				} else {
+					s.cacheLock.Unlock()
+					c <- itemToArchive{item.fullPath, item.relPath, "", nil, size, item.ModTime().Unix(), cachedItem}
 				}
-				c <- itemToArchive{item.fullPath, item.relPath, cachedItem.Sha1, size}
 			}
 		}
 	}()
 	return c
 }
 
-// Archives one item in the CAS table.
-func (s *Stats) archiveItem(item itemToArchive, cas CasTable) {
+// Archives one item in the CAS table. Returns the item as it was actually
+// archived; its digest differs if the file changed since it was hashed. An
+// item not found in the cache is hashed while it is stored. A new item larger
+// than |chunkThreshold| is stored in chunks.
+func (s *Stats) archiveItem(item itemToArchive, cas CasTable, chunkThreshold int64) itemToArchive {
 	f, err := os.Open(item.fullPath)
 	if err != nil {
 		s.errors.Add(1)
 		s.out <- fmt.Sprintf("Failed to archive %s: %s", item.fullPath, err)
-		return
+		return item
 	}
 	defer f.Close()
-	err = cas.AddEntry(f, item.sha1)
-	if os.IsExist(err) {
+	if item.chunks != nil || (item.cache != nil && chunkThreshold != 0 && item.size > chunkThreshold) {
+		return s.archiveChunkedItem(item, f, cas)
+	}
+	if item.cache != nil {
+		item.sha1, err = cas.AddStream(f)
+		if err == nil || os.IsExist(err) {
+			//s.out <- fmt.Sprintf("Hashed: %s", item.relPath)
+			s.nbHashed.Add(1)
+			s.bytesHashed.Add(item.size)
+			s.cacheLock.Lock()
+			item.cache.Sha1 = item.sha1
+			item.cache.Chunks = nil
+			item.cache.Size = item.size
+			item.cache.Timestamp = item.timestamp
+			item.cache.LastTested = time.Now().Unix()
+			s.cacheLock.Unlock()
+		}
+	} else {
+		err = cas.AddEntry(f, item.sha1)
+	}
+	if mismatch, ok := err.(*HashMismatchError); ok {
+		// Either the file was modified while being archived or the cache was
+		// stale. Keep the content that was actually stored.
+		s.nbChanged.Add(1)
+		s.bytesChanged.Add(mismatch.Size)
+		s.out <- fmt.Sprintf("%s changed during backup", item.fullPath)
+		item.sha1 = mismatch.Actual
+		item.size = mismatch.Size
+		s.changedLock.Lock()
+		s.changed = append(s.changed, item)
+		s.changedLock.Unlock()
+	} else if os.IsExist(err) {
 		s.nbNotArchived.Add(1)
 		s.bytesNotArchived.Add(item.size)
 	} else if err == nil {
@@ -311,6 +379,90 @@ func (s *Stats) archiveItem(item itemToArchive, cas CasTable) {
 		s.errors.Add(1)
 		s.out <- fmt.Sprintf("Failed to archive %s: %s", item.fullPath, err)
 	}
+	return item
+}
+
+// Archives one item stored in chunks. Like archiveItem(), the chunks are
+// calculated again if the file changed since it was chunked.
+func (s *Stats) archiveChunkedItem(item itemToArchive, f *os.File, cas CasTable) itemToArchive {
+	var stored int64
+	var err error
+	if item.cache == nil {
+		stored, err = addKnownChunks(cas, f, item.chunks)
+		if _, ok := err.(*HashMismatchError); ok {
+			s.nbChanged.Add(1)
+			s.bytesChanged.Add(item.size)
+			s.out <- fmt.Sprintf("%s changed during backup", item.fullPath)
+			if _, err = f.Seek(0, os.SEEK_SET); err == nil {
+				item.chunks, _, err = addChunks(cas, f)
+			}
+			if err == nil {
+				item.size = chunksSize(item.chunks)
+				if item.size <= minChunkSize {
+					item.sha1, err = chunksAsObject(cas, item.chunks)
+					item.chunks = nil
+				}
+			}
+			if err != nil {
+				s.errors.Add(1)
+				s.out <- fmt.Sprintf("Failed to archive %s: %s", item.fullPath, err)
+				item.chunks = nil
+				return item
+			}
+			s.changedLock.Lock()
+			s.changed = append(s.changed, item)
+			s.changedLock.Unlock()
+			return item
+		}
+	} else {
+		item.chunks, stored, err = addChunks(cas, f)
+		if err == nil {
+			item.size = chunksSize(item.chunks)
+			if item.size <= minChunkSize {
+				item.sha1, err = chunksAsObject(cas, item.chunks)
+				item.chunks = nil
+			}
+		}
+		if err == nil {
+			s.nbHashed.Add(1)
+			s.bytesHashed.Add(item.size)
+			s.cacheLock.Lock()
+			item.cache.Sha1 = item.sha1
+			item.cache.Chunks = item.chunks
+			item.cache.Size = item.size
+			item.cache.Timestamp = item.timestamp
+			item.cache.LastTested = time.Now().Unix()
+			s.cacheLock.Unlock()
+		}
+	}
+	if err != nil {
+		s.errors.Add(1)
+		s.out <- fmt.Sprintf("Failed to archive %s: %s", item.fullPath, err)
+		item.chunks = nil
+		return item
+	}
+	if stored != 0 {
+		s.nbArchived.Add(1)
+	} else {
+		s.nbNotArchived.Add(1)
+	}
+	s.bytesArchived.Add(stored)
+	s.bytesNotArchived.Add(item.size - stored)
+	return item
+}
+
+// Returns the digest of the content of |chunks| as a single object. A file
+// not larger than a chunk, e.g. one truncated since it was listed, is archived
+// this way so its Entry has a Sha1 instead of no chunks at all.
+func chunksAsObject(cas CasTable, chunks []Chunk) (string, error) {
+	if len(chunks) == 1 {
+		return chunks[0].Sha1, nil
+	}
+	digest, err := AddBytes(cas, []byte{})
+	if os.IsExist(err) {
+		err = nil
+	}
+	return digest, err
 }
 
 // Creates the Entry instance and the necessary Entry tree for |item|.
@@ -325,54 +477,215 @@ func makeEntry(root *Entry, item itemToArchive) {
 		root = root.Files[p]
 	}
 	root.Sha1 = item.sha1
+	root.Chunks = item.chunks
 	root.Size = item.size
 }
 
-// Archives the items.
-func (s *Stats) archiveInputs(a DumbcasApplication, cas CasTable, items <-chan itemToArchive) <-chan string {
-	c := make(chan string)
+// Archives each directory of the tree as a separate object, children first,
+// so an unchanged subtree is the same object in every backup. Returns the
+// digest of the object for |entry|.
+func (s *Stats) archiveTree(cas CasTable, entry *Entry) (string, error) {
+	dir := &Entry{}
+	if entry.Files != nil {
+		dir.Files = make(map[string]*Entry, len(entry.Files))
+	}
+	for name, child := range entry.Files {
+		if child.isDir() {
+			digest, err := s.archiveTree(cas, child)
+			if err != nil {
+				return "", err
+			}
+			child = &Entry{Dir: digest}
+		}
+		dir.Files[name] = child
+	}
+	data, err := json.Marshal(dir)
+	if err != nil {
+		return "", err
+	}
+	digest, err := AddBytes(cas, data)
+	if os.IsExist(err) {
+		s.nbNotArchived.Add(1)
+		s.bytesNotArchived.Add(int64(len(data)))
+	} else if err == nil {
+		s.nbArchived.Add(1)
+		s.bytesArchived.Add(int64(len(data)))
+	} else {
+		return "", err
+	}
+	return digest, nil
+}
+
+// Maximum number of digests queried at once with CasTable.Missing().
+const missingBatchSize = 1024
+
+// Sends the items whose objects are all present in |cas| directly to
+// |archived|, without reading them, and the others to the returned channel.
+// The items whose digest is known are queried in batches of up to
+// missingBatchSize digests, so a remote table answers with a single request for
+// the whole batch. Calls wg.Done() once it stops sending to |archived|.
+func (s *Stats) skipPresentItems(cas CasTable, items <-chan itemToArchive, archived chan<- itemToArchive, wg *sync.WaitGroup) <-chan itemToArchive {
+	c := make(chan itemToArchive, 4096)
+	// Returns false on interruption, since the workers stop reading |c|.
+	send := func(item itemToArchive) bool {
+		select {
+		case <-InterruptedChannel:
+			s.interrupted.Add(1)
+			return false
+		case c <- item:
+			return true
+		}
+	}
+	// Sends the items of |batch| missing objects to |c| and the others to
+	// |archived|. On failure, all of them are sent to |c| and AddEntry() sorts
+	// them out.
+	flush := func(batch []itemToArchive, digests []string) bool {
+		missing, err := cas.Missing(digests)
+		if err != nil {
+			s.out <- fmt.Sprintf("Failed to query the missing objects: %s", err)
+		}
+		isMissing := make(map[string]bool, len(missing))
+		for _, digest := range missing {
+			isMissing[digest] = true
+		}
+		for _, item := range batch {
+			present := err == nil
+			for _, digest := range item.digests() {
+				present = present && !isMissing[digest]
+			}
+			if present {
+				s.nbNotArchived.Add(1)
+				s.bytesNotArchived.Add(item.size)
+				archived <- item
+			} else if !send(item) {
+				return false
+			}
+		}
+		return true
+	}
 	go func() {
 		defer func() {
 			close(c)
-			s.done <- true
+			wg.Done()
 		}()
-		entryRoot := &Entry{}
-		cont := true
-		for cont {
+		var batch []itemToArchive
+		var digests []string
+		for {
+			var item itemToArchive
+			ok := true
+			if len(batch) == 0 {
+				// Waits for the next item.
+				select {
+				case <-InterruptedChannel:
+					s.interrupted.Add(1)
+					return
+				case item, ok = <-items:
+				}
+			} else {
+				// Takes the items already queued then queries the batch.
+				select {
+				case item, ok = <-items:
+				default:
+					if !flush(batch, digests) {
+						return
+					}
+					batch, digests = nil, nil
+					continue
+				}
+			}
+			if !ok {
+				if len(batch) != 0 {
+					flush(batch, digests)
+				}
+				return
+			}
+			if item.cache != nil {
+				// The digest is calculated while the item is stored.
+				if !send(item) {
+					return
+				}
+				continue
+			}
+			batch = append(batch, item)
+			digests = append(digests, item.digests()...)
+			if len(digests) >= missingBatchSize {
+				if !flush(batch, digests) {
+					return
+				}
+				batch, digests = nil, nil
+			}
+		}
+	}()
+	return c
+}
+
+// Returns the digests of the objects of an item whose digest is known.
+func (i *itemToArchive) digests() []string {
+	if i.chunks == nil {
+		return []string{i.sha1}
+	}
+	out := make([]string, 0, len(i.chunks))
+	for _, chunk := range i.chunks {
+		out = append(out, chunk.Sha1)
+	}
+	return out
+}
+
+// Archives the items with |jobs| concurrent workers. The items already present
+// in |cas| are skipped without being read.
+func (s *Stats) archiveInputs(a DumbcasApplication, cas CasTable, items <-chan itemToArchive, jobs int, chunkThreshold int64) <-chan string {
+	c := make(chan string)
+	archived := make(chan itemToArchive, 4096)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	toArchive := s.skipPresentItems(cas, items, archived, &wg)
+	worker := func() {
+		defer wg.Done()
+		for {
 			select {
 			case <-InterruptedChannel:
 				// Early exit.
 				s.interrupted.Add(1)
 				return
-			case item, ok := <-items:
+			case item, ok := <-toArchive:
 				if !ok {
-					cont = false
-					continue
+					return
 				}
 				//s.out <- fmt.Sprintf("Archiving: %s", item.relPath)
+				archived <- s.archiveItem(item, cas, chunkThreshold)
+			}
+		}
+	}
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go worker()
+	}
+	go func() {
+		wg.Wait()
+		close(archived)
+	}()
+	go func() {
+		defer func() {
+			close(c)
+			s.done <- true
+		}()
+		// The Entry tree is only modified by this goroutine.
+		entryRoot := &Entry{}
+		for item := range archived {
+			if item.sha1 != "" || item.chunks != nil {
 				makeEntry(entryRoot, item)
-				s.archiveItem(item, cas)
 			}
 		}
-		// Serializes the entry file to archive it too.
-		data, err := json.Marshal(entryRoot)
+		if s.interrupted.Get() != 0 {
+			return
+		}
+		// Serializes the directories to archive them too.
+		entrySha1, err := s.archiveTree(cas, entryRoot)
 		if err != nil {
 			s.errors.Add(1)
-			s.out <- fmt.Sprintf("Failed to marshal entry file: %s", err)
+			s.out <- fmt.Sprintf("Failed to archive entry file: %s", err)
 		} else {
-			entrySha1, err := AddBytes(cas, data)
-			if os.IsExist(err) {
-				s.nbNotArchived.Add(1)
-				s.bytesNotArchived.Add(int64(len(data)))
-				c <- entrySha1
-			} else if err == nil {
-				s.nbArchived.Add(1)
-				s.bytesArchived.Add(int64(len(data)))
-				c <- entrySha1
-			} else {
-				s.errors.Add(1)
-				s.out <- fmt.Sprintf("Failed to archive entry file: %s", err)
-			}
+			c <- entrySha1
 		}
 	}()
 	return c
@@ -399,31 +712,44 @@ func toMb(i int64) float64 {
 // - Updating the hash for each items in the cache.
 // - Archiving items.
 func (c *archiveRun) main(a DumbcasApplication, toArchiveArg string) error {
+	start := time.Now().UTC()
 	if err := c.Parse(a, true); err != nil {
 		return err
 	}
+	defer c.Close()
 
+	if c.jobs < 1 {
+		return fmt.Errorf("-jobs must be at least 1")
+	}
+	if c.chunkThreshold < 0 {
+		return fmt.Errorf("-chunk-threshold can't be negative")
+	}
 	toArchive, err := filepath.Abs(toArchiveArg)
 	if err != nil {
 		return fmt.Errorf("Failed to process %s", toArchiveArg)
 	}
 
-	inputs, err := readFileAsStrings(toArchive)
+	inputs, excludes, err := loadToArchive(toArchive, c.excludeFrom)
 	if err != nil {
 		return err
 	}
-	// Make sure the file itself is archived too.
-	inputs = append(inputs, toArchive)
-	a.GetLog().Printf("Found %d entries to backup in %s", len(inputs), toArchive)
-	cleanupList(filepath.Dir(toArchive), inputs)
+	a.GetLog().Printf("Found %d entries to backup and %d exclusion patterns in %s", len(inputs), len(excludes), toArchive)
+
+	// LoadCache must return a valid Cache instance even in case of failure.
+	h := c.cas.GetHashAlgorithm()
+	cache, err := a.LoadCache(h)
+	if err != nil {
+		a.GetLog().Printf("Failed to load cache: %s\nWARNING: It will be unbearably slow!", err)
+		err = nil
+	}
 
 	// Start the processes.
 	output := make(chan string)
 	done := make(chan bool, 3)
 	s := Stats{out: output, done: done}
-	items_to_scan := s.enumerateInputs(inputs)
-	items_hashed := s.hashInputs(a, items_to_scan)
-	entry := s.archiveInputs(a, c.cas, items_hashed)
+	items_to_scan := s.enumerateInputs(inputs, excludes)
+	items_hashed := s.hashInputs(cache, items_to_scan)
+	entry := s.archiveInputs(a, c.cas, items_hashed, c.jobs, c.chunkThreshold*1024*1024)
 
 	headerWasPrinted := false
 	columns := []string{
@@ -461,7 +787,19 @@ func (c *archiveRun) main(a DumbcasApplication, toArchiveArg string) error {
 				continue
 			}
 			if item != "" {
-				node := &Node{Entry: item, Comment: c.comment}
+				end := time.Now().UTC()
+				node := &Node{
+					Entry:   item,
+					Comment: c.comment,
+					User:    currentUser(),
+					Start:   &start,
+					End:     &end,
+					Inputs:  inputs,
+					Version: version,
+					Stats:   s.Copy().nodeStats(),
+				}
+				// The hostname is informative; the node is still saved without it.
+				node.Hostname, _ = shortHostname()
 				_, err = c.nodes.AddEntry(node, filepath.Base(toArchive))
 				err = errDone
 			} else {
@@ -482,9 +820,9 @@ func (c *archiveRun) main(a DumbcasApplication, toArchiveArg string) error {
 					headerWasPrinted = true
 				}
 				prevStats = nextStats
-				fractionDone := float64(prevStats.bytesArchived.Get()+prevStats.bytesNotArchived.Get()) / float64(prevStats.totalSize.Get())
+				fractionDone := float64(prevStats.bytesArchived.Get()+prevStats.bytesNotArchived.Get()+prevStats.bytesChanged.Get()) / float64(prevStats.totalSize.Get())
 				a.GetLog().Printf(
-					"%6d(%8.1fmb) %6d(%8.1fmb) %6d(%8.1fmb) %6d(%8.1fmb) %6d(%8.1fmb) %3.1f%% %d errors",
+					"%6d(%8.1fmb) %6d(%8.1fmb) %6d(%8.1fmb) %6d(%8.1fmb) %6d(%8.1fmb) %3.1f%% %d changed %d errors",
 					prevStats.found.Get(),
 					toMb(prevStats.totalSize.Get()),
 					prevStats.nbHashed.Get(),
@@ -496,6 +834,7 @@ func (c *archiveRun) main(a DumbcasApplication, toArchiveArg string) error {
 					prevStats.nbNotArchived.Get(),
 					toMb(prevStats.bytesNotArchived.Get()),
 					100.*fractionDone,
+					prevStats.nbChanged.Get(),
 					prevStats.errors.Get())
 			}
 		}
@@ -511,8 +850,14 @@ func (c *archiveRun) main(a DumbcasApplication, toArchiveArg string) error {
 	for i := 0; i < 3; i++ {
 		<-done
 	}
+	// Forget the digest of the files that changed so they are hashed again on
+	// the next run.
+	for _, item := range s.changed {
+		FindInCache(cache, item.fullPath).Timestamp = 0
+	}
+	cache.Close()
 	fmt.Fprintf(a.GetOut(), column+"\n")
-	fractionDone := float64(s.bytesArchived.Get()+s.bytesNotArchived.Get()) / float64(s.totalSize.Get())
+	fractionDone := float64(s.bytesArchived.Get()+s.bytesNotArchived.Get()+s.bytesChanged.Get()) / float64(s.totalSize.Get())
 	fmt.Fprintf(
 		a.GetOut(),
 		"%7d(%7.1fmb) %7d(%7.1fmb) %7d(%7.1fmb) %7d(%7.1fmb) %7d(%7.1fmb) %3.1f%% %d errors\n",
@@ -528,6 +873,12 @@ func (c *archiveRun) main(a DumbcasApplication, toArchiveArg string) error {
 		toMb(s.bytesNotArchived.Get()),
 		100.*fractionDone,
 		s.errors.Get())
+	if len(excludes) != 0 {
+		fmt.Fprintf(a.GetOut(), "%d files and directories excluded by: %s\n", s.nbExcluded.Get(), excludes)
+	}
+	if s.nbChanged.Get() != 0 {
+		fmt.Fprintf(a.GetOut(), "%d files (%.1fmb) changed during backup\n", s.nbChanged.Get(), toMb(s.bytesChanged.Get()))
+	}
 	return nil
 }
 
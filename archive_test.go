@@ -10,11 +10,42 @@ limitations under the License. */
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"github.com/maruel/subcommands/subcommandstest"
+	"io"
+	"os"
 	"path/filepath"
 	"sort"
+	"sync"
 	"testing"
+	"time"
 )
 
+// Returns the digests of the objects archive stores for each directory of the
+// serialized |entries|, the root directory last.
+func treeDigests(t *subcommandstest.TB, h *HashAlgorithm, entries []byte) []string {
+	entry := &Entry{}
+	t.Assertf(json.Unmarshal(entries, entry) == nil, "Failed to unmarshal %s", entries)
+	var split func(entry *Entry) []string
+	split = func(entry *Entry) []string {
+		out := []string{}
+		dir := &Entry{Files: map[string]*Entry{}}
+		for name, child := range entry.Files {
+			if child.isDir() {
+				digests := split(child)
+				out = append(out, digests...)
+				child = &Entry{Dir: digests[len(digests)-1]}
+			}
+			dir.Files[name] = child
+		}
+		data, err := json.Marshal(dir)
+		t.Assertf(err == nil, "Unexpected error: %s", err)
+		return append(out, h.HashBytes(data))
+	}
+	return split(entry)
+}
+
 func TestArchive(t *testing.T) {
 	t.Parallel()
 	f := makeDumbcasAppMock(t)
@@ -44,14 +75,383 @@ func TestArchive(t *testing.T) {
 	items := EnumerateCasAsList(f.TB, f.cas)
 
 	expected := make([]string, 0, len(items))
-	sha1tree, entries := marshalData(f.TB, archived)
+	h := f.cas.GetHashAlgorithm()
+	sha1tree, entries := marshalData(f.TB, h, archived)
 	for _, v := range sha1tree {
 		expected = append(expected, v)
 	}
-	expected = append(expected, sha1Bytes(entries))
+	expected = append(expected, treeDigests(f.TB, h, entries)...)
 	sort.Strings(expected)
 	f.Assertf(Equals(items, expected), "Unexpected items:\n%s\n%s", items, expected)
 
 	nodes := EnumerateNodesAsList(f.TB, f.nodes)
 	f.Assertf(len(nodes) == 2, "Unexpected nodes: %s", nodes)
 }
+
+func TestArchiveMetadata(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(f.TB, "archive_metadata")
+	defer removeTempDir(tempData)
+
+	tree := map[string]string{
+		"toArchive": "x\ndir1\n",
+		"x":         "x\n",
+		"dir1/bar":  "bar\n",
+	}
+	if err := createTree(tempData, tree); err != nil {
+		f.Fatal(err)
+	}
+	before := time.Now().UTC().Add(-time.Second)
+	args := []string{"archive", "-root=\\test_archive", "-comment=hi", filepath.Join(tempData, "toArchive")}
+	f.Run(args, 0)
+	f.CheckBuffer(true, false)
+
+	nodes := EnumerateNodesAsList(f.TB, f.nodes)
+	f.Assertf(len(nodes) == 2, "Unexpected nodes: %s", nodes)
+	node, err := LoadNode(f.nodes, nodes[0])
+	f.Assertf(err == nil, "Unexpected error: %s", err)
+	f.Assertf(node.Comment == "hi", "Unexpected comment %s", node.Comment)
+	hostname, _ := shortHostname()
+	f.Assertf(node.Hostname == hostname, "Unexpected hostname %s", node.Hostname)
+	f.Assertf(node.User == currentUser(), "Unexpected user %s", node.User)
+	f.Assertf(node.Version == version, "Unexpected version %s", node.Version)
+	f.Assertf(node.Start != nil && !node.Start.Before(before), "Unexpected start %s", node.Start)
+	f.Assertf(node.End != nil && !node.End.Before(*node.Start), "Unexpected end %s", node.End)
+	expectedInputs := []string{
+		filepath.Join(tempData, "x"),
+		filepath.Join(tempData, "dir1"),
+		filepath.Join(tempData, "toArchive"),
+	}
+	f.Assertf(Equals(node.Inputs, expectedInputs), "Unexpected inputs %q", node.Inputs)
+	// Archived also counts the objects storing the directories.
+	s := node.Stats
+	f.Assertf(s != nil, "Missing stats")
+	f.Assertf(s.Found == 3 && s.Size == 13 && s.Hashed == 3 && s.BytesHashed == 13, "Unexpected stats %#v", s)
+	f.Assertf(s.Archived == 4 && s.Errors == 0, "Unexpected stats %#v", s)
+}
+
+func TestArchiveStaleCache(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(f.TB, "archive_stale")
+	defer removeTempDir(tempData)
+
+	tree := map[string]string{
+		"toArchive": "x\n",
+		"x":         "x\n",
+	}
+	if err := createTree(tempData, tree); err != nil {
+		f.Fatal(err)
+	}
+
+	// Simulate a file modified without its timestamp or size being updated.
+	f.MakeCasTable("")
+	h := f.cas.GetHashAlgorithm()
+	xPath := filepath.Join(tempData, "x")
+	stat, err := os.Stat(xPath)
+	f.Assertf(err == nil, "Unexpected error: %s", err)
+	f.cache = &fakeCache{f.TB, &EntryCache{}, false, nil}
+	cached := FindInCache(f.cache, xPath)
+	cached.Sha1 = h.HashBytes([]byte("y\n"))
+	cached.Size = stat.Size()
+	cached.Timestamp = stat.ModTime().Unix()
+	f.cache.closed = true
+
+	args := []string{"archive", "-root=\\test_archive", filepath.Join(tempData, "toArchive")}
+	f.Run(args, 0)
+	f.CheckBuffer(true, false)
+
+	nodes := EnumerateNodesAsList(f.TB, f.nodes)
+	f.Assertf(len(nodes) == 2, "Unexpected nodes: %s", nodes)
+	n, err := f.nodes.Open(nodes[0])
+	f.Assertf(err == nil, "Unexpected error: %s", err)
+	defer n.Close()
+	node := &Node{}
+	f.Assertf(loadReaderAsJson(n, node) == nil, "Failed to load node")
+	entry, err := LoadEntry(f.cas, node.Entry)
+	f.Assertf(err == nil, "Unexpected error: %s", err)
+	actual := entry.Files["x"].Sha1
+	f.Assertf(actual == h.HashBytes([]byte("x\n")), "Unexpected digest %s", actual)
+	f.Assertf(cached.Timestamp == 0, "The cache entry wasn't invalidated")
+}
+
+func TestArchiveExclude(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(f.TB, "archive_exclude")
+	defer removeTempDir(tempData)
+
+	tree := map[string]string{
+		"toArchive":                "dir1\n!*.tmp\n!node_modules/\n",
+		"excludes":                 "dir1/cache\n",
+		"dir1/bar":                 "bar\n",
+		"dir1/bar.tmp":             "bar.tmp\n",
+		"dir1/node_modules/x/foo":  "foo\n",
+		"dir1/cache/baz":           "baz\n",
+		"dir1/dir2/node_modules/y": "y\n",
+	}
+	archived := map[string]string{
+		"toArchive": tree["toArchive"],
+		"bar":       "bar\n",
+	}
+	if err := createTree(tempData, tree); err != nil {
+		f.Fatal(err)
+	}
+
+	args := []string{"archive", "-root=\\test_archive", "-exclude-from=" + filepath.Join(tempData, "excludes"), filepath.Join(tempData, "toArchive")}
+	f.Run(args, 0)
+	f.CheckBuffer(true, false)
+	items := EnumerateCasAsList(f.TB, f.cas)
+
+	expected := make([]string, 0, len(items))
+	h := f.cas.GetHashAlgorithm()
+	sha1tree, entries := marshalData(f.TB, h, archived)
+	for _, v := range sha1tree {
+		expected = append(expected, v)
+	}
+	expected = append(expected, treeDigests(f.TB, h, entries)...)
+	sort.Strings(expected)
+	f.Assertf(Equals(items, expected), "Unexpected items:\n%s\n%s", items, expected)
+}
+
+func TestArchiveJobs(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(f.TB, "archive_jobs")
+	defer removeTempDir(tempData)
+
+	tree := map[string]string{
+		"toArchive": "dir1\n",
+	}
+	archived := map[string]string{
+		"toArchive": "dir1\n",
+	}
+	for i := 0; i < 50; i++ {
+		content := fmt.Sprintf("content %d\n", i)
+		tree[fmt.Sprintf("dir1/dir%d/file%d", i%5, i)] = content
+		archived[fmt.Sprintf("dir%d/file%d", i%5, i)] = content
+	}
+	if err := createTree(tempData, tree); err != nil {
+		f.Fatal(err)
+	}
+
+	args := []string{"archive", "-root=\\test_archive", "-jobs=4", filepath.Join(tempData, "toArchive")}
+	f.Run(args, 0)
+	f.CheckBuffer(true, false)
+	items := EnumerateCasAsList(f.TB, f.cas)
+
+	expected := make([]string, 0, len(items))
+	h := f.cas.GetHashAlgorithm()
+	sha1tree, entries := marshalData(f.TB, h, archived)
+	for _, v := range sha1tree {
+		expected = append(expected, v)
+	}
+	expected = append(expected, treeDigests(f.TB, h, entries)...)
+	sort.Strings(expected)
+	f.Assertf(Equals(items, expected), "Unexpected items:\n%s\n%s", items, expected)
+}
+
+func TestArchiveJobsInvalid(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	args := []string{"archive", "-root=\\test_archive", "-jobs=0", "toArchive"}
+	f.Run(args, 1)
+	f.CheckBuffer(false, true)
+}
+
+func TestArchiveChunked(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(f.TB, "archive_chunked")
+	defer removeTempDir(tempData)
+
+	data := makeRandomData(3, 6*1024*1024)
+	tree := map[string]string{
+		"toArchive": "big\nsmall\n",
+		"big":       string(data),
+		"small":     "small\n",
+	}
+	if err := createTree(tempData, tree); err != nil {
+		f.Fatal(err)
+	}
+
+	args := []string{"archive", "-root=\\test_archive", "-chunk-threshold=1", filepath.Join(tempData, "toArchive")}
+	f.Run(args, 0)
+	f.CheckBuffer(true, false)
+	before := EnumerateCasAsList(f.TB, f.cas)
+
+	nodes := EnumerateNodesAsList(f.TB, f.nodes)
+	n, err := f.nodes.Open(nodes[0])
+	f.Assertf(err == nil, "Unexpected error: %s", err)
+	defer n.Close()
+	node := &Node{}
+	f.Assertf(loadReaderAsJson(n, node) == nil, "Failed to load node")
+	entry, err := LoadEntry(f.cas, node.Entry)
+	f.Assertf(err == nil, "Unexpected error: %s", err)
+	f.Assertf(entry.validate(f.cas.GetHashAlgorithm()) == nil, "Invalid entry")
+	big := entry.Files["big"]
+	f.Assertf(big.Sha1 == "" && len(big.Chunks) > 1, "Unexpected entry %v", big)
+	small := entry.Files["small"]
+	f.Assertf(small.Sha1 != "" && small.Chunks == nil, "Unexpected entry %v", small)
+
+	// The file is restored from its chunks.
+	out := filepath.Join(tempData, "out")
+	count, err := restoreEntry(f.GetLog(), f.cas, entry, out)
+	f.Assertf(err == nil && count == 3, "Unexpected result %d %s", count, err)
+	actual, err := ReadTree(out)
+	f.Assertf(err == nil, "Unexpected error: %s", err)
+	f.Assertf(MapsEquals(tree, actual), "Tree mismatch")
+
+	// Appending to the file only stores the last chunk again, along the entry.
+	fh, err := os.OpenFile(filepath.Join(tempData, "big"), os.O_WRONLY|os.O_APPEND, 0)
+	f.Assertf(err == nil, "Unexpected error: %s", err)
+	fh.WriteString("appended")
+	fh.Close()
+	f.Run(args, 0)
+	after := EnumerateCasAsList(f.TB, f.cas)
+	f.Assertf(len(after) == len(before)+2, "Unexpected items:\n%s\n%s", before, after)
+}
+
+func TestArchiveChunkedTruncated(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(f.TB, "archive_truncated")
+	defer removeTempDir(tempData)
+
+	tree := map[string]string{"empty": "", "small": "small\n"}
+	if err := createTree(tempData, tree); err != nil {
+		f.Fatal(err)
+	}
+	// Both files were larger than the threshold when they were listed. They are
+	// archived as a single object instead of as no or a single chunk.
+	cas := makeFakeCasTable(f.TB)
+	out := make(chan string, 10)
+	s := &Stats{out: out}
+	for name, content := range tree {
+		cache := &EntryCache{}
+		item := itemToArchive{filepath.Join(tempData, name), name, "", nil, 2 * 1024 * 1024, 0, cache}
+		item = s.archiveItem(item, cas, 1024*1024)
+		expected := cas.GetHashAlgorithm().HashBytes([]byte(content))
+		f.Assertf(item.sha1 == expected && item.chunks == nil, "Unexpected item %v", item)
+		f.Assertf(item.size == int64(len(content)), "Unexpected size %d", item.size)
+		f.Assertf(cache.Sha1 == expected && cache.Chunks == nil, "Unexpected cache %v", cache)
+		_, err := cas.Stat(expected)
+		f.Assertf(err == nil, "Unexpected error: %s", err)
+	}
+	f.Assertf(s.errors.g() == 0 && len(out) == 0, "Unexpected errors")
+}
+
+func TestArchiveSubtrees(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(f.TB, "archive_subtrees")
+	defer removeTempDir(tempData)
+
+	tree := map[string]string{
+		"toArchive":           "data\n",
+		"data/dir1/sub/file1": "content1\n",
+		"data/dir2/sub/file2": "content2\n",
+	}
+	if err := createTree(tempData, tree); err != nil {
+		f.Fatal(err)
+	}
+	args := []string{"archive", "-root=\\test_archive", filepath.Join(tempData, "toArchive")}
+	f.Run(args, 0)
+	f.CheckBuffer(true, false)
+	before := EnumerateCasAsList(f.TB, f.cas)
+
+	// Only the modified file and the directories on its path are stored again.
+	tree = map[string]string{"data/dir1/sub/file1": "modified content\n"}
+	if err := createTree(tempData, tree); err != nil {
+		f.Fatal(err)
+	}
+	f.Run(args, 0)
+	after := EnumerateCasAsList(f.TB, f.cas)
+	f.Assertf(len(after) == len(before)+4, "Unexpected items:\n%s\n%s", before, after)
+
+	nodes := EnumerateNodesAsList(f.TB, f.nodes)
+	f.Assertf(len(nodes) == 3, "Unexpected nodes: %s", nodes)
+	entries := []*Entry{}
+	for _, name := range nodes[:2] {
+		n, err := f.nodes.Open(name)
+		f.Assertf(err == nil, "Unexpected error: %s", err)
+		node := &Node{}
+		f.Assertf(loadReaderAsJson(n, node) == nil, "Failed to load node")
+		n.Close()
+		entry, err := LoadEntry(f.cas, node.Entry)
+		f.Assertf(err == nil, "Unexpected error: %s", err)
+		entries = append(entries, entry)
+	}
+	dir1 := entries[0].Files["dir1"]
+	f.Assertf(dir1.Dir != "" && dir1.Files == nil, "Unexpected entry %v", dir1)
+	f.Assertf(dir1.Dir != entries[1].Files["dir1"].Dir, "dir1 wasn't modified")
+	f.Assertf(entries[0].Files["dir2"].Dir == entries[1].Files["dir2"].Dir, "dir2 was modified")
+
+	// The directories are loaded on demand.
+	out := filepath.Join(tempData, "out")
+	count, err := restoreEntry(f.GetLog(), f.cas, entries[0], out)
+	f.Assertf(err == nil && count == 3, "Unexpected result %d %s", count, err)
+
+	// gc follows the directories.
+	f.Run([]string{"gc", "-root=\\test_archive"}, 0)
+	f.Assertf(Equals(EnumerateCasAsList(f.TB, f.cas), after), "gc removed referenced objects")
+	f.Assertf(f.nodes.Remove(nodes[0], nil) == nil, "Failed to remove %s", nodes[0])
+	f.Run([]string{"gc", "-root=\\test_archive", "-grace=0"}, 0)
+	remaining := EnumerateCasAsList(f.TB, f.cas)
+	f.Assertf(len(remaining) == len(after)-4, "Unexpected items:\n%s\n%s", after, remaining)
+}
+
+// Counts the calls that send a request each to a remote CasTable.
+type countingCasTable struct {
+	CasTable
+	lock     sync.Mutex
+	addEntry int
+	missing  int
+}
+
+func (c *countingCasTable) AddEntry(source io.Reader, name string) error {
+	c.lock.Lock()
+	c.addEntry++
+	c.lock.Unlock()
+	return c.CasTable.AddEntry(source, name)
+}
+
+func (c *countingCasTable) Missing(names []string) ([]string, error) {
+	c.lock.Lock()
+	c.missing++
+	c.lock.Unlock()
+	return c.CasTable.Missing(names)
+}
+
+func TestArchiveBatchesPresentItems(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(f.TB, "archive_batch")
+	defer removeTempDir(tempData)
+
+	tree := map[string]string{"toArchive": "dir1\n"}
+	for i := 0; i < 50; i++ {
+		tree[fmt.Sprintf("dir1/file%d", i)] = fmt.Sprintf("content%d", i)
+	}
+	if err := createTree(tempData, tree); err != nil {
+		f.Fatal(err)
+	}
+	counting := &countingCasTable{CasTable: makeFakeCasTable(f.TB)}
+	f.cas = counting
+	args := []string{"archive", "-root=\\test_archive", "-jobs=4", filepath.Join(tempData, "toArchive")}
+	f.Run(args, 0)
+	f.CheckBuffer(true, false)
+
+	// The files are all in the cache the second time; they are queried in
+	// batches instead of being sent one by one. Only the directory, whose
+	// digest isn't known before it is serialized, is sent.
+	counting.addEntry = 0
+	counting.missing = 0
+	f.Run(args, 0)
+	f.CheckBuffer(true, false)
+	f.Assertf(counting.addEntry == 1, "Unexpected AddEntry() calls: %d", counting.addEntry)
+	f.Assertf(counting.missing >= 1 && counting.missing < 50, "Unexpected Missing() calls: %d", counting.missing)
+	nodes := EnumerateNodesAsList(f.TB, f.nodes)
+	f.Assertf(len(nodes) == 3, "Unexpected nodes: %s", nodes)
+}
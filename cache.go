@@ -29,6 +29,7 @@ func init() {
 // this structure is more compact than a flat list for deep trees.
 type EntryCache struct {
 	Sha1       string
+	Chunks     []Chunk // Set instead of Sha1 for a file stored in chunks.
 	Size       int64
 	Timestamp  int64 // In Unix() epoch.
 	LastTested int64 // Last time this file was tested for presence.
@@ -103,22 +104,29 @@ func getCachePath() (string, error) {
 	return filepath.Join(usr.HomeDir, ".dumbcas"), nil
 }
 
-// Loads the cache from ~/.dumbcas/cache.json and keeps it open until the call
+// Loads the cache from ~/.dumbcas/cache.gob and keeps it open until the call
 // to Save(). It is guaranteed to return a non-nil Cache instance even in case
 // of failure to load the cache from disk and that error is non-nil.
 //
+// The digests are only valid for a single hash algorithm so each algorithm
+// other than legacyHashName uses its own file, e.g. cache_sha256.gob.
+//
 // TODO(maruel): Ensure proper file locking. One way is to always create a new
 // file when adding data and then periodically garbage-collect the files.
-func loadCache(l *log.Logger) (Cache, error) {
+func loadCache(h *HashAlgorithm, l *log.Logger) (Cache, error) {
 	cacheDir, err := getCachePath()
 	if err != nil {
 		return &cache{&EntryCache{}, "", l}, err
 	}
-	return loadCacheInner(cacheDir, l)
+	return loadCacheInner(cacheDir, h, l)
 }
 
-func loadCacheInner(cacheDir string, l *log.Logger) (Cache, error) {
-	cache := &cache{&EntryCache{}, filepath.Join(cacheDir, "cache.gob"), l}
+func loadCacheInner(cacheDir string, h *HashAlgorithm, l *log.Logger) (Cache, error) {
+	cacheName := "cache.gob"
+	if h.Name != legacyHashName {
+		cacheName = "cache_" + h.Name + ".gob"
+	}
+	cache := &cache{&EntryCache{}, filepath.Join(cacheDir, cacheName), l}
 	if err := os.Mkdir(cacheDir, 0700); err != nil && !os.IsExist(err) {
 		return cache, fmt.Errorf("Failed to access %s: %s", cacheDir, err)
 	}
@@ -35,10 +35,10 @@ func (c *fakeCache) Root() *EntryCache {
 
 func (c *fakeCache) Close() {
 	c.Assertf(c.closed == false, "Was unexpectedly closed")
-	c.closed = false
+	c.closed = true
 }
 
-func (a *DumbcasAppMock) LoadCache() (Cache, error) {
+func (a *DumbcasAppMock) LoadCache(h *HashAlgorithm) (Cache, error) {
 	//return loadCache()
 	if a.cache == nil {
 		a.cache = &fakeCache{a.TB, &EntryCache{}, false, debug.Stack()}
@@ -53,7 +53,8 @@ func TestCacheNormal(t *testing.T) {
 	// Just makes sure loading the real cache doesn't crash.
 	t.Parallel()
 	tb := subcommandstest.MakeTB(t)
-	cache, err := loadCache(tb.GetLog())
+	h, _ := GetHashAlgorithm(defaultHashName)
+	cache, err := loadCache(h, tb.GetLog())
 	tb.Assertf(err == nil, "Oops")
 	defer cache.Close()
 	tb.Assertf(cache.Root() != nil, "Oops")
@@ -72,8 +73,9 @@ func TestCacheRedirected(t *testing.T) {
 	tb := subcommandstest.MakeTB(t)
 	tempData := makeTempDir(tb, "cache")
 	defer removeTempDir(tempData)
+	h, _ := GetHashAlgorithm(defaultHashName)
 	load := func() (Cache, error) {
-		return loadCacheInner(tempData, tb.GetLog())
+		return loadCacheInner(tempData, h, tb.GetLog())
 	}
 	testCacheImpl(tb, load)
 }
@@ -84,6 +86,7 @@ func TestFakeCache(t *testing.T) {
 	// Keep the cache alive, since it's all in-memory.
 	fake := &fakeCache{tb, &EntryCache{}, false, nil}
 	load := func() (Cache, error) {
+		fake.closed = false
 		return fake, nil
 	}
 	testCacheImpl(tb, load)
@@ -10,17 +10,82 @@ limitations under the License. */
 package main
 
 import (
+	"fmt"
 	"io"
+	"os"
+	"time"
 )
 
+// CasTable must be safe for concurrent use.
 type CasTable interface {
 	Table
-	// Adds a node to the table.
+	// Adds a node to the table. The digest of the content is calculated while
+	// it is stored; if it doesn't match |name|, the content is stored under its
+	// actual digest instead and a *HashMismatchError is returned. Returns
+	// os.ErrExist if the content was already present; its modification time is
+	// then updated so gc sees it was referenced recently.
 	AddEntry(source io.Reader, name string) error
+	// Adds content whose digest is not known yet. The digest is calculated while
+	// the content is stored and is returned. Returns os.ErrExist along the
+	// digest if the content was already present, after updating its
+	// modification time like AddEntry().
+	AddStream(source io.Reader) (string, error)
+	// Returns the size and the modification time of an entry.
+	Stat(name string) (*ObjectInfo, error)
+	// Updates the modification time of an entry like AddEntry() does when the
+	// content is already present, so gc keeps it. Returns os.ErrNotExist if the
+	// entry is missing.
+	Touch(name string) error
+	// Returns the entries of |names| that are missing. The others are touched
+	// like Touch() does where it is cheap; a table in S3 relies on its lock to
+	// keep gc away instead. A remote table answers with a single request, so
+	// the callers query the entries in batches before sending their content.
+	Missing(names []string) ([]string, error)
 	// Sets the bit that the table needs to be checked for consistency.
 	SetFsckBit()
 	// Returns if the fsck bit is set.
 	GetFsckBit() bool
 	// Clears the fsck bit.
 	ClearFsckBit()
+	// Returns the algorithm used to calculate the digest of each entry.
+	GetHashAlgorithm() *HashAlgorithm
+	// Removes the partially written entries left behind by an interrupted
+	// AddEntry(). Returns the number of files removed.
+	RemoveTemporaryFiles() (int, error)
+	// Returns the trash where Remove() moves the entries. The path of an item in
+	// the trash may be split in directories; the digest is the path without its
+	// separators.
+	GetTrash() Trash
+}
+
+// Implements CasTable.Missing() with Touch() for the tables where it is cheap.
+func missingByTouch(cas CasTable, names []string) ([]string, error) {
+	missing := []string{}
+	for _, name := range names {
+		if err := cas.Touch(name); os.IsNotExist(err) {
+			missing = append(missing, name)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return missing, nil
+}
+
+// Size and modification time of an entry in a CasTable.
+type ObjectInfo struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// HashMismatchError is returned when the content doesn't match the digest it
+// was supposed to have.
+type HashMismatchError struct {
+	Expected string
+	Actual   string
+	// Size of the content that was actually read.
+	Size int64
+}
+
+func (e *HashMismatchError) Error() string {
+	return fmt.Sprintf("Content mismatch, expected %s, got %s", e.Expected, e.Actual)
 }
@@ -0,0 +1,569 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Returns true if |root| is the URL of a repository served by web instead of
+// a local directory.
+func isRemoteRoot(root string) bool {
+	return strings.HasPrefix(root, "http://") || strings.HasPrefix(root, "https://")
+}
+
+// Sends the requests of the remote tables to the API served by web. |token|
+// authorizes the requests modifying the repository. |lockId| is the lock held
+// by the server on behalf of this client, if any.
+type httpClient struct {
+	base   *url.URL
+	token  string
+	client *http.Client
+	lockId string
+}
+
+func makeHttpClient(root, token string) (*httpClient, error) {
+	base, err := url.Parse(strings.TrimRight(root, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid root %s: %s", root, err)
+	}
+	return &httpClient{base: base, token: token, client: &http.Client{}}, nil
+}
+
+func (c *httpClient) newRequest(method, urlPath string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, c.base.String()+urlPath, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	if c.lockId != "" {
+		req.Header.Set(apiLockHeader, c.lockId)
+	}
+	return req, nil
+}
+
+// Sends |req| and returns the response if its status is one of |statuses|.
+// Otherwise the body is closed and the error sent by the server is returned;
+// a 404 is returned as os.ErrNotExist and a failed precondition as os.ErrExist.
+func (c *httpClient) do(req *http.Request, statuses ...int) (*http.Response, error) {
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range statuses {
+		if resp.StatusCode == status {
+			return resp, nil
+		}
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return nil, os.ErrNotExist
+	case http.StatusPreconditionFailed:
+		return nil, os.ErrExist
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return nil, fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Path, resp.Status, strings.TrimSpace(string(msg)))
+}
+
+// Sends a request whose response body is not needed.
+func (c *httpClient) call(method, urlPath string, body io.Reader, statuses ...int) (*http.Response, error) {
+	req, err := c.newRequest(method, urlPath, body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req, statuses...)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+// Returns the body of a GET request.
+func (c *httpClient) get(urlPath string) ([]byte, error) {
+	req, err := c.newRequest("GET", urlPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Sends a body and returns the body of the response along its status.
+func (c *httpClient) send(method, urlPath string, body io.Reader, statuses ...int) (int, []byte, error) {
+	req, err := c.newRequest(method, urlPath, body)
+	if err != nil {
+		return 0, nil, err
+	}
+	resp, err := c.do(req, statuses...)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, data, err
+}
+
+// Removes an entry, sending |record| so the server journals why.
+func (c *httpClient) remove(urlPath string, record *TrashRecord) error {
+	if record == nil {
+		record = &TrashRecord{Reason: TrashRemoved}
+	}
+	if record.Command == "" {
+		record.Command = strings.Join(os.Args, " ")
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = c.call("DELETE", urlPath, bytes.NewReader(data), http.StatusNoContent)
+	return err
+}
+
+// Reads the enumeration sent by the server.
+func (c *httpClient) enumerate(urlPath string) <-chan EnumerationEntry {
+	items := make(chan EnumerationEntry)
+	go func() {
+		defer close(items)
+		req, err := c.newRequest("GET", urlPath, nil)
+		if err != nil {
+			items <- EnumerationEntry{Error: err}
+			return
+		}
+		resp, err := c.do(req, http.StatusOK)
+		if err != nil {
+			items <- EnumerationEntry{Error: err}
+			return
+		}
+		defer resp.Body.Close()
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if strings.HasPrefix(line, "!") {
+				items <- EnumerationEntry{Error: errors.New(line[1:])}
+			} else {
+				items <- EnumerationEntry{Item: line}
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			items <- EnumerationEntry{Error: err}
+		}
+	}()
+	return items
+}
+
+// Forwards the requests of web to the server, so a remote repository can be
+// served too.
+func (c *httpClient) proxy(urlPath string) http.Handler {
+	return &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			r.URL.Scheme = c.base.Scheme
+			r.URL.Host = c.base.Host
+			r.URL.Path = c.base.Path + urlPath + r.URL.Path
+			r.URL.RawPath = ""
+			r.Host = c.base.Host
+		},
+	}
+}
+
+// A CasTable served by web -writable on another host. The server holds the lock
+// on the repository. Only the content missing on the server is sent.
+type httpCasTable struct {
+	client *httpClient
+	hash   *HashAlgorithm
+	proxy  http.Handler
+}
+
+func makeHttpCasTable(root, token string) (CasTable, error) {
+	client, err := makeHttpClient(root, token)
+	if err != nil {
+		return nil, err
+	}
+	data, err := client.get(apiConfigPath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to %s: %s", root, err)
+	}
+	config := &apiConfig{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("Invalid configuration served by %s: %s", root, err)
+	}
+	h, err := GetHashAlgorithm(config.Hash)
+	if err != nil {
+		return nil, err
+	}
+	return &httpCasTable{client, h, client.proxy("/content/retrieve/default")}, nil
+}
+
+func (t *httpCasTable) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	t.proxy.ServeHTTP(w, r)
+}
+
+func (t *httpCasTable) Enumerate() <-chan EnumerationEntry {
+	return t.client.enumerate(apiEnumerateCasPath)
+}
+
+func (t *httpCasTable) Open(hash string) (ReadSeekCloser, error) {
+	if !t.hash.IsValid(hash) {
+		return nil, fmt.Errorf("Invalid digest %s", hash)
+	}
+	return openHttpObject(hash, func(offset int64) (*http.Response, error) {
+		req, err := t.client.newRequest("GET", apiObjectPath+hash, nil)
+		if err != nil {
+			return nil, err
+		}
+		if offset != 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+		return t.client.do(req, http.StatusOK, http.StatusPartialContent)
+	})
+}
+
+func (t *httpCasTable) Remove(hash string, record *TrashRecord) error {
+	return t.client.remove(apiObjectPath+hash, record)
+}
+
+// A single request is sent. The server answers before the content is sent if
+// it already has the object, so the content is only sent when it is missing.
+func (t *httpCasTable) AddEntry(source io.Reader, hash string) error {
+	// The HTTP client would close |source|; it belongs to the caller.
+	req, err := t.client.newRequest("PUT", apiObjectPath+hash, ioutil.NopCloser(source))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Expect", "100-continue")
+	resp, err := t.client.do(req, http.StatusCreated, http.StatusOK, http.StatusConflict)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return os.ErrExist
+	case http.StatusConflict:
+		mismatch := &HashMismatchError{}
+		if err := json.Unmarshal(data, mismatch); err != nil {
+			return fmt.Errorf("Invalid response: %s", err)
+		}
+		return mismatch
+	}
+	return nil
+}
+
+func (t *httpCasTable) AddStream(source io.Reader) (string, error) {
+	status, data, err := t.client.send("POST", apiObjectPath, ioutil.NopCloser(source), http.StatusCreated, http.StatusOK)
+	if err != nil {
+		return "", err
+	}
+	hash := string(data)
+	if !t.hash.IsValid(hash) {
+		return "", fmt.Errorf("Invalid digest %q returned by the server", hash)
+	}
+	if status == http.StatusOK {
+		return hash, os.ErrExist
+	}
+	return hash, nil
+}
+
+func (t *httpCasTable) Stat(hash string) (*ObjectInfo, error) {
+	resp, err := t.client.call("HEAD", apiObjectPath+hash, nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	modTime, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid modification time of %s: %s", hash, err)
+	}
+	return &ObjectInfo{resp.ContentLength, modTime}, nil
+}
+
+func (t *httpCasTable) Touch(hash string) error {
+	missing, err := t.Missing([]string{hash})
+	if err != nil {
+		return err
+	}
+	if len(missing) != 0 {
+		return os.ErrNotExist
+	}
+	return nil
+}
+
+// Sends |hashes| in a single request.
+func (t *httpCasTable) Missing(hashes []string) ([]string, error) {
+	body := strings.Join(hashes, "\n") + "\n"
+	_, data, err := t.client.send("POST", apiMissingPath, strings.NewReader(body), http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	missing := strings.Fields(string(data))
+	for _, hash := range missing {
+		if !t.hash.IsValid(hash) {
+			return nil, fmt.Errorf("Invalid digest %q returned by the server", hash)
+		}
+	}
+	return missing, nil
+}
+
+func (t *httpCasTable) SetFsckBit() {
+	log.Printf("Marking for fsck")
+	if _, err := t.client.call("PUT", apiFsckPath, nil, http.StatusNoContent); err != nil {
+		log.Printf("Failed to mark for fsck: %s", err)
+	}
+}
+
+func (t *httpCasTable) GetFsckBit() bool {
+	data, err := t.client.get(apiFsckPath)
+	// Assume the worst if the server can't be reached.
+	return err != nil || string(data) != "false"
+}
+
+func (t *httpCasTable) ClearFsckBit() {
+	// Ignore the error.
+	t.client.call("DELETE", apiFsckPath, nil, http.StatusNoContent)
+}
+
+func (t *httpCasTable) GetHashAlgorithm() *HashAlgorithm {
+	return t.hash
+}
+
+// The server only removes them while this client holds the repository
+// exclusively.
+func (t *httpCasTable) RemoveTemporaryFiles() (int, error) {
+	_, data, err := t.client.send("DELETE", apiTemporaryPath, nil, http.StatusOK)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(data))
+}
+
+func (t *httpCasTable) GetTrash() Trash {
+	return remoteTrash{}
+}
+
+// A lock held by the server of a remote repository on behalf of this process.
+// It is renewed until it is released.
+type httpLock struct {
+	client *httpClient
+	done   chan bool
+	wg     sync.WaitGroup
+}
+
+// Locks the repository served at the root of |cas| through its server, waiting
+// up to |wait| for the conflicting locks to be released. The requests sent by
+// the tables sharing the client of |cas| then carry the lock.
+func lockHttpRepository(cas CasTable, exclusive bool, wait time.Duration) (Lock, error) {
+	t, ok := cas.(*httpCasTable)
+	if !ok {
+		return nil, fmt.Errorf("Internal error: %T is not a remote CasTable", cas)
+	}
+	urlPath := apiLockPath
+	if exclusive {
+		urlPath += "?exclusive=true"
+	}
+	deadline := time.Now().Add(wait)
+	for {
+		status, data, err := t.client.send("POST", urlPath, nil, http.StatusCreated, http.StatusConflict, http.StatusUnauthorized, http.StatusForbidden)
+		if err != nil {
+			return nil, err
+		}
+		switch status {
+		case http.StatusCreated:
+			t.client.lockId = string(data)
+			l := &httpLock{client: t.client, done: make(chan bool)}
+			l.wg.Add(1)
+			go l.renew()
+			return l, nil
+		case http.StatusUnauthorized, http.StatusForbidden:
+			if exclusive {
+				return nil, fmt.Errorf("Can't lock %s: %s", t.client.base, strings.TrimSpace(string(data)))
+			}
+			// A client that can't modify the repository reads it unlocked.
+			return remoteLock{}, nil
+		}
+		remaining := deadline.Sub(time.Now())
+		if remaining <= 0 || IsInterrupted() {
+			return nil, errors.New(strings.TrimSpace(string(data)))
+		}
+		if remaining > lockPollInterval {
+			remaining = lockPollInterval
+		}
+		time.Sleep(remaining)
+	}
+}
+
+func (l *httpLock) renew() {
+	defer l.wg.Done()
+	ticker := time.NewTicker(apiLockTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+			if _, err := l.client.call("PUT", apiLockPath+l.client.lockId, nil, http.StatusNoContent); err != nil {
+				log.Printf("Failed to renew the lock on %s: %s", l.client.base, err)
+			}
+		}
+	}
+}
+
+func (l *httpLock) Release() error {
+	close(l.done)
+	l.wg.Wait()
+	id := l.client.lockId
+	l.client.lockId = ""
+	_, err := l.client.call("DELETE", apiLockPath+id, nil, http.StatusNoContent)
+	return err
+}
+
+// An object read with a GET request. Seeking sends a new request for the
+// remaining content with a Range header.
+type httpObject struct {
+	name string
+	// Sends the GET request for the content starting at |offset|.
+	request func(offset int64) (*http.Response, error)
+	// -1 while unknown.
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func openHttpObject(name string, request func(offset int64) (*http.Response, error)) (*httpObject, error) {
+	o := &httpObject{name: name, request: request, size: -1}
+	if err := o.get(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func (o *httpObject) get() error {
+	resp, err := o.request(o.offset)
+	if err != nil {
+		return err
+	}
+	if o.offset != 0 && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return fmt.Errorf("The server doesn't support seeking in %s", o.name)
+	}
+	if o.size == -1 && resp.StatusCode == http.StatusOK {
+		o.size = resp.ContentLength
+	}
+	o.body = resp.Body
+	return nil
+}
+
+func (o *httpObject) Read(p []byte) (int, error) {
+	if o.size != -1 && o.offset >= o.size {
+		return 0, io.EOF
+	}
+	if o.body == nil {
+		if err := o.get(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	return n, err
+}
+
+func (o *httpObject) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		if o.size == -1 {
+			return 0, fmt.Errorf("The size of %s is unknown", o.name)
+		}
+		offset += o.size
+	default:
+		return 0, fmt.Errorf("Invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("Invalid offset %d", offset)
+	}
+	if offset != o.offset && o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+	o.offset = offset
+	return offset, nil
+}
+
+func (o *httpObject) Close() error {
+	if o.body == nil {
+		return nil
+	}
+	err := o.body.Close()
+	o.body = nil
+	return err
+}
+
+var errRemoteTrash = errors.New("The trash of a remote repository can only be accessed on its server")
+
+// The trash of a remote repository. The server moves the entries to its own
+// trash; it can only be managed there.
+type remoteTrash struct{}
+
+func (remoteTrash) Move(relPath string, record *TrashRecord) error {
+	return errRemoteTrash
+}
+
+func (remoteTrash) Journal() ([]*TrashRecord, error) {
+	return nil, errRemoteTrash
+}
+
+func (remoteTrash) Enumerate() <-chan EnumerationEntry {
+	items := make(chan EnumerationEntry, 1)
+	items <- EnumerationEntry{Error: errRemoteTrash}
+	close(items)
+	return items
+}
+
+func (remoteTrash) Open(relPath string) (ReadSeekCloser, error) {
+	return nil, errRemoteTrash
+}
+
+func (remoteTrash) Stat(relPath string) (*ObjectInfo, error) {
+	return nil, errRemoteTrash
+}
+
+func (remoteTrash) Restore(relPath string) error {
+	return errRemoteTrash
+}
+
+func (remoteTrash) Remove(relPath string) error {
+	return errRemoteTrash
+}
@@ -0,0 +1,197 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"bytes"
+	"github.com/maruel/subcommands/subcommandstest"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// Token given to the servers started by the tests.
+const testToken = "secret"
+
+// Serves a local repository created in |tempData| like web does and returns
+// the URL to use as -root.
+func serveLocalRepository(t *subcommandstest.TB, tempData string, writable bool) *httptest.Server {
+	_, err := initLocalRepository(tempData, "", 0)
+	t.Assertf(err == nil, "Unexpected error: %s", err)
+	cas, err := makeLocalCasTable(tempData)
+	t.Assertf(err == nil, "Unexpected error: %s", err)
+	nodes, err := loadLocalNodesTable(tempData, cas, t.GetLog())
+	t.Assertf(err == nil, "Unexpected error: %s", err)
+	lock := func(exclusive bool) (Lock, error) {
+		return lockLocalRepository(tempData, exclusive, 0)
+	}
+	return httptest.NewServer(makeServeMux(cas, nodes, writable, testToken, lock))
+}
+
+func TestIsRemoteRoot(t *testing.T) {
+	t.Parallel()
+	tb := subcommandstest.MakeTB(t)
+	tb.Assertf(isRemoteRoot("http://nas:8010/"), "Unexpected local root")
+	tb.Assertf(isRemoteRoot("https://nas/dumbcas"), "Unexpected local root")
+	tb.Assertf(!isRemoteRoot("/path/to/storage"), "Unexpected remote root")
+	tb.Assertf(!isRemoteRoot("http"), "Unexpected remote root")
+
+	c := &CommonFlags{Root: "http://nas:8010/"}
+	tb.Assertf(c.ParseRoot() == nil && c.Root == "http://nas:8010/", "Unexpected root %s", c.Root)
+}
+
+func TestHttpCasTable(t *testing.T) {
+	t.Parallel()
+	tb := subcommandstest.MakeTB(t)
+	tempData := makeTempDir(tb, "cas_http")
+	defer removeTempDir(tempData)
+	server := serveLocalRepository(tb, tempData, true)
+	defer server.Close()
+
+	cas, err := makeHttpCasTable(server.URL+"/", testToken)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	tb.Assertf(cas.GetHashAlgorithm().Name == defaultHashName, "Unexpected algorithm %s", cas.GetHashAlgorithm().Name)
+	testCasTableImpl(tb, cas)
+
+	// The partially written objects are only removed while the repository is
+	// locked exclusively.
+	_, err = cas.RemoveTemporaryFiles()
+	tb.Assertf(err != nil, "Unexpected success")
+	lock, err := lockHttpRepository(cas, true, 0)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	removed, err := cas.RemoveTemporaryFiles()
+	tb.Assertf(err == nil && removed == 0, "Unexpected result %d %s", removed, err)
+	tb.Assertf(lock.Release() == nil, "Failed to release")
+	_, err = cas.GetTrash().Journal()
+	tb.Assertf(err == errRemoteTrash, "Unexpected error: %s", err)
+	_, err = makeHttpCasTable(server.URL+"/missing", testToken)
+	tb.Assertf(err != nil, "Unexpected success")
+}
+
+func TestHttpCasTableMissing(t *testing.T) {
+	t.Parallel()
+	tb := subcommandstest.MakeTB(t)
+	tempData := makeTempDir(tb, "cas_http_missing")
+	defer removeTempDir(tempData)
+	server := serveLocalRepository(tb, tempData, true)
+	defer server.Close()
+	local, err := makeLocalCasTable(tempData)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	file1, err := AddBytes(local, []byte("content1"))
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	old := time.Now().Add(-48 * time.Hour)
+	err = os.Chtimes(local.(*casTable).filePath(file1), old, old)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+
+	// The present objects are touched.
+	cas, err := makeHttpCasTable(server.URL, testToken)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	file2 := cas.GetHashAlgorithm().HashBytes([]byte("content2"))
+	missing, err := cas.(*httpCasTable).Missing([]string{file1, file2})
+	tb.Assertf(err == nil && Equals(missing, []string{file2}), "Unexpected result %q %s", missing, err)
+	info, err := local.Stat(file1)
+	tb.Assertf(err == nil && time.Since(info.ModTime) < time.Hour, "Unexpected result %v %s", info, err)
+	_, err = cas.(*httpCasTable).Missing([]string{"invalid"})
+	tb.Assertf(err != nil, "Unexpected success")
+
+	// The content of a present object isn't sent again.
+	err = cas.AddEntry(&failingReader{}, file1)
+	tb.Assertf(os.IsExist(err), "Unexpected error: %s", err)
+}
+
+func TestHttpCasTableToken(t *testing.T) {
+	t.Parallel()
+	tb := subcommandstest.MakeTB(t)
+	tempData := makeTempDir(tb, "cas_http_token")
+	defer removeTempDir(tempData)
+	server := serveLocalRepository(tb, tempData, true)
+	defer server.Close()
+
+	// The objects can be read without the token but not modified.
+	for _, token := range []string{"", "invalid"} {
+		cas, err := makeHttpCasTable(server.URL, token)
+		tb.Assertf(err == nil, "Unexpected error: %s", err)
+		_, err = AddBytes(cas, []byte("content1"))
+		tb.Assertf(err != nil && !os.IsExist(err), "Unexpected error: %s", err)
+		_, err = cas.AddStream(bytes.NewBufferString("content1"))
+		tb.Assertf(err != nil && !os.IsExist(err), "Unexpected error: %s", err)
+		items := EnumerateCasAsList(tb, cas)
+		tb.Assertf(len(items) == 0, "Found unexpected values: %q", items)
+		nodes, err := makeHttpNodesTable(server.URL, token)
+		tb.Assertf(err == nil, "Unexpected error: %s", err)
+		_, err = nodes.AddEntry(&Node{Entry: "0"}, "tag")
+		tb.Assertf(err != nil, "Unexpected success")
+	}
+}
+
+func TestHttpCasTableSeek(t *testing.T) {
+	t.Parallel()
+	tb := subcommandstest.MakeTB(t)
+	tempData := makeTempDir(tb, "cas_http_seek")
+	defer removeTempDir(tempData)
+	server := serveLocalRepository(tb, tempData, true)
+	defer server.Close()
+	cas, err := makeHttpCasTable(server.URL, testToken)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+
+	data := makeRandomData(5, 100*1024)
+	hash, err := AddBytes(cas, data)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	f, err := cas.Open(hash)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	defer f.Close()
+
+	// Seeking sends a new request for the rest of the object.
+	buf := make([]byte, 10)
+	_, err = io.ReadFull(f, buf)
+	tb.Assertf(err == nil && bytes.Equal(buf, data[:10]), "Unexpected read %s", err)
+	offset, err := f.Seek(50000, os.SEEK_SET)
+	tb.Assertf(err == nil && offset == 50000, "Unexpected seek %d %s", offset, err)
+	_, err = io.ReadFull(f, buf)
+	tb.Assertf(err == nil && bytes.Equal(buf, data[50000:50010]), "Unexpected read %s", err)
+	offset, err = f.Seek(-10, os.SEEK_END)
+	tb.Assertf(err == nil && offset == int64(len(data)-10), "Unexpected seek %d %s", offset, err)
+	rest, err := ioutil.ReadAll(f)
+	tb.Assertf(err == nil && bytes.Equal(rest, data[len(data)-10:]), "Unexpected read %s", err)
+	_, err = f.Seek(-1, os.SEEK_SET)
+	tb.Assertf(err != nil, "Unexpected success")
+}
+
+func TestHttpCasTableReadOnly(t *testing.T) {
+	t.Parallel()
+	tb := subcommandstest.MakeTB(t)
+	tempData := makeTempDir(tb, "cas_http_readonly")
+	defer removeTempDir(tempData)
+	server := serveLocalRepository(tb, tempData, false)
+	defer server.Close()
+	local, err := makeLocalCasTable(tempData)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	hash, err := AddBytes(local, []byte("content1"))
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+
+	// The objects can be read but not modified.
+	cas, err := makeHttpCasTable(server.URL, testToken)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	items := EnumerateCasAsList(tb, cas)
+	tb.Assertf(Equals(items, []string{hash}), "Found unexpected values: %q", items)
+	info, err := cas.Stat(hash)
+	tb.Assertf(err == nil && info.Size == 8, "Unexpected result %v %s", info, err)
+	_, err = AddBytes(cas, []byte("content2"))
+	tb.Assertf(err != nil && !os.IsExist(err), "Unexpected error: %s", err)
+	err = cas.Remove(hash, nil)
+	tb.Assertf(err != nil, "Unexpected success")
+	_, err = cas.RemoveTemporaryFiles()
+	tb.Assertf(err != nil, "Unexpected success")
+	items = EnumerateCasAsList(tb, cas)
+	tb.Assertf(Equals(items, []string{hash}), "Found unexpected values: %q", items)
+}
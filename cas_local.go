@@ -11,36 +11,41 @@ package main
 
 import (
 	"bytes"
-	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
+	"time"
 )
 
 const casName = "cas"
 const needFsckName = "need_fsck"
 
+// Objects are written in this CAS subdirectory first and then renamed into
+// place.
+const tempName = "tmp"
+
 type casTable struct {
 	rootDir      string
 	casDir       string
+	tempDir      string
 	prefixLength int
-	hashLength   int
-	validPath    *regexp.Regexp
+	hash         *HashAlgorithm
 	trash        Trash
 }
 
 // Converts an entry in the table into a proper file path.
 func (c *casTable) filePath(hash string) string {
-	match := c.validPath.FindStringSubmatch(hash)
-	if match == nil {
+	if !c.hash.IsValid(hash) {
 		log.Printf("filePath(%s) is invalid", hash)
 		return ""
 	}
-	fullPath := filepath.Join(c.casDir, match[0][:c.prefixLength], match[0][c.prefixLength:])
+	fullPath := filepath.Join(c.casDir, hash[:c.prefixLength], hash[c.prefixLength:])
 	if !filepath.IsAbs(fullPath) {
 		log.Printf("filePath(%s) is invalid", hash)
 		return ""
@@ -55,36 +60,53 @@ func prefixSpace(prefixLength uint) int {
 	return 1 << (prefixLength * 4)
 }
 
+// Creates the CAS directory of a new repository.
+func initLocalCasTable(rootDir string, config *RepositoryConfig) error {
+	casDir := filepath.Join(rootDir, casName)
+	if err := os.MkdirAll(casDir, 0750); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("InitCasTable(%s): failed to create the directory: %s", casDir, err)
+	}
+	// Create all the prefixes at initialization time so they don't need to be
+	// tested all the time.
+	for i := 0; i < prefixSpace(uint(config.PrefixLength)); i++ {
+		prefix := fmt.Sprintf("%0*x", config.PrefixLength, i)
+		if err := os.Mkdir(filepath.Join(casDir, prefix), 0750); err != nil && !os.IsExist(err) {
+			return fmt.Errorf("Failed to create %s: %s\n", prefix, err)
+		}
+	}
+	tempDir := filepath.Join(casDir, tempName)
+	if err := os.Mkdir(tempDir, 0750); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("Failed to create %s: %s\n", tempDir, err)
+	}
+	return nil
+}
+
 func makeLocalCasTable(rootDir string) (CasTable, error) {
 	//log.Printf("makeCasTable(%s)", rootDir)
-	// Creates 16^3 (4096) directories. Preferable values are 2 or 3.
-	prefixLength := 3
-	// Currently hardcoded for SHA-1 but could be used for any length.
-	hashLength := sha1.Size * 2
-
 	if !filepath.IsAbs(rootDir) {
 		return nil, fmt.Errorf("MakeCasTable(%s) is not valid", rootDir)
 	}
 	rootDir = filepath.Clean(rootDir)
+	config, err := loadRepositoryConfig(rootDir)
+	if err != nil {
+		return nil, err
+	}
+	// validate() already verified the algorithm is known.
+	hash, _ := GetHashAlgorithm(config.Hash)
 	casDir := filepath.Join(rootDir, casName)
-	if err := os.MkdirAll(casDir, 0750); err != nil && !os.IsExist(err) {
-		return nil, fmt.Errorf("MakeCasTable(%s): failed to create the directory: %s", casDir, err)
-	} else if !os.IsExist(err) {
-		// Create all the prefixes at initialization time so they don't need to be
-		// tested all the time.
-		for i := 0; i < prefixSpace(uint(prefixLength)); i++ {
-			prefix := fmt.Sprintf("%0*x", prefixLength, i)
-			if err := os.Mkdir(filepath.Join(casDir, prefix), 0750); err != nil && !os.IsExist(err) {
-				return nil, fmt.Errorf("Failed to create %s: %s\n", prefix, err)
-			}
-		}
+	if !isDir(casDir) {
+		return nil, fmt.Errorf("MakeCasTable(%s): %s is missing", rootDir, casDir)
+	}
+	tempDir := filepath.Join(casDir, tempName)
+	if err := os.Mkdir(tempDir, 0750); err != nil && !os.IsExist(err) {
+		return nil, fmt.Errorf("MakeCasTable(%s): failed to create %s: %s", rootDir, tempDir, err)
 	}
 	return &casTable{
 		rootDir,
 		casDir,
-		prefixLength,
-		hashLength,
-		regexp.MustCompile(fmt.Sprintf("^([a-f0-9]{%d})$", hashLength)),
+		tempDir,
+		config.PrefixLength,
+		hash,
 		MakeTrash(casDir),
 	}, nil
 }
@@ -109,7 +131,7 @@ func (c *casTable) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 // into the trash.
 func (c *casTable) Enumerate() <-chan EnumerationEntry {
 	rePrefix := regexp.MustCompile(fmt.Sprintf("^[a-f0-9]{%d}$", c.prefixLength))
-	reRest := regexp.MustCompile(fmt.Sprintf("^[a-f0-9]{%d}$", c.hashLength-c.prefixLength))
+	reRest := regexp.MustCompile(fmt.Sprintf("^[a-f0-9]{%d}$", c.hash.HexLength()-c.prefixLength))
 	items := make(chan EnumerationEntry)
 
 	// TODO(maruel): No need to read all at once.
@@ -122,11 +144,11 @@ func (c *casTable) Enumerate() <-chan EnumerationEntry {
 				if IsInterrupted() {
 					break
 				}
-				if prefix == TrashName {
+				if prefix == TrashName || prefix == needFsckName || prefix == tempName {
 					continue
 				}
 				if !rePrefix.MatchString(prefix) {
-					c.trash.Move(prefix)
+					c.trash.Move(prefix, &TrashRecord{Reason: TrashInvalid})
 					c.SetFsckBit()
 					continue
 				}
@@ -140,7 +162,7 @@ func (c *casTable) Enumerate() <-chan EnumerationEntry {
 				}
 				for _, item := range subitems {
 					if !reRest.MatchString(item) {
-						c.trash.Move(filepath.Join(prefix, item))
+						c.trash.Move(filepath.Join(prefix, item), &TrashRecord{Reason: TrashInvalid})
 						c.SetFsckBit()
 						continue
 					}
@@ -155,20 +177,118 @@ func (c *casTable) Enumerate() <-chan EnumerationEntry {
 
 // Adds an entry with the hash calculated already if not alreaady present. It's
 // a performance optimization to be able to not write the object unless needed.
+//
+// The content is written to a temporary file while its digest is calculated,
+// synced and only then renamed into place. An interrupted write can't leave a
+// truncated object under a valid name. If the content doesn't match |hash|, it
+// is stored under its actual digest.
 func (c *casTable) AddEntry(source io.Reader, hash string) error {
 	dst := c.filePath(hash)
-	df, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
-	if os.IsExist(err) {
-		return err
+	if dst == "" {
+		return fmt.Errorf("AddEntry(%s) is invalid", hash)
 	}
+	if c.touch(dst) {
+		return os.ErrExist
+	}
+	tempPath, actual, size, err := c.writeTemporary(source, hash+"_")
 	if err != nil {
-		return fmt.Errorf("Failed to copy(dst) %s: %s", dst, err)
+		return err
+	}
+	err = c.commitTemporary(tempPath, actual)
+	if actual != hash && (err == nil || os.IsExist(err)) {
+		return &HashMismatchError{hash, actual, size}
 	}
-	defer df.Close()
-	_, err = io.Copy(df, source)
 	return err
 }
 
+// The content is stored under the digest calculated while it is copied, so the
+// source is only read once.
+func (c *casTable) AddStream(source io.Reader) (string, error) {
+	tempPath, actual, _, err := c.writeTemporary(source, "stream_")
+	if err != nil {
+		return "", err
+	}
+	return actual, c.commitTemporary(tempPath, actual)
+}
+
+// Copies |source| into a new file in the temporary directory. Returns the path
+// of the file, the digest and the size of the content. Nothing is left behind
+// on failure.
+func (c *casTable) writeTemporary(source io.Reader, prefix string) (string, string, int64, error) {
+	df, err := ioutil.TempFile(c.tempDir, prefix)
+	if err != nil {
+		return "", "", 0, fmt.Errorf("Failed to create a temporary file: %s", err)
+	}
+	tempPath := df.Name()
+	digest := c.hash.New()
+	size, err := io.Copy(io.MultiWriter(df, digest), source)
+	if err == nil {
+		err = df.Sync()
+	}
+	if err2 := df.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		// Ignore the error.
+		os.Remove(tempPath)
+		return "", "", 0, err
+	}
+	return tempPath, hex.EncodeToString(digest.Sum(nil)), size, nil
+}
+
+// Moves the temporary file at |tempPath| to its final location. The temporary
+// file is discarded and os.ErrExist is returned if the content is already
+// present.
+func (c *casTable) commitTemporary(tempPath string, hash string) error {
+	dst := c.filePath(hash)
+	if c.touch(dst) {
+		// Ignore the error.
+		os.Remove(tempPath)
+		return os.ErrExist
+	}
+	if err := os.Rename(tempPath, dst); err != nil {
+		// Ignore the error.
+		os.Remove(tempPath)
+		return err
+	}
+	return nil
+}
+
+// Updates the modification time of an existing object so a concurrent gc
+// doesn't collect it before the node referencing it is saved. Returns false if
+// the object doesn't exist.
+func (c *casTable) touch(dst string) bool {
+	now := time.Now()
+	return os.Chtimes(dst, now, now) == nil
+}
+
+func (c *casTable) Touch(hash string) error {
+	dst := c.filePath(hash)
+	if dst == "" {
+		return fmt.Errorf("Touch(%s) is invalid", hash)
+	}
+	if !c.touch(dst) {
+		return os.ErrNotExist
+	}
+	return nil
+}
+
+func (c *casTable) Missing(hashes []string) ([]string, error) {
+	return missingByTouch(c, hashes)
+}
+
+func (c *casTable) Stat(hash string) (*ObjectInfo, error) {
+	fp := c.filePath(hash)
+	if fp == "" {
+		return nil, os.ErrInvalid
+	}
+	stat, err := os.Stat(fp)
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectInfo{stat.Size(), stat.ModTime()}, nil
+}
+
 func (c *casTable) Open(hash string) (ReadSeekCloser, error) {
 	fp := c.filePath(hash)
 	if fp == "" {
@@ -199,16 +319,38 @@ func (c *casTable) ClearFsckBit() {
 	os.Remove(filepath.Join(c.casDir, needFsckName))
 }
 
-func (c *casTable) Remove(hash string) error {
-	match := c.validPath.FindStringSubmatch(hash)
-	if match == nil {
+func (c *casTable) GetHashAlgorithm() *HashAlgorithm {
+	return c.hash
+}
+
+func (c *casTable) RemoveTemporaryFiles() (int, error) {
+	names, err := readDirNames(c.tempDir)
+	if err != nil {
+		return 0, fmt.Errorf("Failed reading %s: %s", c.tempDir, err)
+	}
+	count := 0
+	for _, name := range names {
+		if err := os.Remove(filepath.Join(c.tempDir, name)); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+func (c *casTable) GetTrash() Trash {
+	return c.trash
+}
+
+func (c *casTable) Remove(hash string, record *TrashRecord) error {
+	if !c.hash.IsValid(hash) {
 		return fmt.Errorf("Remove(%s) is invalid", hash)
 	}
-	return c.trash.Move(filepath.Join(hash[:c.prefixLength], hash[c.prefixLength:]))
+	return c.trash.Move(filepath.Join(hash[:c.prefixLength], hash[c.prefixLength:]), record)
 }
 
 // Utility function when the data is already in memory but not yet hashed.
 func AddBytes(c CasTable, data []byte) (string, error) {
-	hash := sha1Bytes(data)
+	hash := c.GetHashAlgorithm().HashBytes(data)
 	return hash, c.AddEntry(bytes.NewBuffer(data), hash)
 }
@@ -10,9 +10,15 @@ limitations under the License. */
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"github.com/maruel/subcommands/subcommandstest"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestPrefixSpace(t *testing.T) {
@@ -45,7 +51,134 @@ func TestCasTableImpl(t *testing.T) {
 	tempData := makeTempDir(tb, "cas")
 	defer removeTempDir(tempData)
 
+	_, err := initLocalRepository(tempData, "", 0)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
 	cas, err := makeLocalCasTable(tempData)
 	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	tb.Assertf(cas.GetHashAlgorithm().Name == defaultHashName, "Unexpected algorithm %s", cas.GetHashAlgorithm().Name)
 	testCasTableImpl(tb, cas)
 }
+
+func TestCasTableHashAlgorithms(t *testing.T) {
+	t.Parallel()
+	tb := subcommandstest.MakeTB(t)
+	for _, name := range hashAlgorithmNames() {
+		tempData := makeTempDir(tb, "cas_"+name)
+		defer removeTempDir(tempData)
+
+		_, err := initLocalRepository(tempData, name, 2)
+		tb.Assertf(err == nil, "Unexpected error: %s", err)
+		cas, err := makeLocalCasTable(tempData)
+		tb.Assertf(err == nil, "Unexpected error: %s", err)
+		tb.Assertf(cas.GetHashAlgorithm().Name == name, "%s != %s", cas.GetHashAlgorithm().Name, name)
+		testCasTableImpl(tb, cas)
+	}
+}
+
+func TestCasTableUninitialized(t *testing.T) {
+	t.Parallel()
+	tb := subcommandstest.MakeTB(t)
+	tempData := makeTempDir(tb, "cas_uninitialized")
+	defer removeTempDir(tempData)
+
+	_, err := makeLocalCasTable(tempData)
+	tb.Assertf(err != nil, "Unexpected success")
+	tb.Assertf(!isDir(filepath.Join(tempData, casName)), "The CAS directory was created")
+}
+
+// Returns the data then fails, like a disk error or a process being killed
+// would.
+type failingReader struct {
+	data []byte
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	if len(f.data) == 0 {
+		return 0, errors.New("Simulated I/O failure")
+	}
+	n := copy(p, f.data)
+	f.data = f.data[n:]
+	return n, nil
+}
+
+func TestCasTableInterruptedWrite(t *testing.T) {
+	t.Parallel()
+	tb := subcommandstest.MakeTB(t)
+	tempData := makeTempDir(tb, "cas_interrupted")
+	defer removeTempDir(tempData)
+
+	_, err := initLocalRepository(tempData, "", 0)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	cas, err := makeLocalCasTable(tempData)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+
+	// The write fails midway; nothing is left behind.
+	hash := cas.GetHashAlgorithm().HashBytes([]byte("content1"))
+	err = cas.AddEntry(&failingReader{[]byte("content")}, hash)
+	tb.Assertf(err != nil, "Unexpected success")
+	items := EnumerateCasAsList(tb, cas)
+	tb.Assertf(len(items) == 0, "Found unexpected values: %q", items)
+	tempDir := filepath.Join(tempData, casName, tempName)
+	names, err := readDirNames(tempDir)
+	tb.Assertf(err == nil && len(names) == 0, "Unexpected temporary files: %q %s", names, err)
+	_, err = cas.AddStream(&failingReader{[]byte("content")})
+	tb.Assertf(err != nil, "Unexpected success")
+	names, err = readDirNames(tempDir)
+	tb.Assertf(err == nil && len(names) == 0, "Unexpected temporary files: %q %s", names, err)
+
+	// The object can still be added afterward.
+	err = cas.AddEntry(bytes.NewBufferString("content1"), hash)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+
+	// A killed process leaves its temporary file, which is ignored by
+	// Enumerate() and removed by RemoveTemporaryFiles().
+	err = ioutil.WriteFile(filepath.Join(tempDir, hash+"_123"), []byte("content"), 0640)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	items = EnumerateCasAsList(tb, cas)
+	tb.Assertf(Equals(items, []string{hash}), "Found unexpected values: %q", items)
+	tb.Assertf(!cas.GetFsckBit(), "Unexpected fsck bit is set")
+	removed, err := cas.RemoveTemporaryFiles()
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	tb.Assertf(removed == 1, "Unexpected count: %d", removed)
+	names, err = readDirNames(tempDir)
+	tb.Assertf(err == nil && len(names) == 0, "Unexpected temporary files: %q %s", names, err)
+}
+
+func TestCasTableTouch(t *testing.T) {
+	t.Parallel()
+	tb := subcommandstest.MakeTB(t)
+	tempData := makeTempDir(tb, "cas_touch")
+	defer removeTempDir(tempData)
+
+	_, err := initLocalRepository(tempData, "", 0)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	cas, err := makeLocalCasTable(tempData)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+
+	hash, err := AddBytes(cas, []byte("content1"))
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	old := time.Now().Add(-48 * time.Hour)
+	err = os.Chtimes(cas.(*casTable).filePath(hash), old, old)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	info, err := cas.Stat(hash)
+	tb.Assertf(err == nil && info.ModTime.Before(time.Now().Add(-time.Hour)), "Unexpected result %v %s", info, err)
+
+	// Adding the content again marks it as recently referenced.
+	_, err = AddBytes(cas, []byte("content1"))
+	tb.Assertf(os.IsExist(err), "Unexpected error: %s", err)
+	info, err = cas.Stat(hash)
+	tb.Assertf(err == nil && time.Since(info.ModTime) < time.Hour, "Unexpected result %v %s", info, err)
+
+	err = os.Chtimes(cas.(*casTable).filePath(hash), old, old)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	_, err = cas.AddStream(bytes.NewBufferString("content1"))
+	tb.Assertf(os.IsExist(err), "Unexpected error: %s", err)
+	info, err = cas.Stat(hash)
+	tb.Assertf(err == nil && time.Since(info.ModTime) < time.Hour, "Unexpected result %v %s", info, err)
+
+	err = os.Chtimes(cas.(*casTable).filePath(hash), old, old)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	tb.Assertf(cas.Touch(hash) == nil, "Failed to touch %s", hash)
+	info, err = cas.Stat(hash)
+	tb.Assertf(err == nil && time.Since(info.ModTime) < time.Hour, "Unexpected result %v %s", info, err)
+}
@@ -0,0 +1,236 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// A CasTable stored in an S3 bucket with the same layout as the local one,
+// cas/<prefix>/<rest of the digest>. The content is hashed before it is
+// uploaded so only valid objects are stored, and it is uploaded along its
+// checksums so S3 verifies it was received intact. Adding content already
+// present doesn't update its modification time, since only Touch() rewrites it.
+type s3CasTable struct {
+	client       *s3Client
+	prefixLength int
+	hash         *HashAlgorithm
+	trash        *s3Trash
+}
+
+func makeS3CasTable(root string, s3config *s3Config) (CasTable, error) {
+	client, err := makeS3Client(root, s3config)
+	if err != nil {
+		return nil, err
+	}
+	config, err := loadS3RepositoryConfig(client, root)
+	if err != nil {
+		return nil, err
+	}
+	// validate() already verified the algorithm is known.
+	hash, _ := GetHashAlgorithm(config.Hash)
+	return &s3CasTable{client, config.PrefixLength, hash, makeS3Trash(client, casName+"/")}, nil
+}
+
+// Returns the key of an object relative to the CAS, which is also its path in
+// the trash. |hash| must be valid.
+func (c *s3CasTable) relKey(hash string) string {
+	return hash[:c.prefixLength] + "/" + hash[c.prefixLength:]
+}
+
+func (c *s3CasTable) key(hash string) string {
+	return casName + "/" + c.relKey(hash)
+}
+
+// Expects the format "/<hash>".
+func (c *s3CasTable) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "" || r.URL.Path[0] != '/' {
+		http.Error(w, "Internal failure. CasTable received an invalid url: "+r.URL.Path, http.StatusNotImplemented)
+		return
+	}
+	hash := r.URL.Path[1:]
+	if !c.hash.IsValid(hash) {
+		http.Error(w, "Invalid CAS url: "+r.URL.Path, http.StatusBadRequest)
+		return
+	}
+	f, err := c.Open(hash)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	http.ServeContent(w, r, hash, time.Time{}, f)
+}
+
+// Enumerates all the entries in the table. Like the local table, an object
+// whose key doesn't match the expected format is moved into the trash.
+func (c *s3CasTable) Enumerate() <-chan EnumerationEntry {
+	rePrefix := regexp.MustCompile(fmt.Sprintf("^[a-f0-9]{%d}$", c.prefixLength))
+	reRest := regexp.MustCompile(fmt.Sprintf("^[a-f0-9]{%d}$", c.hash.HexLength()-c.prefixLength))
+	items := make(chan EnumerationEntry)
+	go func() {
+		defer close(items)
+		err := c.client.list(casName+"/", "", func(page *s3ListResult) error {
+			for _, o := range page.Contents {
+				relKey := o.Key[len(casName)+1:]
+				if relKey == needFsckName || strings.HasPrefix(relKey, TrashName+"/") {
+					continue
+				}
+				parts := strings.Split(relKey, "/")
+				if len(parts) != 2 || !rePrefix.MatchString(parts[0]) || !reRest.MatchString(parts[1]) {
+					c.trash.Move(filepath.FromSlash(relKey), &TrashRecord{Reason: TrashInvalid})
+					c.SetFsckBit()
+					continue
+				}
+				items <- EnumerationEntry{Item: parts[0] + parts[1]}
+			}
+			return nil
+		})
+		if err != nil {
+			items <- EnumerationEntry{Error: err}
+		}
+	}()
+	return items
+}
+
+func (c *s3CasTable) AddEntry(source io.Reader, hash string) error {
+	if !c.hash.IsValid(hash) {
+		return fmt.Errorf("AddEntry(%s) is invalid", hash)
+	}
+	if _, err := c.client.head(c.key(hash)); err == nil {
+		return os.ErrExist
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	spool, err := spoolS3Object(c.hash, source)
+	if err != nil {
+		return err
+	}
+	defer spool.remove()
+	err = c.store(spool)
+	if spool.digest != hash && (err == nil || os.IsExist(err)) {
+		return &HashMismatchError{hash, spool.digest, spool.size}
+	}
+	return err
+}
+
+func (c *s3CasTable) AddStream(source io.Reader) (string, error) {
+	spool, err := spoolS3Object(c.hash, source)
+	if err != nil {
+		return "", err
+	}
+	defer spool.remove()
+	return spool.digest, c.store(spool)
+}
+
+// Uploads the spooled content under its digest unless it is already present.
+func (c *s3CasTable) store(spool *s3Spool) error {
+	if _, err := c.client.head(c.key(spool.digest)); err == nil {
+		return os.ErrExist
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return spool.upload(c.client, c.key(spool.digest))
+}
+
+func (c *s3CasTable) Stat(hash string) (*ObjectInfo, error) {
+	if !c.hash.IsValid(hash) {
+		return nil, os.ErrInvalid
+	}
+	return c.client.head(c.key(hash))
+}
+
+// S3 has no way to update the modification time of an object but to copy it
+// onto itself.
+func (c *s3CasTable) Touch(hash string) error {
+	if !c.hash.IsValid(hash) {
+		return fmt.Errorf("Touch(%s) is invalid", hash)
+	}
+	return c.client.copy(c.key(hash), c.key(hash))
+}
+
+// Touching an object rewrites it, so the objects are only looked up. gc can't
+// remove them meanwhile since it locks the repository exclusively.
+func (c *s3CasTable) Missing(hashes []string) ([]string, error) {
+	missing := []string{}
+	for _, hash := range hashes {
+		if _, err := c.Stat(hash); os.IsNotExist(err) {
+			missing = append(missing, hash)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return missing, nil
+}
+
+func (c *s3CasTable) Open(hash string) (ReadSeekCloser, error) {
+	if !c.hash.IsValid(hash) {
+		return nil, os.ErrInvalid
+	}
+	return c.client.open(c.key(hash))
+}
+
+func (c *s3CasTable) SetFsckBit() {
+	log.Printf("Marking for fsck")
+	if err := c.client.putBytes(casName+"/"+needFsckName, []byte{}, false); err != nil {
+		log.Printf("Failed to mark for fsck: %s", err)
+	}
+}
+
+func (c *s3CasTable) GetFsckBit() bool {
+	_, err := c.client.head(casName + "/" + needFsckName)
+	// Assume the worst unless S3 confirmed the bit isn't there.
+	return !os.IsNotExist(err)
+}
+
+func (c *s3CasTable) ClearFsckBit() {
+	// Ignore the error.
+	c.client.delete(casName + "/" + needFsckName)
+}
+
+func (c *s3CasTable) GetHashAlgorithm() *HashAlgorithm {
+	return c.hash
+}
+
+// A single PUT is atomic but the parts of a multipart upload interrupted
+// before it completed are kept until it is aborted. fsck holds the exclusive
+// lock so none of them is still in progress.
+func (c *s3CasTable) RemoveTemporaryFiles() (int, error) {
+	removed := 0
+	err := c.client.listUploads(casName+"/", func(page *s3UploadsResult) error {
+		for _, upload := range page.Uploads {
+			if err := c.client.abortMultipart(upload.Key, upload.UploadId); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			removed++
+		}
+		return nil
+	})
+	return removed, err
+}
+
+func (c *s3CasTable) GetTrash() Trash {
+	return c.trash
+}
+
+func (c *s3CasTable) Remove(hash string, record *TrashRecord) error {
+	if !c.hash.IsValid(hash) {
+		return fmt.Errorf("Remove(%s) is invalid", hash)
+	}
+	return c.trash.Move(filepath.FromSlash(c.relKey(hash)), record)
+}
@@ -0,0 +1,132 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/maruel/subcommands/subcommandstest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestS3CasTable(t *testing.T) {
+	t.Parallel()
+	tb := subcommandstest.MakeTB(t)
+	server := makeFakeS3()
+	defer server.Close()
+
+	_, err := makeS3CasTable("s3://bucket/backups", server.config())
+	tb.Assertf(err != nil && strings.Contains(err.Error(), "not a dumbcas repository"), "Unexpected error: %s", err)
+	_, err = initS3Repository("s3://bucket/backups", server.config(), "", 0)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	_, err = initS3Repository("s3://bucket/backups", server.config(), "", 0)
+	tb.Assertf(err != nil && strings.Contains(err.Error(), "already a dumbcas repository"), "Unexpected error: %s", err)
+
+	cas, err := makeS3CasTable("s3://bucket/backups", server.config())
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	tb.Assertf(cas.GetHashAlgorithm().Name == defaultHashName, "Unexpected algorithm %s", cas.GetHashAlgorithm().Name)
+	testCasTableImpl(tb, cas)
+
+	// An object larger than a part is uploaded in parts.
+	cas.(*s3CasTable).client.partSize = 4
+	hash, err := cas.AddStream(bytes.NewBufferString("large content"))
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	info, err := cas.Stat(hash)
+	tb.Assertf(err == nil && info.Size == 13, "Unexpected result %v %s", info, err)
+	// It is then touched and trashed with copies in parts.
+	cas.(*s3CasTable).client.maxCopySize = 4
+	server.lock.Lock()
+	server.maxCopySize = 4
+	server.lock.Unlock()
+	err = cas.AddEntry(bytes.NewBufferString("large content"), hash)
+	tb.Assertf(os.IsExist(err), "Unexpected error: %s", err)
+	tb.Assertf(cas.Remove(hash, nil) == nil, "Failed to remove")
+
+	// The multipart uploads left behind by a killed process are aborted.
+	server.lock.Lock()
+	for i := 0; i < 4; i++ {
+		server.uploads[fmt.Sprintf("killed%d", i)] = &fakeS3Upload{"backups/cas/xx/killed", map[int][]byte{1: []byte("part")}}
+	}
+	server.uploads["nodes"] = &fakeS3Upload{"backups/nodes/killed", map[int][]byte{}}
+	server.lock.Unlock()
+	removed, err := cas.RemoveTemporaryFiles()
+	tb.Assertf(err == nil && removed == 4, "Unexpected result %d %s", removed, err)
+	tb.Assertf(len(server.uploads) == 1, "Unexpected uploads %v", server.uploads)
+	for _, key := range server.keys() {
+		tb.Assertf(strings.HasPrefix(key, "backups/"), "Unexpected key %s", key)
+	}
+}
+
+func TestS3CasTableInvalidKey(t *testing.T) {
+	t.Parallel()
+	tb := subcommandstest.MakeTB(t)
+	server := makeFakeS3()
+	defer server.Close()
+
+	_, err := initS3Repository("s3://bucket", server.config(), "sha1", 2)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	cas, err := makeS3CasTable("s3://bucket", server.config())
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	hash, err := cas.AddStream(bytes.NewBufferString("content1"))
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	tb.Assertf(cas.(*s3CasTable).client.putBytes("cas/xx/invalid", []byte("content"), false) == nil, "Failed to put")
+
+	// The invalid object is moved to the trash and the fsck bit is set.
+	items := EnumerateCasAsList(tb, cas)
+	tb.Assertf(Equals(items, []string{hash}), "Found unexpected values: %q", items)
+	tb.Assertf(cas.GetFsckBit(), "Expected the fsck bit to be set")
+	items = []string{}
+	for v := range cas.GetTrash().Enumerate() {
+		tb.Assertf(v.Error == nil, "Unexpected error: %s", v.Error)
+		items = append(items, filepath.ToSlash(v.Item))
+	}
+	tb.Assertf(Equals(items, []string{"xx/invalid"}), "Found unexpected values: %q", items)
+	records, err := cas.GetTrash().Journal()
+	tb.Assertf(err == nil && len(records) == 1 && records[0].Reason == TrashInvalid, "Unexpected journal %v %s", records, err)
+	cas.ClearFsckBit()
+	tb.Assertf(!cas.GetFsckBit(), "Unexpected fsck bit is set")
+
+	// The fsck bit is assumed to be set when S3 can't be reached.
+	server.setErrorCode("SlowDown")
+	tb.Assertf(cas.GetFsckBit(), "Expected the fsck bit to be set")
+}
+
+func TestS3CasTableLookup(t *testing.T) {
+	t.Parallel()
+	tb := subcommandstest.MakeTB(t)
+	server := makeFakeS3()
+	defer server.Close()
+
+	_, err := initS3Repository("s3://bucket", server.config(), "", 0)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	cas, err := makeS3CasTable("s3://bucket", server.config())
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	hash1, err := cas.AddStream(bytes.NewBufferString("content1"))
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	hash2 := cas.GetHashAlgorithm().HashBytes([]byte("content2"))
+
+	// The present objects are looked up, not rewritten.
+	missing, err := cas.Missing([]string{hash1, hash2})
+	tb.Assertf(err == nil && Equals(missing, []string{hash2}), "Unexpected result %q %s", missing, err)
+	err = cas.AddEntry(bytes.NewBufferString("content1"), hash1)
+	tb.Assertf(os.IsExist(err), "Unexpected error: %s", err)
+	_, err = cas.AddStream(bytes.NewBufferString("content1"))
+	tb.Assertf(os.IsExist(err), "Unexpected error: %s", err)
+	tb.Assertf(server.copies == 0, "Unexpected copies: %d", server.copies)
+
+	// A copy failing after S3 replied 200 fails Touch().
+	tb.Assertf(cas.Touch(hash1) == nil, "Failed to touch")
+	server.setCopyErrorCode("InternalError")
+	err = cas.Touch(hash1)
+	tb.Assertf(err != nil && !os.IsNotExist(err), "Unexpected error: %s", err)
+}
@@ -18,30 +18,50 @@ import (
 	"net/http"
 	"os"
 	"sort"
+	"sync"
 	"testing"
+	"time"
 )
 
 // A working CasTable implementation that keeps all the data in memory.
+// It is safe for concurrent use.
 type fakeCasTable struct {
+	lock     sync.Mutex
 	entries  map[string][]byte
+	modTimes map[string]time.Time
+	trash    *fakeTrash
 	needFsck bool
+	hash     *HashAlgorithm
 	t        *subcommandstest.TB
 }
 
+// Creates a fakeCasTable. The tests hardcode sha1 digests by default.
+func makeFakeCasTable(t *subcommandstest.TB) *fakeCasTable {
+	h, _ := GetHashAlgorithm(legacyHashName)
+	entries := make(map[string][]byte)
+	return &fakeCasTable{entries: entries, modTimes: make(map[string]time.Time), trash: makeFakeTrash(entries), hash: h, t: t}
+}
+
+// Doesn't require InitRepository() to be called first, to keep the tests
+// short.
 func (a *DumbcasAppMock) MakeCasTable(rootDir string) (CasTable, error) {
 	if a.cas == nil {
-		a.cas = &fakeCasTable{make(map[string][]byte), false, a.TB}
+		a.cas = makeFakeCasTable(a.TB)
 	}
 	return a.cas, nil
 }
 
 func (m *fakeCasTable) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	m.t.GetLog().Printf("fakeCasTable.ServeHTTP(%s)", r.URL.Path)
+	m.lock.Lock()
+	defer m.lock.Unlock()
 	w.Write(m.entries[r.URL.Path[1:]])
 }
 
 func (m *fakeCasTable) Enumerate() <-chan EnumerationEntry {
 	// First make a copy of the keys.
+	m.lock.Lock()
+	defer m.lock.Unlock()
 	keys := make([]string, len(m.entries))
 	i := 0
 	for k, _ := range m.entries {
@@ -61,18 +81,76 @@ func (m *fakeCasTable) Enumerate() <-chan EnumerationEntry {
 
 func (m *fakeCasTable) AddEntry(source io.Reader, item string) error {
 	m.t.GetLog().Printf("fakeCasTable.AddEntry(%s)", item)
+	data, err := ioutil.ReadAll(source)
+	if err != nil {
+		return err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	now := time.Now()
 	if _, ok := m.entries[item]; ok {
+		m.modTimes[item] = now
 		return os.ErrExist
 	}
+	if actual := m.hash.HashBytes(data); actual != item {
+		if _, ok := m.entries[actual]; !ok {
+			m.entries[actual] = data
+		}
+		m.modTimes[actual] = now
+		return &HashMismatchError{item, actual, int64(len(data))}
+	}
+	m.entries[item] = data
+	m.modTimes[item] = now
+	return nil
+}
+
+func (m *fakeCasTable) AddStream(source io.Reader) (string, error) {
 	data, err := ioutil.ReadAll(source)
-	if err == nil {
-		m.entries[item] = data
+	if err != nil {
+		return "", err
+	}
+	digest := m.hash.HashBytes(data)
+	m.t.GetLog().Printf("fakeCasTable.AddStream() %s", digest)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.modTimes[digest] = time.Now()
+	if _, ok := m.entries[digest]; ok {
+		return digest, os.ErrExist
+	}
+	m.entries[digest] = data
+	return digest, nil
+}
+
+// The entries set directly in |entries| by a test have a zero modification
+// time.
+func (m *fakeCasTable) Stat(item string) (*ObjectInfo, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	data, ok := m.entries[item]
+	if !ok {
+		return nil, os.ErrNotExist
 	}
-	return err
+	return &ObjectInfo{int64(len(data)), m.modTimes[item]}, nil
+}
+
+func (m *fakeCasTable) Touch(item string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.entries[item]; !ok {
+		return os.ErrNotExist
+	}
+	m.modTimes[item] = time.Now()
+	return nil
+}
+
+func (m *fakeCasTable) Missing(items []string) ([]string, error) {
+	return missingByTouch(m, items)
 }
 
 func (m *fakeCasTable) Open(item string) (ReadSeekCloser, error) {
 	m.t.GetLog().Printf("fakeCasTable.Open(%s)", item)
+	m.lock.Lock()
+	defer m.lock.Unlock()
 	data, ok := m.entries[item]
 	if !ok {
 		return nil, fmt.Errorf("Missing: %s", item)
@@ -80,13 +158,12 @@ func (m *fakeCasTable) Open(item string) (ReadSeekCloser, error) {
 	return Buffer{bytes.NewReader(data)}, nil
 }
 
-func (m *fakeCasTable) Remove(item string) error {
+func (m *fakeCasTable) Remove(item string, record *TrashRecord) error {
 	m.t.GetLog().Printf("fakeCasTable.Remove(%s)", item)
-	if _, ok := m.entries[item]; !ok {
-		return os.ErrNotExist
-	}
-	delete(m.entries, item)
-	return nil
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.modTimes, item)
+	return m.trash.Move(item, record)
 }
 
 func (m *fakeCasTable) SetFsckBit() {
@@ -104,22 +181,25 @@ func (m *fakeCasTable) ClearFsckBit() {
 	m.needFsck = false
 }
 
-// Adds noop Close() to a bytes.Reader.
-type Buffer struct {
-	*bytes.Reader
+func (m *fakeCasTable) GetHashAlgorithm() *HashAlgorithm {
+	return m.hash
 }
 
-func (b Buffer) Close() error {
-	return nil
+func (m *fakeCasTable) RemoveTemporaryFiles() (int, error) {
+	return 0, nil
+}
+
+func (m *fakeCasTable) GetTrash() Trash {
+	return m.trash
 }
 
 // Returns a sorted list of all the entries.
 func EnumerateCasAsList(t *subcommandstest.TB, cas CasTable) []string {
 	items := []string{}
+	h := cas.GetHashAlgorithm()
 	for v := range cas.Enumerate() {
 		t.Assertf(v.Error == nil, "Unexpected failure")
-		// Hardcoded for sha1.
-		t.Assertf(len(v.Item) == 40, "Unexpected sha1 entry %s", v.Item)
+		t.Assertf(h.IsValid(v.Item), "Unexpected %s entry %s", h.Name, v.Item)
 		items = append(items, v.Item)
 	}
 	sort.Strings(items)
@@ -129,8 +209,7 @@ func EnumerateCasAsList(t *subcommandstest.TB, cas CasTable) []string {
 func TestFakeCasTable(t *testing.T) {
 	t.Parallel()
 	tb := subcommandstest.MakeTB(t)
-	cas := &fakeCasTable{make(map[string][]byte), false, tb}
-	testCasTableImpl(tb, cas)
+	testCasTableImpl(tb, makeFakeCasTable(tb))
 }
 
 func testCasTableImpl(t *subcommandstest.TB, cas CasTable) {
@@ -151,6 +230,54 @@ func testCasTableImpl(t *subcommandstest.TB, cas CasTable) {
 	items = EnumerateCasAsList(t, cas)
 	t.Assertf(Equals(items, []string{file1}), "Found unexpected values: %q != %s", items, file1)
 
+	// Add content under the wrong digest. It is stored under its actual digest.
+	file3 := cas.GetHashAlgorithm().HashBytes([]byte("content3"))
+	file4 := cas.GetHashAlgorithm().HashBytes([]byte("content4"))
+	err = cas.AddEntry(bytes.NewBufferString("content4"), file3)
+	mismatch, ok := err.(*HashMismatchError)
+	t.Assertf(ok, "Unexpected error: %s", err)
+	t.Assertf(mismatch.Expected == file3, "Unexpected digest %s", mismatch.Expected)
+	t.Assertf(mismatch.Actual == file4, "Unexpected digest %s", mismatch.Actual)
+	t.Assertf(mismatch.Size == 8, "Unexpected size %d", mismatch.Size)
+
+	expected := []string{file1, file4}
+	sort.Strings(expected)
+	items = EnumerateCasAsList(t, cas)
+	t.Assertf(Equals(items, expected), "Found unexpected values: %q != %q", items, expected)
+
+	// Again, while the actual content is already present.
+	err = cas.AddEntry(bytes.NewBufferString("content4"), file3)
+	mismatch, ok = err.(*HashMismatchError)
+	t.Assertf(ok, "Unexpected error: %s", err)
+	t.Assertf(mismatch.Actual == file4, "Unexpected digest %s", mismatch.Actual)
+	items = EnumerateCasAsList(t, cas)
+	t.Assertf(Equals(items, expected), "Found unexpected values: %q != %q", items, expected)
+	err = cas.Remove(file4, nil)
+	t.Assertf(err == nil, "Unexpected error: %s", err)
+
+	// Add content without knowing its digest.
+	file5, err := cas.AddStream(bytes.NewBufferString("content5"))
+	t.Assertf(err == nil, "Unexpected error: %s", err)
+	t.Assertf(file5 == cas.GetHashAlgorithm().HashBytes([]byte("content5")), "Unexpected digest %s", file5)
+	file6, err := cas.AddStream(bytes.NewBufferString("content5"))
+	t.Assertf(os.IsExist(err), "Unexpected error: %s", err)
+	t.Assertf(file5 == file6, "Hash mismatch %s != %s", file5, file6)
+	expected = []string{file1, file5}
+	sort.Strings(expected)
+	items = EnumerateCasAsList(t, cas)
+	t.Assertf(Equals(items, expected), "Found unexpected values: %q != %q", items, expected)
+	err = cas.Remove(file5, nil)
+	t.Assertf(err == nil, "Unexpected error: %s", err)
+
+	info, err := cas.Stat(file1)
+	t.Assertf(err == nil, "Unexpected error: %s", err)
+	t.Assertf(info.Size == 8, "Unexpected size %d", info.Size)
+	t.Assertf(time.Since(info.ModTime) < time.Hour, "Unexpected time %s", info.ModTime)
+	_, err = cas.Stat(file5)
+	t.Assertf(err != nil, "Unexpected success")
+	t.Assertf(cas.Touch(file1) == nil, "Failed to touch %s", file1)
+	t.Assertf(os.IsNotExist(cas.Touch(file5)), "Unexpected success")
+
 	f, err := cas.Open(file1)
 	t.Assertf(err == nil, "Unexpected error: %s", err)
 
@@ -162,10 +289,10 @@ func testCasTableImpl(t *subcommandstest.TB, cas CasTable) {
 	_, err = cas.Open("0")
 	t.Assertf(err != nil, "Unexpected success")
 
-	err = cas.Remove(file1)
+	err = cas.Remove(file1, nil)
 	t.Assertf(err == nil, "Unexpected error: %s", err)
 
-	err = cas.Remove(file1)
+	err = cas.Remove(file1, nil)
 	t.Assertf(err != nil, "Unexpected success")
 
 	// Test fsck bit.
@@ -0,0 +1,258 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"io"
+	"os"
+	"sort"
+)
+
+// The boundaries between chunks only depend on the content around them so an
+// insertion or a deletion in a large file only changes the chunks around it.
+const (
+	minChunkSize = 256 * 1024
+	maxChunkSize = 4 * 1024 * 1024
+	// A boundary is found on average every 2^chunkBits bytes after minChunkSize.
+	chunkBits = 20
+)
+
+// Uses the most significant bits, which depend on the last 64 bytes.
+const chunkMask = uint64(1<<chunkBits-1) << (64 - chunkBits)
+
+// Random values used by the gear rolling hash. They must never change, since
+// it would change all the boundaries.
+var gearTable [256]uint64
+
+func init() {
+	// splitmix64 with a fixed seed.
+	seed := uint64(0x6475626d63617321)
+	for i := range gearTable {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gearTable[i] = z ^ (z >> 31)
+	}
+}
+
+// Chunk is a part of a large file stored as a separate object in the CasTable.
+type Chunk struct {
+	Sha1 string `json:"h"`
+	Size int64  `json:"s"`
+}
+
+// Returns the size of the file made of |chunks|.
+func chunksSize(chunks []Chunk) int64 {
+	total := int64(0)
+	for _, c := range chunks {
+		total += c.Size
+	}
+	return total
+}
+
+// Splits a stream in content-defined chunks.
+type chunker struct {
+	source io.Reader
+	buf    []byte
+	// Data in buf[start:end] was read but not returned yet.
+	start int
+	end   int
+	eof   bool
+}
+
+func newChunker(source io.Reader) *chunker {
+	return &chunker{source: source, buf: make([]byte, maxChunkSize)}
+}
+
+// Returns the next chunk. The slice is only valid until the next call. Returns
+// io.EOF once all the content was returned.
+func (c *chunker) Next() ([]byte, error) {
+	copy(c.buf, c.buf[c.start:c.end])
+	c.end -= c.start
+	c.start = 0
+	if !c.eof {
+		n, err := io.ReadFull(c.source, c.buf[c.end:])
+		c.end += n
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if c.end == 0 {
+		return nil, io.EOF
+	}
+	c.start = cutPoint(c.buf[:c.end])
+	return c.buf[:c.start], nil
+}
+
+// Returns the length of the first chunk of |data|.
+func cutPoint(data []byte) int {
+	if len(data) <= minChunkSize {
+		return len(data)
+	}
+	n := len(data)
+	if n > maxChunkSize {
+		n = maxChunkSize
+	}
+	h := uint64(0)
+	for i := minChunkSize; i < n; i++ {
+		h = (h << 1) + gearTable[data[i]]
+		if h&chunkMask == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// Splits |source| in chunks and stores them. Returns the chunks along the
+// number of bytes that were not already present.
+func addChunks(cas CasTable, source io.Reader) ([]Chunk, int64, error) {
+	chunks := []Chunk{}
+	stored := int64(0)
+	c := newChunker(source)
+	for {
+		data, err := c.Next()
+		if err == io.EOF {
+			return chunks, stored, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		digest, err := AddBytes(cas, data)
+		if err == nil {
+			stored += int64(len(data))
+		} else if !os.IsExist(err) {
+			return nil, 0, err
+		}
+		chunks = append(chunks, Chunk{digest, int64(len(data))})
+	}
+}
+
+// Splits |source| in chunks without storing them.
+func hashChunks(h *HashAlgorithm, source io.Reader) ([]Chunk, error) {
+	chunks := []Chunk{}
+	c := newChunker(source)
+	for {
+		data, err := c.Next()
+		if err == io.EOF {
+			return chunks, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, Chunk{h.HashBytes(data), int64(len(data))})
+	}
+}
+
+// Stores the chunks of |source| when they are already known, which only reads
+// the chunks that are missing. Returns the number of bytes that were not
+// already present. Returns a *HashMismatchError if the content doesn't match
+// the chunks anymore.
+func addKnownChunks(cas CasTable, source io.ReaderAt, chunks []Chunk) (int64, error) {
+	stored := int64(0)
+	offset := int64(0)
+	for _, chunk := range chunks {
+		err := cas.AddEntry(io.NewSectionReader(source, offset, chunk.Size), chunk.Sha1)
+		if mismatch, ok := err.(*HashMismatchError); ok {
+			return stored, mismatch
+		} else if err == nil {
+			stored += chunk.Size
+		} else if !os.IsExist(err) {
+			return stored, err
+		}
+		offset += chunk.Size
+	}
+	return stored, nil
+}
+
+// Reads the chunks of a file as if it was a single object.
+type chunkedReader struct {
+	cas    CasTable
+	chunks []Chunk
+	// Offset of each chunk in the file.
+	starts []int64
+	size   int64
+	offset int64
+	// Chunk being read, if any, and the offset where it ends.
+	current ReadSeekCloser
+	end     int64
+}
+
+func newChunkedReader(cas CasTable, chunks []Chunk) *chunkedReader {
+	r := &chunkedReader{cas: cas, chunks: chunks, starts: make([]int64, len(chunks))}
+	for i, chunk := range chunks {
+		r.starts[i] = r.size
+		r.size += chunk.Size
+	}
+	return r
+}
+
+func (r *chunkedReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.current == nil {
+		i := sort.Search(len(r.starts), func(i int) bool { return r.starts[i] > r.offset }) - 1
+		f, err := r.cas.Open(r.chunks[i].Sha1)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := f.Seek(r.offset-r.starts[i], os.SEEK_SET); err != nil {
+			f.Close()
+			return 0, err
+		}
+		r.current = f
+		r.end = r.starts[i] + r.chunks[i].Size
+	}
+	if remaining := r.end - r.offset; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := r.current.Read(p)
+	r.offset += int64(n)
+	if r.offset == r.end || err != nil {
+		r.current.Close()
+		r.current = nil
+		if err == io.EOF {
+			err = nil
+			if r.offset != r.end {
+				err = io.ErrUnexpectedEOF
+			}
+		}
+	}
+	return n, err
+}
+
+func (r *chunkedReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case os.SEEK_CUR:
+		offset += r.offset
+	case os.SEEK_END:
+		offset += r.size
+	}
+	if offset < 0 {
+		return r.offset, os.ErrInvalid
+	}
+	if r.current != nil {
+		r.current.Close()
+		r.current = nil
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *chunkedReader) Close() error {
+	if r.current != nil {
+		r.current.Close()
+		r.current = nil
+	}
+	return nil
+}
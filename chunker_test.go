@@ -0,0 +1,116 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"bytes"
+	"github.com/maruel/subcommands/subcommandstest"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+// Returns reproducible pseudo-random content.
+func makeRandomData(seed int64, size int) []byte {
+	data := make([]byte, size)
+	r := rand.New(rand.NewSource(seed))
+	for i := range data {
+		data[i] = byte(r.Intn(256))
+	}
+	return data
+}
+
+func chunkAll(t *subcommandstest.TB, data []byte) [][]byte {
+	out := [][]byte{}
+	c := newChunker(bytes.NewReader(data))
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			return out
+		}
+		t.Assertf(err == nil, "Unexpected error: %s", err)
+		out = append(out, append([]byte{}, chunk...))
+	}
+}
+
+func TestChunker(t *testing.T) {
+	t.Parallel()
+	tb := subcommandstest.MakeTB(t)
+	data := makeRandomData(1, 12*1024*1024)
+	chunks := chunkAll(tb, data)
+	tb.Assertf(len(chunks) > 3, "Unexpected number of chunks %d", len(chunks))
+	for i, c := range chunks {
+		tb.Assertf(len(c) <= maxChunkSize, "Chunk %d is too large: %d", i, len(c))
+		if i != len(chunks)-1 {
+			tb.Assertf(len(c) >= minChunkSize, "Chunk %d is too small: %d", i, len(c))
+		}
+	}
+	tb.Assertf(bytes.Equal(bytes.Join(chunks, nil), data), "Content mismatch")
+
+	// Inserting data at the start only modifies the first chunk.
+	modified := chunkAll(tb, append([]byte("inserted"), data...))
+	tb.Assertf(len(modified) == len(chunks), "%d != %d", len(modified), len(chunks))
+	for i := 1; i < len(chunks); i++ {
+		tb.Assertf(bytes.Equal(modified[i], chunks[i]), "Chunk %d differs", i)
+	}
+
+	tb.Assertf(len(chunkAll(tb, []byte{})) == 0, "Unexpected chunk")
+	small := chunkAll(tb, []byte("small"))
+	tb.Assertf(len(small) == 1 && string(small[0]) == "small", "Unexpected chunks %q", small)
+}
+
+func TestChunkedReader(t *testing.T) {
+	t.Parallel()
+	tb := subcommandstest.MakeTB(t)
+	cas := makeFakeCasTable(tb)
+	data := makeRandomData(2, 6*1024*1024)
+	chunks, stored, err := addChunks(cas, bytes.NewReader(data))
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	tb.Assertf(stored == int64(len(data)), "Unexpected size %d", stored)
+	tb.Assertf(chunksSize(chunks) == int64(len(data)), "Unexpected size %d", chunksSize(chunks))
+
+	// Adding the same content again doesn't store anything.
+	_, stored, err = addChunks(cas, bytes.NewReader(data))
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	tb.Assertf(stored == 0, "Unexpected size %d", stored)
+	stored, err = addKnownChunks(cas, bytes.NewReader(data), chunks)
+	tb.Assertf(err == nil && stored == 0, "Unexpected result %d %s", stored, err)
+	// A modification is only noticed when the chunk is missing.
+	modified := append([]byte{}, data...)
+	modified[len(data)-1]++
+	last := chunks[len(chunks)-1]
+	tb.Assertf(cas.Remove(last.Sha1, nil) == nil, "Failed to remove %s", last.Sha1)
+	_, err = addKnownChunks(cas, bytes.NewReader(modified), chunks)
+	_, ok := err.(*HashMismatchError)
+	tb.Assertf(ok, "Unexpected error: %s", err)
+	_, err = addKnownChunks(cas, bytes.NewReader(data), chunks)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+
+	r := newChunkedReader(cas, chunks)
+	defer r.Close()
+	actual, err := ioutil.ReadAll(r)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	tb.Assertf(bytes.Equal(actual, data), "Content mismatch")
+
+	// Seek in the middle of a chunk and read across the boundary.
+	offset := chunks[0].Size - 10
+	pos, err := r.Seek(offset, os.SEEK_SET)
+	tb.Assertf(err == nil && pos == offset, "Unexpected seek %d %s", pos, err)
+	buf := make([]byte, 20)
+	_, err = io.ReadFull(r, buf)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	tb.Assertf(bytes.Equal(buf, data[offset:offset+20]), "Content mismatch")
+	pos, err = r.Seek(-5, os.SEEK_END)
+	tb.Assertf(err == nil && pos == int64(len(data)-5), "Unexpected seek %d %s", pos, err)
+	actual, err = ioutil.ReadAll(r)
+	tb.Assertf(err == nil && bytes.Equal(actual, data[len(data)-5:]), "Unexpected %q %s", actual, err)
+}
@@ -10,8 +10,7 @@ limitations under the License. */
 package main
 
 import (
-	"crypto/sha1"
-	"encoding/hex"
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -20,7 +19,10 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"os/user"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
 // Table represents a flag table of data.
@@ -31,8 +33,9 @@ type Table interface {
 	Enumerate() <-chan EnumerationEntry
 	// Opens an entry for reading.
 	Open(name string) (ReadSeekCloser, error)
-	// Removes a node enumerated by Enumerate().
-	Remove(name string) error
+	// Moves an entry enumerated by Enumerate() to the trash. |record| tells why;
+	// it may be nil.
+	Remove(name string, record *TrashRecord) error
 }
 
 type EnumerationEntry struct {
@@ -46,28 +49,58 @@ type ReadSeekCloser interface {
 	io.Closer
 }
 
+// Adds noop Close() to a bytes.Reader.
+type Buffer struct {
+	*bytes.Reader
+}
+
+func (b Buffer) Close() error {
+	return nil
+}
+
 // Common flags.
 type CommonFlags struct {
 	subcommands.CommandRunBase
 	Root string
+	Wait time.Duration
+	// Set by the commands that modify or remove existing data, like gc, so
+	// they hold the repository lock exclusively.
+	exclusive bool
+	// Set by web, which locks the repository for each request modifying it
+	// instead of for as long as it runs.
+	unlocked bool
 	// These are not "flags" per se but are created indirectly by the -root flag.
 	cas   CasTable
 	nodes NodesTable
+	lock  Lock
 }
 
 func (c *CommonFlags) Init() {
-	c.Flags.StringVar(&c.Root, "root", os.Getenv("DUMBCAS_ROOT"), "Root directory; required. Set $DUMBCAS_ROOT to set a default.")
+	c.Flags.StringVar(&c.Root, "root", os.Getenv("DUMBCAS_ROOT"), "Root directory, URL of a repository served by web -writable or s3://bucket/prefix; required. Set $DUMBCAS_ROOT to set a default.")
+	c.Flags.DurationVar(&c.Wait, "wait", 0, "Time to wait for a conflicting lock on the repository to be released, e.g. 10m")
 }
 
-func (c *CommonFlags) Parse(d DumbcasApplication, bypassFsck bool) error {
+// Validates -root and converts it to an absolute path, unless it is the URL of
+// a remote repository or of an S3 bucket.
+func (c *CommonFlags) ParseRoot() error {
 	if c.Root == "" {
 		return errors.New("Must provide -root")
 	}
+	if isRemoteRoot(c.Root) || isS3Root(c.Root) {
+		return nil
+	}
 	if root, err := filepath.Abs(c.Root); err != nil {
 		return fmt.Errorf("Failed to find %s", c.Root)
 	} else {
 		c.Root = root
 	}
+	return nil
+}
+
+func (c *CommonFlags) Parse(d DumbcasApplication, bypassFsck bool) error {
+	if err := c.ParseRoot(); err != nil {
+		return err
+	}
 
 	if cas, err := d.MakeCasTable(c.Root); err != nil {
 		return err
@@ -75,13 +108,22 @@ func (c *CommonFlags) Parse(d DumbcasApplication, bypassFsck bool) error {
 		c.cas = cas
 	}
 
+	if !c.unlocked {
+		if lock, err := d.LockRepository(c.Root, c.cas, c.exclusive, c.Wait); err != nil {
+			return err
+		} else {
+			c.lock = lock
+		}
+	}
 	if c.cas.GetFsckBit() {
 		if !bypassFsck {
+			c.Close()
 			return fmt.Errorf("Can't run if fsck is needed. Please run fsck first.")
 		}
 		fmt.Fprintf(os.Stderr, "WARNING: fsck is needed.")
 	}
 	if nodes, err := d.LoadNodesTable(c.Root, c.cas); err != nil {
+		c.Close()
 		return err
 	} else {
 		c.nodes = nodes
@@ -89,13 +131,25 @@ func (c *CommonFlags) Parse(d DumbcasApplication, bypassFsck bool) error {
 	return nil
 }
 
+// Releases the repository lock acquired by Parse().
+func (c *CommonFlags) Close() {
+	if c.lock != nil {
+		c.lock.Release()
+		c.lock = nil
+	}
+}
+
 type TreeItem struct {
 	FullPath string
 	os.FileInfo
 	Error error
 }
 
-func recurseEnumerateTree(rootDir string, c chan<- TreeItem) bool {
+// Returns true if the file or directory should be skipped. A skipped directory
+// is not enumerated.
+type SkipFunc func(fullPath string, info os.FileInfo) bool
+
+func recurseEnumerateTree(rootDir string, c chan<- TreeItem, skip SkipFunc) bool {
 	f, err := os.Open(rootDir)
 	if err != nil {
 		c <- TreeItem{Error: err}
@@ -120,8 +174,11 @@ func recurseEnumerateTree(rootDir string, c chan<- TreeItem) bool {
 			}
 			name := d.Name()
 			fullPath := filepath.Join(rootDir, name)
+			if skip != nil && skip(fullPath, d) {
+				continue
+			}
 			if d.IsDir() {
-				if !recurseEnumerateTree(fullPath, c) {
+				if !recurseEnumerateTree(fullPath, c, skip) {
 					return false
 				}
 			} else {
@@ -134,9 +191,14 @@ func recurseEnumerateTree(rootDir string, c chan<- TreeItem) bool {
 
 // Walk the directory tree.
 func EnumerateTree(rootDir string) <-chan TreeItem {
+	return EnumerateTreeSkip(rootDir, nil)
+}
+
+// Walk the directory tree, skipping the items for which |skip| returns true.
+func EnumerateTreeSkip(rootDir string, skip SkipFunc) <-chan TreeItem {
 	c := make(chan TreeItem)
 	go func() {
-		recurseEnumerateTree(rootDir, c)
+		recurseEnumerateTree(rootDir, c, skip)
 		close(c)
 	}()
 	return c
@@ -147,6 +209,32 @@ func isDir(path string) bool {
 	return stat != nil && stat.IsDir()
 }
 
+func isFile(path string) bool {
+	stat, _ := os.Stat(path)
+	return stat != nil && !stat.IsDir()
+}
+
+// Returns the hostname without its domain.
+func shortHostname() (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("Failed to get the hostname: %s", err)
+	}
+	return strings.SplitN(hostname, ".", 2)[0], nil
+}
+
+// Returns the name of the user running the process, or an empty string if it
+// can't be determined.
+func currentUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	if name := os.Getenv("USER"); name != "" {
+		return name
+	}
+	return os.Getenv("USERNAME")
+}
+
 // Reads a directory list and guarantees to return a list.
 func readDirNames(dirPath string) ([]string, error) {
 	f, err := os.Open(dirPath)
@@ -181,29 +269,6 @@ func readDirFancy(dirPath string) ([]string, error) {
 	return names, err
 }
 
-func sha1File(f io.Reader) (string, error) {
-	hash := sha1.New()
-	if _, err := io.Copy(hash, f); err != nil {
-		return "", err
-	}
-	return hex.EncodeToString(hash.Sum(nil)), nil
-}
-
-func sha1FilePath(filePath string) (string, error) {
-	f, err := os.Open(filePath)
-	if err != nil {
-		return "", err
-	}
-	defer f.Close()
-	return sha1File(f)
-}
-
-func sha1Bytes(content []byte) string {
-	hash := sha1.New()
-	hash.Write(content)
-	return hex.EncodeToString(hash.Sum(nil))
-}
-
 func loadReaderAsJson(r io.Reader, value interface{}) error {
 	data, err := ioutil.ReadAll(r)
 	if err == nil {
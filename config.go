@@ -0,0 +1,185 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The repository configuration is stored at the root of the repository.
+const configName = "config.json"
+
+// Version of the on-disk layout. Bump it on any incompatible change.
+const configVersion = 1
+
+// Prefix length used by repositories created before config.json existed.
+const legacyPrefixLength = 3
+
+// File in the CAS directory that recorded the hash algorithm before
+// config.json existed.
+const legacyHashAlgorithmName = "hash_algorithm"
+
+// RepositoryConfig describes the layout of a repository. It is written once by
+// "dumbcas init" and never modified afterward.
+type RepositoryConfig struct {
+	Version int `json:"version"`
+	// Name of the HashAlgorithm used to address the CasTable.
+	Hash string `json:"hash"`
+	// Number of hex characters of the digest used as the CAS subdirectory.
+	PrefixLength int       `json:"prefix_length"`
+	Created      time.Time `json:"created"`
+	UUID         string    `json:"uuid"`
+}
+
+// Creates a new configuration for a repository that is about to be created.
+func makeRepositoryConfig(hashName string, prefixLength int) (*RepositoryConfig, error) {
+	if _, err := GetHashAlgorithm(hashName); err != nil {
+		return nil, err
+	}
+	if prefixLength < 1 || prefixLength > 4 {
+		return nil, fmt.Errorf("Invalid prefix length %d; must be between 1 and 4", prefixLength)
+	}
+	uuid, err := newUUID()
+	if err != nil {
+		return nil, err
+	}
+	return &RepositoryConfig{configVersion, hashName, prefixLength, time.Now().UTC(), uuid}, nil
+}
+
+// Returns a random (version 4) UUID.
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("Failed to generate an UUID: %s", err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// Verifies the configuration can be used by this version of the tool.
+func (r *RepositoryConfig) validate() error {
+	if r.Version != configVersion {
+		return fmt.Errorf("Unsupported repository format version %d; this tool only supports version %d", r.Version, configVersion)
+	}
+	if _, err := GetHashAlgorithm(r.Hash); err != nil {
+		return err
+	}
+	if r.PrefixLength < 1 || r.PrefixLength > 4 {
+		return fmt.Errorf("Invalid prefix length %d", r.PrefixLength)
+	}
+	return nil
+}
+
+// Loads and validates config.json of the repository at |rootDir|.
+func loadRepositoryConfig(rootDir string) (*RepositoryConfig, error) {
+	config := &RepositoryConfig{}
+	configPath := filepath.Join(rootDir, configName)
+	if err := loadFileAsJson(configPath, config); err != nil {
+		if !isFile(configPath) {
+			return nil, fmt.Errorf("%s is not a dumbcas repository; run \"dumbcas init -root=%s\" first", rootDir, rootDir)
+		}
+		return nil, err
+	}
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %s", configPath, err)
+	}
+	return config, nil
+}
+
+// Writes config.json. Refuses to overwrite an existing file. Like a node, it is
+// written to a temporary file then linked under its name so a crash never
+// leaves it truncated.
+func (r *RepositoryConfig) save(rootDir string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Failed to marshall the configuration: %s", err)
+	}
+	configPath := filepath.Join(rootDir, configName)
+	tempPath := filepath.Join(rootDir, "."+configName+".tmp")
+	defer os.Remove(tempPath)
+	f, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return fmt.Errorf("Failed to create %s: %s", tempPath, err)
+	}
+	_, err = f.Write(append(data, '\n'))
+	if err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to write %s: %s", tempPath, err)
+	}
+	if err := os.Link(tempPath, configPath); err != nil {
+		return fmt.Errorf("Failed to create %s: %s", configPath, err)
+	}
+	return nil
+}
+
+// Creates a local repository at |rootDir|. An empty |hashName| or a zero
+// |prefixLength| selects the default. A repository created before config.json
+// existed is adopted as-is; its layout is detected and must match the
+// requested values, if any.
+func initLocalRepository(rootDir string, hashName string, prefixLength int) (*RepositoryConfig, error) {
+	if !filepath.IsAbs(rootDir) {
+		return nil, fmt.Errorf("InitRepository(%s) is not valid", rootDir)
+	}
+	if isFile(filepath.Join(rootDir, configName)) {
+		return nil, fmt.Errorf("%s is already a dumbcas repository", rootDir)
+	}
+	defaultHash := defaultHashName
+	defaultPrefixLength := legacyPrefixLength
+	casDir := filepath.Join(rootDir, casName)
+	recordPath := filepath.Join(casDir, legacyHashAlgorithmName)
+	legacy := isDir(casDir)
+	if legacy {
+		defaultHash = legacyHashName
+		if data, err := ioutil.ReadFile(recordPath); err == nil {
+			defaultHash = strings.TrimSpace(string(data))
+		}
+		if (hashName != "" && hashName != defaultHash) || (prefixLength != 0 && prefixLength != defaultPrefixLength) {
+			return nil, fmt.Errorf("%s already contains a repository using %s with a prefix length of %d", rootDir, defaultHash, defaultPrefixLength)
+		}
+	}
+	if hashName == "" {
+		hashName = defaultHash
+	}
+	if prefixLength == 0 {
+		prefixLength = defaultPrefixLength
+	}
+	config, err := makeRepositoryConfig(hashName, prefixLength)
+	if err != nil {
+		return nil, err
+	}
+	if err := initLocalCasTable(rootDir, config); err != nil {
+		return nil, err
+	}
+	if err := initLocalNodesTable(rootDir); err != nil {
+		return nil, err
+	}
+	// Written last so an interrupted initialization is not a valid repository.
+	if err := config.save(rootDir); err != nil {
+		return nil, err
+	}
+	if legacy {
+		// Ignore the error.
+		os.Remove(recordPath)
+	}
+	return config, nil
+}
@@ -0,0 +1,115 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"github.com/maruel/subcommands/subcommandstest"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+func TestRepositoryConfig(t *testing.T) {
+	t.Parallel()
+	tb := subcommandstest.MakeTB(t)
+	tempData := makeTempDir(tb, "config")
+	defer removeTempDir(tempData)
+
+	config, err := initLocalRepository(tempData, "sha1", 2)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	reUUID := regexp.MustCompile("^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$")
+	tb.Assertf(reUUID.MatchString(config.UUID), "Invalid UUID %s", config.UUID)
+	tb.Assertf(isDir(filepath.Join(tempData, casName, "ff")), "Missing prefix directory")
+	tb.Assertf(isDir(filepath.Join(tempData, nodesName)), "Missing nodes directory")
+
+	loaded, err := loadRepositoryConfig(tempData)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	tb.Assertf(*loaded == *config, "%v != %v", loaded, config)
+
+	_, err = initLocalRepository(tempData, "", 0)
+	tb.Assertf(err != nil, "Unexpected success")
+
+	// An existing configuration is never overwritten and the temporary file
+	// is not left behind.
+	other := *config
+	other.UUID = "other"
+	tb.Assertf(other.save(tempData) != nil, "Unexpected success")
+	loaded, err = loadRepositoryConfig(tempData)
+	tb.Assertf(err == nil && *loaded == *config, "Unexpected config %v %s", loaded, err)
+	_, err = os.Stat(filepath.Join(tempData, "."+configName+".tmp"))
+	tb.Assertf(os.IsNotExist(err), "Unexpected error: %s", err)
+}
+
+func TestRepositoryConfigUnknownVersion(t *testing.T) {
+	t.Parallel()
+	tb := subcommandstest.MakeTB(t)
+	tempData := makeTempDir(tb, "config_version")
+	defer removeTempDir(tempData)
+
+	_, err := initLocalRepository(tempData, "", 0)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	configPath := filepath.Join(tempData, configName)
+	err = ioutil.WriteFile(configPath, []byte("{\"version\": 2, \"hash\": \"sha256\", \"prefix_length\": 3}"), 0640)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+
+	_, err = makeLocalCasTable(tempData)
+	tb.Assertf(err != nil, "Unexpected success")
+	_, err = loadLocalNodesTable(tempData, makeFakeCasTable(tb), tb.GetLog())
+	tb.Assertf(err != nil, "Unexpected success")
+}
+
+func TestRepositoryConfigLegacy(t *testing.T) {
+	t.Parallel()
+	tb := subcommandstest.MakeTB(t)
+	tempData := makeTempDir(tb, "config_legacy")
+	defer removeTempDir(tempData)
+
+	// A repository created before config.json existed.
+	err := os.Mkdir(filepath.Join(tempData, casName), 0750)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	_, err = makeLocalCasTable(tempData)
+	tb.Assertf(err != nil, "Unexpected success")
+
+	// Its layout is not guessed from the requested values.
+	_, err = initLocalRepository(tempData, "sha256", 0)
+	tb.Assertf(err != nil, "Unexpected success")
+	_, err = initLocalRepository(tempData, "", 2)
+	tb.Assertf(err != nil, "Unexpected success")
+
+	config, err := initLocalRepository(tempData, "", 0)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	tb.Assertf(config.Hash == legacyHashName, "Unexpected algorithm %s", config.Hash)
+	tb.Assertf(config.PrefixLength == legacyPrefixLength, "Unexpected prefix %d", config.PrefixLength)
+	cas, err := makeLocalCasTable(tempData)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	testCasTableImpl(tb, cas)
+}
+
+func TestRepositoryConfigLegacyRecorded(t *testing.T) {
+	t.Parallel()
+	tb := subcommandstest.MakeTB(t)
+	tempData := makeTempDir(tb, "config_recorded")
+	defer removeTempDir(tempData)
+
+	// A repository that recorded its algorithm in the CAS directory.
+	casDir := filepath.Join(tempData, casName)
+	err := os.Mkdir(casDir, 0750)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	recordPath := filepath.Join(casDir, legacyHashAlgorithmName)
+	err = ioutil.WriteFile(recordPath, []byte("blake2b-256\n"), 0640)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+
+	config, err := initLocalRepository(tempData, "", 0)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	tb.Assertf(config.Hash == "blake2b-256", "Unexpected algorithm %s", config.Hash)
+	tb.Assertf(!isFile(recordPath), "%s wasn't removed", recordPath)
+}
@@ -0,0 +1,342 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"fmt"
+	"github.com/maruel/subcommands"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var cmdDiff = &subcommands.Command{
+	UsageLine: "diff <nodeA> <nodeB> | -live <node> <.toArchive>",
+	ShortDesc: "lists the files that changed between two nodes",
+	LongDesc:  "Lists the files added, removed, modified or moved between two nodes. With -live, compares a node with the files currently listed by a .toArchive file, using the cache to not hash the files again.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &diffRun{}
+		c.Init()
+		c.Flags.BoolVar(&c.live, "live", false, "Compares the node with the files listed by a .toArchive file")
+		c.Flags.StringVar(&c.excludeFrom, "exclude-from", "", "With -live, file listing additional exclusion patterns, one per line")
+		return c
+	},
+}
+
+type diffRun struct {
+	CommonFlags
+	live        bool
+	excludeFrom string
+}
+
+// A file with the same content found at another path.
+type movedFile struct {
+	From string
+	To   string
+}
+
+// Differences between two trees. The paths are sorted.
+type treeDiff struct {
+	Added    []string
+	Removed  []string
+	Modified []string
+	Moved    []movedFile
+}
+
+// Returns a string identifying the content of a file, whether it is stored
+// whole or in chunks.
+func contentKey(e *Entry) string {
+	if e.Chunks == nil {
+		return e.Sha1
+	}
+	digests := make([]string, len(e.Chunks))
+	for i, c := range e.Chunks {
+		digests[i] = c.Sha1
+	}
+	return strings.Join(digests, ",")
+}
+
+// Adds all the files of |entry| to |out|.
+func flattenEntry(cas CasTable, entry *Entry, relPath string, out map[string]*Entry) error {
+	if entry.isFile() {
+		out[relPath] = entry
+		return nil
+	}
+	dir, err := entry.loadDir(cas)
+	if err != nil {
+		return err
+	}
+	for name, child := range dir.Files {
+		if err := flattenEntry(cas, child, filepath.Join(relPath, name), out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Adds the files that differ between |a| and |b| to |before| and |after|
+// respectively. Either can be nil. A directory stored as the same object on
+// both sides is skipped without being loaded.
+func collectDifferences(cas CasTable, a *Entry, b *Entry, relPath string, before map[string]*Entry, after map[string]*Entry) error {
+	if a == nil {
+		return flattenEntry(cas, b, relPath, after)
+	}
+	if b == nil {
+		return flattenEntry(cas, a, relPath, before)
+	}
+	if a.isFile() && b.isFile() {
+		if contentKey(a) != contentKey(b) {
+			before[relPath] = a
+			after[relPath] = b
+		}
+		return nil
+	}
+	if a.isFile() || b.isFile() {
+		// A file replaced by a directory or the reverse.
+		if err := flattenEntry(cas, a, relPath, before); err != nil {
+			return err
+		}
+		return flattenEntry(cas, b, relPath, after)
+	}
+	if a.Dir != "" && a.Dir == b.Dir {
+		return nil
+	}
+	dirA, err := a.loadDir(cas)
+	if err != nil {
+		return err
+	}
+	dirB, err := b.loadDir(cas)
+	if err != nil {
+		return err
+	}
+	for name, child := range dirA.Files {
+		if err := collectDifferences(cas, child, dirB.Files[name], filepath.Join(relPath, name), before, after); err != nil {
+			return err
+		}
+	}
+	for name, child := range dirB.Files {
+		if _, ok := dirA.Files[name]; !ok {
+			if err := flattenEntry(cas, child, filepath.Join(relPath, name), after); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Compares the files of two trees. A file removed at one path and added with
+// the same content at another path is reported as moved.
+func diffFiles(before map[string]*Entry, after map[string]*Entry) *treeDiff {
+	d := &treeDiff{Added: []string{}, Removed: []string{}, Modified: []string{}, Moved: []movedFile{}}
+	removed := []string{}
+	for p, e := range before {
+		if n, ok := after[p]; !ok {
+			removed = append(removed, p)
+		} else if contentKey(n) != contentKey(e) {
+			d.Modified = append(d.Modified, p)
+		}
+	}
+	sort.Strings(removed)
+	sort.Strings(d.Modified)
+	// Paths of the removed files by content.
+	sources := map[string][]string{}
+	for _, p := range removed {
+		key := contentKey(before[p])
+		sources[key] = append(sources[key], p)
+	}
+	added := []string{}
+	for p := range after {
+		if _, ok := before[p]; !ok {
+			added = append(added, p)
+		}
+	}
+	sort.Strings(added)
+	moved := map[string]bool{}
+	for _, p := range added {
+		key := contentKey(after[p])
+		if from := sources[key]; len(from) != 0 {
+			d.Moved = append(d.Moved, movedFile{from[0], p})
+			sources[key] = from[1:]
+			moved[from[0]] = true
+		} else {
+			d.Added = append(d.Added, p)
+		}
+	}
+	for _, p := range removed {
+		if !moved[p] {
+			d.Removed = append(d.Removed, p)
+		}
+	}
+	return d
+}
+
+// Compares the entries of two nodes.
+func diffNodes(cas CasTable, a *Entry, b *Entry) (*treeDiff, error) {
+	before := map[string]*Entry{}
+	after := map[string]*Entry{}
+	if err := collectDifferences(cas, a, b, "", before, after); err != nil {
+		return nil, err
+	}
+	return diffFiles(before, after), nil
+}
+
+// Returns the Entry of a file currently on disk. The digest from the cache is
+// used when it is still valid, otherwise the file is hashed the same way as in
+// |previous|, if any, so the content of a file that wasn't modified matches.
+func liveEntry(h *HashAlgorithm, cache Cache, item inputItem, previous *Entry) (*Entry, error) {
+	cached := FindInCache(cache, item.fullPath)
+	if isCacheValid(cached, item) && (cached.Sha1 != "" || cached.Chunks != nil) {
+		return &Entry{Sha1: cached.Sha1, Chunks: cached.Chunks, Size: cached.Size}, nil
+	}
+	if previous == nil || previous.Chunks == nil {
+		digest, err := h.HashFilePath(item.fullPath)
+		if err != nil {
+			return nil, err
+		}
+		return &Entry{Sha1: digest, Size: item.Size()}, nil
+	}
+	f, err := os.Open(item.fullPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	chunks, err := hashChunks(h, f)
+	if err != nil {
+		return nil, err
+	}
+	return &Entry{Chunks: chunks, Size: chunksSize(chunks)}, nil
+}
+
+// Lists the files as archive would, keyed by their path in the node.
+func enumerateLive(inputs []string, excludes Excludes) (map[string]inputItem, error) {
+	out := map[string]inputItem{}
+	for _, input := range inputs {
+		stat, err := os.Stat(input)
+		if err != nil {
+			return nil, err
+		}
+		if excludes.MatchRecursive(input, stat.IsDir()) {
+			continue
+		}
+		if !stat.IsDir() {
+			out[filepath.Base(input)] = inputItem{input, filepath.Base(input), stat}
+			continue
+		}
+		skip := func(fullPath string, info os.FileInfo) bool {
+			return excludes.Match(fullPath, info.IsDir())
+		}
+		for item := range EnumerateTreeSkip(input, skip) {
+			if item.Error != nil {
+				return nil, item.Error
+			}
+			if !item.IsDir() {
+				relPath := item.FullPath[len(input)+1:]
+				out[relPath] = inputItem{item.FullPath, relPath, item.FileInfo}
+			}
+		}
+	}
+	return out, nil
+}
+
+// Compares the entry of a node with the files listed by the .toArchive file
+// at the absolute path |toArchive|.
+func (c *diffRun) diffLive(a DumbcasApplication, entry *Entry, toArchive string) (*treeDiff, error) {
+	inputs, excludes, err := loadToArchive(toArchive, c.excludeFrom)
+	if err != nil {
+		return nil, err
+	}
+	items, err := enumerateLive(inputs, excludes)
+	if err != nil {
+		return nil, err
+	}
+	before := map[string]*Entry{}
+	if err := flattenEntry(c.cas, entry, "", before); err != nil {
+		return nil, err
+	}
+	h := c.cas.GetHashAlgorithm()
+	cache, err := a.LoadCache(h)
+	if err != nil {
+		a.GetLog().Printf("Failed to load cache: %s", err)
+	}
+	defer cache.Close()
+	after := map[string]*Entry{}
+	for relPath, item := range items {
+		if after[relPath], err = liveEntry(h, cache, item, before[relPath]); err != nil {
+			return nil, err
+		}
+	}
+	return diffFiles(before, after), nil
+}
+
+func (c *diffRun) main(a DumbcasApplication, args []string) error {
+	if err := c.Parse(a, true); err != nil {
+		return err
+	}
+	defer c.Close()
+	node, err := LoadNode(c.nodes, args[0])
+	if err != nil {
+		return err
+	}
+	entry, err := LoadEntry(c.cas, node.Entry)
+	if err != nil {
+		return err
+	}
+	var d *treeDiff
+	if c.live {
+		toArchive, err := filepath.Abs(args[1])
+		if err != nil {
+			return fmt.Errorf("Failed to process %s", args[1])
+		}
+		if d, err = c.diffLive(a, entry, toArchive); err != nil {
+			return err
+		}
+	} else {
+		other, err := LoadNode(c.nodes, args[1])
+		if err != nil {
+			return err
+		}
+		otherEntry, err := LoadEntry(c.cas, other.Entry)
+		if err != nil {
+			return err
+		}
+		if d, err = diffNodes(c.cas, entry, otherEntry); err != nil {
+			return err
+		}
+	}
+	for _, p := range d.Added {
+		fmt.Fprintf(a.GetOut(), "+ %s\n", p)
+	}
+	for _, p := range d.Removed {
+		fmt.Fprintf(a.GetOut(), "- %s\n", p)
+	}
+	for _, p := range d.Modified {
+		fmt.Fprintf(a.GetOut(), "M %s\n", p)
+	}
+	for _, m := range d.Moved {
+		fmt.Fprintf(a.GetOut(), "R %s -> %s\n", m.From, m.To)
+	}
+	fmt.Fprintf(a.GetOut(), "%d added, %d removed, %d modified, %d moved\n", len(d.Added), len(d.Removed), len(d.Modified), len(d.Moved))
+	return nil
+}
+
+func (c *diffRun) Run(a subcommands.Application, args []string) int {
+	if len(args) != 2 {
+		fmt.Fprintf(a.GetErr(), "%s: Must provide two nodes, or a node and a .toArchive file with -live.\n", a.GetName())
+		return 1
+	}
+	HandleCtrlC()
+	d := a.(DumbcasApplication)
+	if err := c.main(d, args); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,130 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"github.com/maruel/subcommands/subcommandstest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func checkDiff(t *subcommandstest.TB, d *treeDiff, added, removed, modified []string, moved []movedFile) {
+	t.Assertf(Equals(d.Added, added), "Unexpected added %q", d.Added)
+	t.Assertf(Equals(d.Removed, removed), "Unexpected removed %q", d.Removed)
+	t.Assertf(Equals(d.Modified, modified), "Unexpected modified %q", d.Modified)
+	t.Assertf(len(d.Moved) == len(moved), "Unexpected moved %v", d.Moved)
+	for i := range moved {
+		t.Assertf(d.Moved[i] == moved[i], "Unexpected moved %v", d.Moved)
+	}
+}
+
+func TestDiffFiles(t *testing.T) {
+	t.Parallel()
+	tb := subcommandstest.MakeTB(t)
+	before := map[string]*Entry{
+		"same":     &Entry{Sha1: "1"},
+		"modified": &Entry{Sha1: "2"},
+		"removed":  &Entry{Sha1: "3"},
+		"old":      &Entry{Sha1: "4"},
+		"chunked":  &Entry{Chunks: []Chunk{{"5", 1}, {"6", 1}}},
+	}
+	after := map[string]*Entry{
+		"same":     &Entry{Sha1: "1"},
+		"modified": &Entry{Sha1: "7"},
+		"added":    &Entry{Sha1: "8"},
+		"new":      &Entry{Sha1: "4"},
+		"chunked":  &Entry{Chunks: []Chunk{{"5", 1}, {"9", 1}}},
+	}
+	d := diffFiles(before, after)
+	checkDiff(tb, d, []string{"added"}, []string{"removed"}, []string{"chunked", "modified"}, []movedFile{{"old", "new"}})
+}
+
+// Returns the entries of all the nodes, in the order they were archived.
+func loadAllEntries(t *subcommandstest.TB, cas CasTable, nodes NodesTable) ([]string, []*Entry) {
+	names := []string{}
+	entries := []*Entry{}
+	for _, name := range EnumerateNodesAsList(t, nodes) {
+		if filepath.Dir(name) == tagsName {
+			continue
+		}
+		node, err := LoadNode(nodes, name)
+		t.Assertf(err == nil, "Unexpected error: %s", err)
+		entry, err := LoadEntry(cas, node.Entry)
+		t.Assertf(err == nil, "Unexpected error: %s", err)
+		names = append(names, name)
+		entries = append(entries, entry)
+	}
+	return names, entries
+}
+
+func TestDiff(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(f.TB, "diff")
+	defer removeTempDir(tempData)
+
+	tree := map[string]string{
+		"toArchive":            "data\n",
+		"data/dir1/file1":      "content1\n",
+		"data/dir1/file2":      "content2\n",
+		"data/dir2/sub/file3":  "content3\n",
+		"data/dir3/unmodified": "unmodified\n",
+	}
+	if err := createTree(tempData, tree); err != nil {
+		f.Fatal(err)
+	}
+	toArchive := filepath.Join(tempData, "toArchive")
+	f.Run([]string{"archive", "-root=\\test_diff", toArchive}, 0)
+
+	// Modify, add, remove and move files.
+	tree = map[string]string{
+		"data/dir1/file1":     "modified content1\n",
+		"data/dir1/added":     "added\n",
+		"data/dir2/sub/moved": "content3\n",
+	}
+	if err := createTree(tempData, tree); err != nil {
+		f.Fatal(err)
+	}
+	f.Assertf(os.Remove(filepath.Join(tempData, "data", "dir1", "file2")) == nil, "Failed to remove")
+	f.Assertf(os.Remove(filepath.Join(tempData, "data", "dir2", "sub", "file3")) == nil, "Failed to remove")
+	expectedAdded := []string{filepath.Join("dir1", "added")}
+	expectedRemoved := []string{filepath.Join("dir1", "file2")}
+	expectedModified := []string{filepath.Join("dir1", "file1")}
+	expectedMoved := []movedFile{{filepath.Join("dir2", "sub", "file3"), filepath.Join("dir2", "sub", "moved")}}
+
+	// Compare the node with the files on disk.
+	names, entries := loadAllEntries(f.TB, f.cas, f.nodes)
+	f.Assertf(len(entries) == 1, "Unexpected nodes %q", names)
+	c := &diffRun{}
+	c.cas = f.cas
+	d, err := c.diffLive(f, entries[0], toArchive)
+	f.Assertf(err == nil, "Unexpected error: %s", err)
+	checkDiff(f.TB, d, expectedAdded, expectedRemoved, expectedModified, expectedMoved)
+
+	// Then with a second node.
+	f.Run([]string{"archive", "-root=\\test_diff", toArchive}, 0)
+	names, entries = loadAllEntries(f.TB, f.cas, f.nodes)
+	f.Assertf(len(entries) == 2, "Unexpected nodes %q", names)
+	d, err = diffNodes(f.cas, entries[0], entries[1])
+	f.Assertf(err == nil, "Unexpected error: %s", err)
+	checkDiff(f.TB, d, expectedAdded, expectedRemoved, expectedModified, expectedMoved)
+	d, err = diffNodes(f.cas, entries[1], entries[1])
+	f.Assertf(err == nil, "Unexpected error: %s", err)
+	checkDiff(f.TB, d, []string{}, []string{}, []string{}, []movedFile{})
+
+	f.CheckBuffer(true, false)
+	f.Run([]string{"diff", "-root=\\test_diff", names[0], names[1]}, 0)
+	f.CheckBuffer(true, false)
+	f.Run([]string{"diff", "-root=\\test_diff", "-live", names[1], toArchive}, 0)
+	f.CheckBuffer(true, false)
+	f.Run([]string{"diff", "-root=\\test_diff", names[1]}, 1)
+	f.CheckBuffer(false, true)
+}
@@ -17,15 +17,21 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"time"
 )
 
-// Can only contain the 2 firsts or the last one.
+// A file has its Size along either its Sha1 or, when it is large, its Chunks.
+// A directory has either its Files or the digest of the object in the CasTable
+// holding them as Dir. Storing each directory as its own object lets identical
+// subtrees be shared across backups; older backups only have Files.
 // TODO(maruel): Investigate if map[string]Entry could be used instead for
 // performance reasons.
 type Entry struct {
-	Sha1  string            `json:"h,omitempty"`
-	Size  int64             `json:"s,omitempty"`
-	Files map[string]*Entry `json:"f,omitempty"`
+	Sha1   string            `json:"h,omitempty"`
+	Size   int64             `json:"s,omitempty"`
+	Chunks []Chunk           `json:"c,omitempty"`
+	Dir    string            `json:"d,omitempty"`
+	Files  map[string]*Entry `json:"f,omitempty"`
 }
 
 func (e *Entry) SortedFiles() []string {
@@ -54,6 +60,16 @@ func (e *Entry) Print(w io.Writer, indent string) {
 		fmt.Fprintf(w, "%sSha1: %s\n", indent, e.Sha1)
 		fmt.Fprintf(w, "%sSize: %d\n", indent, e.Size)
 	}
+	if e.Dir != "" {
+		fmt.Fprintf(w, "%sDir: %s\n", indent, e.Dir)
+	}
+	if e.Chunks != nil {
+		fmt.Fprintf(w, "%sSize: %d\n", indent, e.Size)
+		fmt.Fprintf(w, "%sChunks:\n", indent)
+		for _, c := range e.Chunks {
+			fmt.Fprintf(w, "%s- %s(%d)\n", indent, c.Sha1, c.Size)
+		}
+	}
 	for _, f := range e.SortedFiles() {
 		fmt.Fprintf(w, "%s- '%s'\n", indent, f)
 		e.Files[f].Print(w, indent+"  ")
@@ -61,7 +77,63 @@ func (e *Entry) Print(w io.Writer, indent string) {
 }
 
 func (e *Entry) isDir() bool {
-	return e.Files != nil
+	return e.Files != nil || e.Dir != ""
+}
+
+// Returns the directory with its Files, loading it from the CasTable if it is
+// stored as a separate object.
+func (e *Entry) loadDir(cas CasTable) (*Entry, error) {
+	if e.Dir == "" {
+		return e, nil
+	}
+	return LoadEntry(cas, e.Dir)
+}
+
+func (e *Entry) isFile() bool {
+	return e.Sha1 != "" || e.Chunks != nil
+}
+
+// Opens the content of a file, whether it is stored whole or in chunks.
+func (e *Entry) Open(cas CasTable) (ReadSeekCloser, error) {
+	if e.Chunks != nil {
+		return newChunkedReader(cas, e.Chunks), nil
+	}
+	return cas.Open(e.Sha1)
+}
+
+// Verifies the digests are well formed and the chunks of each file add up to
+// its size. Doesn't load the directories stored as separate objects.
+func (e *Entry) validate(h *HashAlgorithm) error {
+	if e.Dir != "" {
+		if !h.IsValid(e.Dir) {
+			return fmt.Errorf("Invalid directory digest %s", e.Dir)
+		}
+		if e.Sha1 != "" || e.Chunks != nil || e.Files != nil {
+			return fmt.Errorf("Directory %s can't also have content", e.Dir)
+		}
+	}
+	if e.Sha1 != "" && !h.IsValid(e.Sha1) {
+		return fmt.Errorf("Invalid digest %s", e.Sha1)
+	}
+	if e.Chunks != nil {
+		if e.Sha1 != "" {
+			return fmt.Errorf("Entry %s can't also have chunks", e.Sha1)
+		}
+		for _, c := range e.Chunks {
+			if !h.IsValid(c.Sha1) {
+				return fmt.Errorf("Invalid chunk digest %s", c.Sha1)
+			}
+		}
+		if total := chunksSize(e.Chunks); total != e.Size {
+			return fmt.Errorf("Chunks add up to %d bytes instead of %d", total, e.Size)
+		}
+	}
+	for name, f := range e.Files {
+		if err := f.validate(h); err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+	}
+	return nil
 }
 
 type EntryFileSystem struct {
@@ -82,13 +154,18 @@ func (e *EntryFileSystem) pathToEntry(itemPath string) *Entry {
 		return toServe
 	}
 	for _, item := range strings.Split(itemPath, "/") {
-		if toServe.Files == nil {
+		if !toServe.isDir() {
+			return nil
+		}
+		dir, err := toServe.loadDir(e.cas)
+		if err != nil {
+			log.Printf("Failed to load %s: %s", itemPath, err)
 			return nil
 		}
-		if _, ok := toServe.Files[item]; !ok {
+		if _, ok := dir.Files[item]; !ok {
 			return nil
 		}
-		toServe = toServe.Files[item]
+		toServe = dir.Files[item]
 	}
 	return toServe
 }
@@ -111,12 +188,18 @@ func (e *EntryFileSystem) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if toServe.isDir() {
 		if !hasTrailing {
 			localRedirect(w, r, filepath.Base(r.URL.Path)+"/")
+		} else if dir, err := toServe.loadDir(e.cas); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to load the directory: %s", err), http.StatusInternalServerError)
 		} else {
-			toServe.ServeDir(w)
+			dir.ServeDir(w, "")
 		}
 	} else {
 		if hasTrailing {
 			localRedirect(w, r, filepath.Base(r.URL.Path))
+		} else if toServe.Chunks != nil {
+			f, _ := toServe.Open(e.cas)
+			defer f.Close()
+			http.ServeContent(w, r, filepath.Base(r.URL.Path), time.Time{}, f)
 		} else {
 			r.URL.Path = "/" + toServe.Sha1
 			e.cas.ServeHTTP(w, r)
@@ -124,7 +207,8 @@ func (e *EntryFileSystem) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (e *Entry) ServeDir(w http.ResponseWriter) {
+// Lists the files of the directory, preceded by |header| if not empty.
+func (e *Entry) ServeDir(w http.ResponseWriter, header string) {
 	names := make([]string, len(e.Files))
 	i := 0
 	for name, entry := range e.Files {
@@ -134,5 +218,5 @@ func (e *Entry) ServeDir(w http.ResponseWriter) {
 		names[i] = name
 		i++
 	}
-	dirList(w, names)
+	dirListWithHeader(w, header, names)
 }
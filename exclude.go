@@ -0,0 +1,211 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// An exclusion pattern, loosely following the .gitignore syntax. A pattern
+// without a path separator, like "*.tmp" or "node_modules", is matched against
+// the base name of every file and directory. A pattern with a path separator,
+// like "${HOME}/.cache", is matched against the full path and is relative to
+// the file it was read from. A trailing path separator only matches
+// directories. Everything inside an excluded directory is excluded too.
+type excludePattern struct {
+	// Original line, used for reporting.
+	line     string
+	pattern  string
+	fullPath bool
+	dirOnly  bool
+}
+
+type Excludes []*excludePattern
+
+// Parses an exclusion pattern. The optional leading "!" is ignored.
+func parseExcludePattern(relDir string, line string) (*excludePattern, error) {
+	line = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), "!"))
+	pattern := os.ExpandEnv(line)
+	pattern = strings.Replace(pattern, "/", string(filepath.Separator), -1)
+	e := &excludePattern{line: line}
+	if strings.HasSuffix(pattern, string(filepath.Separator)) {
+		e.dirOnly = true
+		pattern = strings.TrimRight(pattern, string(filepath.Separator))
+	}
+	if pattern == "" {
+		return nil, fmt.Errorf("Invalid exclusion pattern \"%s\"", line)
+	}
+	if strings.Contains(pattern, string(filepath.Separator)) {
+		e.fullPath = true
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(relDir, pattern)
+		}
+		pattern = filepath.Clean(pattern)
+	}
+	// Catch malformed patterns early.
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("Invalid exclusion pattern \"%s\": %s", line, err)
+	}
+	e.pattern = pattern
+	return e, nil
+}
+
+// Returns true if the file or directory at |fullPath| is excluded. Doesn't
+// look at the parent directories.
+func (e Excludes) Match(fullPath string, isDir bool) bool {
+	for _, p := range e {
+		if p.dirOnly && !isDir {
+			continue
+		}
+		target := fullPath
+		if !p.fullPath {
+			target = filepath.Base(fullPath)
+		}
+		if ok, _ := filepath.Match(p.pattern, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if the input at |fullPath| is excluded, either itself or by a
+// full path pattern matching one of its parent directories. The parent
+// directories are not archived so the base name patterns don't apply to them;
+// "build" doesn't exclude the input /home/me/build/project.
+func (e Excludes) MatchRecursive(fullPath string, isDir bool) bool {
+	if e.Match(fullPath, isDir) {
+		return true
+	}
+	fullPaths := Excludes{}
+	for _, p := range e {
+		if p.fullPath {
+			fullPaths = append(fullPaths, p)
+		}
+	}
+	for {
+		parent := filepath.Dir(fullPath)
+		if parent == fullPath {
+			return false
+		}
+		if fullPaths.Match(parent, true) {
+			return true
+		}
+		fullPath = parent
+	}
+}
+
+// Returns the patterns as they were written.
+func (e Excludes) String() string {
+	lines := make([]string, len(e))
+	for i, p := range e {
+		lines[i] = p.line
+	}
+	return strings.Join(lines, ", ")
+}
+
+// Splits the lines of a .toArchive file into the inputs and the exclusion
+// patterns. Lines starting with "#" are comments and lines starting with "!"
+// are exclusion patterns. The inputs are converted to absolute paths and glob
+// patterns are expanded.
+func parseToArchive(relDir string, lines []string) ([]string, Excludes, error) {
+	inputs := []string{}
+	excludes := Excludes{}
+	for _, line := range lines {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "!") {
+			e, err := parseExcludePattern(relDir, line)
+			if err != nil {
+				return nil, nil, err
+			}
+			excludes = append(excludes, e)
+			continue
+		}
+		inputs = append(inputs, line)
+	}
+	cleanupList(relDir, inputs)
+	inputs, err := expandGlobs(inputs)
+	return inputs, excludes, err
+}
+
+// Reads the inputs and the exclusion patterns of the .toArchive file at the
+// absolute path |toArchive|, along the ones of |excludeFrom|, if any. The
+// .toArchive file is one of the inputs so it is archived too.
+func loadToArchive(toArchive string, excludeFrom string) ([]string, Excludes, error) {
+	lines, err := readFileAsStrings(toArchive)
+	if err != nil {
+		return nil, nil, err
+	}
+	lines = append(lines, toArchive)
+	inputs, excludes, err := parseToArchive(filepath.Dir(toArchive), lines)
+	if err != nil {
+		return nil, nil, err
+	}
+	if excludeFrom != "" {
+		more, err := loadExcludeFile(excludeFrom)
+		if err != nil {
+			return nil, nil, err
+		}
+		excludes = append(excludes, more...)
+	}
+	return inputs, excludes, nil
+}
+
+// Loads the exclusion patterns from a file, one per line. The leading "!" is
+// optional. The anchored patterns are relative to the directory of the file,
+// so a relative |filePath| is made absolute first.
+func loadExcludeFile(filePath string) (Excludes, error) {
+	filePath, err := filepath.Abs(filePath)
+	if err != nil {
+		return nil, err
+	}
+	lines, err := readFileAsStrings(filePath)
+	if err != nil {
+		return nil, err
+	}
+	excludes := Excludes{}
+	for _, line := range lines {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		e, err := parseExcludePattern(filepath.Dir(filePath), line)
+		if err != nil {
+			return nil, err
+		}
+		excludes = append(excludes, e)
+	}
+	return excludes, nil
+}
+
+// Replaces each input containing glob meta characters by the paths it
+// matches, if any.
+func expandGlobs(inputs []string) ([]string, error) {
+	out := make([]string, 0, len(inputs))
+	for _, input := range inputs {
+		if !strings.ContainsAny(input, "*?[") {
+			out = append(out, input)
+			continue
+		}
+		matches, err := filepath.Glob(input)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid pattern %s: %s", input, err)
+		}
+		if len(matches) == 0 {
+			// Keep it so it is reported as missing.
+			out = append(out, input)
+		}
+		out = append(out, matches...)
+	}
+	return out, nil
+}
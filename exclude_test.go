@@ -0,0 +1,111 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"github.com/maruel/subcommands/subcommandstest"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestExcludes(t *testing.T) {
+	t.Parallel()
+	tb := subcommandstest.MakeTB(t)
+	root := filepath.Join(string(filepath.Separator), "root")
+	excludes := Excludes{}
+	for _, line := range []string{"!*.tmp", "!node_modules/", "!cache/data", "!" + filepath.Join(root, "dir1", "skip")} {
+		e, err := parseExcludePattern(root, line)
+		tb.Assertf(err == nil, "Unexpected error: %s", err)
+		excludes = append(excludes, e)
+	}
+	type S struct {
+		path  string
+		isDir bool
+	}
+	checks := map[S]bool{
+		S{"foo.tmp", false}:            true,
+		S{"a/b/foo.tmp", false}:        true,
+		S{"foo.tmp2", false}:           false,
+		S{"node_modules", true}:        true,
+		S{"a/node_modules", true}:      true,
+		S{"a/node_modules", false}:     false,
+		S{"cache/data", false}:         true,
+		S{"a/cache/data", false}:       false,
+		S{"dir1/skip", true}:           true,
+		S{"dir1/skip2", true}:          false,
+		S{"dir1/skip/foo", false}:      false,
+		S{"dir1/node_modules/x", true}: false,
+	}
+	for s, expected := range checks {
+		fullPath := filepath.Join(root, filepath.FromSlash(s.path))
+		tb.Assertf(excludes.Match(fullPath, s.isDir) == expected, "%s: expected %t", s.path, expected)
+	}
+	tb.Assertf(excludes.MatchRecursive(filepath.Join(root, "dir1", "skip", "foo"), false), "Parent directory is not excluded")
+	tb.Assertf(excludes.MatchRecursive(filepath.Join(root, "a", "node_modules"), true), "Input is not excluded")
+	// The base name patterns don't apply to the parent directories of an input.
+	tb.Assertf(!excludes.MatchRecursive(filepath.Join(root, "a", "node_modules", "x"), false), "Unexpected exclusion")
+	tb.Assertf(!excludes.MatchRecursive(filepath.Join(root, "a", "x"), false), "Unexpected exclusion")
+	tb.Assertf(excludes.String() == "*.tmp, node_modules/, cache/data, "+filepath.Join(root, "dir1", "skip"), "Unexpected: %s", excludes)
+
+	_, err := parseExcludePattern(root, "!")
+	tb.Assertf(err != nil, "Unexpected success")
+	_, err = parseExcludePattern(root, "![")
+	tb.Assertf(err != nil, "Unexpected success")
+}
+
+func TestParseToArchive(t *testing.T) {
+	t.Parallel()
+	tb := subcommandstest.MakeTB(t)
+	tempData := makeTempDir(tb, "exclude")
+	defer removeTempDir(tempData)
+
+	tree := map[string]string{
+		"a.jpg":   "a",
+		"b.jpg":   "b",
+		"c.txt":   "c",
+		"d/e.jpg": "e",
+	}
+	if err := createTree(tempData, tree); err != nil {
+		t.Fatal(err)
+	}
+	lines := []string{"# A comment", "*.jpg", "d", "!*.tmp", "missing*"}
+	inputs, excludes, err := parseToArchive(tempData, lines)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	sort.Strings(inputs)
+	expected := []string{
+		filepath.Join(tempData, "a.jpg"),
+		filepath.Join(tempData, "b.jpg"),
+		filepath.Join(tempData, "d"),
+		filepath.Join(tempData, "missing*"),
+	}
+	tb.Assertf(Equals(inputs, expected), "%q != %q", inputs, expected)
+	tb.Assertf(len(excludes) == 1, "Unexpected excludes: %s", excludes)
+}
+
+func TestLoadExcludeFileRelative(t *testing.T) {
+	t.Parallel()
+	tb := subcommandstest.MakeTB(t)
+	tempData := makeTempDir(tb, "exclude_from")
+	defer removeTempDir(tempData)
+
+	if err := createTree(tempData, map[string]string{"ex.txt": "build/out\n"}); err != nil {
+		t.Fatal(err)
+	}
+	cwd, err := os.Getwd()
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	relPath, err := filepath.Rel(cwd, filepath.Join(tempData, "ex.txt"))
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	excludes, err := loadExcludeFile(relPath)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	tb.Assertf(excludes.Match(filepath.Join(tempData, "build", "out"), true), "Anchored pattern doesn't match: %s", excludes)
+	tb.Assertf(!excludes.Match(filepath.Join(tempData, "a", "build", "out"), true), "Unexpected match: %s", excludes)
+}
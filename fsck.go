@@ -12,65 +12,281 @@ package main
 import (
 	"fmt"
 	"github.com/maruel/subcommands"
-	"regexp"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
 )
 
 var cmdFsck = &subcommands.Command{
 	UsageLine: "fsck",
 	ShortDesc: "moves to trash all objects that are not valid content anymore",
-	LongDesc:  "Recalculate the sha-1 of each dumbcas entry and remove any that are corrupted",
+	LongDesc:  "Recalculate the digest of each dumbcas entry and remove any that are corrupted, then verify every object referenced by each node is present. With -mark-damaged, the files missing their objects are recorded in the node so ls and info report them. Use -jobs and -rate to tune the load on the storage. With -budget or -budget-objects, only the objects that were not verified for the longest time are verified, so running it regularly eventually verifies the whole CAS.",
 	CommandRun: func() subcommands.CommandRun {
 		c := &fsckRun{}
 		c.Init()
+		c.exclusive = true
+		c.Flags.BoolVar(&c.markDamaged, "mark-damaged", false, "Records in each node the files whose objects are missing")
+		c.Flags.IntVar(&c.jobs, "jobs", runtime.NumCPU(), "Number of objects verified concurrently. Use 1 on a single hard disk.")
+		c.Flags.Float64Var(&c.rate, "rate", 0, "Maximum read throughput in mb/s, 0 for unlimited")
+		c.Flags.StringVar(&c.budget, "budget", "", "Maximum amount of data to verify, e.g. 200GB")
+		c.Flags.IntVar(&c.budgetObjects, "budget-objects", 0, "Maximum number of objects to verify")
 		return c
 	},
 }
 
 type fsckRun struct {
 	CommonFlags
+	markDamaged   bool
+	jobs          int
+	rate          float64
+	budget        string
+	budgetObjects int
+}
+
+// The result of rehashing an object.
+type verifiedObject struct {
+	item   string
+	actual string
+	size   int64
+	err    error
+}
+
+// Rehashes the object |item|. The file is closed before returning.
+func verifyObject(cas CasTable, item string, limiter *rateLimiter) verifiedObject {
+	f, err := cas.Open(item)
+	if err != nil {
+		return verifiedObject{item: item, err: fmt.Errorf("Failed to open %s: %s", item, err)}
+	}
+	defer f.Close()
+	r := &throttledReader{r: f, limiter: limiter}
+	h := cas.GetHashAlgorithm()
+	actual, err := h.HashReader(r)
+	if err != nil {
+		// Probably Disk error.
+		err = fmt.Errorf("Aborting! Failed to calcultate the %s of %s: %s. Please find a valid copy of your CAS table ASAP.", h.Name, item, err)
+	}
+	return verifiedObject{item, actual, r.n, err}
+}
+
+// Rehashes |items| with |jobs| concurrent workers. The results are returned in
+// no specific order. Stops early when |stop| is closed or on interruption.
+func verifyObjects(cas CasTable, items []string, jobs int, limiter *rateLimiter, stop <-chan bool) <-chan verifiedObject {
+	todo := make(chan string)
+	go func() {
+		defer close(todo)
+		for _, item := range items {
+			select {
+			case todo <- item:
+			case <-stop:
+				return
+			case <-InterruptedChannel:
+				return
+			}
+		}
+	}()
+	results := make(chan verifiedObject)
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range todo {
+				if IsInterrupted() {
+					return
+				}
+				results <- verifyObject(cas, item, limiter)
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	return results
+}
+
+// How often the scrub journal is saved while verifying, so an interrupted or
+// killed fsck keeps most of its progress.
+const scrubSaveInterval = time.Minute
+
+// Formats the progress of the verification. The ETA is extrapolated from the
+// number of objects since the objects are verified in the order of their
+// digest, which is unrelated to their size.
+func fsckProgress(done, total int, bytes int64, elapsed time.Duration) string {
+	seconds := elapsed.Seconds()
+	if seconds <= 0 || done == 0 {
+		return fmt.Sprintf("Verified %d/%d objects", done, total)
+	}
+	eta := time.Duration(float64(elapsed) * float64(total-done) / float64(done))
+	return fmt.Sprintf(
+		"Verified %d/%d objects (%.1fmb) %.1f objects/s %.1fmb/s ETA %s",
+		done, total, toMb(bytes), float64(done)/seconds, toMb(bytes)/seconds, eta-eta%time.Second)
+}
+
+// Returns the paths of the files and directories under |entry| whose objects
+// are not in |present|. "" means |entry| itself. The result for a directory
+// stored as a separate object is cached in |dirs| since unchanged directories
+// are shared across nodes.
+func missingObjects(cas CasTable, present map[string]bool, dirs map[string][]string, entry *Entry) []string {
+	if entry.Sha1 != "" && !present[entry.Sha1] {
+		return []string{""}
+	}
+	for _, c := range entry.Chunks {
+		if !present[c.Sha1] {
+			return []string{""}
+		}
+	}
+	if entry.Dir != "" {
+		if missing, ok := dirs[entry.Dir]; ok {
+			return missing
+		}
+		var missing []string
+		if !present[entry.Dir] {
+			missing = []string{""}
+		} else if dir, err := entry.loadDir(cas); err != nil {
+			missing = []string{""}
+		} else {
+			missing = missingObjects(cas, present, dirs, dir)
+		}
+		dirs[entry.Dir] = missing
+		return missing
+	}
+	var out []string
+	for _, name := range entry.SortedFiles() {
+		for _, p := range missingObjects(cas, present, dirs, entry.Files[name]) {
+			out = append(out, path.Join(name, p))
+		}
+	}
+	return out
 }
 
 func (c *fsckRun) main(a DumbcasApplication) error {
+	if c.jobs < 1 {
+		return fmt.Errorf("-jobs must be at least 1")
+	}
+	if c.budgetObjects < 0 {
+		return fmt.Errorf("-budget-objects can't be negative")
+	}
+	var budget int64
+	if c.budget != "" {
+		var err error
+		if budget, err = parseSize(c.budget); err != nil {
+			return fmt.Errorf("-budget: %s", err)
+		}
+	}
+	// A scrub only verifies part of the objects.
+	scrub := budget != 0 || c.budgetObjects != 0
 	if err := c.Parse(a, true); err != nil {
 		return err
 	}
+	defer c.Close()
 
-	count := 0
-	corrupted := 0
+	// Safe since the exclusive lock guarantees no archive is running
+	// concurrently.
+	if removed, err := c.cas.RemoveTemporaryFiles(); err != nil {
+		a.GetLog().Printf("Failed to remove partially written objects: %s", err)
+	} else if removed != 0 {
+		a.GetLog().Printf("Removed %d partially written objects.", removed)
+	}
+
+	h := c.cas.GetHashAlgorithm()
+	items := []string{}
 	for item := range c.cas.Enumerate() {
 		if item.Error != nil {
 			a.GetLog().Printf("While enumerating the CAS table: %s", item.Error)
 			continue
 		}
-		count += 1
-		f, err := c.cas.Open(item.Item)
-		if err != nil {
-			// TODO(maruel): Leaks channel.
-			return fmt.Errorf("Failed to open %s: %s", item.Item, err)
+		items = append(items, item.Item)
+	}
+
+	journal, err := a.LoadScrubJournal(c.Root)
+	if err != nil {
+		return err
+	}
+	toVerify := items
+	if scrub {
+		if toVerify, err = journal.Oldest(c.cas, items, budget, c.budgetObjects); err != nil {
+			return err
 		}
-		defer f.Close()
-		actual, err := sha1File(f)
-		if err != nil {
-			// Probably Disk error.
-			// TODO(maruel): Leaks channel.
-			return fmt.Errorf("Aborting! Failed to calcultate the sha1 of %s: %s. Please find a valid copy of your CAS table ASAP.", item.Item, err)
-		}
-		if actual != item.Item {
-			corrupted += 1
-			a.GetLog().Printf("Found corrupted object, %s != %s", item.Item, actual)
-			if err := c.cas.Remove(item.Item); err != nil {
-				// TODO(maruel): Leaks channel.
-				return fmt.Errorf("Failed to trash object %s: %s", item.Item, err)
+	}
+
+	count := 0
+	corrupted := 0
+	var bytes int64
+	// The objects not verified in a scrub are assumed valid, to find the ones
+	// missing in the nodes.
+	present := map[string]bool{}
+	for _, item := range items {
+		present[item] = true
+	}
+	start := time.Now()
+	stop := make(chan bool)
+	results := verifyObjects(c.cas, toVerify, c.jobs, makeRateLimiter(c.rate), stop)
+	// Stops the workers and waits for them before returning |err|. The objects
+	// verified so far are kept in the journal.
+	abort := func(err error) error {
+		close(stop)
+		for _ = range results {
+		}
+		if saveErr := journal.Save(); saveErr != nil {
+			a.GetLog().Printf("%s", saveErr)
+		}
+		return err
+	}
+	progress := time.NewTicker(5 * time.Second)
+	defer progress.Stop()
+	save := time.NewTicker(scrubSaveInterval)
+	defer save.Stop()
+	for results != nil {
+		select {
+		case r, ok := <-results:
+			if !ok {
+				results = nil
+				break
+			}
+			if r.err != nil {
+				return abort(r.err)
+			}
+			count++
+			bytes += r.size
+			journal.Add(r.item, r.actual != r.item, time.Now())
+			if r.actual != r.item {
+				corrupted++
+				delete(present, r.item)
+				a.GetLog().Printf("Found corrupted object, %s != %s", r.item, r.actual)
+				if err := c.cas.Remove(r.item, &TrashRecord{Reason: TrashCorrupted, Expected: r.item, Actual: r.actual}); err != nil {
+					return abort(fmt.Errorf("Failed to trash object %s: %s", r.item, err))
+				}
+			}
+		case <-progress.C:
+			a.GetLog().Print(fsckProgress(count, len(toVerify), bytes, time.Since(start)))
+		case <-save.C:
+			if err := journal.Save(); err != nil {
+				a.GetLog().Printf("%s", err)
 			}
 		}
 	}
+	// Keep the progress even if interrupted; the workers stop on Ctrl-C.
+	journal.Trim(items)
+	if err := journal.Save(); err != nil {
+		a.GetLog().Printf("%s", err)
+	}
+	if IsInterrupted() {
+		return fmt.Errorf("Was interrupted.")
+	}
+	a.GetLog().Print(fsckProgress(count, len(toVerify), bytes, time.Since(start)))
 	a.GetLog().Printf("Scanned %d entries in CasTable; found %d corrupted.", count, corrupted)
+	if scrub {
+		a.GetLog().Print(scrubSummary(journal, items))
+	}
 
-	// TODO(maruel): Get the value from CasTable.
-	hashLength := 40
-	resha1 := regexp.MustCompile(fmt.Sprintf("^([a-f0-9]{%d})$", hashLength))
 	count = 0
 	corrupted = 0
+	damaged := 0
+	dirs := map[string][]string{}
 	for item := range c.nodes.Enumerate() {
 		// TODO(maruel): Can't differentiate between an I/O error or a corrupted node.
 		// NodesTable.Enumerate() automatically clears corrupted nodes.
@@ -83,28 +299,72 @@ func (c *fsckRun) main(a DumbcasApplication) error {
 		f, err := c.nodes.Open(item.Item)
 		if err != nil {
 			a.GetLog().Printf("Failed opening node %s: %s", item.Item, err)
-			c.nodes.Remove(item.Item)
+			c.nodes.Remove(item.Item, &TrashRecord{Reason: TrashInvalid})
 			corrupted++
 			continue
 		}
-		defer f.Close()
 		node := &Node{}
-		if err := loadReaderAsJson(f, node); err != nil {
+		err = loadReaderAsJson(f, node)
+		// Closed right away since Update() replaces the file.
+		f.Close()
+		if err != nil {
 			a.GetLog().Printf("Failed opening node %s: %s", item.Item, err)
-			c.nodes.Remove(item.Item)
+			c.nodes.Remove(item.Item, &TrashRecord{Reason: TrashInvalid})
 			corrupted++
 			continue
 		}
-		if !resha1.MatchString(node.Entry) {
+		if !h.IsValid(node.Entry) {
 			a.GetLog().Printf("Node %s is corrupted: %v", item.Item, node)
-			c.nodes.Remove(item.Item)
+			c.nodes.Remove(item.Item, &TrashRecord{Reason: TrashInvalid})
 			corrupted++
 			continue
 		}
+		// An entry that can't be loaded is reported as missing below.
+		if entry, err := LoadEntry(c.cas, node.Entry); err == nil {
+			if err := entry.validate(h); err != nil {
+				a.GetLog().Printf("Node %s is corrupted: %s", item.Item, err)
+				c.nodes.Remove(item.Item, &TrashRecord{Reason: TrashInvalid})
+				corrupted++
+				continue
+			}
+		}
+		// The tags are copies of or symlinks to the nodes.
+		if strings.HasPrefix(filepath.ToSlash(item.Item), tagsName+"/") {
+			continue
+		}
+		missing := missingObjects(c.cas, present, dirs, &Entry{Dir: node.Entry})
+		if missing != nil && missing[0] == "" {
+			// The root directory itself is missing.
+			missing = []string{"."}
+		}
+		if missing != nil {
+			damaged++
+			fmt.Fprintf(a.GetOut(), "Node %s is missing the objects of %d files or directories:\n", item.Item, len(missing))
+			for _, p := range missing {
+				fmt.Fprintf(a.GetOut(), "  %s\n", p)
+			}
+		}
+		if c.markDamaged && strings.Join(missing, "\n") != strings.Join(node.Damaged, "\n") {
+			// Also clears the mark once the objects were restored.
+			node.Damaged = missing
+			if err := c.nodes.Update(item.Item, node); err != nil {
+				return fmt.Errorf("Failed to mark node %s as damaged: %s", item.Item, err)
+			}
+		}
 	}
 	a.GetLog().Printf("Scanned %d entries in NodesTable; found %d corrupted.", count, corrupted)
+	if damaged != 0 {
+		fmt.Fprintf(a.GetOut(), "Found %d damaged nodes.", damaged)
+		if c.markDamaged {
+			fmt.Fprintf(a.GetOut(), " They were marked as damaged.\n")
+		} else {
+			fmt.Fprintf(a.GetOut(), " Use -mark-damaged to record the missing files in the nodes.\n")
+		}
+	}
 
-	c.cas.ClearFsckBit()
+	if !scrub {
+		c.cas.ClearFsckBit()
+	}
 	return nil
 }
 
@@ -113,6 +373,7 @@ func (c *fsckRun) Run(a subcommands.Application, args []string) int {
 		fmt.Fprintf(a.GetErr(), "%s: Unsupported arguments.\n", a.GetName())
 		return 1
 	}
+	HandleCtrlC()
 	d := a.(DumbcasApplication)
 	if err := c.main(d); err != nil {
 		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
@@ -10,7 +10,12 @@ limitations under the License. */
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"github.com/maruel/subcommands/subcommandstest"
+	"sort"
 	"testing"
+	"time"
 )
 
 func TestFsckEmpty(t *testing.T) {
@@ -44,6 +49,12 @@ func TestFsckCorruptCasFile(t *testing.T) {
 	// CasTable.
 	i1 := EnumerateCasAsList(f.TB, f.cas)
 	f.Assertf(len(i1) == 2, "Unexpected items: %d", len(i1))
+	// The trash journal records both digests.
+	journal, err := cas.GetTrash().Journal()
+	f.Assertf(err == nil && len(journal) == 1, "Unexpected journal: %v %s", journal, err)
+	r := journal[0]
+	f.Assertf(r.Item == sha1String("content1") && r.Reason == TrashCorrupted, "Unexpected record: %v", r)
+	f.Assertf(r.Expected == sha1String("content1") && r.Actual == sha1String("content5"), "Unexpected record: %v", r)
 
 	// Note: The node is not quarantined, because in theory the data could be
 	// found on another copy of the CasTable so it's preferable to not delete the
@@ -74,3 +85,112 @@ func TestFsckCorruptNodeEntry(t *testing.T) {
 	n1 := EnumerateNodesAsList(f.TB, f.nodes)
 	f.Assertf(len(n1) == 1, "Unexpected nodes: %q", n1)
 }
+
+func TestFsckInvalidChunks(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	args := []string{"fsck", "-root=\\test_fsck_chunks"}
+	f.Run(args, 0)
+
+	// The chunks don't add up to the size of the file.
+	chunk, err := AddBytes(f.cas, []byte("chunk"))
+	f.Assertf(err == nil, "Unexpected error: %s", err)
+	entry := &Entry{Files: map[string]*Entry{"big": &Entry{Size: 10, Chunks: []Chunk{{chunk, 5}}}}}
+	data, err := json.Marshal(entry)
+	f.Assertf(err == nil, "Unexpected error: %s", err)
+	entrySha1, err := AddBytes(f.cas, data)
+	f.Assertf(err == nil, "Unexpected error: %s", err)
+	_, err = f.nodes.AddEntry(&Node{Entry: entrySha1, Comment: "invalid"}, "invalid")
+	f.Assertf(err == nil, "Unexpected error: %s", err)
+	f.Run(args, 0)
+
+	n1 := EnumerateNodesAsList(f.TB, f.nodes)
+	f.Assertf(len(n1) == 0, "Unexpected nodes: %q", n1)
+}
+
+func TestFsckMissingObjects(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	args := []string{"fsck", "-root=\\test_fsck_missing"}
+	f.Run(args, 0)
+
+	_, nodeName, entry := archiveData(f.TB, f.cas, f.nodes, map[string]string{
+		"file1":           "content1",
+		"dir1/dir2/file2": "content2",
+	})
+	f.Run(args, 0)
+	f.CheckBuffer(false, false)
+
+	// The object was lost, e.g. a partial rsync.
+	cas := f.cas.(*fakeCasTable)
+	delete(cas.entries, sha1String("content2"))
+	f.Run(args, 0)
+	f.CheckBuffer(true, false)
+	node, err := LoadNode(f.nodes, nodeName)
+	f.Assertf(err == nil && node.Damaged == nil, "Unexpected node: %v %s", node, err)
+
+	f.Run([]string{"fsck", "-root=\\test_fsck_missing", "-mark-damaged"}, 0)
+	f.CheckBuffer(true, false)
+	node, err = LoadNode(f.nodes, nodeName)
+	f.Assertf(err == nil && Equals(node.Damaged, []string{"dir1/dir2/file2"}), "Unexpected node: %v %s", node, err)
+	infos, err := loadNodeInfos(f.cas, f.nodes, &nodeFilter{}, f.GetLog())
+	f.Assertf(err == nil && len(infos) == 1 && infos[0].Damaged, "Unexpected infos: %v %s", infos, err)
+
+	// The mark is cleared once the object is found again.
+	_, err = AddBytes(f.cas, []byte("content2"))
+	f.Assertf(err == nil, "Unexpected error: %s", err)
+	f.Run([]string{"fsck", "-root=\\test_fsck_missing", "-mark-damaged"}, 0)
+	f.CheckBuffer(false, false)
+	node, err = LoadNode(f.nodes, nodeName)
+	f.Assertf(err == nil && node.Damaged == nil, "Unexpected node: %v %s", node, err)
+
+	// Without its root directory, the node is listed as damaged even before it
+	// is marked.
+	delete(cas.entries, entry)
+	infos, err = loadNodeInfos(f.cas, f.nodes, &nodeFilter{}, f.GetLog())
+	f.Assertf(err == nil && len(infos) == 1 && infos[0].Damaged, "Unexpected infos: %v %s", infos, err)
+	f.Run([]string{"fsck", "-root=\\test_fsck_missing", "-mark-damaged"}, 0)
+	f.CheckBuffer(true, false)
+	node, err = LoadNode(f.nodes, nodeName)
+	f.Assertf(err == nil && Equals(node.Damaged, []string{"."}), "Unexpected node: %v %s", node, err)
+	infos, err = loadNodeInfos(f.cas, f.nodes, &nodeFilter{}, f.GetLog())
+	f.Assertf(err == nil && len(infos) == 1 && infos[0].Damaged, "Unexpected infos: %v %s", infos, err)
+	n := EnumerateNodesAsList(f.TB, f.nodes)
+	f.Assertf(len(n) == 2, "Unexpected nodes: %q", n)
+}
+
+func TestFsckJobs(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	f.MakeCasTable("")
+	f.LoadNodesTable("", f.cas)
+	for i := 0; i < 50; i++ {
+		_, err := AddBytes(f.cas, []byte(fmt.Sprintf("content%d", i)))
+		f.Assertf(err == nil, "Unexpected error: %s", err)
+	}
+	cas := f.cas.(*fakeCasTable)
+	corrupted := []string{sha1String("content3"), sha1String("content17"), sha1String("content42")}
+	for _, item := range corrupted {
+		cas.entries[item] = []byte("corrupted")
+	}
+
+	f.Run([]string{"fsck", "-root=\\test_fsck_jobs", "-jobs=0"}, 1)
+	f.CheckBuffer(false, true)
+	f.Run([]string{"fsck", "-root=\\test_fsck_jobs", "-jobs=8", "-rate=100"}, 0)
+	f.CheckBuffer(false, false)
+	i := EnumerateCasAsList(f.TB, f.cas)
+	f.Assertf(len(i) == 47, "Unexpected items: %d", len(i))
+	trashed := EnumerateTrashAsList(f.TB, cas.GetTrash())
+	sort.Strings(corrupted)
+	f.Assertf(Equals(trashed, corrupted), "Unexpected trash: %q", trashed)
+}
+
+func TestFsckProgress(t *testing.T) {
+	t.Parallel()
+	tb := subcommandstest.MakeTB(t)
+	p := fsckProgress(0, 10, 0, 0)
+	tb.Assertf(p == "Verified 0/10 objects", "Unexpected progress: %s", p)
+	p = fsckProgress(5, 20, 10*1024*1024, 10*time.Second)
+	expected := "Verified 5/20 objects (10.0mb) 0.5 objects/s 1.0mb/s ETA 30s"
+	tb.Assertf(p == expected, "Unexpected progress: %s", p)
+}
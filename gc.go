@@ -12,92 +12,356 @@ package main
 import (
 	"fmt"
 	"github.com/maruel/subcommands"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 )
 
 var cmdGc = &subcommands.Command{
 	UsageLine: "gc",
 	ShortDesc: "moves to trash all objects that are not referenced anymore",
-	LongDesc:  "Scans each node and each entry file to determine if each cas entry is referenced or not.",
+	LongDesc:  "Scans each node and each entry file to determine if each cas entry is referenced or not. The objects modified within the -grace period are kept since an archive running concurrently may not have saved the node referencing them yet.",
 	CommandRun: func() subcommands.CommandRun {
 		c := &gcRun{}
 		c.Init()
+		c.exclusive = true
+		c.Flags.DurationVar(&c.grace, "grace", defaultGcGrace, "Keeps the unreferenced objects modified within this period")
+		c.Flags.BoolVar(&c.dryRun, "dry-run", false, "Prints how much space would be reclaimed without removing anything")
+		c.Flags.BoolVar(&c.force, "force", false, "Removes the orphans even if some nodes are damaged; the objects only referenced below their missing directories are then removed too")
 		return c
 	},
 }
 
+// An archive touches every object it references so it is safe to collect the
+// objects that were not modified for this long.
+const defaultGcGrace = 24 * time.Hour
+
 type gcRun struct {
 	CommonFlags
+	grace  time.Duration
+	dryRun bool
+	force  bool
+}
+
+// Returned by TagRecurse() when a directory object is missing from the CasTable.
+type missingObjectError struct {
+	hash string
+}
+
+func (e *missingObjectError) Error() string {
+	return fmt.Sprintf("Missing object %s", e.hash)
 }
 
-func TagRecurse(entries map[string]bool, entry *Entry) {
+// Tags all the objects referenced by |entry|. A directory stored as a separate
+// object that is already tagged is not loaded again, since its whole subtree
+// is tagged too. A directory object that is missing doesn't stop the rest of
+// the tree from being tagged; a *missingObjectError is then returned. Any other
+// failure to load a directory aborts since the objects of its subtree can't be
+// tagged.
+func TagRecurse(cas CasTable, entries map[string]bool, entry *Entry) error {
 	if entry.Sha1 != "" {
 		entries[entry.Sha1] = true
 	}
+	for _, c := range entry.Chunks {
+		entries[c.Sha1] = true
+	}
+	if entry.Dir != "" {
+		if entries[entry.Dir] {
+			return nil
+		}
+		dir, err := entry.loadDir(cas)
+		if err != nil {
+			if _, statErr := cas.Stat(entry.Dir); os.IsNotExist(statErr) {
+				return &missingObjectError{entry.Dir}
+			}
+			return err
+		}
+		entries[entry.Dir] = true
+		entry = dir
+	}
+	var out error
 	for _, i := range entry.Files {
-		TagRecurse(entries, i)
+		if err := TagRecurse(cas, entries, i); err != nil {
+			if _, ok := err.(*missingObjectError); !ok {
+				return err
+			}
+			if out == nil {
+				out = err
+			}
+		}
 	}
+	return out
 }
 
-func (c *gcRun) main(a DumbcasApplication) error {
-	if err := c.Parse(a, false); err != nil {
-		return err
-	}
+// Objects that are not referenced anymore, attributed to the node in the trash
+// that was the last to reference them. |node| is empty when the node is not
+// known, e.g. when the trash was emptied.
+type orphanGroup struct {
+	node  string
+	count int
+	size  int64
+}
 
+// Result of the scan done by gc.
+type gcReport struct {
+	// Objects not referenced by any node and older than the grace period.
+	orphans []string
+	size    int64
+	// Objects not referenced by any node but modified within the grace period.
+	recent     int
+	recentSize int64
+	grace      time.Duration
+	// Nodes referencing missing objects. Nothing is removed while there is any,
+	// unless forced, since the objects below a missing directory can't be
+	// tagged.
+	damaged []string
+	// The node that was last to reference each orphan, newest node first.
+	groups []*orphanGroup
+}
+
+// Finds the objects in |cas| not referenced by any node and not modified within
+// |grace|.
+func findOrphans(a DumbcasApplication, cas CasTable, nodes NodesTable, grace time.Duration) (*gcReport, error) {
+	cutoff := time.Now().Add(-grace)
 	entries := map[string]bool{}
-	for item := range c.cas.Enumerate() {
+	for item := range cas.Enumerate() {
 		if item.Error != nil {
 			// TODO(maruel): Leaks channel.
-			c.cas.SetFsckBit()
-			return fmt.Errorf("Failed enumerating the CAS table %s", item.Error)
+			cas.SetFsckBit()
+			return nil, fmt.Errorf("Failed enumerating the CAS table %s", item.Error)
 		}
 		entries[item.Item] = false
 	}
 	a.GetLog().Printf("Found %d entries", len(entries))
 
 	// Load all the nodes.
-	for item := range c.nodes.Enumerate() {
+	report := &gcReport{grace: grace}
+	for item := range nodes.Enumerate() {
 		if item.Error != nil {
 			// TODO(maruel): Leaks channel.
-			return item.Error
+			return nil, item.Error
 		}
-		f, err := c.nodes.Open(item.Item)
+		f, err := nodes.Open(item.Item)
 		if err != nil {
 			// TODO(maruel): Leaks channel.
-			c.cas.SetFsckBit()
-			return fmt.Errorf("Failed opening node %s: %s", item.Item, err)
+			cas.SetFsckBit()
+			return nil, fmt.Errorf("Failed opening node %s: %s", item.Item, err)
 		}
 		defer f.Close()
 		node := &Node{}
 		if err := loadReaderAsJson(f, node); err != nil {
 			// TODO(maruel): Leaks channel.
-			c.cas.SetFsckBit()
-			return fmt.Errorf("Failed opening node %s: %s", item.Item, err)
+			cas.SetFsckBit()
+			return nil, fmt.Errorf("Failed opening node %s: %s", item.Item, err)
 		}
 
-		entries[node.Entry] = true
-		entry, err := LoadEntry(c.cas, node.Entry)
+		if !cas.GetHashAlgorithm().IsValid(node.Entry) {
+			// TODO(maruel): Leaks channel.
+			cas.SetFsckBit()
+			return nil, fmt.Errorf("Node %s references an invalid entry %s", item.Item, node.Entry)
+		}
+		if err := TagRecurse(cas, entries, &Entry{Dir: node.Entry}); err != nil {
+			if _, ok := err.(*missingObjectError); !ok {
+				// TODO(maruel): Leaks channel.
+				cas.SetFsckBit()
+				return nil, fmt.Errorf("Failed loading node %s: %s", item.Item, err)
+			}
+			a.GetLog().Printf("Node %s is damaged: %s", item.Item, err)
+			if !strings.HasPrefix(filepath.ToSlash(item.Item), tagsName+"/") {
+				report.damaged = append(report.damaged, item.Item)
+			}
+		}
+	}
+	sort.Strings(report.damaged)
+	sizes := map[string]int64{}
+	for entry, tagged := range entries {
+		if tagged {
+			continue
+		}
+		info, err := cas.Stat(entry)
 		if err != nil {
-			return err
+			cas.SetFsckBit()
+			return nil, fmt.Errorf("Failed to stat %s: %s", entry, err)
+		}
+		if info.ModTime.After(cutoff) {
+			report.recent++
+			report.recentSize += info.Size
+			continue
 		}
-		TagRecurse(entries, entry)
+		report.orphans = append(report.orphans, entry)
+		report.size += info.Size
+		sizes[entry] = info.Size
 	}
+	sort.Strings(report.orphans)
+	a.GetLog().Printf("Found %d orphan; kept %d modified within %s", len(report.orphans), report.recent, grace)
+	report.groups = attributeOrphans(cas, nodes.GetTrash(), sizes)
+	return report, nil
+}
 
-	orphans := []string{}
-	for entry, tagged := range entries {
-		if !tagged {
-			orphans = append(orphans, entry)
+// Loads an entry referenced by a node in the trash. Unlike LoadEntry(), a
+// missing object is expected since it may have been collected already.
+func loadTrashedEntry(cas CasTable, hash string) *Entry {
+	f, err := cas.Open(hash)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	entry := &Entry{}
+	if loadReaderAsJson(f, entry) != nil {
+		return nil
+	}
+	return entry
+}
+
+// Adds to |refs| the objects referenced by |entry|. The directories that were
+// collected already are skipped.
+func referencedObjects(cas CasTable, refs map[string]bool, entry *Entry) {
+	if entry.Sha1 != "" {
+		refs[entry.Sha1] = true
+	}
+	for _, c := range entry.Chunks {
+		refs[c.Sha1] = true
+	}
+	if entry.Dir != "" {
+		if refs[entry.Dir] {
+			return
+		}
+		refs[entry.Dir] = true
+		if entry = loadTrashedEntry(cas, entry.Dir); entry == nil {
+			return
+		}
+	}
+	for _, i := range entry.Files {
+		referencedObjects(cas, refs, i)
+	}
+}
+
+// Attributes each orphan in |sizes| to the newest node in |trash| referencing
+// it.
+func attributeOrphans(cas CasTable, trash Trash, sizes map[string]int64) []*orphanGroup {
+	trashed := []*NodeInfo{}
+	for item := range trash.Enumerate() {
+		if item.Error != nil {
+			// The attribution is best effort.
+			continue
+		}
+		if strings.HasPrefix(filepath.ToSlash(item.Item), tagsName+"/") {
+			continue
+		}
+		info, err := parseNodeName(item.Item)
+		if err != nil {
+			continue
+		}
+		trashed = append(trashed, info)
+	}
+	sort.Sort(sort.Reverse(nodeInfosByTime(trashed)))
+
+	groups := []*orphanGroup{}
+	attributed := map[string]bool{}
+	for _, info := range trashed {
+		f, err := trash.Open(info.Name)
+		if err != nil {
+			continue
+		}
+		node := &Node{}
+		err = loadReaderAsJson(f, node)
+		f.Close()
+		if err != nil {
+			continue
+		}
+		refs := map[string]bool{node.Entry: true}
+		if entry := loadTrashedEntry(cas, node.Entry); entry != nil {
+			referencedObjects(cas, refs, entry)
+		}
+		group := &orphanGroup{node: info.Name}
+		for digest := range refs {
+			if size, ok := sizes[digest]; ok && !attributed[digest] {
+				attributed[digest] = true
+				group.count++
+				group.size += size
+			}
+		}
+		if group.count != 0 {
+			groups = append(groups, group)
+		}
+	}
+	unknown := &orphanGroup{}
+	for digest, size := range sizes {
+		if !attributed[digest] {
+			unknown.count++
+			unknown.size += size
+		}
+	}
+	if unknown.count != 0 {
+		groups = append(groups, unknown)
+	}
+	return groups
+}
+
+// Prints the number and size of the orphans and which nodes referenced them.
+func (r *gcReport) Print(w io.Writer, dryRun bool) {
+	verb := "Removed"
+	if dryRun {
+		verb = "Would remove"
+	}
+	fmt.Fprintf(w, "%s %d orphans (%.1fmb)\n", verb, len(r.orphans), toMb(r.size))
+	if r.recent != 0 {
+		fmt.Fprintf(w, "Kept %d orphans (%.1fmb) modified within %s\n", r.recent, toMb(r.recentSize), r.grace)
+	}
+	if len(r.groups) != 0 {
+		fmt.Fprintf(w, "Last referenced by:\n")
+	}
+	for _, g := range r.groups {
+		name := g.node
+		if name == "" {
+			name = "(unknown)"
 		}
+		fmt.Fprintf(w, "  %-50s %7d objects %9.1fmb\n", name, g.count, toMb(g.size))
+	}
+	if len(r.damaged) != 0 {
+		fmt.Fprintf(w, "Skipped the missing objects of %d damaged nodes; run fsck:\n", len(r.damaged))
+		for _, name := range r.damaged {
+			fmt.Fprintf(w, "  %s\n", name)
+		}
+	}
+}
+
+// Moves to the trash all the objects in |cas| not referenced by any node and
+// not modified within |grace|, then prints a report. Only prints the report
+// with |dryRun|. Nothing is removed when a node is damaged unless |force| is
+// set.
+func collectGarbage(a DumbcasApplication, cas CasTable, nodes NodesTable, grace time.Duration, dryRun, force bool) error {
+	report, err := findOrphans(a, cas, nodes, grace)
+	if err != nil {
+		return err
 	}
-	a.GetLog().Printf("Found %d orphan", len(orphans))
-	for _, orphan := range orphans {
-		if err := c.cas.Remove(orphan); err != nil {
-			c.cas.SetFsckBit()
-			return fmt.Errorf("Internal error while removing %s: %s", orphan, err)
+	if len(report.damaged) != 0 && !dryRun && !force {
+		report.Print(a.GetOut(), true)
+		return fmt.Errorf("%d nodes are damaged; run fsck first or use -force", len(report.damaged))
+	}
+	if !dryRun {
+		for _, orphan := range report.orphans {
+			if err := cas.Remove(orphan, &TrashRecord{Reason: TrashOrphan}); err != nil {
+				cas.SetFsckBit()
+				return fmt.Errorf("Internal error while removing %s: %s", orphan, err)
+			}
 		}
 	}
+	report.Print(a.GetOut(), dryRun)
 	return nil
 }
 
+func (c *gcRun) main(a DumbcasApplication) error {
+	if err := c.Parse(a, false); err != nil {
+		return err
+	}
+	defer c.Close()
+	return collectGarbage(a, c.cas, c.nodes, c.grace, c.dryRun, c.force)
+}
+
 func (c *gcRun) Run(a subcommands.Application, args []string) int {
 	if len(args) != 0 {
 		fmt.Fprintf(a.GetErr(), "%s: Unsupported arguments.\n", a.GetName())
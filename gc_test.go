@@ -10,8 +10,13 @@ limitations under the License. */
 package main
 
 import (
+	"bytes"
+	"os"
+	"path"
 	"sort"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestGcEmpty(t *testing.T) {
@@ -52,7 +57,8 @@ func TestGcKept(t *testing.T) {
 func TestGcTrim(t *testing.T) {
 	t.Parallel()
 	f := makeDumbcasAppMock(t)
-	args := []string{"gc", "-root=\\test_gc_trim"}
+	// The objects were just created so the grace period must be disabled.
+	args := []string{"gc", "-root=\\test_gc_trim", "-grace=0"}
 	f.Run(args, 0) // Instantiate f.cas and f.nodes
 
 	// Create a tree of stuff.
@@ -77,11 +83,16 @@ func TestGcTrim(t *testing.T) {
 	f.Assertf(len(n2) == 3, "Unexpected items: %q", n2)
 
 	// Remove the first node and gc.
-	err := f.nodes.Remove(n1[0])
+	err := f.nodes.Remove(n1[0], nil)
 	f.Assertf(err == nil, "Unexpected: %s", err)
 	f.Run(args, 0)
 	i3 := EnumerateCasAsList(f.TB, f.cas)
 	f.Assertf(len(i3) == 5, "Unexpected items: %d", len(i3))
+	journal, err := f.cas.GetTrash().Journal()
+	f.Assertf(err == nil && len(journal) == 2, "Unexpected journal: %v %s", journal, err)
+	for _, r := range journal {
+		f.Assertf(r.Reason == TrashOrphan && r.Command != "", "Unexpected record: %v", r)
+	}
 	n3 := EnumerateNodesAsList(f.TB, f.nodes)
 	f.Assertf(len(n3) == 2, "Unexpected items: %q", n3)
 
@@ -93,3 +104,145 @@ func TestGcTrim(t *testing.T) {
 	sort.Strings(rest)
 	f.Assertf(Equals(i3, rest), "Unexpected difference: %q != %q", i3, rest)
 }
+
+func TestGcGrace(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	f.MakeCasTable("")
+	f.LoadNodesTable("", f.cas)
+	cas := f.cas.(*fakeCasTable)
+
+	_, nodeName, _ := archiveData(f.TB, f.cas, f.nodes, map[string]string{"file1": "content1"})
+	items := EnumerateCasAsList(f.TB, f.cas)
+	f.Assertf(f.nodes.Remove(nodeName, nil) == nil, "Failed to remove %s", nodeName)
+	f.Assertf(f.nodes.Remove(path.Join(tagsName, "fictious"), nil) == nil, "Failed to remove the tag")
+
+	// The orphans were modified recently.
+	f.Run([]string{"gc", "-root=\\test_gc_grace"}, 0)
+	i := EnumerateCasAsList(f.TB, f.cas)
+	f.Assertf(Equals(i, items), "Unexpected items: %q", i)
+
+	// Once an orphan is old enough, it is collected.
+	cas.modTimes[sha1String("content1")] = time.Now().Add(-2 * defaultGcGrace)
+	f.Run([]string{"gc", "-root=\\test_gc_grace"}, 0)
+	i = EnumerateCasAsList(f.TB, f.cas)
+	expected := Sub(items, []string{sha1String("content1")})
+	f.Assertf(Equals(i, expected), "Unexpected items: %q", i)
+
+	// Adding an old object again marks it as recent.
+	f.Assertf(len(expected) == 1, "Unexpected items: %q", expected)
+	cas.modTimes[expected[0]] = time.Time{}
+	err := cas.AddEntry(bytes.NewReader(cas.entries[expected[0]]), expected[0])
+	f.Assertf(os.IsExist(err), "Unexpected error: %s", err)
+	f.Run([]string{"gc", "-root=\\test_gc_grace"}, 0)
+	i = EnumerateCasAsList(f.TB, f.cas)
+	f.Assertf(Equals(i, expected), "Unexpected items: %q", i)
+}
+
+func TestGcDryRun(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	f.MakeCasTable("")
+	f.LoadNodesTable("", f.cas)
+
+	archiveData(f.TB, f.cas, f.nodes, map[string]string{
+		"file1":           "content1",
+		"dir1/dir2/file2": "content2",
+	})
+	_, nodeName, entry2 := archiveData(f.TB, f.cas, f.nodes, map[string]string{
+		"file1":      "content1",
+		"dir3/file3": "content3",
+	})
+	f.Assertf(f.nodes.Remove(nodeName, nil) == nil, "Failed to remove %s", nodeName)
+	// The tag is a copy of the node just removed.
+	f.Assertf(f.nodes.Remove(path.Join(tagsName, "fictious"), nil) == nil, "Failed to remove the tag")
+	// An orphan no node ever referenced.
+	unknown, err := AddBytes(f.cas, []byte("stray"))
+	f.Assertf(err == nil, "Unexpected error: %s", err)
+	items := EnumerateCasAsList(f.TB, f.cas)
+
+	f.Run([]string{"gc", "-root=\\test_gc_dry_run", "-grace=0", "-dry-run"}, 0)
+	f.CheckBuffer(true, false)
+	i := EnumerateCasAsList(f.TB, f.cas)
+	f.Assertf(Equals(i, items), "Unexpected items: %q", i)
+
+	report, err := findOrphans(f, f.cas, f.nodes, 0)
+	f.Assertf(err == nil, "Unexpected error: %s", err)
+	expected := []string{entry2, sha1String("content3"), unknown}
+	sort.Strings(expected)
+	f.Assertf(Equals(report.orphans, expected), "Unexpected orphans: %q", report.orphans)
+	f.Assertf(report.size == int64(len(f.cas.(*fakeCasTable).entries[entry2])+8+5), "Unexpected size %d", report.size)
+	f.Assertf(len(report.groups) == 2, "Unexpected groups: %v", report.groups)
+	g := report.groups[0]
+	f.Assertf(g.node == nodeName && g.count == 2, "Unexpected group %v", g)
+	g = report.groups[1]
+	f.Assertf(g.node == "" && g.count == 1 && g.size == 5, "Unexpected group %v", g)
+
+	out := &bytes.Buffer{}
+	report.Print(out, true)
+	f.Assertf(strings.HasPrefix(out.String(), "Would remove 3 orphans"), "Unexpected report:\n%s", out)
+	f.Assertf(strings.Contains(out.String(), nodeName), "Unexpected report:\n%s", out)
+
+	// The orphans are removed without -dry-run.
+	f.Run([]string{"gc", "-root=\\test_gc_dry_run", "-grace=0"}, 0)
+	f.CheckBuffer(true, false)
+	i = EnumerateCasAsList(f.TB, f.cas)
+	f.Assertf(Equals(i, Sub(items, expected)), "Unexpected items: %q", i)
+}
+
+func TestGcDamaged(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	f.MakeCasTable("")
+	f.LoadNodesTable("", f.cas)
+
+	_, damaged, entry1 := archiveData(f.TB, f.cas, f.nodes, map[string]string{
+		"file1": "content1",
+	})
+	archiveData(f.TB, f.cas, f.nodes, map[string]string{
+		"file2":     "content2",
+		"dir3/file": "content3",
+	})
+	f.Assertf(f.nodes.Remove(path.Join(tagsName, "fictious"), nil) == nil, "Failed to remove the tag")
+	// The root directory of the first node is lost; gc still completes and keeps
+	// the objects of the other node.
+	delete(f.cas.(*fakeCasTable).entries, entry1)
+	items := EnumerateCasAsList(f.TB, f.cas)
+	report, err := findOrphans(f, f.cas, f.nodes, 0)
+	f.Assertf(err == nil, "Unexpected error: %s", err)
+	f.Assertf(Equals(report.damaged, []string{damaged}), "Unexpected damaged nodes: %q", report.damaged)
+	f.Assertf(Equals(report.orphans, []string{sha1String("content1")}), "Unexpected orphans: %q", report.orphans)
+
+	// Loading the root directory flagged the CAS table for fsck.
+	f.Assertf(f.cas.GetFsckBit(), "Expected fsck bit")
+	f.cas.ClearFsckBit()
+	// Nothing is removed while a node is damaged unless forced.
+	f.Run([]string{"gc", "-root=\\test_gc_damaged", "-grace=0"}, 1)
+	f.CheckBuffer(true, true)
+	i := EnumerateCasAsList(f.TB, f.cas)
+	f.Assertf(Equals(i, items), "Unexpected items: %q", i)
+	f.cas.ClearFsckBit()
+	f.Run([]string{"gc", "-root=\\test_gc_damaged", "-grace=0", "-force"}, 0)
+	f.CheckBuffer(true, false)
+	i = EnumerateCasAsList(f.TB, f.cas)
+	expected := Sub(items, []string{sha1String("content1")})
+	f.Assertf(Equals(i, expected), "Unexpected items: %q", i)
+}
+
+func TestGcUnreadableDir(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	f.MakeCasTable("")
+	f.LoadNodesTable("", f.cas)
+
+	_, _, entry := archiveData(f.TB, f.cas, f.nodes, map[string]string{
+		"file1": "content1",
+	})
+	// The root directory is present but can't be read; its files must not be
+	// collected.
+	f.cas.(*fakeCasTable).entries[entry] = []byte("corrupted")
+	report, err := findOrphans(f, f.cas, f.nodes, 0)
+	f.Assertf(err != nil, "Expected error")
+	f.Assertf(report == nil, "Unexpected report")
+	f.Assertf(f.cas.GetFsckBit(), "Expected fsck bit")
+}
@@ -0,0 +1,118 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"golang.org/x/crypto/blake2b"
+	"hash"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Algorithm used by repositories that do not record one. These were all
+// created before the algorithm became configurable.
+const legacyHashName = "sha1"
+
+// Algorithm used when creating a new repository.
+const defaultHashName = "sha256"
+
+// HashAlgorithm is a digest algorithm that can be used to address the content
+// of a CasTable. The digests are always stored as lower case hex strings.
+type HashAlgorithm struct {
+	Name string
+	// Size of the digest in bytes.
+	Size      int
+	new       func() hash.Hash
+	validHash *regexp.Regexp
+}
+
+var hashAlgorithms = []*HashAlgorithm{
+	makeHashAlgorithm("sha1", sha1.Size, sha1.New),
+	makeHashAlgorithm("sha256", sha256.Size, sha256.New),
+	makeHashAlgorithm("blake2b-256", blake2b.Size256, newBlake2b256),
+}
+
+func makeHashAlgorithm(name string, size int, new func() hash.Hash) *HashAlgorithm {
+	return &HashAlgorithm{
+		name,
+		size,
+		new,
+		regexp.MustCompile(fmt.Sprintf("^([a-f0-9]{%d})$", size*2)),
+	}
+}
+
+func newBlake2b256() hash.Hash {
+	// New256() only fails when a key longer than 64 bytes is used.
+	h, _ := blake2b.New256(nil)
+	return h
+}
+
+// Returns the names of all the supported algorithms.
+func hashAlgorithmNames() []string {
+	out := make([]string, len(hashAlgorithms))
+	for i, h := range hashAlgorithms {
+		out[i] = h.Name
+	}
+	return out
+}
+
+// GetHashAlgorithm returns the algorithm named |name|.
+func GetHashAlgorithm(name string) (*HashAlgorithm, error) {
+	for _, h := range hashAlgorithms {
+		if h.Name == name {
+			return h, nil
+		}
+	}
+	return nil, fmt.Errorf("Unknown hash algorithm \"%s\"; supported are %s", name, strings.Join(hashAlgorithmNames(), ", "))
+}
+
+// Returns a new hash.Hash instance to calculate a digest incrementally.
+func (h *HashAlgorithm) New() hash.Hash {
+	return h.new()
+}
+
+// Returns the length of the digest once hex encoded.
+func (h *HashAlgorithm) HexLength() int {
+	return h.Size * 2
+}
+
+// Returns true if |digest| is a well formed digest for this algorithm.
+func (h *HashAlgorithm) IsValid(digest string) bool {
+	return h.validHash.MatchString(digest)
+}
+
+func (h *HashAlgorithm) HashReader(f io.Reader) (string, error) {
+	d := h.New()
+	if _, err := io.Copy(d, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(d.Sum(nil)), nil
+}
+
+func (h *HashAlgorithm) HashFilePath(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return h.HashReader(f)
+}
+
+func (h *HashAlgorithm) HashBytes(content []byte) string {
+	d := h.New()
+	d.Write(content)
+	return hex.EncodeToString(d.Sum(nil))
+}
@@ -0,0 +1,42 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"bytes"
+	"github.com/maruel/subcommands/subcommandstest"
+	"testing"
+)
+
+func TestHashAlgorithms(t *testing.T) {
+	t.Parallel()
+	tb := subcommandstest.MakeTB(t)
+	expected := map[string]string{
+		"sha1":        "a9993e364706816aba3e25717850c26c9cd0d89d",
+		"sha256":      "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad",
+		"blake2b-256": "bddd813c634239723171ef3fee98579b94964e3bb1cb3e427262c8c068d52319",
+	}
+	tb.Assertf(len(hashAlgorithms) == len(expected), "Unexpected algorithms: %s", hashAlgorithmNames())
+	for name, digest := range expected {
+		h, err := GetHashAlgorithm(name)
+		tb.Assertf(err == nil, "Unexpected error: %s", err)
+		tb.Assertf(h.HexLength() == len(digest), "%s: Unexpected length %d", name, h.HexLength())
+		actual := h.HashBytes([]byte("abc"))
+		tb.Assertf(actual == digest, "%s: %s != %s", name, actual, digest)
+		actual, err = h.HashReader(bytes.NewBufferString("abc"))
+		tb.Assertf(err == nil, "Unexpected error: %s", err)
+		tb.Assertf(actual == digest, "%s: %s != %s", name, actual, digest)
+		tb.Assertf(h.IsValid(digest), "%s: %s is invalid", name, digest)
+		tb.Assertf(!h.IsValid(digest[1:]), "%s: %s is valid", name, digest[1:])
+		tb.Assertf(!h.IsValid("X"+digest[1:]), "%s: X%s is valid", name, digest[1:])
+	}
+	_, err := GetHashAlgorithm("md5")
+	tb.Assertf(err != nil, "Unexpected success")
+}
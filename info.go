@@ -31,14 +31,23 @@ type infoRun struct {
 	CommonFlags
 }
 
-func printEntry(out io.Writer, entry *Entry, relPath string) (count int) {
-	if entry.Sha1 != "" {
+func printEntry(out io.Writer, cas CasTable, entry *Entry, relPath string) (count int, err error) {
+	if entry.Chunks != nil {
+		fmt.Fprintf(out, " %s(%d in %d chunks)\n", relPath, entry.Size, len(entry.Chunks))
+		count += 1
+	} else if entry.Sha1 != "" {
 		fmt.Fprintf(out, " %s(%d)\n", relPath, entry.Size)
 		count += 1
 	}
-	for name, child := range entry.Files {
-		c := printEntry(out, child, filepath.Join(relPath, name))
+	if entry, err = entry.loadDir(cas); err != nil {
+		return
+	}
+	for _, name := range entry.SortedFiles() {
+		c, err := printEntry(out, cas, entry.Files[name], filepath.Join(relPath, name))
 		count += c
+		if err != nil {
+			return count, err
+		}
 	}
 	return
 }
@@ -47,6 +56,7 @@ func (c *infoRun) main(a DumbcasApplication, nodeArg string) error {
 	if err := c.Parse(a, true); err != nil {
 		return err
 	}
+	defer c.Close()
 
 	// Load the Node and process it.
 	f, err := c.nodes.Open(nodeArg)
@@ -64,9 +74,10 @@ func (c *infoRun) main(a DumbcasApplication, nodeArg string) error {
 		return err
 	}
 
-	count := printEntry(a.GetOut(), entry, "")
+	node.Print(a.GetOut())
+	count, err := printEntry(a.GetOut(), c.cas, entry, "")
 	fmt.Fprintf(a.GetOut(), "Total %d\n", count)
-	return nil
+	return err
 }
 
 func (c *infoRun) Run(a subcommands.Application, args []string) int {
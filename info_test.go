@@ -34,7 +34,7 @@ func TestInfo(t *testing.T) {
 	args := []string{"info", "-root=\\test_archive", nodeName}
 	f.Run(args, 0)
 
-	expected := " dir1/bar(4)\n dir1/dir2/dir3/foo(4)\n dir1/dir2/file2(8)\n file1(8)\n x(2)\nTotal 5\n"
+	expected := "Comment: useful comment\n dir1/bar(4)\n dir1/dir2/dir3/foo(4)\n dir1/dir2/file2(8)\n file1(8)\n x(2)\nTotal 5\n"
 	f.CheckOut(expected)
 	f.CheckBuffer(false, false)
 }
@@ -0,0 +1,60 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"fmt"
+	"github.com/maruel/subcommands"
+	"strings"
+)
+
+var cmdInit = &subcommands.Command{
+	UsageLine: "init",
+	ShortDesc: "creates a new dumbcas repository",
+	LongDesc:  "Creates the directory layout and config.json of a new repository in -root. A repository created by an older version without config.json is adopted as-is.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &initRun{}
+		c.Init()
+		c.Flags.StringVar(&c.hash, "hash", "", "Hash algorithm to address the content; one of "+strings.Join(hashAlgorithmNames(), ", ")+". Defaults to "+defaultHashName+".")
+		c.Flags.IntVar(&c.prefixLength, "prefix", 0, fmt.Sprintf("Number of hex characters used for the CAS subdirectories, between 1 and 4. Defaults to %d.", legacyPrefixLength))
+		return c
+	},
+}
+
+type initRun struct {
+	CommonFlags
+	hash         string
+	prefixLength int
+}
+
+func (c *initRun) main(a DumbcasApplication) error {
+	if err := c.ParseRoot(); err != nil {
+		return err
+	}
+	config, err := a.InitRepository(c.Root, c.hash, c.prefixLength)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(a.GetOut(), "Initialized repository %s in %s using %s\n", config.UUID, c.Root, config.Hash)
+	return nil
+}
+
+func (c *initRun) Run(a subcommands.Application, args []string) int {
+	if len(args) != 0 {
+		fmt.Fprintf(a.GetErr(), "%s: Unsupported arguments.\n", a.GetName())
+		return 1
+	}
+	d := a.(DumbcasApplication)
+	if err := c.main(d); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
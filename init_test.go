@@ -0,0 +1,60 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func (a *DumbcasAppMock) InitRepository(rootDir string, hashName string, prefixLength int) (*RepositoryConfig, error) {
+	if a.cas != nil {
+		return nil, fmt.Errorf("%s is already a dumbcas repository", rootDir)
+	}
+	if hashName == "" {
+		hashName = defaultHashName
+	}
+	if prefixLength == 0 {
+		prefixLength = legacyPrefixLength
+	}
+	config, err := makeRepositoryConfig(hashName, prefixLength)
+	if err != nil {
+		return nil, err
+	}
+	cas := makeFakeCasTable(a.TB)
+	cas.hash, _ = GetHashAlgorithm(hashName)
+	a.cas = cas
+	return config, nil
+}
+
+func TestInit(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	args := []string{"init", "-root=\\test_init", "-hash=blake2b-256"}
+	f.Run(args, 0)
+	f.CheckBuffer(true, false)
+	f.Assertf(f.cas.GetHashAlgorithm().Name == "blake2b-256", "Unexpected algorithm %s", f.cas.GetHashAlgorithm().Name)
+
+	// Can't be initialized twice.
+	f.Run(args, 1)
+	f.CheckBuffer(false, true)
+}
+
+func TestInitInvalid(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	f.Run([]string{"init", "-root=\\test_init", "-hash=md5"}, 1)
+	f.CheckBuffer(false, true)
+	f.Run([]string{"init", "-root=\\test_init", "-prefix=5"}, 1)
+	f.CheckBuffer(false, true)
+	f.Run([]string{"init", "-root=\\test_init", "-prefix=2"}, 0)
+	f.CheckBuffer(true, false)
+	f.Assertf(f.cas.GetHashAlgorithm().Name == defaultHashName, "Unexpected algorithm %s", f.cas.GetHashAlgorithm().Name)
+}
@@ -0,0 +1,161 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The locks are stored in a separate directory at the root of the repository.
+// Each process holding a lock has its own file in it.
+const locksName = "locks"
+
+// How often a conflicting lock is checked again while waiting for it.
+const lockPollInterval = time.Second
+
+// A lock held on a repository. Multiple processes can hold a shared lock
+// concurrently, e.g. archive and web, but an exclusive lock, e.g. for gc, can
+// only be held by a single process.
+type Lock interface {
+	Release() error
+}
+
+// Content of a lock file.
+type lockInfo struct {
+	Hostname  string    `json:"hostname"`
+	PID       int       `json:"pid"`
+	Exclusive bool      `json:"exclusive"`
+	Created   time.Time `json:"created"`
+}
+
+func (l *lockInfo) String() string {
+	kind := "shared"
+	if l.Exclusive {
+		kind = "exclusive"
+	}
+	return fmt.Sprintf("%s lock held by pid %d on %s since %s", kind, l.PID, l.Hostname, l.Created.Format("2006-01-02 15:04:05"))
+}
+
+type localLock struct {
+	path string
+}
+
+func (l *localLock) Release() error {
+	return os.Remove(l.path)
+}
+
+// A repository that isn't locked: a client that can't modify a remote
+// repository reads it like the pages served by web.
+type remoteLock struct{}
+
+func (remoteLock) Release() error {
+	return nil
+}
+
+// Locks the repository at |rootDir|, waiting up to |wait| for the conflicting
+// locks to be released.
+func lockLocalRepository(rootDir string, exclusive bool, wait time.Duration) (Lock, error) {
+	hostname, err := shortHostname()
+	if err != nil {
+		return nil, err
+	}
+	locksDir := filepath.Join(rootDir, locksName)
+	if err := os.MkdirAll(locksDir, 0750); err != nil {
+		return nil, fmt.Errorf("Failed to create %s: %s", locksDir, err)
+	}
+	info := &lockInfo{hostname, os.Getpid(), exclusive, time.Now().UTC()}
+	return waitForLock(wait, func() (Lock, *lockInfo, error) {
+		if lock, conflict, err := tryLock(locksDir, info); lock != nil {
+			return lock, nil, nil
+		} else {
+			return nil, conflict, err
+		}
+	})
+}
+
+// Calls |try| until it doesn't return a conflicting lock, for up to |wait|.
+func waitForLock(wait time.Duration, try func() (Lock, *lockInfo, error)) (Lock, error) {
+	deadline := time.Now().Add(wait)
+	for {
+		lock, conflict, err := try()
+		if err != nil || conflict == nil {
+			return lock, err
+		}
+		remaining := deadline.Sub(time.Now())
+		if remaining <= 0 || IsInterrupted() {
+			return nil, fmt.Errorf("The repository is locked: %s", conflict)
+		}
+		if remaining > lockPollInterval {
+			remaining = lockPollInterval
+		}
+		time.Sleep(remaining)
+	}
+}
+
+// Creates the lock file then looks for conflicting locks. On conflict, the
+// lock file is removed and the conflicting lock is returned. Since every
+// process creates its file before looking at the others, two processes racing
+// for conflicting locks can both back off but can't both succeed.
+func tryLock(locksDir string, info *lockInfo) (*localLock, *lockInfo, error) {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to marshall internal state: %s", err)
+	}
+	name := fmt.Sprintf("%s_%d_%d", info.Hostname, info.PID, time.Now().UnixNano())
+	// Write to a temporary name first so other processes never read a partial
+	// lock file.
+	tempPath := filepath.Join(locksDir, name+".tmp")
+	if err := ioutil.WriteFile(tempPath, data, 0640); err != nil {
+		os.Remove(tempPath)
+		return nil, nil, fmt.Errorf("Failed to write %s: %s", tempPath, err)
+	}
+	lock := &localLock{filepath.Join(locksDir, name+".lock")}
+	if err := os.Rename(tempPath, lock.path); err != nil {
+		os.Remove(tempPath)
+		return nil, nil, fmt.Errorf("Failed to create %s: %s", lock.path, err)
+	}
+
+	names, err := readDirNames(locksDir)
+	if err != nil {
+		lock.Release()
+		return nil, nil, err
+	}
+	for _, other := range names {
+		otherPath := filepath.Join(locksDir, other)
+		if !strings.HasSuffix(other, ".lock") || otherPath == lock.path {
+			continue
+		}
+		otherInfo := &lockInfo{}
+		if err := loadFileAsJson(otherPath, otherInfo); err != nil {
+			if !isFile(otherPath) {
+				// Released in the meantime.
+				continue
+			}
+			lock.Release()
+			return nil, nil, fmt.Errorf("Invalid lock file %s: %s", otherPath, err)
+		}
+		if otherInfo.Hostname == info.Hostname && !processExists(otherInfo.PID) {
+			// The process was killed before releasing its lock.
+			os.Remove(otherPath)
+			continue
+		}
+		if info.Exclusive || otherInfo.Exclusive {
+			lock.Release()
+			return nil, otherInfo, nil
+		}
+	}
+	return lock, nil, nil
+}
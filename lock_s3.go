@@ -0,0 +1,103 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// A lock held on a repository stored in S3. Like the local locks, each process
+// holding a lock has its own object under "locks/". S3 lists an object as soon
+// as it is written, so the same protocol applies.
+type s3Lock struct {
+	client *s3Client
+	key    string
+}
+
+func (l *s3Lock) Release() error {
+	return l.client.delete(l.key)
+}
+
+// Locks the repository of |cas|, waiting up to |wait| for the conflicting
+// locks to be released.
+func lockS3Repository(cas CasTable, exclusive bool, wait time.Duration) (Lock, error) {
+	t, ok := cas.(*s3CasTable)
+	if !ok {
+		return nil, fmt.Errorf("Internal error: %T is not an S3 CasTable", cas)
+	}
+	hostname, err := shortHostname()
+	if err != nil {
+		return nil, err
+	}
+	info := &lockInfo{hostname, os.Getpid(), exclusive, time.Now().UTC()}
+	return waitForLock(wait, func() (Lock, *lockInfo, error) {
+		if lock, conflict, err := tryS3Lock(t.client, info); lock != nil {
+			return lock, nil, nil
+		} else {
+			return nil, conflict, err
+		}
+	})
+}
+
+// Creates the lock object then looks for conflicting locks. On conflict, the
+// lock object is removed and the conflicting lock is returned.
+func tryS3Lock(client *s3Client, info *lockInfo) (*s3Lock, *lockInfo, error) {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to marshall internal state: %s", err)
+	}
+	lock := &s3Lock{client, fmt.Sprintf("%s/%s_%d_%d.lock", locksName, info.Hostname, info.PID, time.Now().UnixNano())}
+	// The write is conditional so another lock is never overwritten.
+	if err := client.putBytes(lock.key, data, true); err != nil {
+		return nil, nil, fmt.Errorf("Failed to create %s: %s", lock.key, err)
+	}
+	var conflict *lockInfo
+	err = client.list(locksName+"/", "", func(page *s3ListResult) error {
+		for _, o := range page.Contents {
+			if conflict != nil || o.Key == lock.key || !strings.HasSuffix(o.Key, ".lock") {
+				continue
+			}
+			data, err := client.get(o.Key)
+			if os.IsNotExist(err) {
+				// Released in the meantime.
+				continue
+			} else if err != nil {
+				return err
+			}
+			other := &lockInfo{}
+			if err := json.Unmarshal(data, other); err != nil {
+				return fmt.Errorf("Invalid lock %s: %s", o.Key, err)
+			}
+			if other.Hostname == info.Hostname && !processExists(other.PID) {
+				// The process was killed before releasing its lock.
+				client.delete(o.Key)
+				continue
+			}
+			if info.Exclusive || other.Exclusive {
+				conflict = other
+			}
+		}
+		return nil
+	})
+	if err == nil && IsInterrupted() {
+		// The listing stopped early.
+		err = errors.New("Interrupted")
+	}
+	if err != nil || conflict != nil {
+		lock.Release()
+		return nil, conflict, err
+	}
+	return lock, nil, nil
+}
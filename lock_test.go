@@ -0,0 +1,218 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/maruel/subcommands/subcommandstest"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A lock that only lives in the DumbcasAppMock.
+type fakeLock struct {
+	a         *DumbcasAppMock
+	exclusive bool
+}
+
+func (l *fakeLock) Release() error {
+	delete(l.a.locks, l)
+	return nil
+}
+
+func (a *DumbcasAppMock) LockRepository(rootDir string, cas CasTable, exclusive bool, wait time.Duration) (Lock, error) {
+	if a.locks == nil {
+		a.locks = map[*fakeLock]bool{}
+	}
+	for l := range a.locks {
+		if exclusive || l.exclusive {
+			return nil, fmt.Errorf("The repository is locked")
+		}
+	}
+	l := &fakeLock{a, exclusive}
+	a.locks[l] = true
+	return l, nil
+}
+
+func TestLock(t *testing.T) {
+	t.Parallel()
+	tb := subcommandstest.MakeTB(t)
+	tempData := makeTempDir(tb, "lock")
+	defer removeTempDir(tempData)
+
+	shared1, err := lockLocalRepository(tempData, false, 0)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	shared2, err := lockLocalRepository(tempData, false, 0)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	_, err = lockLocalRepository(tempData, true, 0)
+	tb.Assertf(err != nil, "Unexpected success")
+
+	tb.Assertf(shared1.Release() == nil, "Failed to release")
+	// Waits for the lock up to the timeout.
+	start := time.Now()
+	_, err = lockLocalRepository(tempData, true, 50*time.Millisecond)
+	tb.Assertf(err != nil, "Unexpected success")
+	tb.Assertf(time.Since(start) >= 50*time.Millisecond, "Didn't wait")
+	tb.Assertf(shared2.Release() == nil, "Failed to release")
+
+	exclusive, err := lockLocalRepository(tempData, true, 0)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	_, err = lockLocalRepository(tempData, false, 0)
+	tb.Assertf(err != nil, "Unexpected success")
+	tb.Assertf(exclusive.Release() == nil, "Failed to release")
+	names, err := readDirNames(filepath.Join(tempData, locksName))
+	tb.Assertf(err == nil && len(names) == 0, "Unexpected lock files: %q %s", names, err)
+}
+
+// Writes a lock file as if it was held by another process.
+func writeLockFile(t *subcommandstest.TB, rootDir string, info *lockInfo) {
+	data, err := json.Marshal(info)
+	t.Assertf(err == nil, "Unexpected error: %s", err)
+	err = os.MkdirAll(filepath.Join(rootDir, locksName), 0750)
+	t.Assertf(err == nil, "Unexpected error: %s", err)
+	name := fmt.Sprintf("%s_%d_1.lock", info.Hostname, info.PID)
+	err = ioutil.WriteFile(filepath.Join(rootDir, locksName, name), data, 0640)
+	t.Assertf(err == nil, "Unexpected error: %s", err)
+}
+
+func TestLockStale(t *testing.T) {
+	t.Parallel()
+	tb := subcommandstest.MakeTB(t)
+	tempData := makeTempDir(tb, "lock_stale")
+	defer removeTempDir(tempData)
+
+	hostname, err := shortHostname()
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	// A PID that can't be running.
+	writeLockFile(tb, tempData, &lockInfo{hostname, 1 << 30, true, time.Now()})
+	lock, err := lockLocalRepository(tempData, true, 0)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	tb.Assertf(lock.Release() == nil, "Failed to release")
+	names, err := readDirNames(filepath.Join(tempData, locksName))
+	tb.Assertf(err == nil && len(names) == 0, "Unexpected lock files: %q %s", names, err)
+
+	// The lock of another host can't be verified so it is never stale.
+	writeLockFile(tb, tempData, &lockInfo{hostname + "_other", 1 << 30, true, time.Now()})
+	_, err = lockLocalRepository(tempData, false, 0)
+	tb.Assertf(err != nil, "Unexpected success")
+}
+
+func TestLockCommands(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	f.Run([]string{"ls", "-root=\\test_lock"}, 0)
+	f.CheckBuffer(false, false)
+	f.Assertf(len(f.locks) == 0, "The lock wasn't released")
+
+	lock, err := f.LockRepository("", nil, false, 0)
+	f.Assertf(err == nil, "Unexpected error: %s", err)
+	f.Run([]string{"ls", "-root=\\test_lock"}, 0)
+	f.CheckBuffer(false, false)
+	f.Run([]string{"gc", "-root=\\test_lock"}, 1)
+	f.CheckBuffer(false, true)
+	f.Run([]string{"fsck", "-root=\\test_lock"}, 1)
+	f.CheckBuffer(false, true)
+	lock.Release()
+
+	f.Run([]string{"gc", "-root=\\test_lock"}, 0)
+	f.CheckBuffer(true, false)
+	f.Assertf(len(f.locks) == 0, "The lock wasn't released")
+}
+
+func TestLockRemoteRepository(t *testing.T) {
+	t.Parallel()
+	tb := subcommandstest.MakeTB(t)
+	tempData := makeTempDir(tb, "lock_remote")
+	defer removeTempDir(tempData)
+	server := serveLocalRepository(tb, tempData, true)
+	defer server.Close()
+	d := &dumbapp{application, tb.GetLog()}
+	cas1, err := makeHttpCasTable(server.URL, testToken)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	cas2, err := makeHttpCasTable(server.URL, testToken)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+
+	// The server locks the repository on behalf of its clients.
+	shared, err := d.LockRepository(server.URL, cas1, false, 0)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	_, err = lockLocalRepository(tempData, true, 0)
+	tb.Assertf(err != nil, "Unexpected success")
+	_, err = d.LockRepository(server.URL, cas2, true, 0)
+	tb.Assertf(err != nil, "Unexpected success")
+	tb.Assertf(shared.Release() == nil, "Failed to release")
+
+	// Only the client holding the repository exclusively can modify it.
+	exclusive, err := d.LockRepository(server.URL, cas2, true, 0)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	_, err = lockLocalRepository(tempData, false, 0)
+	tb.Assertf(err != nil, "Unexpected success")
+	_, err = cas1.AddStream(bytes.NewBufferString("content1"))
+	tb.Assertf(err != nil, "Unexpected success")
+	_, err = cas2.AddStream(bytes.NewBufferString("content1"))
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	tb.Assertf(exclusive.Release() == nil, "Failed to release")
+
+	// The server doesn't hold a lock between the requests.
+	local, err := lockLocalRepository(tempData, true, 0)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	local.Release()
+
+	// A client without the token can't lock the repository but can read it.
+	cas3, err := makeHttpCasTable(server.URL, "")
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	_, err = d.LockRepository(server.URL, cas3, true, 0)
+	tb.Assertf(err != nil, "Unexpected success")
+	lock, err := d.LockRepository(server.URL, cas3, false, 0)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	tb.Assertf(lock.Release() == nil, "Failed to release")
+}
+
+func TestLockS3Repository(t *testing.T) {
+	t.Parallel()
+	tb := subcommandstest.MakeTB(t)
+	server := makeFakeS3()
+	defer server.Close()
+	_, err := initS3Repository("s3://bucket/backups", server.config(), "", 0)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	cas, err := makeS3CasTable("s3://bucket/backups", server.config())
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+
+	shared1, err := lockS3Repository(cas, false, 0)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	shared2, err := lockS3Repository(cas, false, 0)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	_, err = lockS3Repository(cas, true, 0)
+	tb.Assertf(err != nil, "Unexpected success")
+	tb.Assertf(shared1.Release() == nil && shared2.Release() == nil, "Failed to release")
+
+	exclusive, err := lockS3Repository(cas, true, 0)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	_, err = lockS3Repository(cas, false, 0)
+	tb.Assertf(err != nil, "Unexpected success")
+	tb.Assertf(exclusive.Release() == nil, "Failed to release")
+	tb.Assertf(Equals(server.keys(), []string{"backups/config.json"}), "Unexpected keys %q", server.keys())
+
+	// The lock of a killed process on this host is removed.
+	hostname, err := shortHostname()
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	data, err := json.Marshal(&lockInfo{hostname, 1 << 30, true, time.Now()})
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	client := cas.(*s3CasTable).client
+	tb.Assertf(client.putBytes(locksName+"/stale.lock", data, false) == nil, "Failed to put")
+	lock, err := lockS3Repository(cas, true, 0)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	tb.Assertf(lock.Release() == nil, "Failed to release")
+	tb.Assertf(Equals(server.keys(), []string{"backups/config.json"}), "Unexpected keys %q", server.keys())
+}
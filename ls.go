@@ -0,0 +1,288 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/maruel/subcommands"
+	"log"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+var cmdLs = &subcommands.Command{
+	UsageLine: "ls",
+	ShortDesc: "lists the nodes",
+	LongDesc:  "Lists the nodes with their timestamp, host, tag, comment, number of files and total size.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &lsRun{}
+		c.Init()
+		c.Flags.StringVar(&c.tag, "tag", "", "Only list the nodes with this tag")
+		c.Flags.StringVar(&c.host, "host", "", "Only list the nodes archived on this host")
+		c.Flags.StringVar(&c.since, "since", "", "Only list the nodes archived on or after this date, as YYYY-MM-DD")
+		c.Flags.StringVar(&c.until, "until", "", "Only list the nodes archived on or before this date, as YYYY-MM-DD")
+		c.Flags.BoolVar(&c.json, "json", false, "Prints the nodes as JSON")
+		return c
+	},
+}
+
+type lsRun struct {
+	CommonFlags
+	tag   string
+	host  string
+	since string
+	until string
+	json  bool
+}
+
+// The name of a node is <host>_<timestamp>_<tag>, with a (<n>) suffix if
+// multiple nodes were archived during the same second.
+var reNodeName = regexp.MustCompile(`^(?:(.+)_)?(\d{4}-\d{2}-\d{2}_\d{2}-\d{2}-\d{2})_(.+?)(?:\(\d+\))?$`)
+
+// Description of a node as listed by ls.
+type NodeInfo struct {
+	Name      string     `json:"name"`
+	Timestamp time.Time  `json:"timestamp"`
+	Host      string     `json:"host,omitempty"`
+	Tag       string     `json:"tag"`
+	User      string     `json:"user,omitempty"`
+	Comment   string     `json:"comment,omitempty"`
+	Entry     string     `json:"entry"`
+	Files     int64      `json:"files"`
+	Size      int64      `json:"size"`
+	Start     *time.Time `json:"start,omitempty"`
+	End       *time.Time `json:"end,omitempty"`
+	Version   string     `json:"version,omitempty"`
+	Stats     *NodeStats `json:"stats,omitempty"`
+	Damaged   bool       `json:"damaged,omitempty"`
+}
+
+// Parses the timestamp, host and tag out of the name of a node.
+func parseNodeName(name string) (*NodeInfo, error) {
+	m := reNodeName.FindStringSubmatch(filepath.Base(name))
+	if m == nil {
+		return nil, fmt.Errorf("Invalid node name %s", name)
+	}
+	timestamp, err := time.Parse("2006-01-02_15-04-05", m[2])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid node name %s: %s", name, err)
+	}
+	return &NodeInfo{Name: name, Timestamp: timestamp, Host: m[1], Tag: m[3]}, nil
+}
+
+// Selects the nodes to list.
+type nodeFilter struct {
+	tag   string
+	host  string
+	since time.Time
+	until time.Time
+}
+
+func (f *nodeFilter) match(n *NodeInfo) bool {
+	return ((f.tag == "" || f.tag == n.Tag) &&
+		(f.host == "" || f.host == n.Host) &&
+		(f.since.IsZero() || !n.Timestamp.Before(f.since)) &&
+		(f.until.IsZero() || n.Timestamp.Before(f.until)))
+}
+
+// Number of files and total size of a tree.
+type treeTotal struct {
+	files int64
+	size  int64
+}
+
+// Sums the files in |entry|. The totals of the directories stored as separate
+// objects are memoized in |known| since they are usually shared by many nodes.
+func sumEntry(cas CasTable, entry *Entry, known map[string]treeTotal) (treeTotal, error) {
+	if entry.isFile() {
+		return treeTotal{1, entry.Size}, nil
+	}
+	if t, ok := known[entry.Dir]; ok && entry.Dir != "" {
+		return t, nil
+	}
+	dir, err := entry.loadDir(cas)
+	if err != nil {
+		return treeTotal{}, err
+	}
+	total := treeTotal{}
+	for _, child := range dir.Files {
+		t, err := sumEntry(cas, child, known)
+		if err != nil {
+			return treeTotal{}, err
+		}
+		total.files += t.files
+		total.size += t.size
+	}
+	if entry.Dir != "" {
+		known[entry.Dir] = total
+	}
+	return total, nil
+}
+
+// Loads the metadata of the nodes matching |filter|, sorted by timestamp,
+// without their totals. The tags are skipped since they are copies of the
+// latest node with the same name.
+func enumerateNodeInfos(nodes NodesTable, filter *nodeFilter) ([]*NodeInfo, error) {
+	out := []*NodeInfo{}
+	for item := range nodes.Enumerate() {
+		if item.Error != nil {
+			// TODO(maruel): Leaks channel.
+			return nil, item.Error
+		}
+		if strings.HasPrefix(filepath.ToSlash(item.Item), tagsName+"/") {
+			continue
+		}
+		info, err := parseNodeName(item.Item)
+		if err != nil {
+			// TODO(maruel): Leaks channel.
+			return nil, err
+		}
+		node, err := LoadNode(nodes, item.Item)
+		if err != nil {
+			// TODO(maruel): Leaks channel.
+			return nil, err
+		}
+		info.Comment = node.Comment
+		info.Entry = node.Entry
+		// Older nodes only have the metadata encoded in their name.
+		if node.Hostname != "" {
+			info.Host = node.Hostname
+		}
+		info.User = node.User
+		info.Start = node.Start
+		info.End = node.End
+		info.Version = node.Version
+		info.Stats = node.Stats
+		info.Damaged = node.Damaged != nil
+		if filter.match(info) {
+			out = append(out, info)
+		}
+	}
+	sort.Sort(nodeInfosByTime(out))
+	return out, nil
+}
+
+// Loads the nodes matching |filter| along the number of files and total size
+// of each. A node whose tree can't be loaded is logged and shown as damaged
+// with its totals left at 0, so the other nodes are still listed.
+func loadNodeInfos(cas CasTable, nodes NodesTable, filter *nodeFilter, log *log.Logger) ([]*NodeInfo, error) {
+	out, err := enumerateNodeInfos(nodes, filter)
+	if err != nil {
+		return nil, err
+	}
+	known := map[string]treeTotal{}
+	for _, info := range out {
+		entry, err := LoadEntry(cas, info.Entry)
+		if err == nil {
+			var total treeTotal
+			if total, err = sumEntry(cas, entry, known); err == nil {
+				info.Files = total.files
+				info.Size = total.size
+				continue
+			}
+		}
+		log.Printf("Node %s is damaged: %s", info.Name, err)
+		info.Damaged = true
+	}
+	return out, nil
+}
+
+type nodeInfosByTime []*NodeInfo
+
+func (n nodeInfosByTime) Len() int      { return len(n) }
+func (n nodeInfosByTime) Swap(i, j int) { n[i], n[j] = n[j], n[i] }
+func (n nodeInfosByTime) Less(i, j int) bool {
+	if n[i].Timestamp.Equal(n[j].Timestamp) {
+		return n[i].Name < n[j].Name
+	}
+	return n[i].Timestamp.Before(n[j].Timestamp)
+}
+
+// Parses a YYYY-MM-DD date. The zero time is returned for an empty string.
+func parseDate(flag string, value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return t, fmt.Errorf("Invalid -%s: %s", flag, err)
+	}
+	return t, nil
+}
+
+func (c *lsRun) main(a DumbcasApplication) error {
+	filter := &nodeFilter{tag: c.tag, host: c.host}
+	var err error
+	if filter.since, err = parseDate("since", c.since); err != nil {
+		return err
+	}
+	if filter.until, err = parseDate("until", c.until); err != nil {
+		return err
+	}
+	if !filter.until.IsZero() {
+		// Includes the whole day.
+		filter.until = filter.until.AddDate(0, 0, 1)
+	}
+	if err := c.Parse(a, true); err != nil {
+		return err
+	}
+	defer c.Close()
+
+	infos, err := loadNodeInfos(c.cas, c.nodes, filter, a.GetLog())
+	if err != nil {
+		return err
+	}
+	if c.json {
+		data, err := json.MarshalIndent(infos, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(a.GetOut(), "%s\n", data)
+		return nil
+	}
+	for _, info := range infos {
+		host := info.Host
+		if info.User != "" {
+			host = info.User + "@" + host
+		}
+		comment := info.Comment
+		if info.Damaged {
+			comment = "[damaged] " + comment
+		}
+		fmt.Fprintf(
+			a.GetOut(),
+			"%s  %s  %-12s %-16s %7d files %9.1fmb  %s\n",
+			info.Name,
+			info.Timestamp.Format("2006-01-02 15:04:05"),
+			host,
+			info.Tag,
+			info.Files,
+			toMb(info.Size),
+			comment)
+	}
+	return nil
+}
+
+func (c *lsRun) Run(a subcommands.Application, args []string) int {
+	if len(args) != 0 {
+		fmt.Fprintf(a.GetErr(), "%s: Unsupported arguments.\n", a.GetName())
+		return 1
+	}
+	d := a.(DumbcasApplication)
+	if err := c.main(d); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,125 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"github.com/maruel/subcommands/subcommandstest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseNodeName(t *testing.T) {
+	t.Parallel()
+	tb := subcommandstest.MakeTB(t)
+	type S struct {
+		host      string
+		timestamp string
+		tag       string
+	}
+	checks := map[string]S{
+		"2012-01/host_2012-01-02_03-04-05_backup":         S{"host", "2012-01-02 03:04:05", "backup"},
+		"2012-01/my_host_2012-01-02_03-04-05_backup(2)":   S{"my_host", "2012-01-02 03:04:05", "backup"},
+		"2012-01/2012-01-02_03-04-05_toArchive_media.txt": S{"", "2012-01-02 03:04:05", "toArchive_media.txt"},
+	}
+	for name, s := range checks {
+		info, err := parseNodeName(filepath.FromSlash(name))
+		tb.Assertf(err == nil, "%s: Unexpected error: %s", name, err)
+		tb.Assertf(info.Host == s.host, "%s: Unexpected host %s", name, info.Host)
+		tb.Assertf(info.Tag == s.tag, "%s: Unexpected tag %s", name, info.Tag)
+		actual := info.Timestamp.Format("2006-01-02 15:04:05")
+		tb.Assertf(actual == s.timestamp, "%s: Unexpected timestamp %s", name, actual)
+	}
+	_, err := parseNodeName("2012-01/foo")
+	tb.Assertf(err != nil, "Unexpected success")
+}
+
+func TestLs(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	args := []string{"ls", "-root=\\test_ls"}
+	f.Run(args, 0)
+	f.CheckBuffer(false, false)
+
+	archiveData(f.TB, f.cas, f.nodes, map[string]string{
+		"file1":           "content1",
+		"dir1/dir2/file2": "content2",
+	})
+	f.Run(args, 0)
+	f.CheckBuffer(true, false)
+	f.Run([]string{"ls", "-root=\\test_ls", "-json"}, 0)
+	f.CheckBuffer(true, false)
+	f.Run([]string{"ls", "-root=\\test_ls", "-since=yesterday"}, 1)
+	f.CheckBuffer(false, true)
+}
+
+func TestLoadNodeInfos(t *testing.T) {
+	t.Parallel()
+	tb := subcommandstest.MakeTB(t)
+	cas := makeFakeCasTable(tb)
+	nodes := makeFakeNodesTable(cas, tb)
+	_, nodeName, entry := archiveData(tb, cas, nodes, map[string]string{
+		"file1":           "content1",
+		"dir1/dir2/file2": "content2",
+	})
+
+	infos, err := loadNodeInfos(cas, nodes, &nodeFilter{}, tb.GetLog())
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	tb.Assertf(len(infos) == 1, "Unexpected nodes: %v", infos)
+	info := infos[0]
+	tb.Assertf(info.Name == nodeName, "Unexpected name %s", info.Name)
+	tb.Assertf(info.Tag == "fictious", "Unexpected tag %s", info.Tag)
+	tb.Assertf(info.Comment == "useful comment", "Unexpected comment %s", info.Comment)
+	tb.Assertf(info.Entry == entry, "Unexpected entry %s", info.Entry)
+	tb.Assertf(info.Files == 2 && info.Size == 16, "Unexpected totals %d %d", info.Files, info.Size)
+
+	now := time.Now().UTC()
+	filters := map[string]*nodeFilter{
+		"tag":   &nodeFilter{tag: "other"},
+		"host":  &nodeFilter{host: "other"},
+		"since": &nodeFilter{since: now.Add(time.Hour)},
+		"until": &nodeFilter{until: now.Add(-time.Hour)},
+	}
+	for name, filter := range filters {
+		infos, err := loadNodeInfos(cas, nodes, filter, tb.GetLog())
+		tb.Assertf(err == nil, "%s: Unexpected error: %s", name, err)
+		tb.Assertf(len(infos) == 0, "%s: Unexpected nodes: %v", name, infos)
+	}
+	infos, err = loadNodeInfos(cas, nodes, &nodeFilter{tag: "fictious", since: now.Add(-time.Hour)}, tb.GetLog())
+	tb.Assertf(err == nil && len(infos) == 1, "Unexpected result %v %s", infos, err)
+
+	// The metadata recorded in the node takes precedence over its name.
+	start := now.Add(-time.Minute)
+	node := &Node{Entry: entry, Hostname: "other", User: "joe", Start: &start, End: &now, Version: version}
+	_, err = nodes.AddEntry(node, "recorded")
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	infos, err = loadNodeInfos(cas, nodes, &nodeFilter{host: "other"}, tb.GetLog())
+	tb.Assertf(err == nil && len(infos) == 1, "Unexpected result %v %s", infos, err)
+	info = infos[0]
+	tb.Assertf(info.Tag == "recorded" && info.User == "joe", "Unexpected node %#v", info)
+	tb.Assertf(info.Start != nil && info.Start.Equal(start), "Unexpected start %v", info.Start)
+	tb.Assertf(info.End != nil && info.End.Equal(now), "Unexpected end %v", info.End)
+	tb.Assertf(info.Version == version, "Unexpected version %s", info.Version)
+
+	// A node whose tree can't be loaded is still listed, as damaged.
+	_, damaged, damagedEntry := archiveData(tb, cas, nodes, map[string]string{
+		"file3": "content3",
+	})
+	delete(cas.entries, damagedEntry)
+	infos, err = loadNodeInfos(cas, nodes, &nodeFilter{tag: "fictious"}, tb.GetLog())
+	tb.Assertf(err == nil && len(infos) == 2, "Unexpected result %v %s", infos, err)
+	for _, info := range infos {
+		if info.Name == damaged {
+			tb.Assertf(info.Damaged && info.Files == 0 && info.Size == 0, "Unexpected node %#v", info)
+		} else {
+			tb.Assertf(!info.Damaged && info.Files == 2, "Unexpected node %#v", info)
+		}
+	}
+}
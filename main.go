@@ -10,10 +10,12 @@ limitations under the License. */
 package main
 
 import (
+	"fmt"
 	"github.com/maruel/subcommands"
 	"github.com/maruel/subcommands/subcommandstest"
 	"log"
 	"os"
+	"time"
 )
 
 var application = &subcommands.DefaultApplication{
@@ -21,11 +23,17 @@ var application = &subcommands.DefaultApplication{
 	Title: "Dumbcas is a simple Content Addressed Datastore to be used as a simple backup tool.",
 	Commands: []*subcommands.Command{
 		cmdArchive,
+		cmdDiff,
 		cmdFsck,
 		cmdGc,
 		subcommands.CmdHelp,
 		cmdInfo,
+		cmdInit,
+		cmdLs,
+		cmdPrune,
 		cmdRestore,
+		cmdSync,
+		cmdTrash,
 		cmdVersion,
 		cmdWeb,
 	},
@@ -34,9 +42,18 @@ var application = &subcommands.DefaultApplication{
 type DumbcasApplication interface {
 	subcommandstest.Application
 	// LoadCache must return a valid Cache instance even in case of failure.
-	LoadCache() (Cache, error)
+	// Each hash algorithm has its own cache.
+	LoadCache(h *HashAlgorithm) (Cache, error)
+	// Creates a new repository. An empty |hashName| or a zero |prefixLength|
+	// selects the default value.
+	InitRepository(rootDir string, hashName string, prefixLength int) (*RepositoryConfig, error)
 	MakeCasTable(rootDir string) (CasTable, error)
 	LoadNodesTable(rootDir string, cas CasTable) (NodesTable, error)
+	// Locks the repository whose CasTable is |cas|, waiting up to |wait| for
+	// conflicting locks to be released.
+	LockRepository(rootDir string, cas CasTable, exclusive bool, wait time.Duration) (Lock, error)
+	// Loads the journal of the verifications done by fsck.
+	LoadScrubJournal(rootDir string) (*ScrubJournal, error)
 }
 
 type dumbapp struct {
@@ -49,18 +66,63 @@ func (d *dumbapp) GetLog() *log.Logger {
 	return d.log
 }
 
-func (d *dumbapp) LoadCache() (Cache, error) {
-	return loadCache(d.log)
+func (d *dumbapp) LoadCache(h *HashAlgorithm) (Cache, error) {
+	return loadCache(h, d.log)
+}
+
+func (d *dumbapp) InitRepository(rootDir string, hashName string, prefixLength int) (*RepositoryConfig, error) {
+	if isRemoteRoot(rootDir) {
+		return nil, fmt.Errorf("Run init on the server of %s", rootDir)
+	}
+	if isS3Root(rootDir) {
+		return initS3Repository(rootDir, s3ConfigFromEnv(), hashName, prefixLength)
+	}
+	return initLocalRepository(rootDir, hashName, prefixLength)
 }
 
 func (d *dumbapp) MakeCasTable(rootDir string) (CasTable, error) {
+	if isRemoteRoot(rootDir) {
+		return makeHttpCasTable(rootDir, os.Getenv("DUMBCAS_TOKEN"))
+	}
+	if isS3Root(rootDir) {
+		return makeS3CasTable(rootDir, s3ConfigFromEnv())
+	}
 	return makeLocalCasTable(rootDir)
 }
 
 func (d *dumbapp) LoadNodesTable(rootDir string, cas CasTable) (NodesTable, error) {
+	if t, ok := cas.(*httpCasTable); ok {
+		// Shares the client so its requests carry the lock too.
+		return newHttpNodesTable(t.client), nil
+	}
+	if isRemoteRoot(rootDir) {
+		return makeHttpNodesTable(rootDir, os.Getenv("DUMBCAS_TOKEN"))
+	}
+	if isS3Root(rootDir) {
+		return makeS3NodesTable(rootDir, s3ConfigFromEnv(), cas, d.GetLog())
+	}
 	return loadLocalNodesTable(rootDir, cas, d.GetLog())
 }
 
+// The server of a remote repository locks it on behalf of the client.
+func (d *dumbapp) LockRepository(rootDir string, cas CasTable, exclusive bool, wait time.Duration) (Lock, error) {
+	if isRemoteRoot(rootDir) {
+		return lockHttpRepository(cas, exclusive, wait)
+	}
+	if isS3Root(rootDir) {
+		return lockS3Repository(cas, exclusive, wait)
+	}
+	return lockLocalRepository(rootDir, exclusive, wait)
+}
+
+// The journal of a remote or S3 repository is not persisted.
+func (d *dumbapp) LoadScrubJournal(rootDir string) (*ScrubJournal, error) {
+	if isRemoteRoot(rootDir) || isS3Root(rootDir) {
+		return &ScrubJournal{Objects: map[string]*ScrubRecord{}}, nil
+	}
+	return loadScrubJournal(rootDir)
+}
+
 func main() {
 	log.SetFlags(log.Lmicroseconds)
 	d := &dumbapp{application, log.New(application.GetErr(), "", log.LstdFlags|log.Lmicroseconds)}
@@ -26,6 +26,8 @@ type DumbcasAppMock struct {
 	cache *fakeCache
 	cas   CasTable
 	nodes NodesTable
+	locks map[*fakeLock]bool
+	scrub *ScrubJournal
 }
 
 func (a *DumbcasAppMock) Run(args []string, expected int) {
@@ -9,15 +9,110 @@ limitations under the License. */
 
 package main
 
-import ()
+import (
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
 
+// Statistics of the archive run that created a Node.
+type NodeStats struct {
+	Found         int64 `json:"found"`
+	Size          int64 `json:"size"`
+	Excluded      int64 `json:"excluded,omitempty"`
+	Hashed        int64 `json:"hashed"`
+	BytesHashed   int64 `json:"bytes_hashed"`
+	InCache       int64 `json:"in_cache"`
+	Archived      int64 `json:"archived"`
+	BytesArchived int64 `json:"bytes_archived"`
+	Changed       int64 `json:"changed,omitempty"`
+	Errors        int64 `json:"errors,omitempty"`
+}
+
+// A Node references the root Entry of a backup. Older nodes only have Entry
+// and Comment.
 type Node struct {
-	Entry   string
-	Comment string `json:",omitempty"`
+	Entry    string
+	Comment  string     `json:",omitempty"`
+	Hostname string     `json:",omitempty"`
+	User     string     `json:",omitempty"`
+	Start    *time.Time `json:",omitempty"`
+	End      *time.Time `json:",omitempty"`
+	Inputs   []string   `json:",omitempty"`
+	Version  string     `json:",omitempty"`
+	Stats    *NodeStats `json:",omitempty"`
+	// The files and directories whose objects were missing when fsck
+	// -mark-damaged last checked the node. "." is the root directory.
+	Damaged []string `json:",omitempty"`
+}
+
+// Prints the metadata of the Node in Yaml-inspired output.
+func (n *Node) Print(w io.Writer) {
+	if n.Comment != "" {
+		fmt.Fprintf(w, "Comment: %s\n", n.Comment)
+	}
+	if n.Hostname != "" {
+		fmt.Fprintf(w, "Hostname: %s\n", n.Hostname)
+	}
+	if n.User != "" {
+		fmt.Fprintf(w, "User: %s\n", n.User)
+	}
+	if n.Start != nil {
+		fmt.Fprintf(w, "Start: %s\n", n.Start.Format("2006-01-02 15:04:05 MST"))
+	}
+	if n.End != nil {
+		fmt.Fprintf(w, "End: %s\n", n.End.Format("2006-01-02 15:04:05 MST"))
+		if n.Start != nil {
+			fmt.Fprintf(w, "Duration: %s\n", n.End.Sub(*n.Start))
+		}
+	}
+	if n.Version != "" {
+		fmt.Fprintf(w, "Version: %s\n", n.Version)
+	}
+	if n.Inputs != nil {
+		fmt.Fprintf(w, "Inputs:\n")
+		for _, i := range n.Inputs {
+			fmt.Fprintf(w, "- '%s'\n", i)
+		}
+	}
+	if n.Damaged != nil {
+		fmt.Fprintf(w, "Damaged:\n")
+		for _, d := range n.Damaged {
+			fmt.Fprintf(w, "- '%s'\n", d)
+		}
+	}
+	if s := n.Stats; s != nil {
+		fmt.Fprintf(w, "Stats:\n")
+		fmt.Fprintf(w, "  Found: %d (%.1fmb)\n", s.Found, toMb(s.Size))
+		fmt.Fprintf(w, "  Excluded: %d\n", s.Excluded)
+		fmt.Fprintf(w, "  Hashed: %d (%.1fmb)\n", s.Hashed, toMb(s.BytesHashed))
+		fmt.Fprintf(w, "  In cache: %d\n", s.InCache)
+		fmt.Fprintf(w, "  Archived: %d (%.1fmb)\n", s.Archived, toMb(s.BytesArchived))
+		fmt.Fprintf(w, "  Changed: %d\n", s.Changed)
+		fmt.Fprintf(w, "  Errors: %d\n", s.Errors)
+	}
+}
+
+// Returns true if |name| is a relative path to a node that stays in its table
+// and isn't in its trash. Enumerate() skips the hidden files, like the
+// temporary ones, so a node can't be hidden either.
+func isValidNodeName(name string) bool {
+	name = filepath.ToSlash(name)
+	return isValidApiName(name) && name != TrashName && !strings.HasPrefix(name, TrashName+"/") && !strings.HasPrefix(path.Base(name), ".")
 }
 
 type NodesTable interface {
 	Table
 	// Adds a node to the table.
 	AddEntry(node *Node, name string) (string, error)
+	// Replaces the content of an existing node.
+	Update(name string, node *Node) error
+	// Adds a node under |name|, e.g. to copy it from another repository. Fails
+	// with os.ErrExist if the node already exists.
+	Create(name string, node *Node) error
+	// Returns the trash where Remove() moves the nodes.
+	GetTrash() Trash
 }
@@ -0,0 +1,109 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// A NodesTable served by web -writable on another host.
+type httpNodesTable struct {
+	client *httpClient
+	proxy  http.Handler
+}
+
+func makeHttpNodesTable(root, token string) (NodesTable, error) {
+	client, err := makeHttpClient(root, token)
+	if err != nil {
+		return nil, err
+	}
+	return newHttpNodesTable(client), nil
+}
+
+func newHttpNodesTable(client *httpClient) NodesTable {
+	return &httpNodesTable{client, client.proxy("/content/retrieve/nodes")}
+}
+
+func (n *httpNodesTable) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n.proxy.ServeHTTP(w, r)
+}
+
+func (n *httpNodesTable) Enumerate() <-chan EnumerationEntry {
+	items := make(chan EnumerationEntry)
+	go func() {
+		defer close(items)
+		for item := range n.client.enumerate(apiEnumerateNodesPath) {
+			item.Item = filepath.FromSlash(item.Item)
+			items <- item
+		}
+	}()
+	return items
+}
+
+func (n *httpNodesTable) urlPath(name string) string {
+	parts := strings.Split(filepath.ToSlash(name), "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return apiNodePath + strings.Join(parts, "/")
+}
+
+// Nodes are small so they are read whole.
+func (n *httpNodesTable) Open(name string) (ReadSeekCloser, error) {
+	data, err := n.client.get(n.urlPath(name))
+	if err != nil {
+		return nil, err
+	}
+	return Buffer{bytes.NewReader(data)}, nil
+}
+
+func (n *httpNodesTable) Remove(name string, record *TrashRecord) error {
+	return n.client.remove(n.urlPath(name), record)
+}
+
+func (n *httpNodesTable) AddEntry(node *Node, name string) (string, error) {
+	data, err := json.Marshal(node)
+	if err != nil {
+		return "", fmt.Errorf("Failed to marshall internal state: %s", err)
+	}
+	_, nodeName, err := n.client.send("POST", apiNodePath+"?tag="+url.QueryEscape(name), bytes.NewReader(data), http.StatusCreated)
+	if err != nil {
+		return "", err
+	}
+	return filepath.FromSlash(string(nodeName)), nil
+}
+
+func (n *httpNodesTable) Update(name string, node *Node) error {
+	data, err := json.Marshal(node)
+	if err != nil {
+		return fmt.Errorf("Failed to marshall internal state: %s", err)
+	}
+	_, err = n.client.call("PUT", n.urlPath(name), bytes.NewReader(data), http.StatusNoContent)
+	return err
+}
+
+func (n *httpNodesTable) Create(name string, node *Node) error {
+	data, err := json.Marshal(node)
+	if err != nil {
+		return fmt.Errorf("Failed to marshall internal state: %s", err)
+	}
+	_, err = n.client.call("POST", n.urlPath(name), bytes.NewReader(data), http.StatusCreated)
+	return err
+}
+
+func (n *httpNodesTable) GetTrash() Trash {
+	return remoteTrash{}
+}
@@ -0,0 +1,39 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"github.com/maruel/subcommands/subcommandstest"
+	"testing"
+)
+
+func TestHttpNodesTable(t *testing.T) {
+	t.Parallel()
+	tb := subcommandstest.MakeTB(t)
+	tempData := makeTempDir(tb, "nodes_http")
+	defer removeTempDir(tempData)
+	server := serveLocalRepository(tb, tempData, true)
+	defer server.Close()
+
+	cas, err := makeHttpCasTable(server.URL, testToken)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	nodes, err := makeHttpNodesTable(server.URL, testToken)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	testNodesTableImpl(tb, cas, nodes)
+	testNodesTableUpdate(tb, nodes)
+	testNodesTableCreate(tb, nodes)
+
+	items := EnumerateNodesAsList(tb, nodes)
+	tb.Assertf(nodes.Remove(items[0], &TrashRecord{Reason: TrashPruned}) == nil, "Failed to remove %s", items[0])
+	rest := EnumerateNodesAsList(tb, nodes)
+	tb.Assertf(Equals(rest, items[1:]), "Unexpected nodes: %q", rest)
+	_, err = LoadNode(nodes, items[0])
+	tb.Assertf(err != nil, "Unexpected success")
+}
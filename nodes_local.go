@@ -10,10 +10,12 @@ limitations under the License. */
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"html"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
@@ -55,17 +57,27 @@ type entryCache struct {
 	lastAccess time.Time
 }
 
-func loadLocalNodesTable(rootDir string, cas CasTable, log *log.Logger) (NodesTable, error) {
+// Creates the nodes directory of a new repository.
+func initLocalNodesTable(rootDir string) error {
 	nodesDir := filepath.Join(rootDir, nodesName)
 	if err := os.Mkdir(nodesDir, 0750); err != nil && !os.IsExist(err) {
-		return nil, fmt.Errorf("LoadNodesTable(%s): Failed to create %s: %s\n", rootDir, nodesDir, err)
+		return fmt.Errorf("InitNodesTable(%s): Failed to create %s: %s\n", rootDir, nodesDir, err)
+	}
+	return nil
+}
+
+func loadLocalNodesTable(rootDir string, cas CasTable, log *log.Logger) (NodesTable, error) {
+	if _, err := loadRepositoryConfig(rootDir); err != nil {
+		return nil, err
 	}
-	hostname, err := os.Hostname()
+	nodesDir := filepath.Join(rootDir, nodesName)
+	if !isDir(nodesDir) {
+		return nil, fmt.Errorf("LoadNodesTable(%s): %s is missing", rootDir, nodesDir)
+	}
+	hostname, err := shortHostname()
 	if err != nil {
-		return nil, fmt.Errorf("Failed to get the hostname: %s", err)
+		return nil, err
 	}
-	parts := strings.SplitN(hostname, ".", 2)
-	hostname = parts[0]
 	return &nodesTable{
 		nodesDir:      nodesDir,
 		cas:           cas,
@@ -140,6 +152,57 @@ func (n *nodesTable) AddEntry(node *Node, name string) (string, error) {
 	return filepath.Join(monthName, nodeName), nil
 }
 
+func (n *nodesTable) Update(name string, node *Node) error {
+	nodePath := filepath.Join(n.nodesDir, name)
+	if _, err := os.Stat(nodePath); err != nil {
+		return err
+	}
+	data, err := json.Marshal(node)
+	if err != nil {
+		return fmt.Errorf("Failed to marshall internal state: %s", err)
+	}
+	// Write to a temporary file first so the node is never left truncated. It is
+	// skipped by Enumerate() since it starts with a dot. Renaming over the node
+	// keeps the tag symlinks pointing to it.
+	tempPath := filepath.Join(filepath.Dir(nodePath), "."+filepath.Base(nodePath)+".tmp")
+	if err := ioutil.WriteFile(tempPath, data, 0640); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("Failed to write %s: %s", tempPath, err)
+	}
+	if err := os.Rename(tempPath, nodePath); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	n.log.Printf("Updated node: %s", name)
+	return nil
+}
+
+// The node is written to a temporary file then linked under its name, so it is
+// never seen truncated and an existing node is never replaced.
+func (n *nodesTable) Create(name string, node *Node) error {
+	if !isValidNodeName(name) {
+		return fmt.Errorf("Invalid node name %s", name)
+	}
+	data, err := json.Marshal(node)
+	if err != nil {
+		return fmt.Errorf("Failed to marshall internal state: %s", err)
+	}
+	nodePath := filepath.Join(n.nodesDir, name)
+	if err := os.MkdirAll(filepath.Dir(nodePath), 0750); err != nil {
+		return fmt.Errorf("Failed to create %s: %s", filepath.Dir(nodePath), err)
+	}
+	tempPath := filepath.Join(filepath.Dir(nodePath), "."+filepath.Base(nodePath)+".tmp")
+	defer os.Remove(tempPath)
+	if err := ioutil.WriteFile(tempPath, data, 0640); err != nil {
+		return fmt.Errorf("Failed to write %s: %s", tempPath, err)
+	}
+	if err := os.Link(tempPath, nodePath); err != nil {
+		return err
+	}
+	n.log.Printf("Created node: %s", name)
+	return nil
+}
+
 func (n *nodesTable) Open(item string) (ReadSeekCloser, error) {
 	return os.Open(filepath.Join(n.nodesDir, item))
 }
@@ -147,7 +210,10 @@ func (n *nodesTable) Open(item string) (ReadSeekCloser, error) {
 // Enumerates all the entries in the table.
 func (n *nodesTable) Enumerate() <-chan EnumerationEntry {
 	items := make(chan EnumerationEntry)
-	c := EnumerateTree(n.nodesDir)
+	trashDir := filepath.Join(n.nodesDir, TrashName)
+	c := EnumerateTreeSkip(n.nodesDir, func(fullPath string, info os.FileInfo) bool {
+		return fullPath == trashDir
+	})
 	go func() {
 		for {
 			select {
@@ -163,15 +229,10 @@ func (n *nodesTable) Enumerate() <-chan EnumerationEntry {
 					items <- EnumerationEntry{Error: v.Error}
 					continue
 				}
-				if v.FileInfo.IsDir() {
-					continue
-				}
-				relPath := v.FullPath[len(n.nodesDir)+1:]
-				if filepath.Base(relPath) == TrashName {
-					// TODO(maruel): Cancel iterating inside the directory!
+				if v.FileInfo.IsDir() || strings.HasPrefix(v.FileInfo.Name(), ".") {
 					continue
 				}
-				items <- EnumerationEntry{Item: relPath}
+				items <- EnumerationEntry{Item: v.FullPath[len(n.nodesDir)+1:]}
 			}
 		}
 		close(items)
@@ -179,9 +240,13 @@ func (n *nodesTable) Enumerate() <-chan EnumerationEntry {
 	return items
 }
 
-func (n *nodesTable) Remove(name string) error {
+func (n *nodesTable) Remove(name string, record *TrashRecord) error {
 	// TODO(maruel): Remove empty directories.
-	return n.trash.Move(name)
+	return n.trash.Move(name, record)
+}
+
+func (n *nodesTable) GetTrash() Trash {
+	return n.trash
 }
 
 // LoadEntry is an utility functiont that loads an node stored in the CasTable
@@ -201,12 +266,34 @@ func LoadEntry(cas CasTable, hash string) (*Entry, error) {
 	return entry, nil
 }
 
+// LoadNode is an utility function that loads a node stored in the NodesTable.
+func LoadNode(nodes NodesTable, name string) (*Node, error) {
+	f, err := nodes.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	node := &Node{}
+	if err := loadReaderAsJson(f, node); err != nil {
+		return nil, fmt.Errorf("Failed reading node %s: %s", name, err)
+	}
+	return node, nil
+}
+
 // Sadly, http.dirList is not exported. Also it doesn't sort the list by
 // default but we don't care about performance.
 func dirList(w http.ResponseWriter, items []string) {
+	dirListWithHeader(w, "", items)
+}
+
+// Same as dirList but prints |header| as text before the list.
+func dirListWithHeader(w http.ResponseWriter, header string, items []string) {
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
 	io.WriteString(w, "<html><body><pre>")
+	if header != "" {
+		io.WriteString(w, html.EscapeString(header)+"\n")
+	}
 	sort.Strings(items)
 	for _, name := range items {
 		name = html.EscapeString(name)
@@ -394,5 +481,24 @@ func (n *nodesTable) serveObj(w http.ResponseWriter, r *http.Request, node *Node
 		n.corruption(w, "Failed to load Entry %s: %s", node.Entry, err)
 		return
 	}
+	if err := serveNodeEntry(w, r, node, &entryFs.EntryFileSystem); err != nil {
+		n.corruption(w, "Failed to load Entry %s: %s", node.Entry, err)
+	}
+}
+
+// Serves the files of |node|. The root directory is listed along the metadata
+// of the node. Returns an error only if the root directory can't be loaded.
+func serveNodeEntry(w http.ResponseWriter, r *http.Request, node *Node, entryFs *EntryFileSystem) error {
+	if strings.Trim(r.URL.Path, "/") == "" {
+		root, err := entryFs.entry.loadDir(entryFs.cas)
+		if err != nil {
+			return err
+		}
+		header := &bytes.Buffer{}
+		node.Print(header)
+		root.ServeDir(w, header.String())
+		return nil
+	}
 	entryFs.ServeHTTP(w, r)
+	return nil
 }
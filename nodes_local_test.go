@@ -11,6 +11,8 @@ package main
 
 import (
 	"github.com/maruel/subcommands/subcommandstest"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -20,10 +22,24 @@ func TestNodesTable(t *testing.T) {
 	tempData := makeTempDir(tb, "nodes")
 	defer removeTempDir(tempData)
 
+	_, err := initLocalRepository(tempData, "", 0)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
 	// Explicitely use a fake in-memory CasTable.
-	cas := &fakeCasTable{make(map[string][]byte), false, tb}
+	cas := makeFakeCasTable(tb)
 	nodes, err := loadLocalNodesTable(tempData, cas, tb.GetLog())
 	tb.Assertf(err == nil, "Unexpected error: %s", err)
 
 	testNodesTableImpl(tb, cas, nodes)
+
+	// The root of a node lists its metadata before its files.
+	name := filepath.ToSlash(EnumerateNodesAsList(tb, nodes)[0])
+	body := request(tb, nodes, "/"+name+"/", 200, "")
+	expected := "<html><body><pre>Comment: useful comment\n\n<a href=\"dir1/\">dir1/</a>\n"
+	tb.Assertf(strings.HasPrefix(body, expected), "Unexpected output:\n%s", body)
+	body = request(tb, nodes, "/"+name+"/dir1/", 200, "")
+	tb.Assertf(!strings.Contains(body, "Comment"), "Unexpected output:\n%s", body)
+
+	testNodesTableUpdate(tb, nodes)
+	testNodesTableCreate(tb, nodes)
+	testNodesTableTrash(tb, nodes)
 }
@@ -0,0 +1,228 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A NodesTable stored in an S3 bucket under nodes/, like the local one. The
+// tags are copies of the nodes since S3 has no symlinks.
+type s3NodesTable struct {
+	client   *s3Client
+	cas      CasTable
+	hostname string
+	log      *log.Logger
+	trash    *s3Trash
+}
+
+func makeS3NodesTable(root string, s3config *s3Config, cas CasTable, log *log.Logger) (NodesTable, error) {
+	client, err := makeS3Client(root, s3config)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := loadS3RepositoryConfig(client, root); err != nil {
+		return nil, err
+	}
+	hostname, err := shortHostname()
+	if err != nil {
+		return nil, err
+	}
+	return &s3NodesTable{client, cas, hostname, log, makeS3Trash(client, nodesName+"/")}, nil
+}
+
+func (n *s3NodesTable) key(name string) string {
+	return nodesName + "/" + filepath.ToSlash(name)
+}
+
+func (n *s3NodesTable) AddEntry(node *Node, name string) (string, error) {
+	data, err := json.Marshal(node)
+	if err != nil {
+		return "", fmt.Errorf("Failed to marshall internal state: %s", err)
+	}
+	now := time.Now().UTC()
+	monthName := now.Format("2006-01")
+	nodeName := ""
+	for suffix := 0; ; suffix++ {
+		nodeName = n.hostname + "_" + now.Format("2006-01-02_15-04-05") + "_" + name
+		if suffix != 0 {
+			nodeName += fmt.Sprintf("(%d)", suffix)
+		}
+		err := n.client.putBytes(n.key(monthName+"/"+nodeName), data, true)
+		if err == nil {
+			break
+		} else if !os.IsExist(err) {
+			return "", fmt.Errorf("Failed to write %s: %s", nodeName, err)
+		}
+	}
+	n.log.Printf("Saved node: %s", filepath.Join(monthName, nodeName))
+	if err := n.client.putBytes(n.key(tagsName+"/"+name), data, false); err != nil {
+		return "", fmt.Errorf("Failed to create tag %s: %s", name, err)
+	}
+	return filepath.Join(monthName, nodeName), nil
+}
+
+func (n *s3NodesTable) Update(name string, node *Node) error {
+	if _, err := n.client.head(n.key(name)); err != nil {
+		return err
+	}
+	data, err := json.Marshal(node)
+	if err != nil {
+		return fmt.Errorf("Failed to marshall internal state: %s", err)
+	}
+	if err := n.client.putBytes(n.key(name), data, false); err != nil {
+		return err
+	}
+	n.log.Printf("Updated node: %s", name)
+	return nil
+}
+
+func (n *s3NodesTable) Create(name string, node *Node) error {
+	if !isValidNodeName(name) {
+		return fmt.Errorf("Invalid node name %s", name)
+	}
+	data, err := json.Marshal(node)
+	if err != nil {
+		return fmt.Errorf("Failed to marshall internal state: %s", err)
+	}
+	if err := n.client.putBytes(n.key(name), data, true); err != nil {
+		return err
+	}
+	n.log.Printf("Created node: %s", name)
+	return nil
+}
+
+// Nodes are small so they are read whole.
+func (n *s3NodesTable) Open(name string) (ReadSeekCloser, error) {
+	data, err := n.client.get(n.key(name))
+	if err != nil {
+		return nil, err
+	}
+	return Buffer{bytes.NewReader(data)}, nil
+}
+
+func (n *s3NodesTable) Enumerate() <-chan EnumerationEntry {
+	items := make(chan EnumerationEntry)
+	go func() {
+		defer close(items)
+		err := n.client.list(nodesName+"/", "", func(page *s3ListResult) error {
+			for _, o := range page.Contents {
+				relKey := o.Key[len(nodesName)+1:]
+				if strings.HasPrefix(relKey, TrashName+"/") || strings.HasPrefix(path.Base(relKey), ".") {
+					continue
+				}
+				items <- EnumerationEntry{Item: filepath.FromSlash(relKey)}
+			}
+			return nil
+		})
+		if err != nil {
+			items <- EnumerationEntry{Error: err}
+		}
+	}()
+	return items
+}
+
+func (n *s3NodesTable) Remove(name string, record *TrashRecord) error {
+	return n.trash.Move(name, record)
+}
+
+func (n *s3NodesTable) GetTrash() Trash {
+	return n.trash
+}
+
+// Serves the nodes like the local table does. The node is the shortest prefix
+// of the path that is an object; the rest of the path is in its entry.
+func (n *s3NodesTable) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "" || r.URL.Path[0] != '/' {
+		http.Error(w, "Internal failure. nodesTable received an invalid url: "+r.URL.Path, http.StatusNotImplemented)
+		return
+	}
+	name := r.URL.Path[1:]
+	parts := strings.Split(strings.Trim(name, "/"), "/")
+	for i := 1; name != "" && i <= len(parts); i++ {
+		nodeName := strings.Join(parts[:i], "/")
+		data, err := n.client.get(n.key(nodeName))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			http.Error(w, fmt.Sprintf("Failure: %s", err), http.StatusInternalServerError)
+			return
+		}
+		node := &Node{}
+		if err := json.Unmarshal(data, node); err != nil {
+			n.corruption(w, "Failed to load Node %s: %s", nodeName, err)
+			return
+		}
+		rest := strings.TrimPrefix(name, nodeName)
+		if rest == "" {
+			localRedirect(w, r, path.Base(r.URL.Path)+"/")
+			return
+		}
+		entry, err := LoadEntry(n.cas, node.Entry)
+		if err != nil {
+			n.corruption(w, "Failed to load Entry %s: %s", node.Entry, err)
+			return
+		}
+		r.URL.Path = rest
+		if err := serveNodeEntry(w, r, node, &EntryFileSystem{entry, n.cas}); err != nil {
+			n.corruption(w, "Failed to load Entry %s: %s", node.Entry, err)
+		}
+		return
+	}
+
+	// It's actually browsing the nodes themselves.
+	dir := n.key(name)
+	if !strings.HasSuffix(dir, "/") {
+		dir += "/"
+	}
+	files := []string{}
+	err := n.client.list(dir, "/", func(page *s3ListResult) error {
+		for _, p := range page.CommonPrefixes {
+			if p.Prefix != n.key(TrashName+"/") {
+				files = append(files, path.Base(p.Prefix)+"/")
+			}
+		}
+		for _, o := range page.Contents {
+			if !strings.HasPrefix(path.Base(o.Key), ".") {
+				files = append(files, path.Base(o.Key))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failure: %s", err), http.StatusInternalServerError)
+		return
+	}
+	if name != "" && len(files) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	if name != "" && name[len(name)-1] != '/' {
+		localRedirect(w, r, path.Base(r.URL.Path)+"/")
+		return
+	}
+	dirList(w, files)
+}
+
+// Either failed to load a Node or an Entry.
+func (n *s3NodesTable) corruption(w http.ResponseWriter, format string, a ...interface{}) {
+	n.cas.SetFsckBit()
+	str := fmt.Sprintf(format, a...)
+	http.Error(w, "Internal failure: "+str, http.StatusNotImplemented)
+}
@@ -0,0 +1,34 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"github.com/maruel/subcommands/subcommandstest"
+	"testing"
+)
+
+func TestS3NodesTable(t *testing.T) {
+	t.Parallel()
+	tb := subcommandstest.MakeTB(t)
+	server := makeFakeS3()
+	defer server.Close()
+
+	_, err := initS3Repository("s3://bucket/backups", server.config(), "", 0)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	cas, err := makeS3CasTable("s3://bucket/backups", server.config())
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	nodes, err := makeS3NodesTable("s3://bucket/backups", server.config(), cas, tb.GetLog())
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+
+	testNodesTableImpl(tb, cas, nodes)
+	testNodesTableUpdate(tb, nodes)
+	testNodesTableCreate(tb, nodes)
+	testNodesTableTrash(tb, nodes)
+}
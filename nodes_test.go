@@ -30,13 +30,19 @@ import (
 // A working NodesTable implementation that keeps data in memory.
 type fakeNodesTable struct {
 	entries map[string][]byte
+	trash   *fakeTrash
 	cas     CasTable
 	t       *subcommandstest.TB
 }
 
+func makeFakeNodesTable(cas CasTable, t *subcommandstest.TB) *fakeNodesTable {
+	entries := make(map[string][]byte)
+	return &fakeNodesTable{entries, makeFakeTrash(entries), cas, t}
+}
+
 func (a *DumbcasAppMock) LoadNodesTable(rootDir string, cas CasTable) (NodesTable, error) {
 	if a.nodes == nil {
-		a.nodes = &fakeNodesTable{make(map[string][]byte), a.cas, a.TB}
+		a.nodes = makeFakeNodesTable(a.cas, a.TB)
 	}
 	return a.nodes, nil
 }
@@ -132,12 +138,46 @@ func (m *fakeNodesTable) AddEntry(node *Node, name string) (string, error) {
 	return nodePath, nil
 }
 
+func (m *fakeNodesTable) Update(name string, node *Node) error {
+	m.t.GetLog().Printf("fakeNodesTable.Update(%s)", name)
+	if _, ok := m.entries[name]; !ok {
+		return os.ErrNotExist
+	}
+	data, err := json.Marshal(node)
+	if err != nil {
+		return fmt.Errorf("Failed to marshall internal state: %s", err)
+	}
+	m.entries[name] = data
+	return nil
+}
+
+func (m *fakeNodesTable) Create(name string, node *Node) error {
+	m.t.GetLog().Printf("fakeNodesTable.Create(%s)", name)
+	if !isValidNodeName(name) {
+		return fmt.Errorf("Invalid node name %s", name)
+	}
+	if _, ok := m.entries[name]; ok {
+		return os.ErrExist
+	}
+	data, err := json.Marshal(node)
+	if err != nil {
+		return fmt.Errorf("Failed to marshall internal state: %s", err)
+	}
+	m.entries[name] = data
+	return nil
+}
+
 func (m *fakeNodesTable) Enumerate() <-chan EnumerationEntry {
 	m.t.GetLog().Printf("fakeNodesTable.Enumerate() %d", len(m.entries))
+	// Make a copy of the keys since fsck updates and removes the nodes while
+	// enumerating.
+	keys := make([]string, 0, len(m.entries))
+	for k, _ := range m.entries {
+		keys = append(keys, k)
+	}
 	c := make(chan EnumerationEntry)
 	go func() {
-		// TODO(maruel): Will blow up if mutated concurrently.
-		for k, _ := range m.entries {
+		for _, k := range keys {
 			c <- EnumerationEntry{Item: k}
 		}
 		close(c)
@@ -154,12 +194,12 @@ func (m *fakeNodesTable) Open(item string) (ReadSeekCloser, error) {
 	return Buffer{bytes.NewReader(data)}, nil
 }
 
-func (m *fakeNodesTable) Remove(name string) error {
-	if _, ok := m.entries[name]; !ok {
-		return os.ErrNotExist
-	}
-	delete(m.entries, name)
-	return nil
+func (m *fakeNodesTable) Remove(name string, record *TrashRecord) error {
+	return m.trash.Move(name, record)
+}
+
+func (m *fakeNodesTable) GetTrash() Trash {
+	return m.trash
 }
 
 // Returns a sorted list of all the entries.
@@ -176,9 +216,64 @@ func EnumerateNodesAsList(t *subcommandstest.TB, nodes NodesTable) []string {
 func TestFakeNodesTable(t *testing.T) {
 	t.Parallel()
 	tb := subcommandstest.MakeTB(t)
-	cas := &fakeCasTable{make(map[string][]byte), false, tb}
-	nodes := &fakeNodesTable{make(map[string][]byte), cas, tb}
+	cas := makeFakeCasTable(tb)
+	nodes := makeFakeNodesTable(cas, tb)
 	testNodesTableImpl(tb, cas, nodes)
+	testNodesTableUpdate(tb, nodes)
+	testNodesTableCreate(tb, nodes)
+	testNodesTableTrash(tb, nodes)
+}
+
+func TestNodePrint(t *testing.T) {
+	t.Parallel()
+	tb := subcommandstest.MakeTB(t)
+	start := time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC)
+	end := start.Add(90 * time.Second)
+	node := &Node{
+		Entry:    "1234",
+		Comment:  "useful comment",
+		Hostname: "host",
+		User:     "joe",
+		Start:    &start,
+		End:      &end,
+		Inputs:   []string{"/a", "/b"},
+		Version:  "0.1",
+		Stats:    &NodeStats{Found: 2, Size: 1024 * 1024, Hashed: 1, BytesHashed: 1024, InCache: 1, Archived: 1, BytesArchived: 1024, Errors: 1},
+		Damaged:  []string{"dir/file"},
+	}
+	out := &bytes.Buffer{}
+	node.Print(out)
+	expected := "Comment: useful comment\n" +
+		"Hostname: host\n" +
+		"User: joe\n" +
+		"Start: 2012-03-04 05:06:07 UTC\n" +
+		"End: 2012-03-04 05:07:37 UTC\n" +
+		"Duration: 1m30s\n" +
+		"Version: 0.1\n" +
+		"Inputs:\n" +
+		"- '/a'\n" +
+		"- '/b'\n" +
+		"Damaged:\n" +
+		"- 'dir/file'\n" +
+		"Stats:\n" +
+		"  Found: 2 (1.0mb)\n" +
+		"  Excluded: 0\n" +
+		"  Hashed: 1 (0.0mb)\n" +
+		"  In cache: 1\n" +
+		"  Archived: 1 (0.0mb)\n" +
+		"  Changed: 0\n" +
+		"  Errors: 1\n"
+	tb.Assertf(out.String() == expected, "Unexpected output:\n%s", out.String())
+
+	// An older node only has its Entry and Comment.
+	out.Reset()
+	(&Node{Entry: "1234", Comment: "old"}).Print(out)
+	tb.Assertf(out.String() == "Comment: old\n", "Unexpected output:\n%s", out.String())
+
+	// It is also saved as such.
+	data, err := json.Marshal(&Node{Entry: "1234", Comment: "old"})
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	tb.Assertf(string(data) == `{"Entry":"1234","Comment":"old"}`, "Unexpected json %s", data)
 }
 
 func request(t *subcommandstest.TB, nodes NodesTable, path string, expectedCode int, expectedBody string) string {
@@ -196,12 +291,12 @@ func request(t *subcommandstest.TB, nodes NodesTable, path string, expectedCode
 	return body
 }
 
-// Returns the tree of sha1s and the json encoded Node as bytes.
-func marshalData(t *subcommandstest.TB, tree map[string]string) (map[string]string, []byte) {
+// Returns the tree of digests and the json encoded Node as bytes.
+func marshalData(t *subcommandstest.TB, hash *HashAlgorithm, tree map[string]string) (map[string]string, []byte) {
 	sha1tree := map[string]string{}
 	entries := &Entry{}
 	for k, v := range tree {
-		h := sha1Bytes([]byte(v))
+		h := hash.HashBytes([]byte(v))
 		sha1tree[k] = h
 		e := entries
 		parts := strings.Split(k, "/")
@@ -230,10 +325,10 @@ func marshalData(t *subcommandstest.TB, tree map[string]string) (map[string]stri
 }
 
 // Archives a tree fictious data.
-// Returns (tree of sha1s, name of the node, sha1 of the node entry).
+// Returns (tree of digests, name of the node, digest of the node entry).
 // Accept the paths as posix.
 func archiveData(t *subcommandstest.TB, cas CasTable, nodes NodesTable, tree map[string]string) (map[string]string, string, string) {
-	sha1tree, entries := marshalData(t, tree)
+	sha1tree, entries := marshalData(t, cas.GetHashAlgorithm(), tree)
 	for k, v := range tree {
 		err := cas.AddEntry(bytes.NewBuffer([]byte(v)), sha1tree[k])
 		t.Assertf(err == nil || err == os.ErrExist, "Unexpected error: %s", err)
@@ -243,7 +338,7 @@ func archiveData(t *subcommandstest.TB, cas CasTable, nodes NodesTable, tree map
 
 	// And finally add the node.
 	now := time.Now().UTC()
-	nodeName, err := nodes.AddEntry(&Node{entrySha1, "useful comment"}, "fictious")
+	nodeName, err := nodes.AddEntry(&Node{Entry: entrySha1, Comment: "useful comment"}, "fictious")
 	t.Assertf(err == nil, "Failed to add node: %s", err)
 	t.Assertf(strings.HasPrefix(nodeName, now.Format("2006-01")+string(filepath.Separator)), "Invalid node name %s", nodeName)
 	return sha1tree, nodeName, entrySha1
@@ -272,3 +367,55 @@ func testNodesTableImpl(t *subcommandstest.TB, cas CasTable, nodes NodesTable) {
 	request(t, nodes, "/"+name+"/dir1/dir2/file3", 404, "")
 	request(t, nodes, "/"+name+"/dir1/dir2", 301, "")
 }
+
+// Verifies Update() replaces the content of a node in place.
+func testNodesTableUpdate(t *subcommandstest.TB, nodes NodesTable) {
+	items := EnumerateNodesAsList(t, nodes)
+	t.Assertf(len(items) != 0, "Found no node")
+	node, err := LoadNode(nodes, items[0])
+	t.Assertf(err == nil, "Unexpected error: %s", err)
+	node.Damaged = []string{"file1"}
+	t.Assertf(nodes.Update(items[0], node) == nil, "Failed to update %s", items[0])
+	node, err = LoadNode(nodes, items[0])
+	t.Assertf(err == nil && Equals(node.Damaged, []string{"file1"}), "Unexpected node: %v %s", node, err)
+	rest := EnumerateNodesAsList(t, nodes)
+	t.Assertf(Equals(rest, items), "Unexpected nodes: %q", rest)
+	t.Assertf(nodes.Update("2012-01/missing", node) != nil, "Unexpected success")
+}
+
+// Verifies Create() adds a node under its name and never replaces one.
+func testNodesTableCreate(t *subcommandstest.TB, nodes NodesTable) {
+	items := EnumerateNodesAsList(t, nodes)
+	t.Assertf(len(items) != 0, "Found no node")
+	node, err := LoadNode(nodes, items[0])
+	t.Assertf(err == nil, "Unexpected error: %s", err)
+	name := filepath.Join("2012-01", "host_2012-01-02_03-04-05_copy")
+	t.Assertf(nodes.Create(name, node) == nil, "Failed to create %s", name)
+	created, err := LoadNode(nodes, name)
+	t.Assertf(err == nil && created.Entry == node.Entry, "Unexpected node: %v %s", created, err)
+	rest := EnumerateNodesAsList(t, nodes)
+	t.Assertf(len(rest) == len(items)+1, "Unexpected nodes: %q", rest)
+	err = nodes.Create(name, &Node{Entry: "invalid"})
+	t.Assertf(os.IsExist(err), "Unexpected error: %s", err)
+	created, err = LoadNode(nodes, name)
+	t.Assertf(err == nil && created.Entry == node.Entry, "Unexpected node: %v %s", created, err)
+	for _, invalid := range []string{"", "../escape", filepath.Join(TrashName, "2012-01", "x")} {
+		t.Assertf(nodes.Create(invalid, node) != nil, "Unexpected success for %q", invalid)
+	}
+}
+
+// Verifies Remove() moves the nodes to the trash.
+func testNodesTableTrash(t *subcommandstest.TB, nodes NodesTable) {
+	items := EnumerateNodesAsList(t, nodes)
+	t.Assertf(len(items) != 0, "Found no node")
+	t.Assertf(nodes.Remove(items[0], nil) == nil, "Failed to remove %s", items[0])
+	trashed := EnumerateTrashAsList(t, nodes.GetTrash())
+	t.Assertf(Equals(trashed, items[:1]), "Unexpected trash: %q", trashed)
+	rest := EnumerateNodesAsList(t, nodes)
+	t.Assertf(Equals(rest, items[1:]), "Unexpected nodes: %q", rest)
+	f, err := nodes.GetTrash().Open(items[0])
+	t.Assertf(err == nil, "Unexpected error: %s", err)
+	defer f.Close()
+	node := &Node{}
+	t.Assertf(loadReaderAsJson(f, node) == nil && node.Entry != "", "Failed to load %s", items[0])
+}
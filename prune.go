@@ -0,0 +1,181 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"fmt"
+	"github.com/maruel/subcommands"
+	"sort"
+	"strings"
+	"time"
+)
+
+var cmdPrune = &subcommands.Command{
+	UsageLine: "prune",
+	ShortDesc: "removes the nodes not kept by a retention policy",
+	LongDesc:  "Applies a retention policy independently to the nodes of each tag and host and moves the nodes it doesn't keep to the trash. The newest node of each period is kept, e.g. -keep-daily 7 keeps the newest node of each of the last 7 days that have nodes. Use -gc to also remove the objects that are not referenced anymore.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &pruneRun{}
+		c.Init()
+		c.exclusive = true
+		c.Flags.IntVar(&c.policy.last, "keep-last", 0, "Keeps the last n nodes")
+		c.Flags.IntVar(&c.policy.daily, "keep-daily", 0, "Keeps the newest node of each of the last n days")
+		c.Flags.IntVar(&c.policy.weekly, "keep-weekly", 0, "Keeps the newest node of each of the last n weeks")
+		c.Flags.IntVar(&c.policy.monthly, "keep-monthly", 0, "Keeps the newest node of each of the last n months")
+		c.Flags.IntVar(&c.policy.yearly, "keep-yearly", 0, "Keeps the newest node of each of the last n years")
+		c.Flags.StringVar(&c.tag, "tag", "", "Only prune the nodes with this tag")
+		c.Flags.StringVar(&c.host, "host", "", "Only prune the nodes archived on this host")
+		c.Flags.BoolVar(&c.dryRun, "dry-run", false, "Prints the nodes that would be removed without removing them")
+		c.Flags.BoolVar(&c.gc, "gc", false, "Runs gc after removing the nodes")
+		c.Flags.DurationVar(&c.grace, "grace", defaultGcGrace, "With -gc, keeps the unreferenced objects modified within this period")
+		return c
+	},
+}
+
+type pruneRun struct {
+	CommonFlags
+	policy retentionPolicy
+	tag    string
+	host   string
+	dryRun bool
+	gc     bool
+	grace  time.Duration
+}
+
+// Number of nodes to keep for each rule. 0 disables a rule.
+type retentionPolicy struct {
+	last    int
+	daily   int
+	weekly  int
+	monthly int
+	yearly  int
+}
+
+func (p *retentionPolicy) validate() error {
+	if p.last < 0 || p.daily < 0 || p.weekly < 0 || p.monthly < 0 || p.yearly < 0 {
+		return fmt.Errorf("-keep-* values can't be negative")
+	}
+	if p.last == 0 && p.daily == 0 && p.weekly == 0 && p.monthly == 0 && p.yearly == 0 {
+		return fmt.Errorf("Must provide at least one -keep-* value")
+	}
+	return nil
+}
+
+// A rule keeps the newest node of each of the last |count| periods. Two nodes
+// are in the same period when |period| returns the same key for both.
+type retentionRule struct {
+	name   string
+	count  int
+	period func(t time.Time) string
+}
+
+func (p *retentionPolicy) rules() []retentionRule {
+	return []retentionRule{
+		// Each node is in its own period.
+		{"last", p.last, nil},
+		{"daily", p.daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{"weekly", p.weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-%02d", year, week)
+		}},
+		{"monthly", p.monthly, func(t time.Time) string { return t.Format("2006-01") }},
+		{"yearly", p.yearly, func(t time.Time) string { return t.Format("2006") }},
+	}
+}
+
+// Returns the rules keeping each node, by name. The nodes missing from the
+// returned map are not kept. The policy is applied independently to the nodes
+// of each tag and host.
+func (p *retentionPolicy) apply(infos []*NodeInfo) map[string][]string {
+	groups := map[string][]*NodeInfo{}
+	for _, info := range infos {
+		key := info.Host + "/" + info.Tag
+		groups[key] = append(groups[key], info)
+	}
+	kept := map[string][]string{}
+	for _, group := range groups {
+		// Newest first.
+		sort.Sort(sort.Reverse(nodeInfosByTime(group)))
+		for _, rule := range p.rules() {
+			used := 0
+			last := ""
+			for _, info := range group {
+				if used == rule.count {
+					break
+				}
+				if rule.period != nil {
+					key := rule.period(info.Timestamp)
+					if used != 0 && key == last {
+						continue
+					}
+					last = key
+				}
+				kept[info.Name] = append(kept[info.Name], rule.name)
+				used++
+			}
+		}
+	}
+	return kept
+}
+
+func (c *pruneRun) main(a DumbcasApplication) error {
+	if err := c.policy.validate(); err != nil {
+		return err
+	}
+	if c.dryRun && c.gc {
+		return fmt.Errorf("-gc can't be used with -dry-run")
+	}
+	if err := c.Parse(a, false); err != nil {
+		return err
+	}
+	defer c.Close()
+
+	infos, err := enumerateNodeInfos(c.nodes, &nodeFilter{tag: c.tag, host: c.host})
+	if err != nil {
+		return err
+	}
+	kept := c.policy.apply(infos)
+	removed := 0
+	for _, info := range infos {
+		if reasons, ok := kept[info.Name]; ok {
+			fmt.Fprintf(a.GetOut(), "keep    %s (%s)\n", info.Name, strings.Join(reasons, ", "))
+			continue
+		}
+		fmt.Fprintf(a.GetOut(), "remove  %s\n", info.Name)
+		removed++
+		if !c.dryRun {
+			if err := c.nodes.Remove(info.Name, &TrashRecord{Reason: TrashPruned}); err != nil {
+				return fmt.Errorf("Failed to remove %s: %s", info.Name, err)
+			}
+		}
+	}
+	if c.dryRun {
+		fmt.Fprintf(a.GetOut(), "Would keep %d nodes and remove %d nodes\n", len(infos)-removed, removed)
+		return nil
+	}
+	fmt.Fprintf(a.GetOut(), "Kept %d nodes and removed %d nodes\n", len(infos)-removed, removed)
+	if c.gc && removed != 0 {
+		return collectGarbage(a, c.cas, c.nodes, c.grace, false, false)
+	}
+	return nil
+}
+
+func (c *pruneRun) Run(a subcommands.Application, args []string) int {
+	if len(args) != 0 {
+		fmt.Fprintf(a.GetErr(), "%s: Unsupported arguments.\n", a.GetName())
+		return 1
+	}
+	d := a.(DumbcasApplication)
+	if err := c.main(d); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
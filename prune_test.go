@@ -0,0 +1,144 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/maruel/subcommands/subcommandstest"
+	"path"
+	"sort"
+	"testing"
+	"time"
+)
+
+// Returns the names of the nodes kept by |policy| out of the nodes created at
+// each of |times| with the tag "data".
+func applyPolicy(t *subcommandstest.TB, policy retentionPolicy, times []string) []string {
+	infos := []*NodeInfo{}
+	for _, s := range times {
+		timestamp, err := time.Parse("2006-01-02_15-04-05", s)
+		t.Assertf(err == nil, "Unexpected error: %s", err)
+		infos = append(infos, &NodeInfo{Name: s, Timestamp: timestamp, Tag: "data"})
+	}
+	kept := []string{}
+	for name := range policy.apply(infos) {
+		kept = append(kept, name)
+	}
+	sort.Strings(kept)
+	return kept
+}
+
+func TestRetentionPolicy(t *testing.T) {
+	t.Parallel()
+	tb := subcommandstest.MakeTB(t)
+	times := []string{
+		"2011-12-31_10-00-00",
+		"2012-01-01_10-00-00",
+		"2012-01-01_22-00-00",
+		"2012-01-02_10-00-00",
+		"2012-02-15_10-00-00",
+		"2012-02-16_10-00-00",
+		"2012-02-16_11-00-00",
+	}
+	data := []struct {
+		policy   retentionPolicy
+		expected []string
+	}{
+		{
+			retentionPolicy{last: 2},
+			[]string{"2012-02-16_10-00-00", "2012-02-16_11-00-00"},
+		},
+		{
+			retentionPolicy{daily: 3},
+			[]string{"2012-01-02_10-00-00", "2012-02-15_10-00-00", "2012-02-16_11-00-00"},
+		},
+		{
+			// 2012-01-01 is a Sunday, it is in the same week as 2011-12-31.
+			retentionPolicy{weekly: 3},
+			[]string{"2012-01-01_22-00-00", "2012-01-02_10-00-00", "2012-02-16_11-00-00"},
+		},
+		{
+			retentionPolicy{monthly: 12},
+			[]string{"2011-12-31_10-00-00", "2012-01-02_10-00-00", "2012-02-16_11-00-00"},
+		},
+		{
+			retentionPolicy{yearly: 1},
+			[]string{"2012-02-16_11-00-00"},
+		},
+		{
+			retentionPolicy{last: 1, yearly: 2},
+			[]string{"2011-12-31_10-00-00", "2012-02-16_11-00-00"},
+		},
+	}
+	for i, d := range data {
+		kept := applyPolicy(tb, d.policy, times)
+		tb.Assertf(Equals(kept, d.expected), "%d: Unexpected nodes %q", i, kept)
+	}
+
+	// The policy is applied independently to each tag and host.
+	infos := []*NodeInfo{
+		&NodeInfo{Name: "a", Timestamp: time.Unix(1, 0), Tag: "data", Host: "host1"},
+		&NodeInfo{Name: "b", Timestamp: time.Unix(2, 0), Tag: "data", Host: "host1"},
+		&NodeInfo{Name: "c", Timestamp: time.Unix(3, 0), Tag: "data", Host: "host2"},
+		&NodeInfo{Name: "d", Timestamp: time.Unix(4, 0), Tag: "other", Host: "host1"},
+	}
+	kept := (&retentionPolicy{last: 1}).apply(infos)
+	_, ok := kept["a"]
+	tb.Assertf(!ok && len(kept) == 3, "Unexpected nodes %v", kept)
+	tb.Assertf(Equals(kept["b"], []string{"last"}), "Unexpected reasons %v", kept["b"])
+}
+
+func TestPrune(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	f.MakeCasTable("")
+	f.LoadNodesTable("", f.cas)
+	nodes := f.nodes.(*fakeNodesTable)
+
+	_, _, entry1 := archiveData(f.TB, f.cas, f.nodes, map[string]string{"file1": "content1"})
+	_, _, entry2 := archiveData(f.TB, f.cas, f.nodes, map[string]string{"file2": "content2"})
+	for k := range nodes.entries {
+		delete(nodes.entries, k)
+	}
+	names := []string{
+		"2012-01/2012-01-01_10-00-00_data",
+		"2012-01/2012-01-02_10-00-00_data",
+		"2012-01/2012-01-02_11-00-00_data",
+	}
+	for i, name := range names {
+		entry := entry2
+		if i == 0 {
+			entry = entry1
+		}
+		data, err := json.Marshal(&Node{Entry: entry})
+		f.Assertf(err == nil, "Unexpected error: %s", err)
+		nodes.entries[name] = data
+	}
+	nodes.entries[path.Join(tagsName, "data")] = nodes.entries[names[2]]
+	objects := EnumerateCasAsList(f.TB, f.cas)
+
+	// At least one rule is required.
+	f.Run([]string{"prune", "-root=\\test_prune"}, 1)
+	f.CheckBuffer(false, true)
+
+	f.Run([]string{"prune", "-root=\\test_prune", "-keep-last=1", "-dry-run"}, 0)
+	f.CheckBuffer(true, false)
+	all := EnumerateNodesAsList(f.TB, f.nodes)
+	f.Assertf(len(all) == 4, "Unexpected nodes: %q", all)
+
+	f.Run([]string{"prune", "-root=\\test_prune", "-keep-daily=1", "-gc", "-grace=0"}, 0)
+	f.CheckBuffer(true, false)
+	all = EnumerateNodesAsList(f.TB, f.nodes)
+	expected := []string{names[2], path.Join(tagsName, "data")}
+	f.Assertf(Equals(all, expected), "Unexpected nodes: %q", all)
+	// The objects only referenced by the first node were removed.
+	remaining := EnumerateCasAsList(f.TB, f.cas)
+	f.Assertf(len(remaining) == len(objects)-2, "Unexpected objects: %q", remaining)
+}
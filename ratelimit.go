@@ -0,0 +1,64 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Spreads the reads of all the goroutines sharing it so their total throughput
+// doesn't exceed bytesPerSec. A nil rateLimiter doesn't throttle.
+type rateLimiter struct {
+	bytesPerSec float64
+	lock        sync.Mutex
+	// When the bytes reserved so far are paid for.
+	next time.Time
+}
+
+// Returns nil if |mbPerSec| is 0, meaning unlimited.
+func makeRateLimiter(mbPerSec float64) *rateLimiter {
+	if mbPerSec <= 0 {
+		return nil
+	}
+	return &rateLimiter{bytesPerSec: mbPerSec * 1024 * 1024}
+}
+
+// Accounts for |n| bytes read, sleeping until the bytes read before are paid
+// for.
+func (r *rateLimiter) Wait(n int) {
+	if r == nil || n <= 0 {
+		return
+	}
+	r.lock.Lock()
+	now := time.Now()
+	if r.next.Before(now) {
+		r.next = now
+	}
+	wait := r.next.Sub(now)
+	r.next = r.next.Add(time.Duration(float64(n) / r.bytesPerSec * float64(time.Second)))
+	r.lock.Unlock()
+	time.Sleep(wait)
+}
+
+// Counts the bytes read and throttles them with limiter, which may be nil.
+type throttledReader struct {
+	r       io.Reader
+	limiter *rateLimiter
+	n       int64
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	t.n += int64(n)
+	t.limiter.Wait(n)
+	return n, err
+}
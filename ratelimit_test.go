@@ -0,0 +1,51 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"bytes"
+	"github.com/maruel/subcommands/subcommandstest"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// Returns at most 1000 bytes per Read() call.
+type smallReader struct {
+	r io.Reader
+}
+
+func (s *smallReader) Read(p []byte) (int, error) {
+	if len(p) > 1000 {
+		p = p[:1000]
+	}
+	return s.r.Read(p)
+}
+
+func TestRateLimiter(t *testing.T) {
+	t.Parallel()
+	tb := subcommandstest.MakeTB(t)
+	tb.Assertf(makeRateLimiter(0) == nil, "Expected no limit")
+
+	data := make([]byte, 4000)
+	r := &throttledReader{r: &smallReader{bytes.NewReader(data)}}
+	_, err := ioutil.ReadAll(r)
+	tb.Assertf(err == nil && r.n == 4000, "Unexpected result %d %s", r.n, err)
+
+	// 20000 bytes/s; the first 1000 bytes are free then each read waits 50ms.
+	limiter := &rateLimiter{bytesPerSec: 20000}
+	start := time.Now()
+	r = &throttledReader{r: &smallReader{bytes.NewReader(data)}, limiter: limiter}
+	_, err = ioutil.ReadAll(r)
+	tb.Assertf(err == nil && r.n == 4000, "Unexpected result %d %s", r.n, err)
+	elapsed := time.Since(start)
+	tb.Assertf(elapsed >= 140*time.Millisecond, "Not throttled: %s", elapsed)
+}
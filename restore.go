@@ -39,8 +39,8 @@ type restoreRun struct {
 // error.
 // Do not overwrite files. A file already present is considered an error.
 func restoreEntry(l *log.Logger, cas CasTable, entry *Entry, root string) (count int, out error) {
-	if entry.Sha1 != "" {
-		f, err := cas.Open(entry.Sha1)
+	if entry.isFile() {
+		f, err := entry.Open(cas)
 		if err != nil {
 			out = fmt.Errorf("Failed to fetch %s for %s: %s", entry.Sha1, root, err)
 		} else {
@@ -70,6 +70,15 @@ func restoreEntry(l *log.Logger, cas CasTable, entry *Entry, root string) (count
 			l.Printf("%s(%d)", root, entry.Size)
 		}
 	}
+	if entry.Dir != "" {
+		dir, err := entry.loadDir(cas)
+		if err != nil {
+			err = fmt.Errorf("Failed to fetch directory %s for %s: %s", entry.Dir, root, err)
+			l.Printf("%s", err)
+			return count, err
+		}
+		entry = dir
+	}
 	for name, child := range entry.Files {
 		c, err := restoreEntry(l, cas, child, filepath.Join(root, name))
 		if err != nil && out == nil {
@@ -84,6 +93,7 @@ func (c *restoreRun) main(a DumbcasApplication, nodeArg string) error {
 	if err := c.Parse(a, true); err != nil {
 		return err
 	}
+	defer c.Close()
 
 	// Load the Node and process it.
 	// Do it serially for now, assuming that it is I/O bound on magnetic disks.
@@ -0,0 +1,873 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SHA-256 of an empty payload, signed for the requests without a body.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// A single PUT is limited to 5GB, so larger objects are uploaded in parts of
+// at least s3PartSize. An upload has at most s3MaxParts parts. A single copy
+// is limited to s3MaxCopySize too.
+const (
+	s3PartSize    = 128 * 1024 * 1024
+	s3MaxParts    = 10000
+	s3MaxCopySize = 5 * 1024 * 1024 * 1024
+)
+
+// Returns true if |root| designates a repository stored in an S3 bucket, e.g.
+// s3://bucket/prefix.
+func isS3Root(root string) bool {
+	return strings.HasPrefix(root, "s3://")
+}
+
+// Where and how to access the S3-compatible service.
+type s3Config struct {
+	// e.g. https://s3.us-east-1.amazonaws.com or http://minio:9000.
+	Endpoint  string
+	Region    string
+	AccessKey string
+	SecretKey string
+}
+
+// Reads the configuration from the environment variables used by the AWS
+// tools. Set $DUMBCAS_S3_ENDPOINT to use another S3-compatible service.
+func s3ConfigFromEnv() *s3Config {
+	config := &s3Config{
+		Endpoint:  os.Getenv("DUMBCAS_S3_ENDPOINT"),
+		Region:    os.Getenv("AWS_REGION"),
+		AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = "https://s3." + config.Region + ".amazonaws.com"
+	}
+	return config
+}
+
+// Sends requests signed with AWS Signature Version 4 to a bucket, using
+// path-style addressing. The keys passed to the methods are relative to
+// |prefix|, which is empty or ends with "/".
+type s3Client struct {
+	config   *s3Config
+	endpoint string
+	bucket   string
+	prefix   string
+	client   *http.Client
+	// Objects larger than this are uploaded in parts.
+	partSize int64
+	// Objects larger than this are copied in parts.
+	maxCopySize int64
+}
+
+func makeS3Client(root string, config *s3Config) (*s3Client, error) {
+	if !isS3Root(root) {
+		return nil, fmt.Errorf("Invalid S3 root %s", root)
+	}
+	bucket := strings.Trim(root[len("s3://"):], "/")
+	prefix := ""
+	if i := strings.Index(bucket, "/"); i != -1 {
+		prefix = bucket[i+1:] + "/"
+		bucket = bucket[:i]
+	}
+	if bucket == "" {
+		return nil, fmt.Errorf("Invalid S3 root %s; use s3://bucket/prefix", root)
+	}
+	if config.AccessKey == "" || config.SecretKey == "" {
+		return nil, fmt.Errorf("Set $AWS_ACCESS_KEY_ID and $AWS_SECRET_ACCESS_KEY to access %s", root)
+	}
+	return &s3Client{config, strings.TrimRight(config.Endpoint, "/"), bucket, prefix, &http.Client{}, s3PartSize, s3MaxCopySize}, nil
+}
+
+// Escapes |s| as required by Signature Version 4: every character but the
+// unreserved ones, and "/" unless |keepSlash| is set.
+func awsEscape(s string, keepSlash bool) string {
+	out := &bytes.Buffer{}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') || c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && keepSlash) {
+			out.WriteByte(c)
+		} else {
+			fmt.Fprintf(out, "%%%02X", c)
+		}
+	}
+	return out.String()
+}
+
+// Returns the query string in its canonical form, sorted by key.
+func awsQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parts := []string{}
+	for _, key := range keys {
+		values := append([]string{}, query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			parts = append(parts, awsEscape(key, false)+"="+awsEscape(value, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// Signs |req| with AWS Signature Version 4. The host and the x-amz-* headers are
+// signed. |payloadHash| is the hex encoded SHA-256 of the body. The query must
+// already be in its canonical form.
+func signV4(req *http.Request, payloadHash, region, service, accessKey, secretKey string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{req.Method, req.URL.EscapedPath(), req.URL.RawQuery, canonicalHeaders, signedHeaders, payloadHash}, "\n")
+	digest := sha256.Sum256([]byte(canonicalRequest))
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(digest[:])
+	key := hmacSha256([]byte("AWS4"+secretKey), date)
+	key = hmacSha256(key, region)
+	key = hmacSha256(key, service)
+	key = hmacSha256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", accessKey, scope, signedHeaders, signature))
+}
+
+// Error returned by S3.
+type s3Error struct {
+	Code    string
+	Message string
+}
+
+// Creates a request for |key|. An empty |key| designates the bucket itself.
+func (c *s3Client) newRequest(method, key string, query url.Values, body io.Reader) (*http.Request, error) {
+	u := c.endpoint + "/" + awsEscape(c.bucket, false)
+	if key != "" {
+		u += "/" + awsEscape(c.prefix+key, true)
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req.URL.RawQuery = awsQuery(query)
+	return req, nil
+}
+
+// Signs and sends |req| and returns the response if its status is one of
+// |statuses|. Otherwise the body is closed and the error is returned; a 404
+// is returned as os.ErrNotExist and a failed precondition as os.ErrExist.
+func (c *s3Client) do(req *http.Request, payloadHash string, statuses ...int) (*http.Response, error) {
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	signV4(req, payloadHash, c.config.Region, "s3", c.config.AccessKey, c.config.SecretKey, time.Now())
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range statuses {
+		if resp.StatusCode == status {
+			return resp, nil
+		}
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return nil, os.ErrNotExist
+	case http.StatusPreconditionFailed:
+		return nil, os.ErrExist
+	}
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	s3err := &s3Error{}
+	if xml.Unmarshal(data, s3err) != nil || s3err.Code == "" {
+		return nil, fmt.Errorf("%s %s: %s", req.Method, req.URL.Path, resp.Status)
+	}
+	return nil, fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Path, s3err.Code, s3err.Message)
+}
+
+// Returns the content of an object.
+func (c *s3Client) get(key string) ([]byte, error) {
+	req, err := c.newRequest("GET", key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req, emptyPayloadHash, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Opens an object for reading. Seeking sends a new request with a Range header.
+func (c *s3Client) open(key string) (ReadSeekCloser, error) {
+	return openHttpObject(key, func(offset int64) (*http.Response, error) {
+		req, err := c.newRequest("GET", key, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		if offset != 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+		return c.do(req, emptyPayloadHash, http.StatusOK, http.StatusPartialContent)
+	})
+}
+
+// Returns the size and the modification time of an object.
+func (c *s3Client) head(key string) (*ObjectInfo, error) {
+	req, err := c.newRequest("HEAD", key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req, emptyPayloadHash, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	modTime, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid modification time of %s: %s", key, err)
+	}
+	return &ObjectInfo{resp.ContentLength, modTime}, nil
+}
+
+// Checksums of the content of an object. They are sent along the content so
+// S3 refuses it if it was corrupted in transit.
+type s3Checksums struct {
+	sha256 []byte
+	md5    []byte
+}
+
+func s3ChecksumsOf(data []byte) *s3Checksums {
+	s := sha256.Sum256(data)
+	m := md5.Sum(data)
+	return &s3Checksums{s[:], m[:]}
+}
+
+// Uploads the |size| bytes of |body| whose checksums are |sums|. If
+// |exclusive| is set, fails with os.ErrExist if the object already exists.
+func (c *s3Client) put(key string, body io.Reader, size int64, sums *s3Checksums, exclusive bool) error {
+	req, err := c.newRequest("PUT", key, nil, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sums.md5))
+	req.Header.Set("X-Amz-Checksum-Sha256", base64.StdEncoding.EncodeToString(sums.sha256))
+	if exclusive {
+		req.Header.Set("If-None-Match", "*")
+	}
+	resp, err := c.do(req, hex.EncodeToString(sums.sha256), http.StatusOK)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+type s3InitiateResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	UploadId string
+}
+
+type s3CompletedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+type s3CompleteUpload struct {
+	XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletedPart `xml:"Part"`
+}
+
+type s3CompleteResult struct {
+	XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+}
+
+type s3CopyPartResult struct {
+	XMLName xml.Name `xml:"CopyPartResult"`
+	ETag    string
+}
+
+// Creates the object |key| of |size| bytes with a multipart upload. |part|
+// sends the |n| bytes at |offset| as the part |number| and returns its ETag.
+// The object only exists once all the parts are sent; the upload is aborted on
+// failure.
+func (c *s3Client) multipart(key string, size int64, part func(uploadId string, number int, offset, n int64) (string, error)) error {
+	req, err := c.newRequest("POST", key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := c.do(req, emptyPayloadHash, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	initiate := &s3InitiateResult{}
+	err = readS3Result(req, resp, initiate)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if err = c.sendParts(key, initiate.UploadId, size, part); err != nil {
+		// Ignore the error.
+		c.abortMultipart(key, initiate.UploadId)
+	}
+	return err
+}
+
+func (c *s3Client) sendParts(key, uploadId string, size int64, part func(uploadId string, number int, offset, n int64) (string, error)) error {
+	partSize := c.partSize
+	if size > partSize*s3MaxParts {
+		partSize = (size + s3MaxParts - 1) / s3MaxParts
+	}
+	complete := &s3CompleteUpload{}
+	for offset := int64(0); offset < size; offset += partSize {
+		n := partSize
+		if offset+n > size {
+			n = size - offset
+		}
+		number := len(complete.Parts) + 1
+		etag, err := part(uploadId, number, offset, n)
+		if err != nil {
+			return err
+		}
+		complete.Parts = append(complete.Parts, s3CompletedPart{number, etag})
+	}
+	data, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	req, err := c.newRequest("POST", key, url.Values{"uploadId": {uploadId}}, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256(data)
+	resp, err := c.do(req, hex.EncodeToString(digest[:]), http.StatusOK)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return readS3Result(req, resp, &s3CompleteResult{})
+}
+
+func (c *s3Client) abortMultipart(key, uploadId string) error {
+	req, err := c.newRequest("DELETE", key, url.Values{"uploadId": {uploadId}}, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req, emptyPayloadHash, http.StatusNoContent)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func partQuery(uploadId string, number int) url.Values {
+	return url.Values{"partNumber": {fmt.Sprintf("%d", number)}, "uploadId": {uploadId}}
+}
+
+// Uploads the |size| bytes of |f| in parts. Each part is sent along its
+// checksums so S3 refuses a corrupted one.
+func (c *s3Client) putMultipart(key string, f io.ReaderAt, size int64) error {
+	return c.multipart(key, size, func(uploadId string, number int, offset, n int64) (string, error) {
+		part := io.NewSectionReader(f, offset, n)
+		s := sha256.New()
+		m := md5.New()
+		if _, err := io.Copy(io.MultiWriter(s, m), part); err != nil {
+			return "", err
+		}
+		if _, err := part.Seek(0, 0); err != nil {
+			return "", err
+		}
+		// The HTTP client would close a ReadCloser.
+		req, err := c.newRequest("PUT", key, partQuery(uploadId, number), ioutil.NopCloser(part))
+		if err != nil {
+			return "", err
+		}
+		req.ContentLength = n
+		req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(m.Sum(nil)))
+		resp, err := c.do(req, hex.EncodeToString(s.Sum(nil)), http.StatusOK)
+		if err != nil {
+			return "", err
+		}
+		resp.Body.Close()
+		return resp.Header.Get("ETag"), nil
+	})
+}
+
+// Copies the |size| bytes of |src| in parts.
+func (c *s3Client) copyMultipart(src, dst string, size int64) error {
+	return c.multipart(dst, size, func(uploadId string, number int, offset, n int64) (string, error) {
+		req, err := c.newRequest("PUT", dst, partQuery(uploadId, number), nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("X-Amz-Copy-Source", c.copySource(src))
+		req.Header.Set("X-Amz-Copy-Source-Range", fmt.Sprintf("bytes=%d-%d", offset, offset+n-1))
+		resp, err := c.do(req, emptyPayloadHash, http.StatusOK)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		result := &s3CopyPartResult{}
+		if err := readS3Result(req, resp, result); err != nil {
+			return "", err
+		}
+		return result.ETag, nil
+	})
+}
+
+func (c *s3Client) putBytes(key string, data []byte, exclusive bool) error {
+	return c.put(key, bytes.NewReader(data), int64(len(data)), s3ChecksumsOf(data), exclusive)
+}
+
+// Reads the XML result of |req| in |result|. S3 can fail a request after it
+// replied 200, in which case the body is an error instead of the result.
+func readS3Result(req *http.Request, resp *http.Response, result interface{}) error {
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("%s %s: %s", req.Method, req.URL.Path, err)
+	}
+	s3err := &s3Error{}
+	if xml.Unmarshal(data, s3err) == nil && s3err.Code != "" {
+		return fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Path, s3err.Code, s3err.Message)
+	}
+	if err := xml.Unmarshal(data, result); err != nil {
+		return fmt.Errorf("%s %s: invalid result: %s", req.Method, req.URL.Path, err)
+	}
+	return nil
+}
+
+type s3CopyResult struct {
+	XMLName xml.Name `xml:"CopyObjectResult"`
+}
+
+func (c *s3Client) copySource(key string) string {
+	return "/" + awsEscape(c.bucket, false) + "/" + awsEscape(c.prefix+key, true)
+}
+
+// Copies an object, in parts if it is larger than a single copy allows.
+// Copying an object onto itself updates its modification time; S3 refuses it
+// unless the metadata is replaced, so the metadata set by put() is sent again.
+func (c *s3Client) copy(src, dst string) error {
+	info, err := c.head(src)
+	if err != nil {
+		return err
+	}
+	if info.Size > c.maxCopySize {
+		return c.copyMultipart(src, dst, info.Size)
+	}
+	req, err := c.newRequest("PUT", dst, nil, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-Amz-Copy-Source", c.copySource(src))
+	req.Header.Set("X-Amz-Metadata-Directive", "REPLACE")
+	resp, err := c.do(req, emptyPayloadHash, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return readS3Result(req, resp, &s3CopyResult{})
+}
+
+// Deletes an object. Deleting a missing object succeeds.
+func (c *s3Client) delete(key string) error {
+	req, err := c.newRequest("DELETE", key, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req, emptyPayloadHash, http.StatusNoContent, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// A page of the result of ListObjectsV2. The keys are relative to the prefix
+// of the client.
+type s3ListResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Contents              []s3ListObject
+	CommonPrefixes        []s3CommonPrefix
+	IsTruncated           bool
+	NextContinuationToken string `xml:",omitempty"`
+}
+
+type s3ListObject struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+type s3CommonPrefix struct {
+	Prefix string
+}
+
+// Calls |page| for each page of the objects whose key starts with |prefix|.
+// With a |delimiter|, the keys containing it after |prefix| are grouped in
+// CommonPrefixes. Stops when interrupted.
+func (c *s3Client) list(prefix, delimiter string, page func(*s3ListResult) error) error {
+	token := ""
+	for !IsInterrupted() {
+		query := url.Values{"list-type": {"2"}, "prefix": {c.prefix + prefix}}
+		if delimiter != "" {
+			query.Set("delimiter", delimiter)
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		req, err := c.newRequest("GET", "", query, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := c.do(req, emptyPayloadHash, http.StatusOK)
+		if err != nil {
+			return err
+		}
+		result := &s3ListResult{}
+		err = xml.NewDecoder(resp.Body).Decode(result)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("Invalid listing of %s: %s", prefix, err)
+		}
+		for i := range result.Contents {
+			result.Contents[i].Key = strings.TrimPrefix(result.Contents[i].Key, c.prefix)
+		}
+		for i := range result.CommonPrefixes {
+			result.CommonPrefixes[i].Prefix = strings.TrimPrefix(result.CommonPrefixes[i].Prefix, c.prefix)
+		}
+		if err := page(result); err != nil {
+			return err
+		}
+		if !result.IsTruncated {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+	return nil
+}
+
+// A page of the result of ListMultipartUploads. The keys are relative to the
+// prefix of the client.
+type s3UploadsResult struct {
+	XMLName            xml.Name   `xml:"ListMultipartUploadsResult"`
+	Uploads            []s3Upload `xml:"Upload"`
+	IsTruncated        bool
+	NextKeyMarker      string `xml:",omitempty"`
+	NextUploadIdMarker string `xml:",omitempty"`
+}
+
+type s3Upload struct {
+	Key      string
+	UploadId string
+}
+
+// Calls |page| for each page of the multipart uploads in progress whose key
+// starts with |prefix|. Stops when interrupted.
+func (c *s3Client) listUploads(prefix string, page func(*s3UploadsResult) error) error {
+	keyMarker := ""
+	uploadIdMarker := ""
+	for !IsInterrupted() {
+		query := url.Values{"uploads": {""}, "prefix": {c.prefix + prefix}}
+		if keyMarker != "" {
+			query.Set("key-marker", keyMarker)
+			query.Set("upload-id-marker", uploadIdMarker)
+		}
+		req, err := c.newRequest("GET", "", query, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := c.do(req, emptyPayloadHash, http.StatusOK)
+		if err != nil {
+			return err
+		}
+		result := &s3UploadsResult{}
+		err = readS3Result(req, resp, result)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		for i := range result.Uploads {
+			result.Uploads[i].Key = strings.TrimPrefix(result.Uploads[i].Key, c.prefix)
+		}
+		if err := page(result); err != nil {
+			return err
+		}
+		if !result.IsTruncated {
+			return nil
+		}
+		keyMarker = result.NextKeyMarker
+		uploadIdMarker = result.NextUploadIdMarker
+	}
+	return nil
+}
+
+// Content copied to a temporary file while its digest and its checksums are
+// calculated, since they must be known before it is uploaded.
+type s3Spool struct {
+	path   string
+	digest string
+	size   int64
+	sums   *s3Checksums
+}
+
+func spoolS3Object(h *HashAlgorithm, source io.Reader) (*s3Spool, error) {
+	f, err := ioutil.TempFile("", "dumbcas_s3_")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create a temporary file: %s", err)
+	}
+	digest := h.New()
+	s := sha256.New()
+	m := md5.New()
+	size, err := io.Copy(io.MultiWriter(f, digest, s, m), source)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		// Ignore the error.
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &s3Spool{f.Name(), hex.EncodeToString(digest.Sum(nil)), size, &s3Checksums{s.Sum(nil), m.Sum(nil)}}, nil
+}
+
+func (s *s3Spool) upload(client *s3Client, key string) error {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if s.size > client.partSize {
+		return client.putMultipart(key, f, s.size)
+	}
+	// The HTTP client would close |f|.
+	return client.put(key, ioutil.NopCloser(f), s.size, s.sums, false)
+}
+
+func (s *s3Spool) remove() {
+	// Ignore the error.
+	os.Remove(s.path)
+}
+
+// Loads and validates config.json at the root of the repository.
+func loadS3RepositoryConfig(client *s3Client, root string) (*RepositoryConfig, error) {
+	data, err := client.get(configName)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s is not a dumbcas repository; run \"dumbcas init -root=%s\" first", root, root)
+	} else if err != nil {
+		return nil, err
+	}
+	config := &RepositoryConfig{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("%s: %s", configName, err)
+	}
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %s", configName, err)
+	}
+	return config, nil
+}
+
+// Creates a repository in an S3 bucket. Only config.json is written since the
+// bucket has no directories to create. An empty |hashName| or a zero
+// |prefixLength| selects the default.
+func initS3Repository(root string, s3config *s3Config, hashName string, prefixLength int) (*RepositoryConfig, error) {
+	client, err := makeS3Client(root, s3config)
+	if err != nil {
+		return nil, err
+	}
+	if hashName == "" {
+		hashName = defaultHashName
+	}
+	if prefixLength == 0 {
+		prefixLength = legacyPrefixLength
+	}
+	config, err := makeRepositoryConfig(hashName, prefixLength)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to marshall the configuration: %s", err)
+	}
+	if err := client.putBytes(configName, append(data, '\n'), true); os.IsExist(err) {
+		return nil, fmt.Errorf("%s is already a dumbcas repository", root)
+	} else if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// The trash of a table stored in S3, under the "trash/" prefix of the table
+// like the local trash. S3 objects can't be appended to, so each record of the
+// journal is a separate object.
+type s3Trash struct {
+	client   *s3Client
+	tableKey string
+	trashKey string
+}
+
+func makeS3Trash(client *s3Client, tableKey string) *s3Trash {
+	return &s3Trash{client, tableKey, tableKey + TrashName + "/"}
+}
+
+func (t *s3Trash) journalKey() string {
+	return t.trashKey + trashJournalName + "/"
+}
+
+func (t *s3Trash) Move(relPath string, record *TrashRecord) error {
+	log.Printf("Move(%s)", relPath)
+	key := filepath.ToSlash(relPath)
+	if err := t.client.copy(t.tableKey+key, t.trashKey+key); err != nil {
+		return err
+	}
+	if err := t.client.delete(t.tableKey + key); err != nil {
+		return err
+	}
+	record = completeTrashRecord(relPath, record)
+	if err := t.appendJournal(record); err != nil {
+		// The item is already in the trash, don't fail the operation.
+		log.Printf("Failed to record %s in the trash journal: %s", relPath, err)
+	}
+	return nil
+}
+
+// The records are named by their time so they are listed in order.
+func (t *s3Trash) appendJournal(record *TrashRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	id, err := newUUID()
+	if err != nil {
+		return err
+	}
+	return t.client.putBytes(fmt.Sprintf("%s%020d_%s", t.journalKey(), record.Time.UnixNano(), id[:8]), data, false)
+}
+
+func (t *s3Trash) Journal() ([]*TrashRecord, error) {
+	out := []*TrashRecord{}
+	err := t.client.list(t.journalKey(), "", func(page *s3ListResult) error {
+		for _, o := range page.Contents {
+			data, err := t.client.get(o.Key)
+			if err != nil {
+				return err
+			}
+			record := &TrashRecord{}
+			if err := json.Unmarshal(data, record); err != nil {
+				log.Printf("Invalid record in the trash journal: %s", err)
+				continue
+			}
+			out = append(out, record)
+		}
+		return nil
+	})
+	return out, err
+}
+
+func (t *s3Trash) Enumerate() <-chan EnumerationEntry {
+	items := make(chan EnumerationEntry)
+	go func() {
+		defer close(items)
+		err := t.client.list(t.trashKey, "", func(page *s3ListResult) error {
+			for _, o := range page.Contents {
+				if !strings.HasPrefix(o.Key, t.journalKey()) {
+					items <- EnumerationEntry{Item: filepath.FromSlash(o.Key[len(t.trashKey):])}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			items <- EnumerationEntry{Error: err}
+		}
+	}()
+	return items
+}
+
+func (t *s3Trash) Open(relPath string) (ReadSeekCloser, error) {
+	return t.client.open(t.trashKey + filepath.ToSlash(relPath))
+}
+
+// The modification time is when the item was trashed since it was copied
+// then.
+func (t *s3Trash) Stat(relPath string) (*ObjectInfo, error) {
+	return t.client.head(t.trashKey + filepath.ToSlash(relPath))
+}
+
+func (t *s3Trash) Restore(relPath string) error {
+	key := filepath.ToSlash(relPath)
+	if _, err := t.client.head(t.tableKey + key); err == nil {
+		return fmt.Errorf("Can't restore %s: %s", relPath, os.ErrExist)
+	}
+	if err := t.client.copy(t.trashKey+key, t.tableKey+key); err != nil {
+		return err
+	}
+	return t.client.delete(t.trashKey + key)
+}
+
+func (t *s3Trash) Remove(relPath string) error {
+	key := t.trashKey + filepath.ToSlash(relPath)
+	if _, err := t.client.head(key); err != nil {
+		return err
+	}
+	return t.client.delete(key)
+}
@@ -0,0 +1,516 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"github.com/maruel/subcommands/subcommandstest"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeS3Object struct {
+	data    []byte
+	modTime time.Time
+}
+
+// A multipart upload in progress.
+type fakeS3Upload struct {
+	key   string
+	parts map[int][]byte
+}
+
+// Implements the subset of the S3 API used by s3Client for the bucket
+// "bucket". The signature and the checksums of each request are verified.
+type fakeS3 struct {
+	*httptest.Server
+	lock     sync.Mutex
+	objects  map[string]*fakeS3Object
+	uploads  map[string]*fakeS3Upload
+	pageSize int
+	// When set, every request fails with this code.
+	errorCode string
+	// When set, the copies fail with this code in the body of a 200 response.
+	copyErrorCode string
+	// When set, larger objects can only be copied in parts.
+	maxCopySize int
+	// Number of objects copied.
+	copies int
+}
+
+func makeFakeS3() *fakeS3 {
+	f := &fakeS3{objects: map[string]*fakeS3Object{}, uploads: map[string]*fakeS3Upload{}, pageSize: 3}
+	f.Server = httptest.NewServer(f)
+	return f
+}
+
+func (f *fakeS3) config() *s3Config {
+	return &s3Config{f.URL, "us-east-1", "access", "secret"}
+}
+
+func (f *fakeS3) setErrorCode(code string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.errorCode = code
+}
+
+func (f *fakeS3) setCopyErrorCode(code string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.copyErrorCode = code
+}
+
+func (f *fakeS3) keys() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	out := make([]string, 0, len(f.objects))
+	for key := range f.objects {
+		out = append(out, key)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func (f *fakeS3) fail(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>Fake S3 error</Message></Error>", code)
+}
+
+// Signs the request again with the same time to compare the signatures.
+func (f *fakeS3) verifySignature(r *http.Request) bool {
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	now, err := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		return false
+	}
+	req, err := http.NewRequest(r.Method, "http://"+r.Host+r.URL.RequestURI(), nil)
+	if err != nil {
+		return false
+	}
+	for name, values := range r.Header {
+		if strings.HasPrefix(strings.ToLower(name), "x-amz-") {
+			req.Header[name] = values
+		}
+	}
+	signV4(req, payloadHash, "us-east-1", "s3", "access", "secret", now)
+	return req.Header.Get("Authorization") == r.Header.Get("Authorization")
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		f.fail(w, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+	f.lock.Lock()
+	code := f.errorCode
+	f.lock.Unlock()
+	if code != "" {
+		f.fail(w, http.StatusServiceUnavailable, code)
+		return
+	}
+	if !f.verifySignature(r) {
+		f.fail(w, http.StatusForbidden, "SignatureDoesNotMatch")
+		return
+	}
+	if digest := sha256.Sum256(body); r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(digest[:]) {
+		f.fail(w, http.StatusBadRequest, "XAmzContentSHA256Mismatch")
+		return
+	}
+	if r.URL.Path == "/bucket" && r.Method == "GET" {
+		if _, ok := r.URL.Query()["uploads"]; ok {
+			f.listUploads(w, r.URL.Query())
+		} else {
+			f.list(w, r.URL.Query())
+		}
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, "/bucket/") {
+		f.fail(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	key := r.URL.Path[len("/bucket/"):]
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	query := r.URL.Query()
+	if _, ok := query["uploads"]; ok && r.Method == "POST" {
+		id := fmt.Sprintf("upload%d", len(f.uploads))
+		f.uploads[id] = &fakeS3Upload{key, map[int][]byte{}}
+		data, _ := xml.Marshal(&s3InitiateResult{UploadId: id})
+		w.Write(data)
+		return
+	}
+	if id := query.Get("uploadId"); id != "" {
+		f.multipart(w, r, key, id, body)
+		return
+	}
+	switch r.Method {
+	case "GET", "HEAD":
+		o, ok := f.objects[key]
+		if !ok {
+			f.fail(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		http.ServeContent(w, r, key, o.modTime, bytes.NewReader(o.data))
+	case "PUT":
+		if source := r.Header.Get("X-Amz-Copy-Source"); source != "" {
+			source, _ = url.PathUnescape(source)
+			source = strings.TrimPrefix(source, "/bucket/")
+			o, ok := f.objects[source]
+			if !ok {
+				f.fail(w, http.StatusNotFound, "NoSuchKey")
+				return
+			}
+			if source == key && r.Header.Get("X-Amz-Metadata-Directive") != "REPLACE" {
+				f.fail(w, http.StatusBadRequest, "InvalidRequest")
+				return
+			}
+			if f.maxCopySize != 0 && len(o.data) > f.maxCopySize {
+				f.fail(w, http.StatusBadRequest, "InvalidRequest")
+				return
+			}
+			if f.copyErrorCode != "" {
+				f.fail(w, http.StatusOK, f.copyErrorCode)
+				return
+			}
+			f.copies++
+			f.objects[key] = &fakeS3Object{o.data, time.Now()}
+			fmt.Fprintf(w, "<CopyObjectResult></CopyObjectResult>")
+			return
+		}
+		sha := sha256.Sum256(body)
+		sum := md5.Sum(body)
+		if r.Header.Get("Content-MD5") != base64.StdEncoding.EncodeToString(sum[:]) ||
+			r.Header.Get("X-Amz-Checksum-Sha256") != base64.StdEncoding.EncodeToString(sha[:]) {
+			f.fail(w, http.StatusBadRequest, "BadDigest")
+			return
+		}
+		if _, ok := f.objects[key]; ok && r.Header.Get("If-None-Match") == "*" {
+			f.fail(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		f.objects[key] = &fakeS3Object{body, time.Now()}
+	case "DELETE":
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.fail(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+// Handles the requests to the multipart upload |id|. The parts are verified
+// like the objects and the object is only created once it is completed.
+func (f *fakeS3) multipart(w http.ResponseWriter, r *http.Request, key, id string, body []byte) {
+	upload, ok := f.uploads[id]
+	if !ok || upload.key != key {
+		f.fail(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+	switch r.Method {
+	case "PUT":
+		number, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+		if err != nil || number < 1 || number > s3MaxParts {
+			f.fail(w, http.StatusBadRequest, "InvalidArgument")
+			return
+		}
+		if source := r.Header.Get("X-Amz-Copy-Source"); source != "" {
+			source, _ = url.PathUnescape(source)
+			o, ok := f.objects[strings.TrimPrefix(source, "/bucket/")]
+			if !ok {
+				f.fail(w, http.StatusNotFound, "NoSuchKey")
+				return
+			}
+			var first, last int
+			if _, err := fmt.Sscanf(r.Header.Get("X-Amz-Copy-Source-Range"), "bytes=%d-%d", &first, &last); err != nil || first > last || last >= len(o.data) {
+				f.fail(w, http.StatusBadRequest, "InvalidArgument")
+				return
+			}
+			upload.parts[number] = o.data[first : last+1]
+			sum := md5.Sum(upload.parts[number])
+			fmt.Fprintf(w, "<CopyPartResult><ETag>&quot;%s&quot;</ETag></CopyPartResult>", hex.EncodeToString(sum[:]))
+			return
+		}
+		sum := md5.Sum(body)
+		if r.Header.Get("Content-MD5") != base64.StdEncoding.EncodeToString(sum[:]) {
+			f.fail(w, http.StatusBadRequest, "BadDigest")
+		} else {
+			upload.parts[number] = body
+			w.Header().Set("ETag", "\""+hex.EncodeToString(sum[:])+"\"")
+		}
+	case "POST":
+		complete := &s3CompleteUpload{}
+		if err := xml.Unmarshal(body, complete); err != nil || len(complete.Parts) == 0 {
+			f.fail(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		data := []byte{}
+		for i, part := range complete.Parts {
+			content, ok := upload.parts[part.PartNumber]
+			sum := md5.Sum(content)
+			if !ok || part.PartNumber != i+1 || part.ETag != "\""+hex.EncodeToString(sum[:])+"\"" {
+				f.fail(w, http.StatusBadRequest, "InvalidPart")
+				return
+			}
+			data = append(data, content...)
+		}
+		f.objects[key] = &fakeS3Object{data, time.Now()}
+		delete(f.uploads, id)
+		fmt.Fprintf(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+	case "DELETE":
+		delete(f.uploads, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.fail(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func uploadLess(a, b s3Upload) bool {
+	return a.Key < b.Key || (a.Key == b.Key && a.UploadId < b.UploadId)
+}
+
+type s3UploadsByKey []s3Upload
+
+func (s s3UploadsByKey) Len() int           { return len(s) }
+func (s s3UploadsByKey) Less(i, j int) bool { return uploadLess(s[i], s[j]) }
+func (s s3UploadsByKey) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// Lists the multipart uploads in progress by key then id, f.pageSize at a
+// time.
+func (f *fakeS3) listUploads(w http.ResponseWriter, query url.Values) {
+	f.lock.Lock()
+	uploads := []s3Upload{}
+	for id, upload := range f.uploads {
+		if strings.HasPrefix(upload.key, query.Get("prefix")) {
+			uploads = append(uploads, s3Upload{upload.key, id})
+		}
+	}
+	f.lock.Unlock()
+	sort.Sort(s3UploadsByKey(uploads))
+	result := &s3UploadsResult{}
+	marker := s3Upload{query.Get("key-marker"), query.Get("upload-id-marker")}
+	for _, upload := range uploads {
+		if !uploadLess(marker, upload) {
+			continue
+		}
+		if len(result.Uploads) == f.pageSize {
+			result.IsTruncated = true
+			break
+		}
+		result.Uploads = append(result.Uploads, upload)
+		result.NextKeyMarker = upload.Key
+		result.NextUploadIdMarker = upload.UploadId
+	}
+	data, _ := xml.Marshal(result)
+	w.Write(data)
+}
+
+// Lists the keys in order, f.pageSize at a time. The continuation token is the
+// last key or common prefix returned.
+func (f *fakeS3) list(w http.ResponseWriter, query url.Values) {
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+	token := query.Get("continuation-token")
+	result := &s3ListResult{}
+	last := ""
+	for _, key := range f.keys() {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		item := key
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i != -1 {
+				item = key[:len(prefix)+i+len(delimiter)]
+			}
+		}
+		if item <= token || item == last {
+			continue
+		}
+		if len(result.Contents)+len(result.CommonPrefixes) == f.pageSize {
+			result.IsTruncated = true
+			result.NextContinuationToken = last
+			break
+		}
+		last = item
+		if item == key {
+			f.lock.Lock()
+			o := f.objects[key]
+			f.lock.Unlock()
+			result.Contents = append(result.Contents, s3ListObject{key, int64(len(o.data)), o.modTime})
+		} else {
+			result.CommonPrefixes = append(result.CommonPrefixes, s3CommonPrefix{item})
+		}
+	}
+	data, _ := xml.Marshal(result)
+	w.Write(data)
+}
+
+func TestIsS3Root(t *testing.T) {
+	t.Parallel()
+	tb := subcommandstest.MakeTB(t)
+	tb.Assertf(isS3Root("s3://bucket/prefix"), "Expected S3 root")
+	tb.Assertf(!isS3Root("/path/to/storage"), "Unexpected S3 root")
+	tb.Assertf(!isS3Root("http://nas:8010/"), "Unexpected S3 root")
+}
+
+func TestSignV4(t *testing.T) {
+	t.Parallel()
+	tb := subcommandstest.MakeTB(t)
+	// The get-vanilla case of the AWS Signature Version 4 test suite.
+	req, err := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	signV4(req, emptyPayloadHash, "us-east-1", "service", "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", now)
+	expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	actual := req.Header.Get("Authorization")
+	tb.Assertf(actual == expected, "%s != %s", actual, expected)
+	tb.Assertf(req.Header.Get("X-Amz-Date") == "20150830T123600Z", "Unexpected date %s", req.Header.Get("X-Amz-Date"))
+}
+
+func TestAwsEscape(t *testing.T) {
+	t.Parallel()
+	tb := subcommandstest.MakeTB(t)
+	tb.Assertf(awsEscape("a b/c~d+e", true) == "a%20b/c~d%2Be", "Unexpected %s", awsEscape("a b/c~d+e", true))
+	tb.Assertf(awsEscape("a b/c", false) == "a%20b%2Fc", "Unexpected %s", awsEscape("a b/c", false))
+	query := url.Values{"prefix": {"a/b"}, "delimiter": {"/"}, "list-type": {"2"}}
+	tb.Assertf(awsQuery(query) == "delimiter=%2F&list-type=2&prefix=a%2Fb", "Unexpected %s", awsQuery(query))
+}
+
+func TestS3Client(t *testing.T) {
+	t.Parallel()
+	tb := subcommandstest.MakeTB(t)
+	server := makeFakeS3()
+	defer server.Close()
+
+	_, err := makeS3Client("s3://", server.config())
+	tb.Assertf(err != nil, "Unexpected success")
+	client, err := makeS3Client("s3://bucket/backups/", server.config())
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+
+	// The keys are relative to the prefix.
+	tb.Assertf(client.putBytes("a b/1", []byte("content1"), true) == nil, "Failed to put")
+	tb.Assertf(Equals(server.keys(), []string{"backups/a b/1"}), "Unexpected keys %q", server.keys())
+	tb.Assertf(os.IsExist(client.putBytes("a b/1", []byte("content2"), true)), "Unexpected success")
+	data, err := client.get("a b/1")
+	tb.Assertf(err == nil && string(data) == "content1", "Unexpected result %q %s", data, err)
+	_, err = client.get("a b/2")
+	tb.Assertf(os.IsNotExist(err), "Unexpected error: %s", err)
+
+	// The content is verified by the server.
+	sums := s3ChecksumsOf([]byte("content2"))
+	err = client.put("a b/2", bytes.NewBufferString("content3"), 8, sums, false)
+	tb.Assertf(err != nil && strings.Contains(err.Error(), "XAmzContentSHA256Mismatch"), "Unexpected error: %s", err)
+	_, err = client.head("a b/2")
+	tb.Assertf(os.IsNotExist(err), "Unexpected error: %s", err)
+
+	// Seeking resumes from the offset.
+	f, err := client.open("a b/1")
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	_, err = f.Seek(3, 0)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	data, err = ioutil.ReadAll(f)
+	f.Close()
+	tb.Assertf(err == nil && string(data) == "tent1", "Unexpected result %q %s", data, err)
+
+	// An object larger than a part is uploaded in parts.
+	client.partSize = 4
+	content := "0123456789"
+	tb.Assertf(client.putMultipart("a b/large", strings.NewReader(content), int64(len(content))) == nil, "Failed to put")
+	data, err = client.get("a b/large")
+	tb.Assertf(err == nil && string(data) == content, "Unexpected result %q %s", data, err)
+	tb.Assertf(client.delete("a b/large") == nil, "Failed to delete")
+	// A part that can't be read aborts the upload.
+	err = client.putMultipart("a b/large", strings.NewReader(content), 20)
+	tb.Assertf(err != nil, "Unexpected success")
+	_, err = client.head("a b/large")
+	tb.Assertf(os.IsNotExist(err), "Unexpected error: %s", err)
+	tb.Assertf(len(server.uploads) == 0, "Unexpected uploads %v", server.uploads)
+
+	// An object larger than a single copy allows is copied in parts.
+	tb.Assertf(client.putMultipart("a b/large", strings.NewReader(content), int64(len(content))) == nil, "Failed to put")
+	server.lock.Lock()
+	server.maxCopySize = 4
+	server.lock.Unlock()
+	client.maxCopySize = 4
+	tb.Assertf(client.copy("a b/large", "a b/large") == nil, "Failed to copy")
+	tb.Assertf(client.copy("a b/large", "a b/copy") == nil, "Failed to copy")
+	data, err = client.get("a b/copy")
+	tb.Assertf(err == nil && string(data) == content, "Unexpected result %q %s", data, err)
+	tb.Assertf(len(server.uploads) == 0, "Unexpected uploads %v", server.uploads)
+	tb.Assertf(client.delete("a b/large") == nil && client.delete("a b/copy") == nil, "Failed to delete")
+	server.lock.Lock()
+	server.maxCopySize = 0
+	server.lock.Unlock()
+	client.partSize = s3PartSize
+	client.maxCopySize = s3MaxCopySize
+
+	// Copying an object onto itself is accepted.
+	tb.Assertf(client.copy("a b/1", "a b/1") == nil, "Failed to copy")
+	err = client.copy("a b/2", "a b/2")
+	tb.Assertf(os.IsNotExist(err), "Unexpected error: %s", err)
+	// A copy can fail after S3 replied 200.
+	server.setCopyErrorCode("InternalError")
+	err = client.copy("a b/1", "a b/1")
+	tb.Assertf(err != nil && strings.Contains(err.Error(), "InternalError"), "Unexpected error: %s", err)
+	server.setCopyErrorCode("")
+
+	// The listing is paginated.
+	for i := 2; i < 9; i++ {
+		tb.Assertf(client.putBytes(fmt.Sprintf("a b/%d", i), []byte("content"), false) == nil, "Failed to put")
+		tb.Assertf(client.putBytes(fmt.Sprintf("dir%d/x", i), []byte("content"), false) == nil, "Failed to put")
+	}
+	keys := []string{}
+	pages := 0
+	err = client.list("a b/", "", func(page *s3ListResult) error {
+		pages++
+		for _, o := range page.Contents {
+			keys = append(keys, o.Key)
+		}
+		return nil
+	})
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	tb.Assertf(pages == 3, "Unexpected pages: %d", pages)
+	tb.Assertf(len(keys) == 8 && keys[0] == "a b/1" && keys[7] == "a b/8", "Unexpected keys %q", keys)
+	prefixes := []string{}
+	err = client.list("", "/", func(page *s3ListResult) error {
+		for _, p := range page.CommonPrefixes {
+			prefixes = append(prefixes, p.Prefix)
+		}
+		return nil
+	})
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	tb.Assertf(len(prefixes) == 8 && prefixes[0] == "a b/" && prefixes[7] == "dir8/", "Unexpected prefixes %q", prefixes)
+
+	tb.Assertf(client.delete("a b/1") == nil, "Failed to delete")
+	_, err = client.head("a b/1")
+	tb.Assertf(os.IsNotExist(err), "Unexpected error: %s", err)
+
+	// A wrong secret is refused.
+	config := server.config()
+	config.SecretKey = "wrong"
+	client, err = makeS3Client("s3://bucket/backups", config)
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	_, err = client.get("a b/2")
+	tb.Assertf(err != nil && strings.Contains(err.Error(), "SignatureDoesNotMatch"), "Unexpected error: %s", err)
+}
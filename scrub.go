@@ -0,0 +1,192 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The verification journal is saved at the root of the repository. It is
+// specific to this copy of the CAS table since it tracks the state of its
+// storage.
+const scrubJournalName = "scrub.gob"
+
+// When an object was last verified and whether its content matched its digest.
+type ScrubRecord struct {
+	Verified  int64 // In Unix() epoch.
+	Corrupted bool
+}
+
+// Records when fsck last verified each object of the CasTable, so fsck -budget
+// verifies the objects that were not verified for the longest time first.
+type ScrubJournal struct {
+	Objects  map[string]*ScrubRecord
+	filePath string
+}
+
+// Loads the journal of the repository at |rootDir|. A missing journal is
+// empty.
+func loadScrubJournal(rootDir string) (*ScrubJournal, error) {
+	s := &ScrubJournal{map[string]*ScrubRecord{}, filepath.Join(rootDir, scrubJournalName)}
+	f, err := os.Open(s.filePath)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := gob.NewDecoder(f).Decode(&s.Objects); err != nil {
+		return nil, fmt.Errorf("Failed to load %s: %s", s.filePath, err)
+	}
+	return s, nil
+}
+
+// Saves the journal. The journal of a fake or remote repository has no path and
+// isn't saved.
+func (s *ScrubJournal) Save() error {
+	if s.filePath == "" {
+		return nil
+	}
+	// Write to a temporary file first so an interrupted save doesn't lose the
+	// whole journal.
+	tempPath := s.filePath + ".tmp"
+	f, err := os.OpenFile(tempPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(f).Encode(s.Objects)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(tempPath, s.filePath)
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("Failed to save %s: %s", s.filePath, err)
+	}
+	return nil
+}
+
+// Records the result of the verification of |hash|.
+func (s *ScrubJournal) Add(hash string, corrupted bool, now time.Time) {
+	s.Objects[hash] = &ScrubRecord{now.Unix(), corrupted}
+}
+
+// Forgets the objects not in |items|, e.g. the ones collected by gc.
+func (s *ScrubJournal) Trim(items []string) {
+	keep := make(map[string]bool, len(items))
+	for _, item := range items {
+		keep[item] = true
+	}
+	for hash := range s.Objects {
+		if !keep[hash] {
+			delete(s.Objects, hash)
+		}
+	}
+}
+
+// Returns when |hash| was last verified, the zero time if never.
+func (s *ScrubJournal) lastVerified(hash string) time.Time {
+	if r, ok := s.Objects[hash]; ok {
+		return time.Unix(r.Verified, 0)
+	}
+	return time.Time{}
+}
+
+// Sorts the objects by when they were last verified, oldest first.
+type byLastVerified struct {
+	items   []string
+	journal *ScrubJournal
+}
+
+func (b byLastVerified) Len() int      { return len(b.items) }
+func (b byLastVerified) Swap(i, j int) { b.items[i], b.items[j] = b.items[j], b.items[i] }
+func (b byLastVerified) Less(i, j int) bool {
+	ti := b.journal.lastVerified(b.items[i])
+	tj := b.journal.lastVerified(b.items[j])
+	if ti.Equal(tj) {
+		return b.items[i] < b.items[j]
+	}
+	return ti.Before(tj)
+}
+
+// Returns the objects of |items| that were not verified for the longest time,
+// up to |maxBytes| and |maxObjects|. A zero limit is ignored. At least one
+// object is returned so a budget smaller than the first object still makes
+// progress.
+func (s *ScrubJournal) Oldest(cas CasTable, items []string, maxBytes int64, maxObjects int) ([]string, error) {
+	sorted := append([]string{}, items...)
+	sort.Sort(byLastVerified{sorted, s})
+	var size int64
+	for i, item := range sorted {
+		if maxObjects != 0 && i == maxObjects {
+			return sorted[:i], nil
+		}
+		if maxBytes != 0 {
+			info, err := cas.Stat(item)
+			if err != nil {
+				return nil, err
+			}
+			size += info.Size
+			if size > maxBytes && i != 0 {
+				return sorted[:i], nil
+			}
+		}
+	}
+	return sorted, nil
+}
+
+// Describes how far behind the verification of |items| is.
+func scrubSummary(s *ScrubJournal, items []string) string {
+	never := 0
+	var oldest time.Time
+	for _, item := range items {
+		t := s.lastVerified(item)
+		if t.IsZero() {
+			never++
+		} else if oldest.IsZero() || t.Before(oldest) {
+			oldest = t
+		}
+	}
+	if never != 0 {
+		return fmt.Sprintf("%d of %d objects were never verified", never, len(items))
+	}
+	if oldest.IsZero() {
+		return "No object to verify"
+	}
+	return fmt.Sprintf("All %d objects were verified since %s", len(items), oldest.Format("2006-01-02 15:04:05"))
+}
+
+// Parses a size like 200GB, 512mb or 1024. The units are powers of 1024.
+func parseSize(value string) (int64, error) {
+	units := []string{"b", "kb", "mb", "gb", "tb"}
+	lower := strings.ToLower(strings.TrimSpace(value))
+	multiplier := int64(1)
+	for i := len(units) - 1; i >= 0; i-- {
+		if strings.HasSuffix(lower, units[i]) {
+			lower = strings.TrimSpace(lower[:len(lower)-len(units[i])])
+			multiplier = int64(1) << uint(10*i)
+			break
+		}
+	}
+	size, err := strconv.ParseInt(lower, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("Invalid size %s", value)
+	}
+	return size * multiplier, nil
+}
@@ -0,0 +1,140 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"fmt"
+	"github.com/maruel/subcommands/subcommandstest"
+	"testing"
+	"time"
+)
+
+// The journal is kept in memory across the commands run by a test.
+func (a *DumbcasAppMock) LoadScrubJournal(rootDir string) (*ScrubJournal, error) {
+	if a.scrub == nil {
+		a.scrub = &ScrubJournal{Objects: map[string]*ScrubRecord{}}
+	}
+	return a.scrub, nil
+}
+
+func TestParseSize(t *testing.T) {
+	t.Parallel()
+	tb := subcommandstest.MakeTB(t)
+	valid := map[string]int64{
+		"0":      0,
+		"1024":   1024,
+		"10b":    10,
+		"2kb":    2048,
+		"512mb":  512 * 1024 * 1024,
+		"200GB":  200 * 1024 * 1024 * 1024,
+		" 1 Tb ": 1024 * 1024 * 1024 * 1024,
+	}
+	for value, expected := range valid {
+		size, err := parseSize(value)
+		tb.Assertf(err == nil && size == expected, "%q: Unexpected result %d %s", value, size, err)
+	}
+	for _, value := range []string{"", "gb", "-1", "1.5gb", "10pb"} {
+		_, err := parseSize(value)
+		tb.Assertf(err != nil, "%q: Unexpected success", value)
+	}
+}
+
+func TestScrubJournal(t *testing.T) {
+	t.Parallel()
+	tb := subcommandstest.MakeTB(t)
+	tempData := makeTempDir(tb, "scrub")
+	defer removeTempDir(tempData)
+
+	journal, err := loadScrubJournal(tempData)
+	tb.Assertf(err == nil && len(journal.Objects) == 0, "Unexpected result %v %s", journal, err)
+	now := time.Unix(1350000000, 0)
+	journal.Add("a", false, now)
+	journal.Add("b", true, now.Add(time.Hour))
+	journal.Add("c", false, now)
+	journal.Trim([]string{"a", "b"})
+	tb.Assertf(journal.Save() == nil, "Failed to save")
+
+	journal, err = loadScrubJournal(tempData)
+	tb.Assertf(err == nil && len(journal.Objects) == 2, "Unexpected result %v %s", journal, err)
+	r := journal.Objects["b"]
+	tb.Assertf(r != nil && r.Corrupted && r.Verified == now.Add(time.Hour).Unix(), "Unexpected record %v", r)
+	tb.Assertf(journal.lastVerified("c").IsZero(), "c wasn't trimmed")
+}
+
+func TestScrubJournalOldest(t *testing.T) {
+	t.Parallel()
+	tb := subcommandstest.MakeTB(t)
+	cas := makeFakeCasTable(tb)
+	items := []string{}
+	for i := 0; i < 4; i++ {
+		item, err := AddBytes(cas, []byte(fmt.Sprintf("content%d", i)))
+		tb.Assertf(err == nil, "Unexpected error: %s", err)
+		items = append(items, item)
+	}
+	journal := &ScrubJournal{Objects: map[string]*ScrubRecord{}}
+	now := time.Now()
+	journal.Add(items[0], false, now)
+	journal.Add(items[1], false, now.Add(-time.Hour))
+
+	// The objects never verified come first.
+	oldest, err := journal.Oldest(cas, items, 0, 3)
+	tb.Assertf(err == nil && len(oldest) == 3 && oldest[2] == items[1], "Unexpected result %q %s", oldest, err)
+	all, err := journal.Oldest(cas, items, 0, 0)
+	tb.Assertf(err == nil && len(all) == 4 && all[3] == items[0], "Unexpected result %q %s", all, err)
+	// Each object is 8 bytes.
+	oldest, err = journal.Oldest(cas, items, 20, 0)
+	tb.Assertf(err == nil && Equals(oldest, all[:2]), "Unexpected result %q %s", oldest, err)
+	oldest, err = journal.Oldest(cas, items, 1, 0)
+	tb.Assertf(err == nil && Equals(oldest, all[:1]), "Unexpected result %q %s", oldest, err)
+}
+
+func TestFsckBudget(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	f.MakeCasTable("")
+	f.LoadNodesTable("", f.cas)
+	items := []string{}
+	for i := 0; i < 10; i++ {
+		item, err := AddBytes(f.cas, []byte(fmt.Sprintf("content%d", i)))
+		f.Assertf(err == nil, "Unexpected error: %s", err)
+		items = append(items, item)
+	}
+	f.Run([]string{"fsck", "-root=\\test_fsck_budget", "-budget=1x"}, 1)
+	f.CheckBuffer(false, true)
+	f.Run([]string{"fsck", "-root=\\test_fsck_budget", "-budget-objects=-1"}, 1)
+	f.CheckBuffer(false, true)
+
+	// Each run verifies the objects never verified first.
+	f.Run([]string{"fsck", "-root=\\test_fsck_budget", "-budget-objects=4"}, 0)
+	f.Assertf(len(f.scrub.Objects) == 4, "Unexpected journal: %d", len(f.scrub.Objects))
+	f.Run([]string{"fsck", "-root=\\test_fsck_budget", "-budget=24b"}, 0)
+	f.Assertf(len(f.scrub.Objects) == 7, "Unexpected journal: %d", len(f.scrub.Objects))
+
+	f.Run([]string{"fsck", "-root=\\test_fsck_budget", "-budget-objects=3"}, 0)
+	f.Assertf(len(f.scrub.Objects) == 10, "Unexpected journal: %d", len(f.scrub.Objects))
+
+	// A corrupted object is found by the next run that verifies it.
+	cas := f.cas.(*fakeCasTable)
+	cas.entries[items[0]] = []byte("corrupted")
+	f.scrub.Objects[items[0]].Verified -= 3600
+	f.cas.SetFsckBit()
+	f.Run([]string{"fsck", "-root=\\test_fsck_budget", "-budget-objects=1"}, 0)
+	r := f.scrub.Objects[items[0]]
+	f.Assertf(r != nil && r.Corrupted, "Unexpected record %v", r)
+	// A partial verification doesn't clear the fsck bit.
+	f.Assertf(f.cas.GetFsckBit(), "Expected fsck bit")
+	i := EnumerateCasAsList(f.TB, f.cas)
+	f.Assertf(len(i) == 9, "Unexpected items: %d", len(i))
+
+	// A full run records every object and forgets the trashed ones.
+	f.Run([]string{"fsck", "-root=\\test_fsck_budget"}, 0)
+	f.Assertf(len(f.scrub.Objects) == 9, "Unexpected journal: %d", len(f.scrub.Objects))
+	f.Assertf(!f.cas.GetFsckBit(), "Unexpected fsck bit")
+}
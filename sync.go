@@ -0,0 +1,276 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/maruel/subcommands"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var cmdSync = &subcommands.Command{
+	UsageLine: "sync -from=<root> -to=<root>",
+	ShortDesc: "copies the backups of a repository into another",
+	LongDesc:  "Copies each node of -from that is missing in -to, after the objects it references. Only the objects missing in -to are copied and their digests are verified. Existing objects and nodes are never overwritten, so syncing two repositories both ways merges them. The tags are not copied. Each root can be a directory, the URL of a repository served by web -writable or s3://bucket/prefix.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &syncRun{}
+		c.Flags.StringVar(&c.from.Root, "from", "", "Repository to copy from; required.")
+		c.Flags.StringVar(&c.to.Root, "to", "", "Repository to copy to; required. It must use the same hash algorithm as -from.")
+		c.Flags.DurationVar(&c.wait, "wait", 0, "Time to wait for a conflicting lock on the repositories to be released, e.g. 10m")
+		return c
+	},
+}
+
+type syncRun struct {
+	subcommands.CommandRunBase
+	from CommonFlags
+	to   CommonFlags
+	wait time.Duration
+}
+
+// Result of a sync.
+type syncReport struct {
+	// Nodes copied and nodes that were already present.
+	nodes   int
+	present int
+	// Objects copied.
+	objects int
+	size    int64
+	// Nodes that couldn't be copied, e.g. because they are damaged.
+	failed []string
+}
+
+var errSyncInterrupted = errors.New("Was interrupted.")
+
+// Copies the object |hash| missing in |dst|.
+func syncObject(src, dst CasTable, hash string, report *syncReport) error {
+	if IsInterrupted() {
+		return errSyncInterrupted
+	}
+	f, err := src.Open(hash)
+	if err != nil {
+		return fmt.Errorf("Failed to open %s: %s", hash, err)
+	}
+	defer f.Close()
+	// AddEntry() verifies the digest of the content.
+	err = dst.AddEntry(f, hash)
+	if _, ok := err.(*HashMismatchError); ok {
+		src.SetFsckBit()
+		return fmt.Errorf("Object %s is corrupted: %s", hash, err)
+	} else if err != nil && !os.IsExist(err) {
+		return fmt.Errorf("Failed to copy %s: %s", hash, err)
+	}
+	if err == nil {
+		size, _ := f.Seek(0, io.SeekCurrent)
+		report.objects++
+		report.size += size
+	}
+	return nil
+}
+
+// Appends to |files| the objects of the files in |entry| and to |dirs| the
+// directories stored as separate objects. The directories of older nodes,
+// stored inline, are walked.
+func directObjects(entry *Entry, files, dirs []string) ([]string, []string) {
+	if entry.Sha1 != "" {
+		files = append(files, entry.Sha1)
+	}
+	for _, c := range entry.Chunks {
+		files = append(files, c.Sha1)
+	}
+	if entry.Dir != "" {
+		return files, append(dirs, entry.Dir)
+	}
+	for _, f := range entry.Files {
+		files, dirs = directObjects(f, files, dirs)
+	}
+	return files, dirs
+}
+
+// Copies to |dst| the objects of the directory |hash| that it is missing, then
+// the directory itself. The directory and its files are looked up in |dst|
+// with a single Missing() call, which also touches the ones present so gc
+// doesn't collect them before the node referencing them is copied. A
+// directory is copied after its content, and only if all of it was copied,
+// so an object in |done| always has its whole subtree in |dst|. Keeps going on
+// error; returns the first one.
+func syncDir(src, dst CasTable, done map[string]bool, hash string, report *syncReport) error {
+	if done[hash] {
+		return nil
+	}
+	if IsInterrupted() {
+		return errSyncInterrupted
+	}
+	dir, err := LoadEntry(src, hash)
+	if err != nil {
+		return fmt.Errorf("Failed to load directory %s: %s", hash, err)
+	}
+	files, dirs := directObjects(&Entry{Files: dir.Files}, nil, nil)
+	query := []string{hash}
+	for _, f := range files {
+		if !done[f] {
+			query = append(query, f)
+		}
+	}
+	missing, err := dst.Missing(query)
+	if err != nil {
+		return err
+	}
+	isMissing := make(map[string]bool, len(missing))
+	for _, m := range missing {
+		isMissing[m] = true
+	}
+	var out error
+	for _, f := range query[1:] {
+		if done[f] {
+			// Listed twice in the directory.
+			continue
+		}
+		if isMissing[f] {
+			if err := syncObject(src, dst, f, report); err != nil {
+				if out == nil {
+					out = err
+				}
+				continue
+			}
+		}
+		done[f] = true
+	}
+	for _, d := range dirs {
+		if err := syncDir(src, dst, done, d, report); err != nil && out == nil {
+			out = err
+		}
+	}
+	if out == nil && isMissing[hash] {
+		out = syncObject(src, dst, hash, report)
+	}
+	if out == nil {
+		done[hash] = true
+	}
+	return out
+}
+
+// Copies to |dstNodes| each node of |srcNodes| it is missing, after the objects
+// the node references. A node that can't be copied whole is skipped. The tags
+// are skipped since they point to the latest node of each tag in the source.
+func syncRepositories(a DumbcasApplication, src CasTable, srcNodes NodesTable, dst CasTable, dstNodes NodesTable) (*syncReport, error) {
+	h := src.GetHashAlgorithm()
+	if h.Name != dst.GetHashAlgorithm().Name {
+		return nil, fmt.Errorf("Can't copy %s objects to a repository using %s", h.Name, dst.GetHashAlgorithm().Name)
+	}
+	names := []string{}
+	for item := range srcNodes.Enumerate() {
+		if item.Error != nil {
+			// TODO(maruel): Leaks channel.
+			return nil, fmt.Errorf("Failed enumerating the nodes: %s", item.Error)
+		}
+		if !strings.HasPrefix(filepath.ToSlash(item.Item), tagsName+"/") {
+			names = append(names, item.Item)
+		}
+	}
+	sort.Strings(names)
+
+	report := &syncReport{}
+	done := map[string]bool{}
+	for _, name := range names {
+		if IsInterrupted() {
+			break
+		}
+		if f, err := dstNodes.Open(name); err == nil {
+			f.Close()
+			report.present++
+			continue
+		}
+		node, err := LoadNode(srcNodes, name)
+		if err == nil && !h.IsValid(node.Entry) {
+			err = fmt.Errorf("Invalid entry %s", node.Entry)
+		}
+		if err == nil {
+			err = syncDir(src, dst, done, node.Entry, report)
+		}
+		if err == nil {
+			err = dstNodes.Create(name, node)
+		}
+		if os.IsExist(err) {
+			// Copied concurrently.
+			report.present++
+		} else if IsInterrupted() {
+			break
+		} else if err != nil {
+			fmt.Fprintf(a.GetOut(), "Failed to copy %s: %s\n", name, err)
+			report.failed = append(report.failed, name)
+		} else {
+			a.GetLog().Printf("Copied node %s", name)
+			report.nodes++
+		}
+	}
+	return report, nil
+}
+
+func (r *syncReport) Print(w io.Writer) {
+	fmt.Fprintf(w, "Copied %d nodes and %d objects (%.1fmb); %d nodes were already present\n", r.nodes, r.objects, toMb(r.size), r.present)
+}
+
+func (c *syncRun) main(a DumbcasApplication) error {
+	if c.from.Root == "" || c.to.Root == "" {
+		return errors.New("Must provide -from and -to")
+	}
+	c.from.Wait = c.wait
+	c.to.Wait = c.wait
+	if err := c.from.ParseRoot(); err != nil {
+		return err
+	}
+	if err := c.to.ParseRoot(); err != nil {
+		return err
+	}
+	if c.from.Root == c.to.Root {
+		return errors.New("-from and -to must be different repositories")
+	}
+	if err := c.from.Parse(a, false); err != nil {
+		return err
+	}
+	defer c.from.Close()
+	if err := c.to.Parse(a, false); err != nil {
+		return err
+	}
+	defer c.to.Close()
+	report, err := syncRepositories(a, c.from.cas, c.from.nodes, c.to.cas, c.to.nodes)
+	if err != nil {
+		return err
+	}
+	report.Print(a.GetOut())
+	if IsInterrupted() {
+		return errSyncInterrupted
+	}
+	if len(report.failed) != 0 {
+		return fmt.Errorf("Failed to copy %d nodes; run fsck on %s", len(report.failed), c.from.Root)
+	}
+	return nil
+}
+
+func (c *syncRun) Run(a subcommands.Application, args []string) int {
+	if len(args) != 0 {
+		fmt.Fprintf(a.GetErr(), "%s: Unsupported arguments.\n", a.GetName())
+		return 1
+	}
+	HandleCtrlC()
+	d := a.(DumbcasApplication)
+	if err := c.main(d); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
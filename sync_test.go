@@ -0,0 +1,191 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSyncRepositories(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	src := makeFakeCasTable(f.TB)
+	srcNodes := makeFakeNodesTable(src, f.TB)
+	dst := makeFakeCasTable(f.TB)
+	dstNodes := makeFakeNodesTable(dst, f.TB)
+
+	tree1 := map[string]string{
+		"file1":           "content1",
+		"dir1/dir2/file2": "content2",
+	}
+	archiveData(f.TB, src, srcNodes, tree1)
+	tree2 := map[string]string{
+		"file1":      "content1",
+		"dir1/file3": "content3",
+	}
+	archiveData(f.TB, src, srcNodes, tree2)
+	// An object already present is not copied again.
+	_, err := AddBytes(dst, []byte("content1"))
+	f.Assertf(err == nil, "Unexpected error: %s", err)
+
+	report, err := syncRepositories(f, src, srcNodes, dst, dstNodes)
+	f.Assertf(err == nil, "Unexpected error: %s", err)
+	objects := EnumerateCasAsList(f.TB, src)
+	f.Assertf(report.nodes == 2 && report.present == 0 && len(report.failed) == 0, "Unexpected report %v", report)
+	f.Assertf(report.objects == len(objects)-1, "Unexpected report %v", report)
+	items := EnumerateCasAsList(f.TB, dst)
+	f.Assertf(Equals(items, objects), "Unexpected objects: %q != %q", items, objects)
+	names := EnumerateNodesAsList(f.TB, dstNodes)
+	f.Assertf(len(names) == 2, "Unexpected nodes: %q", names)
+	for _, name := range names {
+		expected, err := LoadNode(srcNodes, name)
+		f.Assertf(err == nil, "Unexpected error: %s", err)
+		actual, err := LoadNode(dstNodes, name)
+		f.Assertf(err == nil && actual.Entry == expected.Entry, "Unexpected node %s: %v %s", name, actual, err)
+	}
+
+	// Nothing is copied again.
+	report, err = syncRepositories(f, src, srcNodes, dst, dstNodes)
+	f.Assertf(err == nil, "Unexpected error: %s", err)
+	f.Assertf(report.nodes == 0 && report.present == 2 && report.objects == 0, "Unexpected report %v", report)
+
+	// A node referencing a missing or a corrupted object is not copied.
+	sha1tree3, _, _ := archiveData(f.TB, src, srcNodes, map[string]string{"file4": "content4"})
+	delete(src.entries, sha1tree3["file4"])
+	sha1tree4, _, _ := archiveData(f.TB, src, srcNodes, map[string]string{"file5": "content5"})
+	src.entries[sha1tree4["file5"]] = []byte("corrupted")
+	report, err = syncRepositories(f, src, srcNodes, dst, dstNodes)
+	f.Assertf(err == nil, "Unexpected error: %s", err)
+	f.Assertf(report.nodes == 0 && report.present == 2 && len(report.failed) == 2, "Unexpected report %v", report)
+	f.Assertf(src.GetFsckBit(), "Expected the fsck bit to be set")
+	names = EnumerateNodesAsList(f.TB, dstNodes)
+	f.Assertf(len(names) == 2, "Unexpected nodes: %q", names)
+	_, err = dst.Stat(sha1tree4["file5"])
+	f.Assertf(err != nil, "Unexpected success")
+}
+
+func TestSyncHashMismatch(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	src := makeFakeCasTable(f.TB)
+	srcNodes := makeFakeNodesTable(src, f.TB)
+	tempData := makeTempDir(f.TB, "sync_hash")
+	defer removeTempDir(tempData)
+	_, err := initLocalRepository(tempData, "", 0)
+	f.Assertf(err == nil, "Unexpected error: %s", err)
+	dst, err := makeLocalCasTable(tempData)
+	f.Assertf(err == nil, "Unexpected error: %s", err)
+	dstNodes, err := loadLocalNodesTable(tempData, dst, f.GetLog())
+	f.Assertf(err == nil, "Unexpected error: %s", err)
+
+	_, err = syncRepositories(f, src, srcNodes, dst, dstNodes)
+	f.Assertf(err != nil, "Unexpected success")
+}
+
+func TestSyncLocalToRemote(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	srcData := makeTempDir(f.TB, "sync_src")
+	defer removeTempDir(srcData)
+	_, err := initLocalRepository(srcData, "", 0)
+	f.Assertf(err == nil, "Unexpected error: %s", err)
+	src, err := makeLocalCasTable(srcData)
+	f.Assertf(err == nil, "Unexpected error: %s", err)
+	srcNodes, err := loadLocalNodesTable(srcData, src, f.GetLog())
+	f.Assertf(err == nil, "Unexpected error: %s", err)
+	tree := map[string]string{
+		"file1":           "content1",
+		"dir1/dir2/file2": "content2",
+	}
+	sha1tree, nodeName, _ := archiveData(f.TB, src, srcNodes, tree)
+
+	remoteData := makeTempDir(f.TB, "sync_remote")
+	defer removeTempDir(remoteData)
+	server := serveLocalRepository(f.TB, remoteData, true)
+	defer server.Close()
+	remote, err := makeHttpCasTable(server.URL, testToken)
+	f.Assertf(err == nil, "Unexpected error: %s", err)
+	remoteNodes, err := makeHttpNodesTable(server.URL, testToken)
+	f.Assertf(err == nil, "Unexpected error: %s", err)
+
+	report, err := syncRepositories(f, src, srcNodes, remote, remoteNodes)
+	f.Assertf(err == nil, "Unexpected error: %s", err)
+	objects := EnumerateCasAsList(f.TB, src)
+	f.Assertf(report.nodes == 1 && report.objects == len(objects), "Unexpected report %v", report)
+	items := EnumerateNodesAsList(f.TB, remoteNodes)
+	f.Assertf(Equals(items, []string{nodeName}), "Unexpected nodes: %q", items)
+
+	// And back into another local repository.
+	dstData := makeTempDir(f.TB, "sync_dst")
+	defer removeTempDir(dstData)
+	_, err = initLocalRepository(dstData, "", 0)
+	f.Assertf(err == nil, "Unexpected error: %s", err)
+	dst, err := makeLocalCasTable(dstData)
+	f.Assertf(err == nil, "Unexpected error: %s", err)
+	dstNodes, err := loadLocalNodesTable(dstData, dst, f.GetLog())
+	f.Assertf(err == nil, "Unexpected error: %s", err)
+	report, err = syncRepositories(f, remote, remoteNodes, dst, dstNodes)
+	f.Assertf(err == nil, "Unexpected error: %s", err)
+	f.Assertf(report.nodes == 1 && report.objects == len(objects), "Unexpected report %v", report)
+	items = EnumerateCasAsList(f.TB, dst)
+	f.Assertf(Equals(items, objects), "Unexpected objects: %q != %q", items, objects)
+	r, err := dst.Open(sha1tree["dir1/dir2/file2"])
+	f.Assertf(err == nil, "Unexpected error: %s", err)
+	defer r.Close()
+	data := &bytes.Buffer{}
+	data.ReadFrom(r)
+	f.Assertf(data.String() == "content2", "Unexpected content %q", data.String())
+}
+
+func TestSyncCommand(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	f.Run([]string{"sync", "-from=\\test_archive"}, 1)
+	f.CheckBuffer(false, true)
+	f.Run([]string{"sync", "-from=\\test_archive", "-to=\\test_archive"}, 1)
+	f.CheckBuffer(false, true)
+
+	// The mock has a single repository so the node is already present.
+	f.MakeCasTable("")
+	f.LoadNodesTable("", f.cas)
+	archiveData(f.TB, f.cas, f.nodes, map[string]string{"file1": "content1"})
+	f.Run([]string{"sync", "-from=\\test_archive", "-to=\\test_copy"}, 0)
+	f.CheckBuffer(true, false)
+}
+
+func TestSyncBatchesPresentObjects(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	src := makeFakeCasTable(f.TB)
+	srcNodes := makeFakeNodesTable(src, f.TB)
+	tree := map[string]string{
+		"file1":           "content1",
+		"file2":           "content2",
+		"dir1/file3":      "content3",
+		"dir1/dir2/file4": "content4",
+	}
+	_, nodeName, _ := archiveData(f.TB, src, srcNodes, tree)
+
+	// The objects are all present but the node isn't; the destination is
+	// queried once per directory object and nothing is sent. archiveData()
+	// stores the whole tree in a single object.
+	dst := &countingCasTable{CasTable: makeFakeCasTable(f.TB)}
+	for item := range src.Enumerate() {
+		dst.CasTable.(*fakeCasTable).entries[item.Item] = src.entries[item.Item]
+	}
+	dstNodes := makeFakeNodesTable(dst, f.TB)
+	report, err := syncRepositories(f, src, srcNodes, dst, dstNodes)
+	f.Assertf(err == nil, "Unexpected error: %s", err)
+	f.Assertf(report.nodes == 1 && report.objects == 0, "Unexpected report %v", report)
+	f.Assertf(dst.missing == 1 && dst.addEntry == 0, "Unexpected calls: %d Missing(), %d AddEntry()", dst.missing, dst.addEntry)
+	names := EnumerateNodesAsList(f.TB, dstNodes)
+	f.Assertf(Equals(names, []string{nodeName}), "Unexpected nodes: %q", names)
+}
@@ -10,13 +10,49 @@ limitations under the License. */
 package main
 
 import (
+	"bufio"
+	"encoding/json"
 	"fmt"
+	"github.com/maruel/subcommands"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 )
 
-const TrashName = "trash"
+const (
+	TrashName = "trash"
+	// Journal of the moves to the trash, one TrashRecord in json per line.
+	trashJournalName = ".journal"
+)
+
+// Reasons why an item is moved to the trash.
+const (
+	TrashCorrupted = "corrupted"
+	TrashInvalid   = "invalid"
+	TrashOrphan    = "orphan"
+	TrashPruned    = "pruned"
+	TrashRemoved   = "removed"
+)
+
+var cmdTrash = &subcommands.Command{
+	UsageLine: "trash <ls|restore|empty> [items]",
+	ShortDesc: "lists, restores or deletes the items in the trash",
+	LongDesc:  "ls lists the objects and the nodes in the trash with when and why they were trashed. restore <items> moves the items back; an object is only restored if its content still matches its digest. empty deletes permanently the items trashed before -older-than.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &trashRun{}
+		c.Init()
+		c.Flags.DurationVar(&c.olderThan, "older-than", 0, "With empty, only deletes the items trashed before this period, e.g. 720h")
+		return c
+	},
+}
+
+type trashRun struct {
+	CommonFlags
+	olderThan time.Duration
+}
 
 type trash struct {
 	rootDir  string
@@ -24,8 +60,43 @@ type trash struct {
 	created  bool
 }
 
+// Records why and by which command an item was moved to the trash. Expected and
+// Actual are the digests of a corrupted object.
+type TrashRecord struct {
+	Item     string    `json:"item"`
+	Time     time.Time `json:"time"`
+	Reason   string    `json:"reason"`
+	Command  string    `json:"command,omitempty"`
+	Expected string    `json:"expected,omitempty"`
+	Actual   string    `json:"actual,omitempty"`
+}
+
+func (r *TrashRecord) String() string {
+	if r.Expected != "" {
+		return fmt.Sprintf("%s, %s != %s", r.Reason, r.Expected, r.Actual)
+	}
+	return r.Reason
+}
+
 type Trash interface {
-	Move(relPath string) error
+	// Moves an item of the table to the trash and appends |record| to the
+	// journal. Item, Time and Command are filled in when empty. |record| may be
+	// nil, in which case the reason is TrashRemoved.
+	Move(relPath string, record *TrashRecord) error
+	// Returns the journal of the moves to the trash, oldest first. It includes
+	// the items that were restored or deleted since.
+	Journal() ([]*TrashRecord, error)
+	// Enumerates the items in the trash, by their path relative to the table.
+	Enumerate() <-chan EnumerationEntry
+	// Opens an item in the trash for reading.
+	Open(relPath string) (ReadSeekCloser, error)
+	// Returns the size of an item in the trash and when it was trashed.
+	Stat(relPath string) (*ObjectInfo, error)
+	// Moves an item back into the table. Fails if the table already has an item
+	// with the same path.
+	Restore(relPath string) error
+	// Deletes an item in the trash permanently.
+	Remove(relPath string) error
 }
 
 func MakeTrash(rootDir string) Trash {
@@ -35,7 +106,24 @@ func MakeTrash(rootDir string) Trash {
 	return &trash{rootDir: rootDir, trashDir: filepath.Join(rootDir, TrashName)}
 }
 
-func (t *trash) Move(relPath string) error {
+// Fills in the fields of |record| left empty by the caller.
+func completeTrashRecord(relPath string, record *TrashRecord) *TrashRecord {
+	if record == nil {
+		record = &TrashRecord{Reason: TrashRemoved}
+	}
+	if record.Item == "" {
+		record.Item = filepath.ToSlash(relPath)
+	}
+	if record.Time.IsZero() {
+		record.Time = time.Now()
+	}
+	if record.Command == "" {
+		record.Command = strings.Join(os.Args, " ")
+	}
+	return record
+}
+
+func (t *trash) Move(relPath string, record *TrashRecord) error {
 	log.Printf("Move(%s)", relPath)
 	if !t.created {
 		if err := os.Mkdir(t.trashDir, 0750); err != nil && !os.IsExist(err) {
@@ -53,5 +141,282 @@ func (t *trash) Move(relPath string) error {
 		}
 		log.Print("Created trash subdir " + dir)
 	}
-	return os.Rename(filepath.Join(t.rootDir, relPath), filepath.Join(t.trashDir, relPath))
+	dst := filepath.Join(t.trashDir, relPath)
+	if err := os.Rename(filepath.Join(t.rootDir, relPath), dst); err != nil {
+		return err
+	}
+	// The modification time records when the item was trashed. Ignore the
+	// error.
+	record = completeTrashRecord(relPath, record)
+	os.Chtimes(dst, record.Time, record.Time)
+	if err := t.appendJournal(record); err != nil {
+		// The item is already in the trash, don't fail the operation.
+		log.Printf("Failed to record %s in the trash journal: %s", relPath, err)
+	}
+	return nil
+}
+
+func (t *trash) appendJournal(record *TrashRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(t.trashDir, trashJournalName), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+func (t *trash) Journal() ([]*TrashRecord, error) {
+	out := []*TrashRecord{}
+	f, err := os.Open(filepath.Join(t.trashDir, trashJournalName))
+	if os.IsNotExist(err) {
+		return out, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		record := &TrashRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+			// A truncated line, e.g. if the disk got full. Skip it.
+			log.Printf("Invalid record in the trash journal: %s", err)
+			continue
+		}
+		out = append(out, record)
+	}
+	return out, scanner.Err()
+}
+
+func (t *trash) Enumerate() <-chan EnumerationEntry {
+	items := make(chan EnumerationEntry)
+	go func() {
+		defer close(items)
+		if !isDir(t.trashDir) {
+			return
+		}
+		journal := filepath.Join(t.trashDir, trashJournalName)
+		for v := range EnumerateTree(t.trashDir) {
+			if v.Error != nil {
+				items <- EnumerationEntry{Error: v.Error}
+				continue
+			}
+			if v.FullPath == journal {
+				continue
+			}
+			items <- EnumerationEntry{Item: v.FullPath[len(t.trashDir)+1:]}
+		}
+	}()
+	return items
+}
+
+func (t *trash) Open(relPath string) (ReadSeekCloser, error) {
+	return os.Open(filepath.Join(t.trashDir, relPath))
+}
+
+func (t *trash) Stat(relPath string) (*ObjectInfo, error) {
+	stat, err := os.Stat(filepath.Join(t.trashDir, relPath))
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectInfo{stat.Size(), stat.ModTime()}, nil
+}
+
+func (t *trash) Restore(relPath string) error {
+	dst := filepath.Join(t.rootDir, relPath)
+	if _, err := os.Lstat(dst); err == nil {
+		return fmt.Errorf("Can't restore %s: %s", relPath, os.ErrExist)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0750); err != nil {
+		return fmt.Errorf("Failed to create %s: %s", filepath.Dir(dst), err)
+	}
+	if err := os.Rename(filepath.Join(t.trashDir, relPath), dst); err != nil {
+		return err
+	}
+	t.removeEmptyDirs(relPath)
+	return nil
+}
+
+func (t *trash) Remove(relPath string) error {
+	if err := os.Remove(filepath.Join(t.trashDir, relPath)); err != nil {
+		return err
+	}
+	t.removeEmptyDirs(relPath)
+	return nil
+}
+
+// Removes the directories of |relPath| in the trash that became empty.
+func (t *trash) removeEmptyDirs(relPath string) {
+	for dir := filepath.Dir(relPath); dir != "."; dir = filepath.Dir(dir) {
+		// Fails if the directory is not empty.
+		if os.Remove(filepath.Join(t.trashDir, dir)) != nil {
+			return
+		}
+	}
+}
+
+// An item in the trash of the CasTable or of the NodesTable. |name| is the
+// path of the item prefixed with the table, e.g. nodes/2012-01/<node>.
+type trashedItem struct {
+	name    string
+	trash   Trash
+	relPath string
+	*ObjectInfo
+	// Why the item was trashed; nil if it isn't in the journal.
+	record *TrashRecord
+}
+
+type trashedItemsByTime []*trashedItem
+
+func (t trashedItemsByTime) Len() int      { return len(t) }
+func (t trashedItemsByTime) Swap(i, j int) { t[i], t[j] = t[j], t[i] }
+func (t trashedItemsByTime) Less(i, j int) bool {
+	if t[i].ModTime.Equal(t[j].ModTime) {
+		return t[i].name < t[j].name
+	}
+	return t[i].ModTime.Before(t[j].ModTime)
+}
+
+// Returns the trash of each table, by the prefix used to name its items.
+func (c *trashRun) trashes() map[string]Trash {
+	return map[string]Trash{
+		casName:   c.cas.GetTrash(),
+		nodesName: c.nodes.GetTrash(),
+	}
+}
+
+// Lists the items in the trash of both tables, oldest first.
+func (c *trashRun) enumerate() ([]*trashedItem, error) {
+	out := []*trashedItem{}
+	for prefix, trash := range c.trashes() {
+		journal, err := trash.Journal()
+		if err != nil {
+			return nil, err
+		}
+		// Keep the latest record of each item, in case it was trashed, restored
+		// and trashed again.
+		records := map[string]*TrashRecord{}
+		for _, record := range journal {
+			records[record.Item] = record
+		}
+		for item := range trash.Enumerate() {
+			if item.Error != nil {
+				// TODO(maruel): Leaks channel.
+				return nil, item.Error
+			}
+			info, err := trash.Stat(item.Item)
+			if err != nil {
+				// TODO(maruel): Leaks channel.
+				return nil, err
+			}
+			relPath := filepath.ToSlash(item.Item)
+			out = append(out, &trashedItem{prefix + "/" + relPath, trash, item.Item, info, records[relPath]})
+		}
+	}
+	sort.Sort(trashedItemsByTime(out))
+	return out, nil
+}
+
+// Moves an item listed by ls back into its table.
+func (c *trashRun) restore(name string) error {
+	parts := strings.SplitN(name, "/", 2)
+	trash, ok := c.trashes()[parts[0]]
+	if !ok || len(parts) != 2 {
+		return fmt.Errorf("Invalid item %s; must start with %s/ or %s/", name, casName, nodesName)
+	}
+	relPath := filepath.FromSlash(parts[1])
+	if parts[0] == casName {
+		// Don't put back an object that was trashed because it is corrupted.
+		f, err := trash.Open(relPath)
+		if err != nil {
+			return err
+		}
+		actual, err := c.cas.GetHashAlgorithm().HashReader(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		if expected := strings.Replace(parts[1], "/", "", -1); actual != expected {
+			return fmt.Errorf("Can't restore %s; its content doesn't match its digest", name)
+		}
+	}
+	return trash.Restore(relPath)
+}
+
+func (c *trashRun) main(a DumbcasApplication, args []string) error {
+	// Restoring and deleting can't happen while gc or fsck runs.
+	c.exclusive = args[0] != "ls"
+	if err := c.Parse(a, true); err != nil {
+		return err
+	}
+	defer c.Close()
+
+	switch args[0] {
+	case "ls":
+		items, err := c.enumerate()
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			reason := "unknown"
+			if item.record != nil {
+				reason = item.record.String()
+			}
+			fmt.Fprintf(a.GetOut(), "%s  %12d  %s (%s)\n", item.ModTime.Format("2006-01-02 15:04:05"), item.Size, item.name, reason)
+		}
+	case "restore":
+		for _, name := range args[1:] {
+			if err := c.restore(name); err != nil {
+				return err
+			}
+			fmt.Fprintf(a.GetOut(), "Restored %s\n", name)
+		}
+	case "empty":
+		items, err := c.enumerate()
+		if err != nil {
+			return err
+		}
+		cutoff := time.Now().Add(-c.olderThan)
+		count := 0
+		var size int64
+		for _, item := range items {
+			if item.ModTime.After(cutoff) {
+				continue
+			}
+			if err := item.trash.Remove(item.relPath); err != nil {
+				return fmt.Errorf("Failed to delete %s: %s", item.name, err)
+			}
+			count++
+			size += item.Size
+		}
+		fmt.Fprintf(a.GetOut(), "Deleted %d items (%.1fmb)\n", count, toMb(size))
+	}
+	return nil
+}
+
+func (c *trashRun) Run(a subcommands.Application, args []string) int {
+	if len(args) == 0 || (args[0] != "ls" && args[0] != "restore" && args[0] != "empty") {
+		fmt.Fprintf(a.GetErr(), "%s: Must provide ls, restore or empty.\n", a.GetName())
+		return 1
+	}
+	if args[0] == "restore" && len(args) == 1 {
+		fmt.Fprintf(a.GetErr(), "%s: Must provide the items to restore.\n", a.GetName())
+		return 1
+	}
+	if args[0] != "restore" && len(args) != 1 {
+		fmt.Fprintf(a.GetErr(), "%s: Unsupported arguments.\n", a.GetName())
+		return 1
+	}
+	d := a.(DumbcasApplication)
+	if err := c.main(d, args); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
 }
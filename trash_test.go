@@ -0,0 +1,222 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/maruel/subcommands/subcommandstest"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// A Trash implementation that keeps the items of an in-memory table.
+type fakeTrash struct {
+	// The items of the table, shared with the table itself.
+	table   map[string][]byte
+	entries map[string][]byte
+	times   map[string]time.Time
+	journal []*TrashRecord
+}
+
+func makeFakeTrash(table map[string][]byte) *fakeTrash {
+	return &fakeTrash{table, make(map[string][]byte), make(map[string]time.Time), nil}
+}
+
+func (f *fakeTrash) Move(relPath string, record *TrashRecord) error {
+	data, ok := f.table[relPath]
+	if !ok {
+		return os.ErrNotExist
+	}
+	record = completeTrashRecord(relPath, record)
+	delete(f.table, relPath)
+	f.entries[relPath] = data
+	f.times[relPath] = record.Time
+	f.journal = append(f.journal, record)
+	return nil
+}
+
+func (f *fakeTrash) Journal() ([]*TrashRecord, error) {
+	return append([]*TrashRecord{}, f.journal...), nil
+}
+
+func (f *fakeTrash) Enumerate() <-chan EnumerationEntry {
+	c := make(chan EnumerationEntry)
+	go func() {
+		// TODO(maruel): Will blow up if mutated concurrently.
+		for k := range f.entries {
+			c <- EnumerationEntry{Item: k}
+		}
+		close(c)
+	}()
+	return c
+}
+
+func (f *fakeTrash) Open(relPath string) (ReadSeekCloser, error) {
+	data, ok := f.entries[relPath]
+	if !ok {
+		return nil, fmt.Errorf("Missing: %s", relPath)
+	}
+	return Buffer{bytes.NewReader(data)}, nil
+}
+
+func (f *fakeTrash) Stat(relPath string) (*ObjectInfo, error) {
+	data, ok := f.entries[relPath]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return &ObjectInfo{int64(len(data)), f.times[relPath]}, nil
+}
+
+func (f *fakeTrash) Restore(relPath string) error {
+	data, ok := f.entries[relPath]
+	if !ok {
+		return os.ErrNotExist
+	}
+	if _, ok := f.table[relPath]; ok {
+		return os.ErrExist
+	}
+	f.table[relPath] = data
+	return f.Remove(relPath)
+}
+
+func (f *fakeTrash) Remove(relPath string) error {
+	if _, ok := f.entries[relPath]; !ok {
+		return os.ErrNotExist
+	}
+	delete(f.entries, relPath)
+	delete(f.times, relPath)
+	return nil
+}
+
+// Returns a sorted list of all the items in the trash.
+func EnumerateTrashAsList(t *subcommandstest.TB, trash Trash) []string {
+	items := []string{}
+	for v := range trash.Enumerate() {
+		t.Assertf(v.Error == nil, "Unexpected failure: %s", v.Error)
+		items = append(items, v.Item)
+	}
+	sort.Strings(items)
+	return items
+}
+
+func TestTrash(t *testing.T) {
+	t.Parallel()
+	tb := subcommandstest.MakeTB(t)
+	tempData := makeTempDir(tb, "trash")
+	defer removeTempDir(tempData)
+
+	trash := MakeTrash(tempData)
+	items := EnumerateTrashAsList(tb, trash)
+	tb.Assertf(len(items) == 0, "Unexpected items: %q", items)
+
+	err := createTree(tempData, map[string]string{"a/b": "content1", "c": "content2"})
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	tb.Assertf(trash.Move(filepath.Join("a", "b"), nil) == nil, "Failed to move")
+	record := &TrashRecord{Reason: TrashCorrupted, Command: "fsck", Expected: "c", Actual: "d"}
+	tb.Assertf(trash.Move("c", record) == nil, "Failed to move")
+	tb.Assertf(trash.Move("c", nil) != nil, "Unexpected success")
+	tb.Assertf(!isFile(filepath.Join(tempData, "c")), "c wasn't moved")
+
+	journal, err := trash.Journal()
+	tb.Assertf(err == nil && len(journal) == 2, "Unexpected journal: %v %s", journal, err)
+	r := journal[0]
+	tb.Assertf(r.Item == "a/b" && r.Reason == TrashRemoved && r.Command != "", "Unexpected record: %v", r)
+	tb.Assertf(time.Since(r.Time) < time.Hour, "Unexpected time %s", r.Time)
+	r = journal[1]
+	tb.Assertf(r.Item == "c" && r.Command == "fsck" && r.String() == "corrupted, c != d", "Unexpected record: %v", r)
+
+	items = EnumerateTrashAsList(tb, trash)
+	expected := []string{filepath.Join("a", "b"), "c"}
+	tb.Assertf(Equals(items, expected), "Unexpected items: %q", items)
+	f, err := trash.Open(filepath.Join("a", "b"))
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	tb.Assertf(err == nil && string(data) == "content1", "Unexpected content %q %s", data, err)
+	info, err := trash.Stat("c")
+	tb.Assertf(err == nil && info.Size == 8, "Unexpected result %v %s", info, err)
+	tb.Assertf(time.Since(info.ModTime) < time.Hour, "Unexpected time %s", info.ModTime)
+
+	// Restore fails if the item was created again.
+	err = createTree(tempData, map[string]string{"c": "content3"})
+	tb.Assertf(err == nil, "Unexpected error: %s", err)
+	tb.Assertf(trash.Restore("c") != nil, "Unexpected success")
+	tb.Assertf(os.Remove(filepath.Join(tempData, "c")) == nil, "Failed to remove c")
+	tb.Assertf(trash.Restore("c") == nil, "Failed to restore")
+	data, err = ioutil.ReadFile(filepath.Join(tempData, "c"))
+	tb.Assertf(err == nil && string(data) == "content2", "Unexpected content %q %s", data, err)
+
+	tb.Assertf(trash.Remove(filepath.Join("a", "b")) == nil, "Failed to remove")
+	items = EnumerateTrashAsList(tb, trash)
+	tb.Assertf(len(items) == 0, "Unexpected items: %q", items)
+	// The journal is kept to audit the deletions.
+	names, err := readDirNames(filepath.Join(tempData, TrashName))
+	tb.Assertf(err == nil && Equals(names, []string{trashJournalName}), "Unexpected directories: %q %s", names, err)
+	journal, err = trash.Journal()
+	tb.Assertf(err == nil && len(journal) == 2, "Unexpected journal: %v %s", journal, err)
+}
+
+func TestTrashCommand(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	f.MakeCasTable("")
+	f.LoadNodesTable("", f.cas)
+	_, nodeName, entry := archiveData(f.TB, f.cas, f.nodes, map[string]string{"file1": "content1"})
+	items := EnumerateCasAsList(f.TB, f.cas)
+	f.Assertf(f.nodes.Remove(nodeName, nil) == nil, "Failed to remove %s", nodeName)
+	f.Assertf(f.nodes.Remove(path.Join(tagsName, "fictious"), nil) == nil, "Failed to remove the tag")
+	f.Run([]string{"gc", "-root=\\test_trash", "-grace=0"}, 0)
+	f.CheckBuffer(true, false)
+	f.Assertf(len(EnumerateCasAsList(f.TB, f.cas)) == 0, "gc didn't collect")
+
+	f.Run([]string{"trash", "-root=\\test_trash"}, 1)
+	f.CheckBuffer(false, true)
+	f.Run([]string{"trash", "-root=\\test_trash", "restore"}, 1)
+	f.CheckBuffer(false, true)
+	f.Run([]string{"trash", "-root=\\test_trash", "ls"}, 0)
+	f.CheckBuffer(true, false)
+
+	// Restore the node and its objects.
+	args := []string{"trash", "-root=\\test_trash", "restore", "nodes/" + filepath.ToSlash(nodeName)}
+	for _, item := range items {
+		args = append(args, "cas/"+item)
+	}
+	f.Run(args, 0)
+	f.CheckBuffer(true, false)
+	i := EnumerateCasAsList(f.TB, f.cas)
+	f.Assertf(Equals(i, items), "Unexpected items: %q", i)
+	n := EnumerateNodesAsList(f.TB, f.nodes)
+	f.Assertf(Equals(n, []string{nodeName}), "Unexpected nodes: %q", n)
+	f.Run([]string{"trash", "-root=\\test_trash", "restore", "nodes/" + filepath.ToSlash(nodeName)}, 1)
+	f.CheckBuffer(false, true)
+
+	// A corrupted object isn't restored.
+	cas := f.cas.(*fakeCasTable)
+	f.Assertf(f.cas.Remove(entry, nil) == nil, "Failed to remove %s", entry)
+	cas.trash.entries[entry] = []byte("corrupted")
+	f.Run([]string{"trash", "-root=\\test_trash", "restore", "cas/" + entry}, 1)
+	f.CheckBuffer(false, true)
+	f.Run([]string{"trash", "-root=\\test_trash", "restore", "foo/" + entry}, 1)
+	f.CheckBuffer(false, true)
+
+	// The item was just trashed.
+	f.Run([]string{"trash", "-root=\\test_trash", "-older-than=1h", "empty"}, 0)
+	f.CheckBuffer(true, false)
+	f.Assertf(len(cas.trash.entries) == 1, "Unexpected trash: %v", cas.trash.entries)
+	f.Run([]string{"trash", "-root=\\test_trash", "empty"}, 0)
+	f.CheckBuffer(true, false)
+	f.Assertf(len(cas.trash.entries) == 0, "Unexpected trash: %v", cas.trash.entries)
+}
@@ -14,6 +14,9 @@ import (
 	"github.com/maruel/subcommands"
 )
 
+// Version of dumbcas, recorded in every Node created by archive.
+const version = "0.1"
+
 var cmdVersion = &subcommands.Command{
 	UsageLine: "version",
 	ShortDesc: "prints version",
@@ -37,6 +40,6 @@ func (c *versionRun) Run(a subcommands.Application, args []string) int {
 		fmt.Fprintf(a.GetErr(), "%s: Unsupported arguments.\n", a.GetName())
 		return 1
 	}
-	fmt.Fprintf(a.GetOut(), "0.1\n")
+	fmt.Fprintf(a.GetOut(), "%s\n", version)
 	return 0
 }
@@ -15,25 +15,31 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"os"
 )
 
 var cmdWeb = &subcommands.Command{
 	UsageLine: "web",
 	ShortDesc: "starts a web service to access the dumbcas",
-	LongDesc:  "Serves each node as a full virtual tree of the archived files.",
+	LongDesc:  "Serves each node as a full virtual tree of the archived files. With -writable, also serves the API used by the commands run with -root=http://host:port/. The repository is only locked while a request modifies it or on behalf of a client.",
 	CommandRun: func() subcommands.CommandRun {
 		c := &webRun{}
 		c.Init()
+		c.unlocked = true
 		c.Flags.IntVar(&c.port, "port", 8010, "port number")
 		c.Flags.BoolVar(&c.local, "local", false, "only listed on localhost")
+		c.Flags.BoolVar(&c.writable, "writable", false, "accepts the requests modifying the repository that carry the token")
+		c.Flags.StringVar(&c.token, "token", os.Getenv("DUMBCAS_TOKEN"), "token required by -writable. Set $DUMBCAS_TOKEN instead to keep it out of the process list.")
 		return c
 	},
 }
 
 type webRun struct {
 	CommonFlags
-	port  int
-	local bool
+	port     int
+	local    bool
+	writable bool
+	token    string
 }
 
 // Converts an handler to log every HTTP request.
@@ -102,18 +108,34 @@ func localRedirect(w http.ResponseWriter, r *http.Request, newPath string) {
 	w.WriteHeader(http.StatusMovedPermanently)
 }
 
-func (c *webRun) main(d DumbcasApplication, ready chan<- net.Listener) error {
-	if err := c.Parse(d, true); err != nil {
-		return err
-	}
-
+// Returns the handler serving the tables along the API to access them
+// remotely. |lock| locks the repository without waiting.
+func makeServeMux(cas CasTable, nodes NodesTable, writable bool, token string, lock func(exclusive bool) (Lock, error)) *http.ServeMux {
 	serveMux := http.NewServeMux()
 
-	x := http.StripPrefix("/content/retrieve/default", c.cas)
+	x := http.StripPrefix("/content/retrieve/default", cas)
 	serveMux.Handle("/content/retrieve/default/", Restrict(x, "GET"))
-	x = http.StripPrefix("/content/retrieve/nodes", c.nodes)
+	x = http.StripPrefix("/content/retrieve/nodes", nodes)
 	serveMux.Handle("/content/retrieve/nodes/", Restrict(x, "GET"))
 	serveMux.Handle("/", Restrict(http.RedirectHandler("/content/retrieve/nodes/", http.StatusFound), "GET"))
+	api := &apiServer{cas: cas, nodes: nodes, writable: writable, token: token, lockRepository: lock, locks: map[string]*apiLock{}}
+	api.register(serveMux)
+	return serveMux
+}
+
+func (c *webRun) main(d DumbcasApplication, ready chan<- net.Listener) error {
+	if c.writable && c.token == "" {
+		return fmt.Errorf("-writable requires -token or $DUMBCAS_TOKEN")
+	}
+	if err := c.Parse(d, true); err != nil {
+		return err
+	}
+	defer c.Close()
+
+	lock := func(exclusive bool) (Lock, error) {
+		return d.LockRepository(c.Root, c.cas, exclusive, 0)
+	}
+	serveMux := makeServeMux(c.cas, c.nodes, c.writable, c.token, lock)
 
 	var addr string
 	if c.local {
@@ -0,0 +1,492 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The API served by web under /content/ to access the repository remotely.
+// The nodes are addressed with "/" as the separator on every OS. The requests
+// modifying the repository must carry the token given to web as
+// "Authorization: Bearer <token>".
+const (
+	apiConfigPath         = "/content/config"
+	apiFsckPath           = "/content/fsck"
+	apiLockPath           = "/content/lock/"
+	apiTemporaryPath      = "/content/tmp"
+	apiObjectPath         = "/content/store/default/"
+	apiMissingPath        = "/content/missing/default"
+	apiNodePath           = "/content/store/nodes/"
+	apiEnumerateCasPath   = "/content/enumerate/default"
+	apiEnumerateNodesPath = "/content/enumerate/nodes"
+)
+
+// A request carrying the id of a lock held by its client in this header is
+// served without locking the repository again.
+const apiLockHeader = "X-Dumbcas-Lock"
+
+// How long a lock held on behalf of a client is kept without being renewed, so
+// the lock of a killed client is released.
+const apiLockTimeout = time.Minute
+
+// Returned by GET /content/config.
+type apiConfig struct {
+	Hash string `json:"hash"`
+}
+
+// A lock held on behalf of a client. It is released when |timer| fires unless
+// the client renews it.
+type apiLock struct {
+	lock      Lock
+	exclusive bool
+	timer     *time.Timer
+}
+
+// Serves the API. The methods modifying the repository are refused unless
+// writable is set and the request carries the token.
+type apiServer struct {
+	cas            CasTable
+	nodes          NodesTable
+	writable       bool
+	token          string
+	lockRepository func(exclusive bool) (Lock, error)
+	locksLock      sync.Mutex
+	locks          map[string]*apiLock
+}
+
+func (s *apiServer) register(serveMux *http.ServeMux) {
+	serveMux.HandleFunc(apiConfigPath, s.serveConfig)
+	serveMux.HandleFunc(apiLockPath, s.serveLock)
+	serveMux.HandleFunc(apiTemporaryPath, s.serveTemporary)
+	serveMux.HandleFunc(apiFsckPath, s.locked(s.serveFsck))
+	serveMux.HandleFunc(apiObjectPath, s.locked(s.serveObject))
+	serveMux.HandleFunc(apiMissingPath, s.locked(s.serveMissing))
+	serveMux.HandleFunc(apiNodePath, s.locked(s.serveNode))
+	serveMux.HandleFunc(apiEnumerateCasPath, s.serveEnumerateCas)
+	serveMux.HandleFunc(apiEnumerateNodesPath, s.serveEnumerateNodes)
+}
+
+// Returns the lock held by the client of the request, if any.
+func (s *apiServer) heldLock(r *http.Request) *apiLock {
+	s.locksLock.Lock()
+	defer s.locksLock.Unlock()
+	return s.locks[r.Header.Get(apiLockHeader)]
+}
+
+// Holds a shared lock on the repository while a request modifying it is
+// served, unless its client already holds a lock. The other requests are
+// refused by |h| itself.
+func (s *apiServer) locked(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" || r.Method == "HEAD" || !s.writable || !s.authorized(r) || s.heldLock(r) != nil {
+			h(w, r)
+			return
+		}
+		lock, err := s.lockRepository(false)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		defer lock.Release()
+		h(w, r)
+	}
+}
+
+// Releases the lock |id| unless it was released in the meantime.
+func (s *apiServer) releaseLock(id string) {
+	s.locksLock.Lock()
+	l := s.locks[id]
+	delete(s.locks, id)
+	s.locksLock.Unlock()
+	if l != nil {
+		l.lock.Release()
+	}
+}
+
+// Replies with an error and returns false if the method of the request is not
+// one of |methods| or if it modifies the repository while it is read-only.
+func (s *apiServer) allow(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method != method {
+			continue
+		}
+		if method == "GET" || method == "HEAD" {
+			return true
+		}
+		if !s.writable {
+			http.Error(w, "The repository is read-only; run web with -writable", http.StatusForbidden)
+			return false
+		}
+		if !s.authorized(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Invalid token; set $DUMBCAS_TOKEN", http.StatusUnauthorized)
+			return false
+		}
+		return true
+	}
+	http.Error(w, "Invalid Method", http.StatusMethodNotAllowed)
+	return false
+}
+
+// Returns true if the request carries the token given to web.
+func (s *apiServer) authorized(r *http.Request) bool {
+	const prefix = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if s.token == "" || !strings.HasPrefix(auth, prefix) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(auth[len(prefix):]), []byte(s.token)) == 1
+}
+
+// Replies with the error returned by a table.
+func apiError(w http.ResponseWriter, err error) {
+	if os.IsNotExist(err) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+	} else if os.IsExist(err) {
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+	} else {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func apiJson(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func apiText(w http.ResponseWriter, status int, text string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	io.WriteString(w, text)
+}
+
+// Decodes the optional TrashRecord sent along a DELETE.
+func apiTrashRecord(r *http.Request) (*TrashRecord, error) {
+	record := &TrashRecord{}
+	if err := json.NewDecoder(r.Body).Decode(record); err == io.EOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Invalid trash record: %s", err)
+	}
+	return record, nil
+}
+
+// Sends one item per line. An error is sent as a line starting with "!".
+func apiEnumeration(w http.ResponseWriter, items <-chan EnumerationEntry) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for item := range items {
+		if item.Error != nil {
+			fmt.Fprintf(w, "!%s\n", strings.Replace(item.Error.Error(), "\n", " ", -1))
+		} else {
+			fmt.Fprintf(w, "%s\n", filepath.ToSlash(item.Item))
+		}
+	}
+}
+
+func (s *apiServer) serveConfig(w http.ResponseWriter, r *http.Request) {
+	if s.allow(w, r, "GET") {
+		apiJson(w, http.StatusOK, &apiConfig{s.cas.GetHashAlgorithm().Name})
+	}
+}
+
+// POST to the directory locks the repository on behalf of the client,
+// exclusively if the query parameter "exclusive" is "true", and returns the id
+// of the lock. A conflicting lock is reported with 409. PUT to the id renews
+// the lock and DELETE releases it.
+func (s *apiServer) serveLock(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Path[len(apiLockPath):]
+	if id == "" {
+		if !s.allow(w, r, "POST") {
+			return
+		}
+		exclusive := r.URL.Query().Get("exclusive") == "true"
+		var buf [16]byte
+		if _, err := rand.Read(buf[:]); err != nil {
+			apiError(w, err)
+			return
+		}
+		lock, err := s.lockRepository(exclusive)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		id = hex.EncodeToString(buf[:])
+		s.locksLock.Lock()
+		s.locks[id] = &apiLock{lock, exclusive, time.AfterFunc(apiLockTimeout, func() { s.releaseLock(id) })}
+		s.locksLock.Unlock()
+		apiText(w, http.StatusCreated, id)
+		return
+	}
+	if !s.allow(w, r, "PUT", "DELETE") {
+		return
+	}
+	s.locksLock.Lock()
+	l := s.locks[id]
+	// A timer that already fired can't be renewed; the lock is being released.
+	if l != nil && r.Method == "PUT" && !l.timer.Reset(apiLockTimeout) {
+		l = nil
+	}
+	if l != nil && r.Method == "DELETE" {
+		l.timer.Stop()
+		delete(s.locks, id)
+	}
+	s.locksLock.Unlock()
+	if l == nil {
+		http.Error(w, "Unknown lock; it may have expired", http.StatusNotFound)
+		return
+	}
+	if r.Method == "DELETE" {
+		if err := l.lock.Release(); err != nil {
+			apiError(w, err)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Removes the partially written objects. Only a client holding the repository
+// exclusively knows that none of them is still being written.
+func (s *apiServer) serveTemporary(w http.ResponseWriter, r *http.Request) {
+	if !s.allow(w, r, "DELETE") {
+		return
+	}
+	if l := s.heldLock(r); l == nil || !l.exclusive {
+		http.Error(w, "The repository must be locked exclusively", http.StatusConflict)
+		return
+	}
+	if removed, err := s.cas.RemoveTemporaryFiles(); err != nil {
+		apiError(w, err)
+	} else {
+		apiText(w, http.StatusOK, fmt.Sprintf("%d", removed))
+	}
+}
+
+func (s *apiServer) serveFsck(w http.ResponseWriter, r *http.Request) {
+	if !s.allow(w, r, "GET", "PUT", "DELETE") {
+		return
+	}
+	switch r.Method {
+	case "GET":
+		apiText(w, http.StatusOK, fmt.Sprintf("%t", s.cas.GetFsckBit()))
+	case "PUT":
+		s.cas.SetFsckBit()
+		w.WriteHeader(http.StatusNoContent)
+	case "DELETE":
+		s.cas.ClearFsckBit()
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *apiServer) serveEnumerateCas(w http.ResponseWriter, r *http.Request) {
+	if s.allow(w, r, "GET") {
+		apiEnumeration(w, s.cas.Enumerate())
+	}
+}
+
+func (s *apiServer) serveEnumerateNodes(w http.ResponseWriter, r *http.Request) {
+	if s.allow(w, r, "GET") {
+		apiEnumeration(w, s.nodes.Enumerate())
+	}
+}
+
+// GET, HEAD, PUT and DELETE an object by its digest. POST to the directory adds
+// an object whose digest is not known yet and returns it.
+func (s *apiServer) serveObject(w http.ResponseWriter, r *http.Request) {
+	hash := r.URL.Path[len(apiObjectPath):]
+	if hash == "" {
+		if !s.allow(w, r, "POST") {
+			return
+		}
+		if hash, err := s.cas.AddStream(r.Body); err == nil {
+			apiText(w, http.StatusCreated, hash)
+		} else if os.IsExist(err) {
+			apiText(w, http.StatusOK, hash)
+		} else {
+			apiError(w, err)
+		}
+		return
+	}
+	if !s.cas.GetHashAlgorithm().IsValid(hash) {
+		http.Error(w, "Invalid digest", http.StatusBadRequest)
+		return
+	}
+	if !s.allow(w, r, "GET", "HEAD", "PUT", "DELETE") {
+		return
+	}
+	switch r.Method {
+	case "GET", "HEAD":
+		info, err := s.cas.Stat(hash)
+		if err != nil {
+			apiError(w, err)
+			return
+		}
+		f, err := s.cas.Open(hash)
+		if err != nil {
+			apiError(w, err)
+			return
+		}
+		defer f.Close()
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, hash, info.ModTime, f)
+	case "PUT":
+		// Answer before reading the content if the object is present, so a
+		// client sending "Expect: 100-continue" doesn't send it.
+		missing, err := s.cas.Missing([]string{hash})
+		if err == nil && len(missing) != 0 {
+			err = s.cas.AddEntry(r.Body, hash)
+		} else if err == nil {
+			err = os.ErrExist
+		}
+		if mismatch, ok := err.(*HashMismatchError); ok {
+			apiJson(w, http.StatusConflict, mismatch)
+		} else if err == nil {
+			w.WriteHeader(http.StatusCreated)
+		} else if os.IsExist(err) {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			apiError(w, err)
+		}
+	case "DELETE":
+		record, err := apiTrashRecord(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		} else if err := s.cas.Remove(hash, record); err != nil {
+			apiError(w, err)
+		} else {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+}
+
+// Receives digests, one per line, and returns the ones that are missing. The
+// others are touched like CasTable.Missing() does; the client can then skip
+// sending their content. This is a POST since
+// a HEAD request has neither a body to carry thousands of digests nor one to
+// return the missing ones; HEAD on a single object is served by serveObject.
+func (s *apiServer) serveMissing(w http.ResponseWriter, r *http.Request) {
+	if !s.allow(w, r, "POST") {
+		return
+	}
+	hashes := []string{}
+	scanner := bufio.NewScanner(r.Body)
+	for scanner.Scan() {
+		hash := scanner.Text()
+		if !s.cas.GetHashAlgorithm().IsValid(hash) {
+			http.Error(w, fmt.Sprintf("Invalid digest %q", hash), http.StatusBadRequest)
+			return
+		}
+		hashes = append(hashes, hash)
+	}
+	if err := scanner.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	missing, err := s.cas.Missing(hashes)
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, hash := range missing {
+		fmt.Fprintf(w, "%s\n", hash)
+	}
+}
+
+// Returns true if |name| is a relative path that stays in its table.
+func isValidApiName(name string) bool {
+	return name != "" && path.Clean(name) == name && !path.IsAbs(name) && name != ".." && !strings.HasPrefix(name, "../") && !strings.Contains(name, "\\")
+}
+
+// GET, PUT and DELETE a node by its name. POST to a name creates the node
+// unless it exists. POST to the directory adds a node for the tag passed as the
+// query parameter "tag" and returns its name.
+func (s *apiServer) serveNode(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Path[len(apiNodePath):]
+	if name == "" {
+		if !s.allow(w, r, "POST") {
+			return
+		}
+		tag := r.URL.Query().Get("tag")
+		if !isValidApiName(tag) || strings.Contains(tag, "/") {
+			http.Error(w, "Invalid tag", http.StatusBadRequest)
+			return
+		}
+		node := &Node{}
+		if err := json.NewDecoder(r.Body).Decode(node); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid node: %s", err), http.StatusBadRequest)
+		} else if nodeName, err := s.nodes.AddEntry(node, tag); err != nil {
+			apiError(w, err)
+		} else {
+			apiText(w, http.StatusCreated, filepath.ToSlash(nodeName))
+		}
+		return
+	}
+	if !isValidNodeName(name) {
+		http.Error(w, "Invalid node name", http.StatusBadRequest)
+		return
+	}
+	if !s.allow(w, r, "GET", "POST", "PUT", "DELETE") {
+		return
+	}
+	name = filepath.FromSlash(name)
+	switch r.Method {
+	case "GET":
+		f, err := s.nodes.Open(name)
+		if err != nil {
+			apiError(w, err)
+			return
+		}
+		defer f.Close()
+		w.Header().Set("Content-Type", "application/json")
+		io.Copy(w, f)
+	case "POST":
+		node := &Node{}
+		if err := json.NewDecoder(r.Body).Decode(node); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid node: %s", err), http.StatusBadRequest)
+		} else if err := s.nodes.Create(name, node); err != nil {
+			apiError(w, err)
+		} else {
+			w.WriteHeader(http.StatusCreated)
+		}
+	case "PUT":
+		node := &Node{}
+		if err := json.NewDecoder(r.Body).Decode(node); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid node: %s", err), http.StatusBadRequest)
+		} else if err := s.nodes.Update(name, node); err != nil {
+			apiError(w, err)
+		} else {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	case "DELETE":
+		record, err := apiTrashRecord(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		} else if err := s.nodes.Remove(name, record); err != nil {
+			apiError(w, err)
+		} else {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+}
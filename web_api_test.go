@@ -0,0 +1,63 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"github.com/maruel/subcommands/subcommandstest"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestApiInvalidRequests(t *testing.T) {
+	t.Parallel()
+	tb := subcommandstest.MakeTB(t)
+	cas := makeFakeCasTable(tb)
+	api := &apiServer{cas: cas, nodes: makeFakeNodesTable(cas, tb), writable: true, token: testToken, locks: map[string]*apiLock{}}
+	// Calls the handlers directly since ServeMux would redirect the paths that
+	// are not clean before they get to verify them.
+	token := testToken
+	check := func(handler http.HandlerFunc, method, urlPath string, expected int) {
+		req, err := http.NewRequest(method, "http://test"+urlPath, strings.NewReader("{}"))
+		tb.Assertf(err == nil, "Unexpected error: %s", err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp := httptest.NewRecorder()
+		handler(resp, req)
+		tb.Assertf(resp.Code == expected, "%s %s: %d != %d", method, urlPath, resp.Code, expected)
+	}
+	check(api.serveObject, "GET", apiObjectPath+"invalid", http.StatusBadRequest)
+	check(api.serveLock, "PUT", apiLockPath+"unknown", http.StatusNotFound)
+	check(api.serveTemporary, "DELETE", apiTemporaryPath, http.StatusConflict)
+	check(api.serveObject, "POST", apiObjectPath+cas.GetHashAlgorithm().HashBytes(nil), http.StatusMethodNotAllowed)
+	check(api.serveNode, "GET", apiNodePath+"2012-01/../../config.json", http.StatusBadRequest)
+	check(api.serveNode, "PUT", apiNodePath+"/etc/passwd", http.StatusBadRequest)
+	check(api.serveNode, "POST", apiNodePath+TrashName+"/2012-01/node", http.StatusBadRequest)
+	check(api.serveNode, "GET", apiNodePath+TrashName, http.StatusBadRequest)
+	check(api.serveNode, "POST", apiNodePath+"2012-01/.node.tmp", http.StatusBadRequest)
+	check(api.serveNode, "POST", apiNodePath+"?tag=../x", http.StatusBadRequest)
+	check(api.serveNode, "POST", apiNodePath+"?tag=", http.StatusBadRequest)
+	check(api.serveFsck, "PATCH", apiFsckPath, http.StatusMethodNotAllowed)
+	check(api.serveMissing, "POST", apiMissingPath, http.StatusBadRequest)
+
+	// The modifications require the token.
+	token = "invalid"
+	check(api.serveFsck, "PUT", apiFsckPath, http.StatusUnauthorized)
+	check(api.serveFsck, "GET", apiFsckPath, http.StatusOK)
+	api.token = ""
+	token = ""
+	check(api.serveFsck, "PUT", apiFsckPath, http.StatusUnauthorized)
+
+	// A read-only server refuses the modifications.
+	api.writable = false
+	check(api.serveFsck, "PUT", apiFsckPath, http.StatusForbidden)
+	tb.Assertf(!cas.GetFsckBit(), "Unexpected fsck bit is set")
+	check(api.serveFsck, "GET", apiFsckPath, http.StatusOK)
+}
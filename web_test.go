@@ -10,6 +10,8 @@ limitations under the License. */
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"github.com/maruel/subcommands"
 	"github.com/maruel/subcommands/subcommandstest"
@@ -46,6 +48,8 @@ func (f *WebDumbcasAppMock) goWeb() {
 	// Simulate -local. It is important to use it while testing otherwise it
 	// may trigger the Windows firewall.
 	r.local = true
+	// Use any free port so the tests can run concurrently.
+	r.port = 0
 	c := make(chan net.Listener)
 	go func() {
 		err := r.main(f, c)
@@ -115,6 +119,7 @@ func TestWeb(t *testing.T) {
 	f.GetLog().Print("T: Serve over web and verify files are accessible.")
 	f.goWeb()
 	defer f.closeWeb()
+	f.Assertf(len(f.locks) == 0, "web holds a lock while it runs")
 	f.GetLog().Print("T: Make sure it gets a redirect.", sha1, nodeName)
 	r := f.get("/content/retrieve/nodes", "/content/retrieve/nodes/")
 	month := time.Now().UTC().Format("2006-01")
@@ -140,3 +145,35 @@ func TestWeb(t *testing.T) {
 	r = f.get("/content/retrieve/nodes/"+nodeName+"/dir1/dir2/file2", "")
 	expectedBody(f.TB, r, "content2")
 }
+
+func TestWebChunkedSubtree(t *testing.T) {
+	t.Parallel()
+	f := makeWebDumbcasAppMock(t)
+	f.DumbcasAppMock.MakeCasTable("")
+	f.DumbcasAppMock.LoadNodesTable("", f.cas)
+	data := makeRandomData(4, 3*1024*1024)
+	chunks, _, err := addChunks(f.cas, bytes.NewReader(data))
+	f.Assertf(err == nil, "Unexpected error: %s", err)
+	f.Assertf(len(chunks) > 1, "Unexpected chunks %v", chunks)
+	// The file is in a directory stored as a separate object.
+	sub := &Entry{Files: map[string]*Entry{"big": &Entry{Size: chunksSize(chunks), Chunks: chunks}}}
+	encoded, err := json.Marshal(sub)
+	f.Assertf(err == nil, "Unexpected error: %s", err)
+	subSha1, err := AddBytes(f.cas, encoded)
+	f.Assertf(err == nil, "Unexpected error: %s", err)
+	entry := &Entry{Files: map[string]*Entry{"sub": &Entry{Dir: subSha1}}}
+	encoded, err = json.Marshal(entry)
+	f.Assertf(err == nil, "Unexpected error: %s", err)
+	entrySha1, err := AddBytes(f.cas, encoded)
+	f.Assertf(err == nil, "Unexpected error: %s", err)
+	nodeName, err := f.nodes.AddEntry(&Node{Entry: entrySha1, Comment: "chunked"}, "chunked")
+	f.Assertf(err == nil, "Unexpected error: %s", err)
+	nodeName = strings.Replace(nodeName, string(filepath.Separator), "/", -1)
+
+	f.goWeb()
+	defer f.closeWeb()
+	r := f.get("/content/retrieve/nodes/"+nodeName+"/sub", "/content/retrieve/nodes/"+nodeName+"/sub/")
+	expectedBody(f.TB, r, "<html><body><pre><a href=\"big\">big</a>\n</pre></body></html>")
+	r = f.get("/content/retrieve/nodes/"+nodeName+"/sub/big", "")
+	f.Assertf(readBody(f.TB, r) == string(data), "Content mismatch")
+}